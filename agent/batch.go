@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"time"
+)
+
+// maxBatchItems is the number of coalesced items that triggers a send before the window ends
+const maxBatchItems = 100
+
+// maxBatchSamples is the number of metric samples Pulse accepts in one batch
+const maxBatchSamples = 10 * maxSamplesPerRequest
+
+type batchItem struct {
+	Type      string            `json:"type"`
+	Heartbeat *heartbeatPayload `json:"heartbeat,omitempty"`
+	Update    *updatePayload    `json:"update,omitempty"`
+	Metrics   *metricsPayload   `json:"metrics,omitempty"`
+}
+
+type batchPayload struct {
+	Items []batchItem `json:"items"`
+}
+
+// batchResponse is Pulse's outcome of each item of a batch, in order. The
+// results of heartbeats carry what a heartbeat response does.
+type batchResponse struct {
+	Results []struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		heartbeatResponse
+	} `json:"results"`
+}
+
+// sendUpdate delivers an update, or buffers it when the agent coalesces updates
+func (a *Agent) sendUpdate(ctx context.Context, p updatePayload) error {
+	if a.Coalesce <= 0 {
+		return a.deliver(ctx, "/agent/update", p)
+	}
+	return a.coalesce(ctx, batchItem{Type: "update", Update: &p})
+}
+
+// coalesce buffers item for the next batch, starting the window on the first
+// one, and sends the batch right away once it is full
+func (a *Agent) coalesce(ctx context.Context, item batchItem) error {
+	a.batchMu.Lock()
+	a.batch = append(a.batch, item)
+	if item.Metrics != nil {
+		a.batchSamples += len(item.Metrics.Samples)
+	}
+	// Another metrics item could take the batch over what Pulse accepts
+	full := len(a.batch) >= maxBatchItems || a.batchSamples > maxBatchSamples-maxSamplesPerRequest
+	if len(a.batch) == 1 && !full {
+		a.batchTimer = time.AfterFunc(a.Coalesce, func() {
+			if err := a.FlushBatch(context.Background()); err != nil {
+				a.logger().Error("batch flush failed", "error", err)
+			}
+		})
+	}
+	a.batchMu.Unlock()
+
+	if full {
+		return a.FlushBatch(ctx)
+	}
+	return nil
+}
+
+// FlushBatch sends the coalesced items right away, in one request to
+// /agent/batch. Like single requests, a batch Pulse can't be reached for is
+// persisted in the agent's Queue when it has one. Pulse validates each item
+// on its own; the ones it rejected are logged. Directives returned along the
+// heartbeats run as they do for a single heartbeat.
+func (a *Agent) FlushBatch(ctx context.Context) error {
+	// Held while sending so batches reach Pulse in order
+	a.batchFlushMu.Lock()
+	defer a.batchFlushMu.Unlock()
+
+	a.batchMu.Lock()
+	items := a.batch
+	a.batch, a.batchSamples = nil, 0
+	if a.batchTimer != nil {
+		a.batchTimer.Stop()
+		a.batchTimer = nil
+	}
+	a.batchMu.Unlock()
+
+	if len(items) == 0 {
+		return nil
+	}
+	var resp batchResponse
+	if err := a.deliverResponse(ctx, "/agent/batch", batchPayload{Items: items}, &resp); err != nil {
+		return err
+	}
+	version := ""
+	for i, r := range resp.Results {
+		if r.Status == "rejected" && i < len(items) {
+			a.logger().Warn("batch item rejected", "type", items[i].Type, "error", r.Error)
+		}
+		for _, d := range r.Directives {
+			a.dispatch(d)
+		}
+		if r.ConfigVersion != "" {
+			version = r.ConfigVersion
+		}
+	}
+	if a.configOutdated(version) {
+		a.refreshConfig()
+	}
+	return nil
+}
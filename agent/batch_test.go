@@ -0,0 +1,229 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchServer records the requests it receives, decoding batches
+func batchServer(t *testing.T) (*httptest.Server, func() ([]string, [][]batchItem)) {
+	t.Helper()
+	var mu sync.Mutex
+	var paths []string
+	var batches [][]batchItem
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path == "/agent/batch" {
+			var p batchPayload
+			json.NewDecoder(r.Body).Decode(&p)
+			batches = append(batches, p.Items)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, func() ([]string, [][]batchItem) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), paths...), append([][]batchItem(nil), batches...)
+	}
+}
+
+// Test updates and task events within the window are sent as one batch, in order
+func TestAgent_Coalesce(t *testing.T) {
+	ts, requests := batchServer(t)
+	agent := newTestAgent(ts.URL)
+	agent.Coalesce = 20 * time.Millisecond
+
+	ctx := context.Background()
+	agent.Update("working", nil)
+	task, _ := agent.StartTask(ctx, "import")
+	task.Succeed(ctx)
+	if paths, _ := requests(); len(paths) != 0 {
+		t.Fatalf("expected updates to be held, got %v", paths)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	paths, batches := requests()
+	if len(paths) != 1 || paths[0] != "/agent/batch" {
+		t.Fatalf("expected one batch, got %v", paths)
+	}
+	items := batches[0]
+	if len(items) != 3 || items[0].Update.Status != "working" || items[1].Update.Task.Event != "started" || items[2].Update.Task.Event != "succeeded" {
+		t.Errorf("expected the update then both task events, got %+v", items)
+	}
+}
+
+// Test a full batch is sent without waiting for the window
+func TestAgent_Coalesce_Full(t *testing.T) {
+	ts, requests := batchServer(t)
+	agent := newTestAgent(ts.URL)
+	agent.Coalesce = time.Hour
+
+	for i := 0; i < maxBatchItems; i++ {
+		if err := agent.Update("working", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, batches := requests()
+	if len(batches) != 1 || len(batches[0]) != maxBatchItems {
+		t.Errorf("expected one full batch, got %d batches", len(batches))
+	}
+}
+
+// Test Shutdown sends held updates along with the final status
+func TestAgent_Coalesce_Shutdown(t *testing.T) {
+	ts, requests := batchServer(t)
+	agent := newTestAgent(ts.URL)
+	agent.Coalesce = time.Hour
+
+	agent.Update("working", nil)
+	if err := agent.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_, batches := requests()
+	if len(batches) != 1 || len(batches[0]) != 2 || batches[0][1].Update.Status != "stopped" {
+		t.Errorf("expected the held update and the final status in one batch, got %+v", batches)
+	}
+}
+
+// Test metrics and, when enabled, heartbeats go in the batch, except heartbeats carrying acks
+func TestAgent_Coalesce_MetricsAndHeartbeats(t *testing.T) {
+	ts, requests := batchServer(t)
+	agent := newTestAgent(ts.URL)
+	agent.Coalesce = time.Hour
+	agent.CoalesceHeartbeats = true
+
+	ctx := context.Background()
+	agent.ReportMetricsContext(ctx, Sample{Name: "queue_depth", Value: 3})
+	if err := agent.FlushMetricsContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.HeartbeatContext(ctx, "healthy"); err != nil {
+		t.Fatal(err)
+	}
+	agent.acks = []directiveAck{{ID: "d1"}}
+	if err := agent.HeartbeatContext(ctx, "healthy"); err != nil {
+		t.Fatal(err)
+	}
+	if paths, _ := requests(); len(paths) != 1 || paths[0] != "/agent/heartbeat" {
+		t.Fatalf("expected only the heartbeat with acks to be sent, got %v", paths)
+	}
+
+	if err := agent.FlushBatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, batches := requests()
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("expected one batch of 2 items, got %+v", batches)
+	}
+	if m, hb := batches[0][0], batches[0][1]; m.Metrics == nil || m.Metrics.Samples[0].Name != "queue_depth" || hb.Heartbeat == nil || hb.Heartbeat.Status != "healthy" {
+		t.Errorf("expected the metrics then the heartbeat, got %+v", batches[0])
+	}
+}
+
+// Test a batch is sent before it holds more samples than Pulse accepts
+func TestAgent_Coalesce_FullOfSamples(t *testing.T) {
+	ts, requests := batchServer(t)
+	agent := newTestAgent(ts.URL)
+	agent.Coalesce = time.Hour
+
+	ctx := context.Background()
+	for i := 0; i <= maxBatchSamples/maxSamplesPerRequest; i++ {
+		payload := metricsPayload{ID: agent.ID.String(), Samples: make([]Sample, maxSamplesPerRequest)}
+		if err := agent.coalesce(ctx, batchItem{Type: "metrics", Metrics: &payload}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := agent.FlushBatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, batches := requests()
+	for _, items := range batches {
+		n := 0
+		for _, it := range items {
+			n += len(it.Metrics.Samples)
+		}
+		if n > maxBatchSamples {
+			t.Errorf("expected at most %d samples per batch, got %d", maxBatchSamples, n)
+		}
+	}
+	if len(batches) < 2 {
+		t.Errorf("expected the samples to be split over batches, got %d", len(batches))
+	}
+}
+
+// Test the items Pulse rejected are logged
+func TestAgent_FlushBatch_Rejected(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"accepted":1,"rejected":1,"results":[{"status":"ok"},{"status":"rejected","error":"invalid status value"}]}`))
+	}))
+	defer ts.Close()
+	agent := newTestAgent(ts.URL)
+	agent.Coalesce = time.Hour
+	var buf bytes.Buffer
+	agent.Logger = slog.New(slog.NewTextHandler(&buf, nil))
+
+	agent.Update("working", nil)
+	agent.Update("sleepy", nil)
+	if err := agent.FlushBatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); strings.Count(out, "batch item rejected") != 1 || !strings.Contains(out, "invalid status value") {
+		t.Errorf("expected the rejected item to be logged, got %q", out)
+	}
+}
+
+// Test directives returned along a coalesced heartbeat run and are acknowledged
+func TestAgent_Coalesce_HeartbeatDirectives(t *testing.T) {
+	var mu sync.Mutex
+	var acks []directiveAck
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/agent/batch":
+			w.Write([]byte(`{"accepted":1,"rejected":0,"results":[{"status":"ok","directives":[{"id":"d1","type":"set_interval","payload":{"interval":42}}]}]}`))
+		case "/agent/heartbeat":
+			var p heartbeatPayload
+			json.NewDecoder(r.Body).Decode(&p)
+			mu.Lock()
+			acks = append(acks, p.Acks...)
+			mu.Unlock()
+		}
+	}))
+	defer ts.Close()
+	agent := newTestAgent(ts.URL)
+	agent.Coalesce = time.Hour
+	agent.CoalesceHeartbeats = true
+
+	ctx := context.Background()
+	if err := agent.HeartbeatContext(ctx, "healthy"); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.FlushBatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return agent.heartbeatInterval() == 42*time.Second })
+	waitFor(t, func() bool {
+		agent.directivesMu.Lock()
+		defer agent.directivesMu.Unlock()
+		return len(agent.acks) == 1
+	})
+	if err := agent.HeartbeatContext(ctx, "healthy"); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(acks) != 1 || acks[0] != (directiveAck{ID: "d1"}) {
+		t.Errorf("expected the directive to be acknowledged, got %+v", acks)
+	}
+}
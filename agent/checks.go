@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultCheckTimeout bounds a StatusCheck without a Timeout
+const DefaultCheckTimeout = 5 * time.Second
+
+// StatusCheck is a health check run before every heartbeat, e.g. pinging a
+// database the process depends on
+type StatusCheck struct {
+	Name    string
+	Check   func(ctx context.Context) error
+	Timeout time.Duration
+	// Critical checks turn the agent's status to `error` when they fail.
+	// Other failures are only reported along the heartbeat.
+	Critical bool
+}
+
+// CheckResult is the outcome of a StatusCheck, sent along the heartbeat
+type CheckResult struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"` // ok or fail
+	Critical bool    `json:"critical,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_ms"`
+	Probe    string  `json:"probe,omitempty"`    // type of the probe that produced the result, if any
+	Failures int     `json:"failures,omitempty"` // failed probe runs in a row
+}
+
+// AddCheck registers a check run on every heartbeat tick. Checks sharing a name replace each other.
+func (a *Agent) AddCheck(c StatusCheck) {
+	a.checksMu.Lock()
+	defer a.checksMu.Unlock()
+	for i := range a.checks {
+		if a.checks[i].Name == c.Name {
+			a.checks[i] = c
+			return
+		}
+	}
+	a.checks = append(a.checks, c)
+}
+
+// RunChecks runs every registered check concurrently, each within its
+// timeout, and adds the latest results of the probes
+func (a *Agent) RunChecks(ctx context.Context) []CheckResult {
+	a.checksMu.Lock()
+	checks := append([]StatusCheck(nil), a.checks...)
+	a.checksMu.Unlock()
+
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runCheck(ctx, c)
+		}()
+	}
+	wg.Wait()
+	return append(results, a.probeResults()...)
+}
+
+func runCheck(ctx context.Context, c StatusCheck) CheckResult {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- c.Check(ctx)
+	}()
+
+	// A check ignoring its context must not hold up the heartbeat
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+
+	r := CheckResult{Name: c.Name, Status: "ok", Critical: c.Critical, Duration: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		r.Status, r.Error = "fail", err.Error()
+	}
+	return r
+}
+
+// aggregateStatus is `error` when a critical check failed, else the task status
+func (a *Agent) aggregateStatus(results []CheckResult) string {
+	for _, r := range results {
+		if r.Critical && r.Status != "ok" {
+			return "error"
+		}
+	}
+	return a.status()
+}
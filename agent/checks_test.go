@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test check results are sent with the heartbeat and a failing critical check means error
+func TestAgent_Tick_SendsChecks(t *testing.T) {
+	var heartbeat heartbeatPayload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/agent/heartbeat" {
+			json.NewDecoder(r.Body).Decode(&heartbeat)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	agent.AddCheck(StatusCheck{Name: "cache", Check: func(ctx context.Context) error { return errors.New("miss rate high") }})
+	agent.AddCheck(StatusCheck{Name: "database", Critical: true, Check: func(ctx context.Context) error { return nil }})
+
+	agent.tick(context.Background())
+	if heartbeat.Status != "healthy" || len(heartbeat.Checks) != 2 {
+		t.Fatalf("expected a healthy heartbeat with 2 checks, got %+v", heartbeat)
+	}
+	if c := heartbeat.Checks[0]; c.Name != "cache" || c.Status != "fail" || c.Error != "miss rate high" {
+		t.Errorf("expected the failed check to be reported, got %+v", c)
+	}
+
+	// Replacing the database check with a failing one puts the agent in error
+	agent.AddCheck(StatusCheck{Name: "database", Critical: true, Check: func(ctx context.Context) error { return errors.New("connection refused") }})
+	agent.tick(context.Background())
+	if heartbeat.Status != "error" || len(heartbeat.Checks) != 2 {
+		t.Errorf("expected an error heartbeat, got %+v", heartbeat)
+	}
+}
+
+// Test a hanging or panicking check fails instead of blocking the heartbeat
+func TestAgent_RunChecks_TimeoutAndPanic(t *testing.T) {
+	agent := newTestAgent("http://localhost")
+	release := make(chan struct{})
+	defer close(release)
+	agent.AddCheck(StatusCheck{Name: "stuck", Timeout: 10 * time.Millisecond, Check: func(ctx context.Context) error {
+		<-release
+		return nil
+	}})
+	agent.AddCheck(StatusCheck{Name: "broken", Check: func(ctx context.Context) error { panic("nil map") }})
+
+	start := time.Now()
+	results := agent.RunChecks(context.Background())
+	if time.Since(start) > time.Second {
+		t.Fatal("expected the stuck check to time out")
+	}
+	if results[0].Status != "fail" || results[1].Status != "fail" || results[1].Error != "panic: nil map" {
+		t.Errorf("expected both checks to fail, got %+v", results)
+	}
+}
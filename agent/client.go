@@ -2,11 +2,15 @@ package agent
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
-	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -18,123 +22,591 @@ type Agent struct {
 	Type      string
 	Info      map[string]interface{}
 	Server    string
-	heartbeat time.Duration
+	servers   []string // Server followed by the fallbacks, see failover
+	serverIdx atomic.Int32
+	token     string
 	Client    *http.Client
-	stopChan  chan struct{}
+	rpc       *grpcTransport // set with the grpc transport, see Config.Transport
+
+	// Logger receives the agent's logs, tagged with its ID. Defaults to slog.Default()
+	Logger *slog.Logger
+
+	// Retry controls how failed requests are retried. NewFromConfig sets it from Config.Retry
+	Retry RetryPolicy
+
+	// Queue, when set, persists updates and metrics that could not be delivered
+	// and replays them once Pulse is reachable. NewFromConfig opens one in Config.QueueDir
+	Queue *Queue
+
+	// Status checks run on every heartbeat tick, see AddCheck
+	checksMu sync.Mutex
+	checks   []StatusCheck
+	// Probes run on their own schedules, see AddProbe
+	probes     []*probe
+	probesStop <-chan struct{} // set once the probes started
+
+	// Host, when set, collects a snapshot of the host on every heartbeat tick,
+	// sent along the heartbeat. With HostMetrics it is also reported as samples.
+	Host        *HostCollector
+	HostMetrics bool
+
+	// Task tracking, see StartTask
+	tasksMu        sync.Mutex
+	runningTasks   int
+	trackingTasks  bool
+	statusOverride string // see SetStatus
+
+	// MetricsBatchSize is the number of buffered samples that triggers a send in ReportMetrics
+	MetricsBatchSize int
+	metricsMu        sync.Mutex
+	metrics          []Sample
+	flushMu          sync.Mutex
+
+	// Log shipping, see ShipLog. LogBatchSize buffered lines, or LogFlushInterval
+	// after the first one, trigger a send
+	LogBatchSize     int
+	LogFlushInterval time.Duration
+	logsMu           sync.Mutex
+	logs             []LogEntry
+	logsDropped      int
+	logsTimer        *time.Timer
+	logsFlushing     bool // a background flush is running
+	logsFlushMu      sync.Mutex
+	logFiles         []string        // see TailLogFile
+	logsStop         <-chan struct{} // set once the files are followed
+
+	// Coalesce, when positive, holds updates, task events included, and
+	// metrics for up to this long and sends them together to /agent/batch.
+	// Update then returns once the update is buffered. See FlushBatch
+	Coalesce time.Duration
+	// CoalesceHeartbeats also holds heartbeats when Coalesce is positive.
+	// Directives and config versions come back once the batch is sent;
+	// heartbeats acknowledging directives are still sent right away.
+	CoalesceHeartbeats bool
+	batchMu            sync.Mutex
+	batch              []batchItem
+	batchSamples       int // metric samples in batch
+	batchTimer         *time.Timer
+	batchFlushMu       sync.Mutex
+
+	// Heartbeat interval, changed by SetHeartbeatInterval
+	intervalMu      sync.Mutex
+	heartbeat       time.Duration
+	intervalChanged chan struct{}
+
+	// Directives from Pulse, see HandleDirective
+	directivesMu      sync.Mutex
+	directiveHandlers map[string]DirectiveHandler
+	directivesSeen    map[string]bool // run or running, until the ack reached Pulse
+	acks              []directiveAck
+
+	// Remote configuration, see OnConfig
+	configMu      sync.Mutex
+	configHandler func(ctx context.Context, raw json.RawMessage, version string) error
+	configVersion string     // applied
+	configSyncMu  sync.Mutex // held while a configuration is fetched and applied
+
+	// Lifecycle, see Shutdown
+	lifeMu       sync.Mutex
+	stopChan     chan struct{}
+	loopDone     chan struct{}
+	stopped      bool
+	shutdownDone chan struct{} // closed once Shutdown returned
+	requestsMu   sync.RWMutex  // read-held by every request in flight
+	shutdownOnce sync.Once
+	shutdownErr  error
 }
 
-// New initializes a new Agent using env vars
+// DefaultHeartbeatInterval is used when no heartbeat interval is configured
+const DefaultHeartbeatInterval = 60 * time.Second
+
+// New initializes a new Agent from ConfigFromEnv. It is lenient: invalid
+// settings are logged and the defaults used instead. Only the settings it can't
+// do without, PULSE_SERVER_URL and the agent's identity, make it panic when
+// missing or invalid. Use NewFromConfig to get errors instead.
 func New(name, agentType string) *Agent {
-	server := os.Getenv("PULSE_SERVER_URL")
-	if server == "" {
-		log.Fatal("PULSE_SERVER_URL not set")
-	}
-	interval := 60 * time.Second // default
-	if v := os.Getenv("PULSE_HEARTBEAT_INTERVAL"); v != "" {
-		if parsed, err := time.ParseDuration(v); err == nil {
-			interval = parsed
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		slog.Warn("agent: ignoring invalid settings", "error", err)
+	}
+	cfg.Name, cfg.Type = name, agentType
+	a, err := NewFromConfig(cfg)
+	if err == nil {
+		return a
+	}
+
+	if reset := cfg.resetInvalid(); reset != nil {
+		slog.Error("agent: invalid settings, using the defaults for them", "error", reset)
+		if a, err = NewFromConfig(cfg); err == nil {
+			return a
+		}
+	}
+
+	if cfg.Validate() == nil {
+		// The identity, TLS files or offline queue could not be loaded
+		slog.Error("agent: running without TLS settings and offline queue", "error", err)
+		cfg.TLS, cfg.QueueDir = TLSConfig{}, ""
+		a, err = NewFromConfig(cfg)
+	}
+	if err != nil {
+		panic("agent: " + err.Error())
+	}
+	return a
+}
+
+// NewFromConfig initializes a new Agent from cfg adjusted by opts. It returns an
+// error when the config is invalid or the agent's identity, TLS files or offline
+// queue can't be loaded.
+func NewFromConfig(cfg Config, opts ...Option) (*Agent, error) {
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	id, err := resolveID(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: time.Duration(cfg.Timeout)}
+	tlsConfig, err := cfg.TLS.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		client.Transport = transport
+	}
+
+	var host *HostCollector
+	if cfg.Host.Enabled {
+		host = &HostCollector{ProcRoot: cfg.Host.ProcRoot}
+	}
+
+	var queue *Queue
+	if cfg.QueueDir != "" {
+		if queue, err = OpenQueue(cfg.QueueDir, cfg.QueueMaxBytes); err != nil {
+			return nil, err
+		}
+	}
+
+	a := &Agent{
+		ID:                 id,
+		Name:               cfg.Name,
+		Type:               cfg.Type,
+		Server:             cfg.Servers[0],
+		servers:            cfg.Servers,
+		token:              cfg.Token,
+		heartbeat:          time.Duration(cfg.HeartbeatInterval),
+		Client:             client,
+		Retry:              cfg.Retry.Policy(),
+		Queue:              queue,
+		MetricsBatchSize:   cfg.MetricsBatchSize,
+		Host:               host,
+		HostMetrics:        cfg.Host.Metrics,
+		Coalesce:           time.Duration(cfg.Coalesce),
+		CoalesceHeartbeats: cfg.CoalesceHeartbeats,
+		LogBatchSize:       cfg.Logs.BatchSize,
+		LogFlushInterval:   time.Duration(cfg.Logs.FlushInterval),
+	}
+	if cfg.Transport == "grpc" {
+		if a.rpc, err = newGRPCTransport(a, cfg, tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range cfg.Probes {
+		if err := a.AddProbe(p); err != nil {
+			return nil, err
 		}
 	}
+	for _, path := range cfg.Logs.Files {
+		a.TailLogFile(path)
+	}
+	return a, nil
+}
 
-	return &Agent{
-		ID:        uuid.New(),
-		Name:      name,
-		Type:      agentType,
-		Server:    server,
-		heartbeat: interval,
-		Client:    &http.Client{Timeout: 5 * time.Second},
-		stopChan:  make(chan struct{}),
+// server returns the Pulse URL requests currently go to
+func (a *Agent) server() string {
+	if len(a.servers) < 2 {
+		return a.Server
 	}
+	return a.servers[int(a.serverIdx.Load())%len(a.servers)]
+}
+
+// failover switches to the next Pulse URL after one could not be reached
+func (a *Agent) failover(from string) {
+	if len(a.servers) < 2 || a.server() != from {
+		return
+	}
+	next := a.servers[int(a.serverIdx.Add(1))%len(a.servers)]
+	a.logger().Warn("pulse unreachable, switching server", "from", from, "to", next)
+}
+
+// heartbeatInterval returns the configured interval, or the default for agents not built by New
+func (a *Agent) heartbeatInterval() time.Duration {
+	a.intervalMu.Lock()
+	defer a.intervalMu.Unlock()
+	if a.heartbeat <= 0 {
+		return DefaultHeartbeatInterval
+	}
+	return a.heartbeat
+}
+
+// logger returns the agent's logger with its ID attached
+func (a *Agent) logger() *slog.Logger {
+	l := a.Logger
+	if l == nil {
+		l = slog.Default()
+	}
+	return l.With("agent_id", a.ID)
 }
 
 func (a *Agent) post(path string, payload any) error {
+	return a.postContext(context.Background(), path, payload)
+}
+
+// postContext sends payload, retrying as configured by the agent's RetryPolicy.
+// Failed requests are returned as *RequestError.
+func (a *Agent) postContext(ctx context.Context, path string, payload any) error {
+	return a.request(ctx, path, payload, nil)
+}
+
+// request is postContext decoding the JSON response into out, unless nil
+func (a *Agent) request(ctx context.Context, path string, payload any, out any) error {
 	data, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("marshal error: %w", err)
 	}
 
-	url := fmt.Sprintf("%s%s", a.Server, path)
-	resp, err := a.Client.Post(url, "application/json", bytes.NewReader(data))
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		status, wait, err := a.send(ctx, path, data, out)
+		if err == nil {
+			return nil
+		}
+
+		reqErr := &RequestError{Path: path, StatusCode: status, Attempts: attempt, Retryable: retryable(ctx, status), Err: err}
+		if !reqErr.Retryable {
+			return reqErr
+		}
+		wait = max(wait, a.Retry.backoff(attempt))
+		if time.Since(start)+wait > a.Retry.MaxElapsedTime {
+			return reqErr
+		}
+
+		a.logger().Debug("retrying request", "path", path, "attempt", attempt, "wait", wait, "error", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return reqErr
+		case <-timer.C:
+		}
+	}
+}
+
+// send makes one attempt. It returns the response status, 0 when none was
+// received, and how long the server asked to wait before retrying.
+func (a *Agent) send(ctx context.Context, path string, data []byte, out any) (int, time.Duration, error) {
+	if a.rpc != nil && a.rpc.carries(path) {
+		a.requestsMu.RLock()
+		defer a.requestsMu.RUnlock()
+		return a.rpc.send(ctx, path, data, out)
+	}
+
+	server := a.server()
+	req, requestID, err := a.newRequest(ctx, http.MethodPost, server, path, bytes.NewReader(data))
 	if err != nil {
-		return fmt.Errorf("post error: %w", err)
+		return 0, 0, fmt.Errorf("post error: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	a.requestsMu.RLock()
+	defer a.requestsMu.RUnlock()
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			a.failover(server)
+		}
+		return 0, 0, fmt.Errorf("post error: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("server returned status %d", resp.StatusCode)
+		a.logger().Debug("request rejected", "path", path, "status", resp.StatusCode, "request_id", requestID)
+		return resp.StatusCode, retryAfter(resp), fmt.Errorf("server returned status %d", resp.StatusCode)
 	}
+	// The request succeeded, a response Pulse versions disagree on is not worth a retry
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil && !errors.Is(err, io.EOF) {
+			a.logger().Warn("invalid response", "path", path, "error", err, "request_id", requestID)
+		}
+	}
+	return resp.StatusCode, 0, nil
+}
+
+// newRequest builds a request to Pulse with the headers every call carries.
+// It also returns the request's ID.
+func (a *Agent) newRequest(ctx context.Context, method, server, path string, body io.Reader) (*http.Request, string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, server+path, body)
+	if err != nil {
+		return nil, "", err
+	}
+	// Sent so the server's logs for this call can be found from the agent's
+	requestID := uuid.NewString()
+	req.Header.Set("X-Request-ID", requestID)
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	return req, requestID, nil
+}
+
+// deliver sends payload like postContext. With a queue, requests Pulse could
+// not be reached for are persisted instead and nil is returned; queued
+// requests are replayed first so Pulse receives everything in order.
+func (a *Agent) deliver(ctx context.Context, path string, payload any) error {
+	return a.deliverResponse(ctx, path, payload, nil)
+}
+
+// deliverResponse is deliver decoding the JSON response into out, unless nil.
+// out is left untouched when the request was queued.
+func (a *Agent) deliverResponse(ctx context.Context, path string, payload any, out any) error {
+	if a.Queue == nil {
+		return a.request(ctx, path, payload, out)
+	}
+
+	err := a.ReplayQueue(ctx)
+	if err == nil {
+		err = a.request(ctx, path, payload, out)
+		// Requests cut short by ctx are kept too, only those rejected by Pulse are not
+		if err == nil || (!IsRetryable(err) && ctx.Err() == nil) {
+			return err
+		}
+	}
+	if qerr := a.Queue.Append(path, payload); qerr != nil {
+		return errors.Join(err, qerr)
+	}
+	a.logger().Warn("request queued", "path", path, "error", err)
 	return nil
 }
 
+// ReplayQueue sends the requests persisted in the queue, oldest first
+func (a *Agent) ReplayQueue(ctx context.Context) error {
+	if a.Queue == nil || !a.Queue.Pending() {
+		return nil
+	}
+	sent, err := a.Queue.Replay(ctx, func(ctx context.Context, path string, payload json.RawMessage) error {
+		return a.postContext(ctx, path, payload)
+	})
+	if sent > 0 {
+		a.logger().Info("replayed queued requests", "count", sent)
+	}
+	return err
+}
+
 type registerPayload struct {
-	ID   string                 `json:"id"`
-	Name string                 `json:"name"`
-	Type string                 `json:"type"`
-	Info map[string]interface{} `json:"info,omitempty"`
+	ID                string                 `json:"id"`
+	Name              string                 `json:"name"`
+	Type              string                 `json:"type"`
+	Info              map[string]interface{} `json:"info,omitempty"`
+	HeartbeatInterval float64                `json:"heartbeat_interval,omitempty"`
 }
 
 // Register sends the registration request to Pulse
 func (a *Agent) Register() error {
+	return a.RegisterContext(context.Background())
+}
+
+// RegisterContext is Register with a context bounding the request, retries included.
+// Pulse refreshes an agent it already knows, e.g. one restarted with the same ID;
+// the 409 older Pulse versions answered instead is reported as ErrAlreadyRegistered.
+// Once registered, the configuration is fetched when a handler was set with OnConfig.
+func (a *Agent) RegisterContext(ctx context.Context) error {
 	payload := registerPayload{
 		ID:   a.ID.String(),
 		Name: a.Name,
 		Type: a.Type,
 		Info: a.Info,
+		// Lets the server tell late heartbeats from a slow schedule
+		HeartbeatInterval: a.heartbeatInterval().Seconds(),
+	}
+	err := a.postContext(ctx, "/agent/register", payload)
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) && reqErr.StatusCode == http.StatusConflict {
+		reqErr.Err = ErrAlreadyRegistered
 	}
-	return a.post("/agent/register", payload)
+	if err == nil || errors.Is(err, ErrAlreadyRegistered) {
+		if cerr := a.syncConfig(ctx); cerr != nil {
+			a.logger().Error("config sync failed", "error", cerr)
+		}
+	}
+	return err
 }
 
 type heartbeatPayload struct {
-	ID     string `json:"id"`
-	Status string `json:"status"`
+	ID     string         `json:"id"`
+	Status string         `json:"status"`
+	Checks []CheckResult  `json:"checks,omitempty"`
+	Host   *HostSnapshot  `json:"host,omitempty"`
+	Acks   []directiveAck `json:"acks,omitempty"`
+
+	ConfigVersion string `json:"config_version,omitempty"`
 }
 
 // Heartbeat sends a heartbeat signal to Pulse
 func (a *Agent) Heartbeat(status string) error {
+	return a.HeartbeatContext(context.Background(), status)
+}
+
+// HeartbeatContext is Heartbeat with a context bounding the request
+func (a *Agent) HeartbeatContext(ctx context.Context, status string) error {
 	payload := heartbeatPayload{
 		ID:     a.ID.String(),
 		Status: status,
 	}
-	return a.post("/agent/heartbeat", payload)
+	return a.sendHeartbeat(ctx, payload)
 }
 
+// StartHeartbeatLoop heartbeats on every interval in the background until
+// StopHeartbeatLoop or Shutdown. It does nothing when the loop already runs or
+// was stopped.
 func (a *Agent) StartHeartbeatLoop() {
-	ticker := time.NewTicker(a.heartbeat)
+	a.lifeMu.Lock()
+	if a.stopped || a.loopDone != nil {
+		a.lifeMu.Unlock()
+		return
+	}
+	stop, done := a.stopChannel(), make(chan struct{})
+	a.loopDone = done
+	a.lifeMu.Unlock()
+
+	// Started without lifeMu: flushing the logs they ship checks isStopped under logsMu
+	a.startProbes(stop)
+	a.startLogTails(stop)
+	changed := a.intervalSignal()
+	ticker := time.NewTicker(a.heartbeatInterval())
 	go func() {
+		defer close(done)
 		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
-				err := a.Heartbeat("healthy")
-				if err != nil {
-					log.Printf("heartbeat error: %v", err)
-				} else {
-					log.Printf("heartbeat sent for agent %s", a.ID)
-				}
-			case <-a.stopChan:
-				log.Println("heartbeat loop stopped")
+				a.tick(context.Background())
+			case <-changed:
+				ticker.Reset(a.heartbeatInterval())
+			case <-stop:
+				a.logger().Info("heartbeat loop stopped")
 				return
 			}
 		}
 	}()
 }
 
+// tick runs the status checks, sends a heartbeat with their results and the host
+// snapshot, and flushes buffered metrics and logs. Retries are cut short by the next tick so heartbeats never pile up.
+func (a *Agent) tick(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, a.heartbeatInterval())
+	defer cancel()
+
+	checks := a.RunChecks(ctx)
+	host := a.collectHost(ctx)
+	err := a.sendHeartbeat(ctx, heartbeatPayload{
+		ID:     a.ID.String(),
+		Status: a.aggregateStatus(checks),
+		Checks: checks,
+		Host:   host,
+	})
+	if err != nil {
+		a.logger().Error("heartbeat failed", "error", err)
+	} else {
+		a.logger().Debug("heartbeat sent")
+	}
+	if err := a.ReplayQueue(ctx); err != nil {
+		a.logger().Error("queue replay failed", "error", err)
+	}
+	if err := a.FlushMetricsContext(ctx); err != nil {
+		a.logger().Error("metrics flush failed", "error", err)
+	}
+	if err := a.FlushLogs(ctx); err != nil {
+		a.logger().Error("logs flush failed", "error", err)
+	}
+}
+
+// FinalStatusTimeout bounds the final status update Run sends once its context is done
+const FinalStatusTimeout = 5 * time.Second
+
+// Run registers the agent, then heartbeats right away and on every interval
+// until ctx is done or Shutdown is called. It then shuts the agent down, on a
+// fresh context since ctx is already cancelled. Run returns an error when the
+// registration or the shutdown fails.
+func (a *Agent) Run(ctx context.Context) error {
+	// An agent restarted with the same ID resumes its history. Older Pulse
+	// versions answer ErrAlreadyRegistered for it rather than refreshing it.
+	if err := a.RegisterContext(ctx); errors.Is(err, ErrAlreadyRegistered) {
+		a.logger().Info("resuming registered agent")
+	} else if err != nil {
+		return fmt.Errorf("register: %w", err)
+	} else {
+		a.logger().Info("agent registered")
+	}
+
+	a.lifeMu.Lock()
+	stop := a.stopChannel()
+	a.lifeMu.Unlock()
+	a.startProbes(stop)
+	a.startLogTails(stop)
+	a.tick(ctx)
+
+	changed := a.intervalSignal()
+	ticker := time.NewTicker(a.heartbeatInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.tick(ctx)
+		case <-changed:
+			ticker.Reset(a.heartbeatInterval())
+		case <-ctx.Done():
+		case <-stop:
+		}
+		if ctx.Err() != nil || a.isStopped() {
+			final, cancel := context.WithTimeout(context.WithoutCancel(ctx), FinalStatusTimeout)
+			defer cancel()
+			return a.Shutdown(final)
+		}
+	}
+}
+
+// StopHeartbeatLoop stops the heartbeat loop without waiting for it, and keeps
+// it from starting if it didn't yet. Use Shutdown to also tell Pulse the agent stopped.
 func (a *Agent) StopHeartbeatLoop() {
-	close(a.stopChan)
+	a.stop()
 }
 
 type updatePayload struct {
 	ID      string                 `json:"id"`
 	Status  string                 `json:"status"`
 	Message map[string]interface{} `json:"message"`
+	Time    time.Time              `json:"time"`
+	Task    *taskPayload           `json:"task,omitempty"`
 }
 
-// Update sends a status update with optional message
+// Update sends a status update with optional message. With a Queue, an update
+// Pulse can't be reached for is persisted, replayed later and nil is returned.
 func (a *Agent) Update(status string, message map[string]interface{}) error {
+	return a.UpdateContext(context.Background(), status, message)
+}
+
+// UpdateContext is Update with a context bounding the request
+func (a *Agent) UpdateContext(ctx context.Context, status string, message map[string]interface{}) error {
 	payload := updatePayload{
 		ID:      a.ID.String(),
 		Status:  status,
 		Message: message,
+		Time:    time.Now(),
 	}
-	return a.post("/agent/update", payload)
+	return a.sendUpdate(ctx, payload)
 }
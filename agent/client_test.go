@@ -1,14 +1,22 @@
 package agent
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/aphrollo/pulse/utils"
 	"github.com/google/uuid"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // Helper function to create agent with test server URL
@@ -110,6 +118,52 @@ func TestNew_FatalOnMissingServerURL(t *testing.T) {
 	_ = New("test-agent", "default")
 }
 
+// Test New logs invalid settings and uses the defaults instead
+func TestNew_FallsBackToDefaults(t *testing.T) {
+	t.Setenv("PULSE_SERVER_URL", "http://localhost")
+	t.Setenv("PULSE_STATE_DIR", t.TempDir())
+	t.Setenv("PULSE_HEARTBEAT_INTERVAL", "soon")
+	t.Setenv("PULSE_COALESCE", "-1s")
+
+	agent := New("test-agent", "default")
+	if agent.heartbeatInterval() != DefaultHeartbeatInterval || agent.Coalesce != 0 {
+		t.Errorf("expected the defaults, got interval %s and coalesce %s", agent.heartbeatInterval(), agent.Coalesce)
+	}
+	if agent.Server != "http://localhost" {
+		t.Errorf("expected the configured server to be kept, got %s", agent.Server)
+	}
+}
+
+// Test New keeps the valid settings next to an invalid one
+func TestNew_KeepsValidSettings(t *testing.T) {
+	t.Setenv("PULSE_SERVER_URL", "http://localhost")
+	t.Setenv("PULSE_STATE_DIR", t.TempDir())
+	t.Setenv("PULSE_HEARTBEAT_INTERVAL", "-5s")
+	t.Setenv("PULSE_COALESCE", "2s")
+	t.Setenv("PULSE_HOST_COLLECTOR", "true")
+
+	agent := New("test-agent", "default")
+	if agent.heartbeatInterval() != DefaultHeartbeatInterval {
+		t.Errorf("expected the default interval, got %s", agent.heartbeatInterval())
+	}
+	if agent.Coalesce != 2*time.Second || agent.Host == nil {
+		t.Errorf("expected the valid settings to be kept, got coalesce %s and host %v", agent.Coalesce, agent.Host)
+	}
+}
+
+// Test New still reads the environment when the config file can't be loaded
+func TestNew_BrokenConfigFile(t *testing.T) {
+	t.Setenv("PULSE_CONFIG", filepath.Join(t.TempDir(), "missing.yaml"))
+	t.Setenv("PULSE_SERVER_URL", "http://localhost")
+	t.Setenv("PULSE_STATE_DIR", t.TempDir())
+	t.Setenv("PULSE_TOKEN", "secret")
+
+	agent := New("test-agent", "default")
+	if agent.Server != "http://localhost" || agent.token != "secret" {
+		t.Errorf("expected the environment to be applied, got server %s and token %q", agent.Server, agent.token)
+	}
+}
+
 // Test Register with server rejecting due to missing fields (simulated server)
 func TestAgent_Register_ServerRejectsMissingFields(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -134,3 +188,119 @@ func TestAgent_Register_ServerRejectsMissingFields(t *testing.T) {
 		t.Errorf("expected 400 status error, got %v", err)
 	}
 }
+
+// Test requests carry a request ID and logs go to the caller supplied logger
+func TestAgent_Logger_AttachesAgentID(t *testing.T) {
+	var requestID string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID = r.Header.Get("X-Request-ID")
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	agent := newTestAgent(ts.URL)
+	agent.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	if err := agent.Heartbeat("healthy"); err == nil {
+		t.Fatal("expected heartbeat to fail")
+	}
+	if requestID == "" {
+		t.Fatal("expected X-Request-ID header to be sent")
+	}
+	logged := buf.String()
+	if !strings.Contains(logged, "agent_id="+agent.ID.String()) || !strings.Contains(logged, "request_id="+requestID) {
+		t.Errorf("expected agent and request IDs in log, got %q", logged)
+	}
+}
+
+// Test Register declares the heartbeat interval so the server can count late beats
+func TestAgent_Register_DeclaresHeartbeatInterval(t *testing.T) {
+	var payload registerPayload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Fatalf("failed to decode JSON payload: %v", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	agent.heartbeat = 30 * time.Second
+
+	if err := agent.Register(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if payload.HeartbeatInterval != 30 {
+		t.Errorf("expected heartbeat_interval 30, got %v", payload.HeartbeatInterval)
+	}
+}
+
+// Test Run registers, heartbeats and reports the agent stopped once its context is done
+func TestAgent_Run(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		calls = append(calls, r.URL.Path+" "+fmt.Sprint(payload["status"]))
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	agent.heartbeat = 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 35*time.Millisecond)
+	defer cancel()
+	if err := agent.Run(ctx); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) < 3 {
+		t.Fatalf("expected register, heartbeats and a final update, got %v", calls)
+	}
+	if calls[0] != "/agent/register <nil>" || calls[1] != "/agent/heartbeat healthy" {
+		t.Errorf("expected register then heartbeat, got %v", calls)
+	}
+	if last := calls[len(calls)-1]; last != "/agent/update stopped" {
+		t.Errorf("expected final stopped update, got %s", last)
+	}
+}
+
+// Test Run returns the registration error without heartbeating
+func TestAgent_Run_RegisterFails(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/agent/register" {
+			t.Errorf("unexpected call to %s", r.URL.Path)
+		}
+		http.Error(w, "invalid Agent type", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	err := newTestAgent(ts.URL).Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "register") {
+		t.Errorf("expected register error, got %v", err)
+	}
+}
+
+// Test HeartbeatContext gives up once the context is cancelled
+func TestAgent_HeartbeatContext_Cancelled(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := newTestAgent(ts.URL).HeartbeatContext(ctx, "healthy")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
@@ -1 +1,443 @@
 package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration written as "30s" or "5m" in config files
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// TLSConfig secures the connection to Pulse. Files are PEM encoded.
+type TLSConfig struct {
+	CAFile             string `json:"ca_file,omitempty" yaml:"ca_file,omitempty"`     // CA bundle to verify Pulse with, defaults to the system pool
+	CertFile           string `json:"cert_file,omitempty" yaml:"cert_file,omitempty"` // client certificate, along with KeyFile
+	KeyFile            string `json:"key_file,omitempty" yaml:"key_file,omitempty"`
+	ServerName         string `json:"server_name,omitempty" yaml:"server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty" yaml:"insecure_skip_verify,omitempty"`
+}
+
+// RetryConfig is the config file form of RetryPolicy
+type RetryConfig struct {
+	InitialInterval Duration `json:"initial_interval" yaml:"initial_interval"`
+	MaxInterval     Duration `json:"max_interval" yaml:"max_interval"`
+	Multiplier      float64  `json:"multiplier" yaml:"multiplier"`
+	Jitter          float64  `json:"jitter" yaml:"jitter"`
+	MaxElapsedTime  Duration `json:"max_elapsed_time" yaml:"max_elapsed_time"` // 0 disables retries
+}
+
+// Policy converts the config to a RetryPolicy
+func (r RetryConfig) Policy() RetryPolicy {
+	return RetryPolicy{
+		InitialInterval: time.Duration(r.InitialInterval),
+		MaxInterval:     time.Duration(r.MaxInterval),
+		Multiplier:      r.Multiplier,
+		Jitter:          r.Jitter,
+		MaxElapsedTime:  time.Duration(r.MaxElapsedTime),
+	}
+}
+
+// HostConfig enables the built-in Linux host collector, see HostCollector
+type HostConfig struct {
+	Enabled  bool   `json:"enabled" yaml:"enabled"`
+	ProcRoot string `json:"proc_root,omitempty" yaml:"proc_root,omitempty"` // defaults to /proc
+	Metrics  bool   `json:"metrics,omitempty" yaml:"metrics,omitempty"`     // also report the snapshots as samples
+}
+
+// LogsConfig sets up log shipping, see ShipLog
+type LogsConfig struct {
+	// Files are followed for new lines, see TailLogFile
+	Files         []string `json:"files,omitempty" yaml:"files,omitempty"`
+	BatchSize     int      `json:"batch_size,omitempty" yaml:"batch_size,omitempty"`
+	FlushInterval Duration `json:"flush_interval,omitempty" yaml:"flush_interval,omitempty"`
+}
+
+// Config describes an agent and how it reaches Pulse. Start from DefaultConfig,
+// ConfigFromEnv or LoadConfigFile, adjust it with options and pass it to NewFromConfig.
+type Config struct {
+	Name string `json:"name" yaml:"name"`
+	Type string `json:"type" yaml:"type"`
+	// ID fixes the agent ID. When empty it is kept in StateDir, or derived from the machine ID and hostname
+	ID string `json:"id,omitempty" yaml:"id,omitempty"`
+
+	// Servers are the Pulse URLs. The first is used until it can't be reached, then the next one
+	Servers           []string  `json:"servers" yaml:"servers"`
+	HeartbeatInterval Duration  `json:"heartbeat_interval" yaml:"heartbeat_interval"`
+	Timeout           Duration  `json:"timeout" yaml:"timeout"` // per request, retries excluded
+	TLS               TLSConfig `json:"tls,omitempty" yaml:"tls,omitempty"`
+	// Token is sent as a bearer token on every request
+	Token string `json:"token,omitempty" yaml:"token,omitempty"`
+	// Transport carries registrations, updates and heartbeats: http, the default,
+	// or grpc. Over gRPC heartbeats go on a session Pulse pushes directives on,
+	// see GRPCAddress; everything else still goes to Servers.
+	Transport   string      `json:"transport,omitempty" yaml:"transport,omitempty"`
+	GRPCAddress string      `json:"grpc_address,omitempty" yaml:"grpc_address,omitempty"` // host:port of Pulse's gRPC listener
+	Retry       RetryConfig `json:"retry" yaml:"retry"`
+
+	QueueDir         string `json:"queue_dir,omitempty" yaml:"queue_dir,omitempty"` // offline queue, disabled when empty
+	QueueMaxBytes    int64  `json:"queue_max_bytes,omitempty" yaml:"queue_max_bytes,omitempty"`
+	StateDir         string `json:"state_dir,omitempty" yaml:"state_dir,omitempty"`
+	MetricsBatchSize int    `json:"metrics_batch_size,omitempty" yaml:"metrics_batch_size,omitempty"`
+	// Coalesce is how long updates and metrics are held to be sent as a batch, 0 sends each right away
+	Coalesce Duration `json:"coalesce,omitempty" yaml:"coalesce,omitempty"`
+	// CoalesceHeartbeats batches heartbeats too, see Agent.CoalesceHeartbeats
+	CoalesceHeartbeats bool `json:"coalesce_heartbeats,omitempty" yaml:"coalesce_heartbeats,omitempty"`
+
+	Host HostConfig `json:"host,omitempty" yaml:"host,omitempty"`
+	// Probes are checks run on their own schedules, see AddProbe
+	Probes []ProbeConfig `json:"probes,omitempty" yaml:"probes,omitempty"`
+	Logs   LogsConfig    `json:"logs,omitempty" yaml:"logs,omitempty"`
+}
+
+// DefaultConfig returns the settings used for anything not configured
+func DefaultConfig() Config {
+	p := DefaultRetryPolicy
+	return Config{
+		HeartbeatInterval: Duration(DefaultHeartbeatInterval),
+		Timeout:           Duration(5 * time.Second),
+		Retry: RetryConfig{
+			InitialInterval: Duration(p.InitialInterval),
+			MaxInterval:     Duration(p.MaxInterval),
+			Multiplier:      p.Multiplier,
+			Jitter:          p.Jitter,
+			MaxElapsedTime:  Duration(p.MaxElapsedTime),
+		},
+		QueueMaxBytes:    DefaultQueueMaxBytes,
+		MetricsBatchSize: DefaultMetricsBatchSize,
+	}
+}
+
+// Option adjusts a Config
+type Option func(*Config)
+
+// WithServers sets the Pulse URLs, in order of preference
+func WithServers(urls ...string) Option {
+	return func(c *Config) { c.Servers = urls }
+}
+
+// WithHeartbeatInterval sets how often the agent heartbeats
+func WithHeartbeatInterval(d time.Duration) Option {
+	return func(c *Config) { c.HeartbeatInterval = Duration(d) }
+}
+
+// WithTimeout sets the timeout of a single request
+func WithTimeout(d time.Duration) Option {
+	return func(c *Config) { c.Timeout = Duration(d) }
+}
+
+// WithTLS sets how the connection to Pulse is secured
+func WithTLS(t TLSConfig) Option {
+	return func(c *Config) { c.TLS = t }
+}
+
+// WithGRPC sends registrations, updates and heartbeats to Pulse's gRPC listener at address
+func WithGRPC(address string) Option {
+	return func(c *Config) { c.Transport, c.GRPCAddress = "grpc", address }
+}
+
+// WithToken sets the bearer token sent to Pulse
+func WithToken(token string) Option {
+	return func(c *Config) { c.Token = token }
+}
+
+// WithRetry sets the retry policy
+func WithRetry(p RetryPolicy) Option {
+	return func(c *Config) {
+		c.Retry = RetryConfig{
+			InitialInterval: Duration(p.InitialInterval),
+			MaxInterval:     Duration(p.MaxInterval),
+			Multiplier:      p.Multiplier,
+			Jitter:          p.Jitter,
+			MaxElapsedTime:  Duration(p.MaxElapsedTime),
+		}
+	}
+}
+
+// WithQueueDir enables the offline queue in dir
+func WithQueueDir(dir string) Option {
+	return func(c *Config) { c.QueueDir = dir }
+}
+
+// WithStateDir sets where the agent keeps its identity
+func WithStateDir(dir string) Option {
+	return func(c *Config) { c.StateDir = dir }
+}
+
+// WithID fixes the agent ID
+func WithID(id string) Option {
+	return func(c *Config) { c.ID = id }
+}
+
+// WithCoalesce sends updates and metrics in batches, each held for up to d
+func WithCoalesce(d time.Duration) Option {
+	return func(c *Config) { c.Coalesce = Duration(d) }
+}
+
+// WithHost sets up the host collector
+func WithHost(h HostConfig) Option {
+	return func(c *Config) { c.Host = h }
+}
+
+// ConfigFromEnv returns DefaultConfig overridden by the file named in PULSE_CONFIG,
+// if any, then by the PULSE_* environment variables. The environment is applied
+// even when the file can't be loaded, so the error can be logged and the config used.
+func ConfigFromEnv() (Config, error) {
+	cfg := DefaultConfig()
+	var fileErr error
+	if path := os.Getenv("PULSE_CONFIG"); path != "" {
+		cfg, fileErr = LoadConfigFile(path)
+	}
+	return cfg, errors.Join(fileErr, cfg.applyEnv())
+}
+
+// applyEnv overrides the config with the PULSE_* environment variables that are set
+func (c *Config) applyEnv() error {
+	var errs []error
+	str := func(key string, dst *string) {
+		if v := os.Getenv(key); v != "" {
+			*dst = v
+		}
+	}
+	duration := func(key string, dst *Duration) {
+		if v := os.Getenv(key); v != "" {
+			if err := dst.UnmarshalText([]byte(v)); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			}
+		}
+	}
+	boolean := func(key string, dst *bool) {
+		if v := os.Getenv(key); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			}
+			*dst = b
+		}
+	}
+
+	if v := os.Getenv("PULSE_SERVER_URL"); v != "" {
+		c.Servers = nil
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				c.Servers = append(c.Servers, s)
+			}
+		}
+	}
+	if v := os.Getenv("PULSE_LOG_FILES"); v != "" {
+		c.Logs.Files = nil
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				c.Logs.Files = append(c.Logs.Files, f)
+			}
+		}
+	}
+	str("PULSE_AGENT_ID", &c.ID)
+	str("PULSE_TOKEN", &c.Token)
+	str("PULSE_TRANSPORT", &c.Transport)
+	str("PULSE_GRPC_ADDR", &c.GRPCAddress)
+	str("PULSE_TLS_CA", &c.TLS.CAFile)
+	str("PULSE_TLS_CERT", &c.TLS.CertFile)
+	str("PULSE_TLS_KEY", &c.TLS.KeyFile)
+	str("PULSE_QUEUE_DIR", &c.QueueDir)
+	str("PULSE_STATE_DIR", &c.StateDir)
+	duration("PULSE_HEARTBEAT_INTERVAL", &c.HeartbeatInterval)
+	duration("PULSE_TIMEOUT", &c.Timeout)
+	duration("PULSE_COALESCE", &c.Coalesce)
+	boolean("PULSE_COALESCE_HEARTBEATS", &c.CoalesceHeartbeats)
+	boolean("PULSE_TLS_INSECURE", &c.TLS.InsecureSkipVerify)
+	boolean("PULSE_HOST_COLLECTOR", &c.Host.Enabled)
+	boolean("PULSE_HOST_METRICS", &c.Host.Metrics)
+	return errors.Join(errs...)
+}
+
+// LoadConfigFile reads a YAML (.yaml, .yml) or JSON (.json) config file on top of DefaultConfig
+func LoadConfigFile(path string) (Config, error) {
+	cfg := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("config: %w", err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &cfg)
+	case ".json":
+		err = json.Unmarshal(data, &cfg)
+	default:
+		return cfg, fmt.Errorf("config: unsupported file type %q", ext)
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("config: %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate reports every invalid setting
+func (c Config) Validate() error {
+	var errs []error
+	for _, p := range c.problems() {
+		errs = append(errs, p.err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("config: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// configProblem is an invalid setting. reset puts the default back, nil for
+// the settings the agent can't do without.
+type configProblem struct {
+	err   error
+	reset func(c *Config)
+}
+
+// resetInvalid puts the default back in place of every invalid setting it can
+// do without, keeping the valid ones. It returns the problems it reset.
+func (c *Config) resetInvalid() error {
+	var errs []error
+	for _, p := range c.problems() {
+		if p.reset != nil {
+			p.reset(c)
+			errs = append(errs, p.err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// problems lists every invalid setting
+func (c Config) problems() []configProblem {
+	var out []configProblem
+	def := DefaultConfig()
+	add := func(err error, reset func(c *Config)) {
+		out = append(out, configProblem{err: err, reset: reset})
+	}
+
+	if c.Name == "" {
+		add(errors.New("name is required"), nil)
+	}
+	if len(c.Servers) == 0 {
+		add(errors.New("at least one server URL is required"), nil)
+	}
+	for _, s := range c.Servers {
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add(fmt.Errorf("invalid server URL %q", s), nil)
+		}
+	}
+	if c.HeartbeatInterval <= 0 {
+		add(errors.New("heartbeat_interval must be positive"), func(c *Config) { c.HeartbeatInterval = def.HeartbeatInterval })
+	}
+	if c.Timeout <= 0 {
+		add(errors.New("timeout must be positive"), func(c *Config) { c.Timeout = def.Timeout })
+	}
+	switch c.Transport {
+	case "", "http":
+	case "grpc":
+		if _, _, err := net.SplitHostPort(c.GRPCAddress); err != nil {
+			add(fmt.Errorf("invalid grpc_address %q", c.GRPCAddress), func(c *Config) { c.Transport, c.GRPCAddress = "", "" })
+		}
+	default:
+		add(fmt.Errorf("invalid transport %q, use http or grpc", c.Transport), func(c *Config) { c.Transport, c.GRPCAddress = "", "" })
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		add(errors.New("tls cert_file and key_file go together"), func(c *Config) { c.TLS.CertFile, c.TLS.KeyFile = "", "" })
+	}
+	if c.Retry.MaxElapsedTime < 0 || c.Retry.InitialInterval < 0 || c.Retry.MaxInterval < 0 {
+		add(errors.New("retry intervals can't be negative"), func(c *Config) {
+			c.Retry.InitialInterval, c.Retry.MaxInterval, c.Retry.MaxElapsedTime = def.Retry.InitialInterval, def.Retry.MaxInterval, def.Retry.MaxElapsedTime
+		})
+	}
+	if c.Retry.Jitter < 0 || c.Retry.Jitter > 1 {
+		add(errors.New("retry jitter must be between 0 and 1"), func(c *Config) { c.Retry.Jitter = def.Retry.Jitter })
+	}
+	if c.Coalesce < 0 {
+		add(errors.New("coalesce can't be negative"), func(c *Config) { c.Coalesce = def.Coalesce })
+	}
+	if c.Logs.BatchSize < 0 || c.Logs.BatchSize > maxLogsPerRequest {
+		add(fmt.Errorf("logs batch_size must be between 0 and %d", maxLogsPerRequest), func(c *Config) { c.Logs.BatchSize = def.Logs.BatchSize })
+	}
+	if c.Logs.FlushInterval < 0 {
+		add(errors.New("logs flush_interval can't be negative"), func(c *Config) { c.Logs.FlushInterval = def.Logs.FlushInterval })
+	}
+	if c.QueueDir != "" && c.QueueMaxBytes <= 0 {
+		add(errors.New("queue_max_bytes must be positive"), func(c *Config) { c.QueueMaxBytes = def.QueueMaxBytes })
+	}
+	names := map[string]bool{}
+	for _, p := range c.Probes {
+		// An invalid probe is dropped along with any other probe of the same name
+		drop := func(c *Config) {
+			kept := c.Probes[:0:0]
+			for _, other := range c.Probes {
+				if other.Name != p.Name {
+					kept = append(kept, other)
+				}
+			}
+			c.Probes = kept
+		}
+		if err := p.Validate(); err != nil {
+			add(err, drop)
+		} else if names[p.Name] {
+			add(fmt.Errorf("probe %s is declared twice", p.Name), drop)
+		}
+		names[p.Name] = true
+	}
+	if c.ID != "" {
+		if _, err := uuid.Parse(c.ID); err != nil {
+			add(fmt.Errorf("invalid id: %w", err), nil)
+		}
+	}
+	return out
+}
+
+// tlsConfig builds the TLS settings of the HTTP client, nil when the defaults apply
+func (t TLSConfig) tlsConfig() (*tls.Config, error) {
+	if t == (TLSConfig{}) {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{ServerName: t.ServerName, InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: no certificate found in %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
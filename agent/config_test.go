@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test YAML and JSON config files are read on top of the defaults
+func TestLoadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"agent.yaml": "name: worker\ntype: bot\nservers: [\"https://pulse.example.com\"]\nheartbeat_interval: 15s\nretry:\n  max_elapsed_time: 1m\n",
+		"agent.json": `{"name": "worker", "type": "bot", "servers": ["https://pulse.example.com"], "heartbeat_interval": "15s", "retry": {"max_elapsed_time": "1m"}}`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			os.WriteFile(path, []byte(content), 0o600)
+
+			cfg, err := LoadConfigFile(path)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if cfg.Name != "worker" || cfg.Type != "bot" || len(cfg.Servers) != 1 {
+				t.Errorf("unexpected config %+v", cfg)
+			}
+			if time.Duration(cfg.HeartbeatInterval) != 15*time.Second || time.Duration(cfg.Retry.MaxElapsedTime) != time.Minute {
+				t.Errorf("expected durations to be parsed, got %+v", cfg)
+			}
+			if time.Duration(cfg.Timeout) != 5*time.Second {
+				t.Errorf("expected unset settings to keep their default, got timeout %s", time.Duration(cfg.Timeout))
+			}
+			if err := cfg.Validate(); err != nil {
+				t.Errorf("expected a valid config, got %v", err)
+			}
+		})
+	}
+
+	if _, err := LoadConfigFile(filepath.Join(dir, "agent.toml")); err == nil {
+		t.Error("expected an error for an unsupported file type")
+	}
+}
+
+// Test environment variables override the defaults
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("PULSE_SERVER_URL", "https://a.example.com, https://b.example.com")
+	t.Setenv("PULSE_HEARTBEAT_INTERVAL", "10s")
+	t.Setenv("PULSE_TOKEN", "secret")
+	t.Setenv("PULSE_HOST_COLLECTOR", "true")
+	t.Setenv("PULSE_LOG_FILES", "/var/log/app.log, /var/log/app.err")
+	t.Setenv("PULSE_TRANSPORT", "grpc")
+	t.Setenv("PULSE_GRPC_ADDR", "pulse.example.com:4000")
+
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(cfg.Servers) != 2 || cfg.Servers[1] != "https://b.example.com" {
+		t.Errorf("expected both servers, got %v", cfg.Servers)
+	}
+	if time.Duration(cfg.HeartbeatInterval) != 10*time.Second || cfg.Token != "secret" || !cfg.Host.Enabled {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+	if len(cfg.Logs.Files) != 2 || cfg.Logs.Files[1] != "/var/log/app.err" {
+		t.Errorf("expected both log files, got %v", cfg.Logs.Files)
+	}
+	if cfg.Transport != "grpc" || cfg.GRPCAddress != "pulse.example.com:4000" {
+		t.Errorf("expected the grpc transport, got %q at %q", cfg.Transport, cfg.GRPCAddress)
+	}
+
+	t.Setenv("PULSE_HEARTBEAT_INTERVAL", "often")
+	if _, err := ConfigFromEnv(); err == nil || !strings.Contains(err.Error(), "PULSE_HEARTBEAT_INTERVAL") {
+		t.Errorf("expected an invalid interval error, got %v", err)
+	}
+}
+
+// Test only the invalid settings are reset, the required ones left to fail
+func TestConfig_ResetInvalid(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Name = "test-agent"
+	cfg.Token = "secret"
+	cfg.Timeout = -1
+	cfg.Transport = "carrier-pigeon"
+	cfg.Probes = []ProbeConfig{
+		{Name: "db", Type: "tcp", Address: "localhost:5432"},
+		{Name: "web", Type: "http"},
+	}
+
+	if err := cfg.resetInvalid(); err == nil {
+		t.Fatal("expected the reset settings to be reported")
+	}
+	if time.Duration(cfg.Timeout) != 5*time.Second || cfg.Transport != "" || cfg.Token != "secret" {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+	if len(cfg.Probes) != 1 || cfg.Probes[0].Name != "db" {
+		t.Errorf("expected only the valid probe to be kept, got %+v", cfg.Probes)
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "server URL") {
+		t.Errorf("expected the missing server to be left invalid, got %v", err)
+	}
+}
+
+// Test every invalid setting is reported
+func TestConfig_Validate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Servers = []string{"pulse:3000"}
+	cfg.HeartbeatInterval = 0
+	cfg.TLS.CertFile = "client.pem"
+	cfg.ID = "not-a-uuid"
+	cfg.Logs.BatchSize = 5000
+	cfg.Transport = "grpc"
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{"name is required", "invalid server URL", "heartbeat_interval", "key_file", "invalid id", "logs batch_size", "invalid grpc_address"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+}
+
+// Test NewFromConfig returns an error instead of exiting
+func TestNewFromConfig_Invalid(t *testing.T) {
+	if _, err := NewFromConfig(DefaultConfig()); err == nil {
+		t.Error("expected an error without server URL and name")
+	}
+}
+
+// Test the agent fails over to the next server and sends its token
+func TestNewFromConfig_FailoverAndToken(t *testing.T) {
+	var auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	cfg := DefaultConfig()
+	cfg.Name = "worker"
+	agent, err := NewFromConfig(cfg,
+		WithServers(down.URL, ts.URL),
+		WithToken("secret"),
+		WithStateDir(t.TempDir()),
+		WithRetry(fastRetry),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if err := agent.Heartbeat("healthy"); err != nil {
+		t.Fatalf("expected the fallback server to be used, got %v", err)
+	}
+	if auth != "Bearer secret" {
+		t.Errorf("expected bearer token, got %q", auth)
+	}
+	if agent.server() != ts.URL {
+		t.Errorf("expected the agent to stay on the fallback server, got %s", agent.server())
+	}
+}
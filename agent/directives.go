@@ -0,0 +1,225 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Directive is an instruction from Pulse, received along a heartbeat response.
+// Pulse sends it again on every heartbeat until the agent acknowledges it, which
+// it does on the heartbeat after the directive's handler returned.
+type Directive struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"` // set_interval, maintenance, disable, reregister, run_task or restart
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Decode unmarshals the directive's payload into v
+func (d Directive) Decode(v any) error {
+	if len(d.Payload) == 0 {
+		return fmt.Errorf("%s directive without payload", d.Type)
+	}
+	return json.Unmarshal(d.Payload, v)
+}
+
+// DirectiveHandler applies a directive. The error, if any, is reported to Pulse with the acknowledgement.
+type DirectiveHandler func(ctx context.Context, d Directive) error
+
+type directiveAck struct {
+	ID    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+type heartbeatResponse struct {
+	Directives    []Directive `json:"directives"`
+	ConfigVersion string      `json:"config_version"`
+}
+
+// HandleDirective registers the handler of a directive type, replacing any
+// previous one. Without a handler, set_interval changes the heartbeat interval
+// and reregister registers the agent again; other directives are acknowledged
+// with an error. A disable handler runs before the agent shuts down, reporting
+// `disabled`; it can refuse by returning an error.
+func (a *Agent) HandleDirective(directiveType string, h DirectiveHandler) {
+	a.directivesMu.Lock()
+	defer a.directivesMu.Unlock()
+	if a.directiveHandlers == nil {
+		a.directiveHandlers = map[string]DirectiveHandler{}
+	}
+	a.directiveHandlers[directiveType] = h
+}
+
+// SetHeartbeatInterval changes how often the agent heartbeats, starting with the next beat
+func (a *Agent) SetHeartbeatInterval(d time.Duration) {
+	a.intervalMu.Lock()
+	a.heartbeat = d
+	changed := a.intervalSignalLocked()
+	a.intervalMu.Unlock()
+
+	select {
+	case changed <- struct{}{}:
+	default: // a change is already pending
+	}
+}
+
+// intervalSignal returns the channel the heartbeat loops watch for interval changes
+func (a *Agent) intervalSignal() chan struct{} {
+	a.intervalMu.Lock()
+	defer a.intervalMu.Unlock()
+	return a.intervalSignalLocked()
+}
+
+func (a *Agent) intervalSignalLocked() chan struct{} {
+	if a.intervalChanged == nil {
+		a.intervalChanged = make(chan struct{}, 1)
+	}
+	return a.intervalChanged
+}
+
+// sendHeartbeat posts a heartbeat carrying the pending acknowledgements and
+// runs the directives of the response, fetching the configuration when it changed
+func (a *Agent) sendHeartbeat(ctx context.Context, payload heartbeatPayload) error {
+	a.directivesMu.Lock()
+	payload.Acks = append([]directiveAck(nil), a.acks...)
+	a.directivesMu.Unlock()
+	payload.ConfigVersion = a.ConfigVersion()
+	if a.CoalesceHeartbeats && a.Coalesce > 0 && len(payload.Acks) == 0 {
+		return a.coalesce(ctx, batchItem{Type: "heartbeat", Heartbeat: &payload})
+	}
+
+	var resp heartbeatResponse
+	if err := a.request(ctx, "/agent/heartbeat", payload, &resp); err != nil {
+		return err
+	}
+
+	// Heartbeats can overlap, so the acks sent are removed by ID: acks added
+	// meanwhile or already removed by another heartbeat are left alone
+	sent := make(map[string]bool, len(payload.Acks))
+	for _, ack := range payload.Acks {
+		sent[ack.ID] = true
+	}
+	a.directivesMu.Lock()
+	pending := a.acks[:0]
+	for _, ack := range a.acks {
+		if !sent[ack.ID] {
+			pending = append(pending, ack)
+		}
+	}
+	a.acks = pending
+	for id := range sent {
+		delete(a.directivesSeen, id)
+	}
+	a.directivesMu.Unlock()
+
+	for _, d := range resp.Directives {
+		a.dispatch(d)
+	}
+	if a.configOutdated(resp.ConfigVersion) {
+		a.refreshConfig()
+	}
+	return nil
+}
+
+// dispatch runs the handler of a directive in the background, unless it
+// already ran or the agent is stopping
+func (a *Agent) dispatch(d Directive) {
+	if a.isStopped() {
+		return
+	}
+	a.directivesMu.Lock()
+	if a.directivesSeen[d.ID] {
+		a.directivesMu.Unlock()
+		return
+	}
+	if a.directivesSeen == nil {
+		a.directivesSeen = map[string]bool{}
+	}
+	a.directivesSeen[d.ID] = true
+	h := a.directiveHandlers[d.Type]
+	a.directivesMu.Unlock()
+
+	if h == nil {
+		h = a.defaultDirectiveHandler(d.Type)
+	}
+	go func() {
+		a.logger().Info("directive received", "directive_id", d.ID, "type", d.Type)
+		err := runDirective(h, d)
+		if err != nil {
+			a.logger().Warn("directive failed", "directive_id", d.ID, "type", d.Type, "error", err)
+		}
+
+		ack := directiveAck{ID: d.ID}
+		if err != nil {
+			ack.Error = err.Error()
+		}
+		a.directivesMu.Lock()
+		a.acks = append(a.acks, ack)
+		a.directivesMu.Unlock()
+
+		if d.Type == "disable" && err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), FinalStatusTimeout)
+			defer cancel()
+			if err := a.shutdown(ctx, "disabled", nil); err != nil {
+				a.logger().Error("shutdown failed", "error", err)
+			}
+		}
+	}()
+}
+
+// runDirective runs h, turning a panic into an error
+func runDirective(h DirectiveHandler, d Directive) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return h(context.Background(), d)
+}
+
+// defaultDirectiveHandler is what the agent does with a directive it has no handler for
+func (a *Agent) defaultDirectiveHandler(directiveType string) DirectiveHandler {
+	switch directiveType {
+	case "set_interval":
+		return func(ctx context.Context, d Directive) error {
+			var p struct {
+				Interval float64 `json:"interval"` // seconds
+			}
+			if err := d.Decode(&p); err != nil {
+				return err
+			}
+			if p.Interval <= 0 {
+				return errors.New("interval must be positive")
+			}
+			a.SetHeartbeatInterval(time.Duration(p.Interval * float64(time.Second)))
+			return nil
+		}
+	case "reregister":
+		// Pulse refreshes a registered agent; an older Pulse answering
+		// ErrAlreadyRegistered instead didn't, which is reported rather than
+		// acknowledged as done
+		return func(ctx context.Context, d Directive) error {
+			return a.RegisterContext(ctx)
+		}
+	case "disable":
+		return func(ctx context.Context, d Directive) error { return nil }
+	default:
+		return func(ctx context.Context, d Directive) error {
+			return fmt.Errorf("no handler for %s directives", directiveType)
+		}
+	}
+}
+
+// flushAcks sends a last heartbeat when acknowledgements are pending, so
+// Pulse doesn't send the directives again once the agent is back
+func (a *Agent) flushAcks(ctx context.Context, status string) error {
+	a.directivesMu.Lock()
+	pending := len(a.acks) > 0
+	a.directivesMu.Unlock()
+	if !pending {
+		return nil
+	}
+	return a.sendHeartbeat(ctx, heartbeatPayload{ID: a.ID.String(), Status: status})
+}
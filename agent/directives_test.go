@@ -0,0 +1,308 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// directiveServer answers every heartbeat with the directives returned by next,
+// leaving out acknowledged ones like Pulse does, and records the acks it receives
+type directiveServer struct {
+	mu      sync.Mutex
+	beats   int
+	acks    []directiveAck
+	updates []string
+	next    func(beat int) []Directive
+
+	registerStatus int // answered to registrations, 200 when unset
+	registers      int
+}
+
+func (s *directiveServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.URL.Path {
+	case "/agent/heartbeat":
+		var p heartbeatPayload
+		json.NewDecoder(r.Body).Decode(&p)
+		s.acks = append(s.acks, p.Acks...)
+		s.beats++
+		var directives []Directive
+		if s.next != nil {
+			for _, d := range s.next(s.beats) {
+				if !s.acked(d.ID) {
+					directives = append(directives, d)
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"status": "OK", "directives": directives})
+	case "/agent/register":
+		s.registers++
+		if s.registerStatus != 0 {
+			w.WriteHeader(s.registerStatus)
+		}
+	case "/agent/update":
+		var p updatePayload
+		json.NewDecoder(r.Body).Decode(&p)
+		s.updates = append(s.updates, p.Status)
+	}
+}
+
+func (s *directiveServer) acked(id string) bool {
+	for _, ack := range s.acks {
+		if ack.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *directiveServer) state() (int, []directiveAck, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.beats, append([]directiveAck(nil), s.acks...), append([]string(nil), s.updates...)
+}
+
+// waitFor polls cond until it holds or a second passed
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+// Test set_interval is applied and acknowledged on the next heartbeat
+func TestAgent_Directive_SetInterval(t *testing.T) {
+	srv := &directiveServer{next: func(beat int) []Directive {
+		return []Directive{{ID: "d1", Type: "set_interval", Payload: json.RawMessage(`{"interval": 42}`)}}
+	}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	agent := newTestAgent(ts.URL)
+
+	agent.Heartbeat("healthy")
+	waitFor(t, func() bool { return agent.heartbeatInterval() == 42*time.Second })
+	waitFor(t, func() bool {
+		agent.directivesMu.Lock()
+		defer agent.directivesMu.Unlock()
+		return len(agent.acks) == 1
+	})
+	agent.Heartbeat("healthy")
+	agent.Heartbeat("healthy")
+
+	_, acks, _ := srv.state()
+	if len(acks) != 1 || acks[0] != (directiveAck{ID: "d1"}) {
+		t.Errorf("expected a single successful ack, got %+v", acks)
+	}
+}
+
+// Test a directive sent again while its handler runs is not run twice
+func TestAgent_Directive_RunsOnce(t *testing.T) {
+	srv := &directiveServer{next: func(beat int) []Directive {
+		return []Directive{{ID: "d1", Type: "run_task", Payload: json.RawMessage(`{"name": "reindex"}`)}}
+	}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	agent := newTestAgent(ts.URL)
+
+	var mu sync.Mutex
+	runs := 0
+	release := make(chan struct{})
+	agent.HandleDirective("run_task", func(ctx context.Context, d Directive) error {
+		mu.Lock()
+		runs++
+		mu.Unlock()
+		<-release
+		return nil
+	})
+
+	agent.Heartbeat("healthy")
+	agent.Heartbeat("healthy") // d1 is still running
+	close(release)
+	waitFor(t, func() bool {
+		agent.directivesMu.Lock()
+		defer agent.directivesMu.Unlock()
+		return len(agent.acks) == 1
+	})
+	agent.Heartbeat("healthy")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if _, acks, _ := srv.state(); runs != 1 || len(acks) != 1 {
+		t.Errorf("expected one run and one ack, got %d runs and acks %+v", runs, acks)
+	}
+}
+
+// Test registered handlers receive their directives and unhandled ones are acknowledged with an error
+func TestAgent_Directive_Handlers(t *testing.T) {
+	srv := &directiveServer{next: func(beat int) []Directive {
+		if beat == 1 {
+			return []Directive{
+				{ID: "d1", Type: "run_task", Payload: json.RawMessage(`{"name": "reindex"}`)},
+				{ID: "d2", Type: "maintenance", Payload: json.RawMessage(`{"enabled": true}`)},
+			}
+		}
+		return nil
+	}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	agent := newTestAgent(ts.URL)
+
+	ran := make(chan string, 1)
+	agent.HandleDirective("run_task", func(ctx context.Context, d Directive) error {
+		var p struct{ Name string }
+		if err := d.Decode(&p); err != nil {
+			return err
+		}
+		ran <- p.Name
+		return errors.New("index locked")
+	})
+
+	agent.Heartbeat("healthy")
+	if name := <-ran; name != "reindex" {
+		t.Errorf("expected the reindex task, got %q", name)
+	}
+	waitFor(t, func() bool {
+		agent.directivesMu.Lock()
+		defer agent.directivesMu.Unlock()
+		return len(agent.acks) == 2
+	})
+	agent.Heartbeat("healthy")
+
+	_, acks, _ := srv.state()
+	got := map[string]string{}
+	for _, ack := range acks {
+		got[ack.ID] = ack.Error
+	}
+	if got["d1"] != "index locked" || got["d2"] != "no handler for maintenance directives" {
+		t.Errorf("expected both directives acknowledged with their errors, got %+v", acks)
+	}
+}
+
+// Test disable shuts the agent down, acknowledging the directive and reporting disabled
+func TestAgent_Directive_Disable(t *testing.T) {
+	srv := &directiveServer{next: func(beat int) []Directive {
+		if beat == 1 {
+			return []Directive{{ID: "d1", Type: "disable"}}
+		}
+		return nil
+	}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	agent := newTestAgent(ts.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := agent.Run(ctx); err != nil {
+		t.Fatalf("expected Run to end without error, got %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("expected the directive to stop Run")
+	}
+
+	_, acks, updates := srv.state()
+	if len(acks) != 1 || acks[0].ID != "d1" || acks[0].Error != "" {
+		t.Errorf("expected the disable directive to be acknowledged, got %+v", acks)
+	}
+	if len(updates) != 1 || updates[0] != "disabled" {
+		t.Errorf("expected a final disabled update, got %v", updates)
+	}
+}
+
+// Test reregister registers again, and is acknowledged with an error when Pulse didn't refresh the agent
+func TestAgent_Directive_Reregister(t *testing.T) {
+	for status, wantErr := range map[int]bool{http.StatusOK: false, http.StatusConflict: true} {
+		srv := &directiveServer{registerStatus: status, next: func(beat int) []Directive {
+			return []Directive{{ID: "d1", Type: "reregister"}}
+		}}
+		ts := httptest.NewServer(srv)
+		agent := newTestAgent(ts.URL)
+
+		agent.Heartbeat("healthy")
+		waitFor(t, func() bool {
+			agent.directivesMu.Lock()
+			defer agent.directivesMu.Unlock()
+			return len(agent.acks) == 1
+		})
+		agent.Heartbeat("healthy")
+		ts.Close()
+
+		srv.mu.Lock()
+		registers := srv.registers
+		srv.mu.Unlock()
+		_, acks, _ := srv.state()
+		if registers != 1 || len(acks) != 1 || (acks[0].Error != "") != wantErr {
+			t.Errorf("status %d: expected one registration acknowledged with error %v, got %d and %+v", status, wantErr, registers, acks)
+		}
+	}
+}
+
+// Test a running loop picks up a new interval right away
+func TestAgent_SetHeartbeatInterval(t *testing.T) {
+	srv := &directiveServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	agent := newTestAgent(ts.URL)
+	agent.heartbeat = time.Hour
+
+	agent.StartHeartbeatLoop()
+	defer agent.StopHeartbeatLoop()
+	agent.SetHeartbeatInterval(5 * time.Millisecond)
+	waitFor(t, func() bool {
+		beats, _, _ := srv.state()
+		return beats >= 2
+	})
+}
+
+// Test overlapping heartbeats only remove the acks they sent
+func TestAgent_Directive_OverlappingAcks(t *testing.T) {
+	arrived, release := make(chan struct{}), make(chan struct{})
+	var mu sync.Mutex
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		first := requests == 1
+		mu.Unlock()
+		if first {
+			close(arrived)
+			<-release
+		}
+		w.Write([]byte(`{"status":"OK"}`))
+	}))
+	defer ts.Close()
+	agent := newTestAgent(ts.URL)
+	agent.acks = []directiveAck{{ID: "d1"}}
+
+	ctx := context.Background()
+	slow := make(chan error, 1)
+	go func() { slow <- agent.sendHeartbeat(ctx, heartbeatPayload{ID: agent.ID.String(), Status: "healthy"}) }()
+	<-arrived
+	if err := agent.sendHeartbeat(ctx, heartbeatPayload{ID: agent.ID.String(), Status: "healthy"}); err != nil {
+		t.Fatal(err)
+	}
+	// A directive handler returns while the first heartbeat is still in flight
+	agent.directivesMu.Lock()
+	agent.acks = append(agent.acks, directiveAck{ID: "d2"})
+	agent.directivesMu.Unlock()
+	close(release)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+
+	agent.directivesMu.Lock()
+	defer agent.directivesMu.Unlock()
+	if len(agent.acks) != 1 || agent.acks[0].ID != "d2" {
+		t.Errorf("expected the unsent ack to be kept, got %+v", agent.acks)
+	}
+}
@@ -0,0 +1,288 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pulsev1 "github.com/aphrollo/pulse/proto/pulse/v1"
+)
+
+// grpcTransport carries registrations, updates and heartbeats to Pulse's gRPC
+// listener, see Config.Transport. Heartbeats go on a session stream Pulse
+// pushes directives on, opened with the first one and again after it broke.
+// The payloads are those of the HTTP endpoints, which the protobuf messages
+// mirror field for field, so requests still go through request with its
+// retries and offline queue.
+type grpcTransport struct {
+	agent   *Agent
+	conn    *grpc.ClientConn
+	client  pulsev1.AgentServiceClient
+	timeout time.Duration
+
+	beatMu  sync.Mutex // held while a heartbeat waits for its answer, so answers match
+	mu      sync.Mutex
+	session *grpcSession
+}
+
+type grpcSession struct {
+	stream  pulsev1.AgentService_SessionClient
+	cancel  context.CancelFunc
+	answers chan *pulsev1.HeartbeatResponse
+	done    chan struct{} // closed once the stream ended, with err set
+	err     error
+}
+
+// newGRPCTransport connects to cfg.GRPCAddress, with TLS when the HTTP
+// connection to Pulse uses it too
+func newGRPCTransport(a *Agent, cfg Config, tlsConfig *tls.Config) (*grpcTransport, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil || strings.HasPrefix(cfg.Servers[0], "https://") {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	conn, err := grpc.NewClient(cfg.GRPCAddress,
+		grpc.WithTransportCredentials(creds),
+		// Lets Pulse tell a session broke by a vanished agent from an idle one
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: 30 * time.Second, Timeout: 10 * time.Second, PermitWithoutStream: true}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("grpc: %w", err)
+	}
+	return &grpcTransport{
+		agent:   a,
+		conn:    conn,
+		client:  pulsev1.NewAgentServiceClient(conn),
+		timeout: time.Duration(cfg.Timeout),
+	}, nil
+}
+
+// carries reports whether requests to path go over gRPC rather than HTTP
+func (t *grpcTransport) carries(path string) bool {
+	return path == "/agent/register" || path == "/agent/update" || path == "/agent/heartbeat"
+}
+
+// outgoing adds the metadata every call carries, like newRequest's headers
+func (t *grpcTransport) outgoing(ctx context.Context) context.Context {
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-request-id", uuid.NewString())
+	if t.agent.token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+t.agent.token)
+	}
+	return ctx
+}
+
+// send makes one attempt like Agent.send, reporting the status the HTTP
+// endpoint would have answered with
+func (t *grpcTransport) send(ctx context.Context, path string, data []byte, out any) (int, time.Duration, error) {
+	unmarshal := protojson.UnmarshalOptions{DiscardUnknown: true}
+	var resp proto.Message
+	var err error
+	switch path {
+	case "/agent/register":
+		req := &pulsev1.RegisterRequest{}
+		if err := unmarshal.Unmarshal(data, req); err != nil {
+			return http.StatusBadRequest, 0, fmt.Errorf("convert payload: %w", err)
+		}
+		ctx, cancel := context.WithTimeout(t.outgoing(ctx), t.timeout)
+		defer cancel()
+		resp, err = t.client.Register(ctx, req)
+	case "/agent/update":
+		req := &pulsev1.UpdateRequest{}
+		if err := unmarshal.Unmarshal(data, req); err != nil {
+			return http.StatusBadRequest, 0, fmt.Errorf("convert payload: %w", err)
+		}
+		ctx, cancel := context.WithTimeout(t.outgoing(ctx), t.timeout)
+		defer cancel()
+		resp, err = t.client.Update(ctx, req)
+	case "/agent/heartbeat":
+		req := &pulsev1.HeartbeatRequest{}
+		if err := unmarshal.Unmarshal(data, req); err != nil {
+			return http.StatusBadRequest, 0, fmt.Errorf("convert payload: %w", err)
+		}
+		resp, err = t.heartbeat(ctx, req)
+	default:
+		return 0, 0, fmt.Errorf("%s is not served over gRPC", path)
+	}
+	if err != nil {
+		code := httpStatus(err)
+		if code != 0 {
+			t.agent.logger().Debug("request rejected", "path", path, "status", code, "error", err)
+		}
+		return code, 0, err
+	}
+
+	if out != nil {
+		data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(resp)
+		if err == nil {
+			err = json.Unmarshal(data, out)
+		}
+		if err != nil {
+			t.agent.logger().Warn("invalid response", "path", path, "error", err)
+		}
+	}
+	return http.StatusOK, 0, nil
+}
+
+// httpStatus maps a gRPC error to the status of the matching HTTP response, 0
+// when Pulse was not reached or did not answer in time
+func httpStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return 0
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// heartbeat sends a heartbeat on the session and waits for its answer. A
+// session that broke, or a heartbeat left unanswered, closes the session and
+// the next heartbeat opens a new one.
+func (t *grpcTransport) heartbeat(ctx context.Context, req *pulsev1.HeartbeatRequest) (*pulsev1.HeartbeatResponse, error) {
+	t.beatMu.Lock()
+	defer t.beatMu.Unlock()
+
+	s, err := t.openSession()
+	if err != nil {
+		return nil, err
+	}
+	// On a broken stream Send returns io.EOF, the cause comes from the receiving side
+	if err := s.stream.Send(&pulsev1.SessionRequest{Heartbeat: req}); err != nil && !errors.Is(err, io.EOF) {
+		t.closeSession(s)
+		return nil, err
+	}
+
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	select {
+	case resp := <-s.answers:
+		return resp, nil
+	case <-s.done:
+		return nil, s.err
+	case <-ctx.Done():
+		t.closeSession(s)
+		return nil, ctx.Err()
+	case <-timer.C:
+		t.closeSession(s)
+		return nil, status.Error(codes.DeadlineExceeded, "heartbeat not answered")
+	}
+}
+
+// openSession returns the open session, opening one if there is none
+func (t *grpcTransport) openSession() (*grpcSession, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.session != nil {
+		return t.session, nil
+	}
+
+	ctx, cancel := context.WithCancel(t.outgoing(context.Background()))
+	stream, err := t.client.Session(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	s := &grpcSession{
+		stream:  stream,
+		cancel:  cancel,
+		answers: make(chan *pulsev1.HeartbeatResponse, 1),
+		done:    make(chan struct{}),
+	}
+	t.session = s
+	go t.receive(s)
+	return s, nil
+}
+
+// closeSession cancels s, which Pulse takes as the agent being gone
+func (t *grpcTransport) closeSession(s *grpcSession) {
+	t.mu.Lock()
+	if t.session == s {
+		t.session = nil
+	}
+	t.mu.Unlock()
+	s.cancel()
+}
+
+// receive hands the answers to heartbeat and dispatches the directives Pulse
+// pushes, until the stream ends
+func (t *grpcTransport) receive(s *grpcSession) {
+	defer close(s.done)
+	for {
+		resp, err := s.stream.Recv()
+		if errors.Is(err, io.EOF) {
+			err = status.Error(codes.Unavailable, "session closed by pulse")
+		}
+		if err != nil {
+			s.err = err
+			t.closeSession(s)
+			return
+		}
+
+		if resp.GetHeartbeat() != nil {
+			select {
+			case s.answers <- resp.GetHeartbeat():
+			default: // the heartbeat gave up, the session is being closed
+			}
+			continue
+		}
+		for _, d := range resp.GetDirectives() {
+			directive := Directive{ID: d.GetId(), Type: d.GetType()}
+			if d.GetPayload() != nil {
+				if directive.Payload, err = protojson.Marshal(d.GetPayload()); err != nil {
+					t.agent.logger().Warn("invalid directive payload", "directive_id", d.GetId(), "error", err)
+					continue
+				}
+			}
+			t.agent.dispatch(directive)
+		}
+	}
+}
+
+// close ends the session, letting Pulse know the agent left rather than
+// vanished, and the connection. ctx bounds waiting for Pulse to end the session.
+func (t *grpcTransport) close(ctx context.Context) error {
+	t.mu.Lock()
+	s := t.session
+	t.mu.Unlock()
+	if s != nil {
+		if err := s.stream.CloseSend(); err == nil {
+			select {
+			case <-s.done:
+			case <-ctx.Done():
+			}
+		}
+		t.closeSession(s)
+	}
+	return t.conn.Close()
+}
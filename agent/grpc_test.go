@@ -0,0 +1,216 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	pulsev1 "github.com/aphrollo/pulse/proto/pulse/v1"
+)
+
+// grpcServer records what the agent sends. Directives sent on push are pushed
+// on the open session; with breakOnce the first session breaks after answering
+// a heartbeat.
+type grpcServer struct {
+	pulsev1.UnimplementedAgentServiceServer
+	push      chan *pulsev1.Directive
+	breakOnce atomic.Bool
+
+	mu         sync.Mutex
+	registered map[string]bool
+	updates    []*pulsev1.UpdateRequest
+	beats      []*pulsev1.HeartbeatRequest
+	sessions   int
+	ended      []error // how each session ended, nil when the agent closed it
+}
+
+func (s *grpcServer) Register(ctx context.Context, in *pulsev1.RegisterRequest) (*pulsev1.RegisterResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registered[in.GetId()] = true
+	return &pulsev1.RegisterResponse{}, nil
+}
+
+func (s *grpcServer) Update(ctx context.Context, in *pulsev1.UpdateRequest) (*pulsev1.UpdateResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updates = append(s.updates, in)
+	return &pulsev1.UpdateResponse{}, nil
+}
+
+func (s *grpcServer) Session(stream pulsev1.AgentService_SessionServer) error {
+	s.mu.Lock()
+	s.sessions++
+	s.mu.Unlock()
+
+	received, recvErr := make(chan *pulsev1.SessionRequest), make(chan error, 1)
+	go func() {
+		for {
+			in, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			received <- in
+		}
+	}()
+	for {
+		select {
+		case in := <-received:
+			s.mu.Lock()
+			s.beats = append(s.beats, in.GetHeartbeat())
+			s.mu.Unlock()
+			if err := stream.Send(&pulsev1.SessionResponse{Heartbeat: &pulsev1.HeartbeatResponse{}}); err != nil {
+				return err
+			}
+			if s.breakOnce.CompareAndSwap(true, false) {
+				return status.Error(codes.Unavailable, "going away")
+			}
+		case d := <-s.push:
+			if err := stream.Send(&pulsev1.SessionResponse{Directives: []*pulsev1.Directive{d}}); err != nil {
+				return err
+			}
+		case err := <-recvErr:
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			s.mu.Lock()
+			s.ended = append(s.ended, err)
+			s.mu.Unlock()
+			return nil
+		}
+	}
+}
+
+func (s *grpcServer) state() (beats []*pulsev1.HeartbeatRequest, sessions int, ended []error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append(beats, s.beats...), s.sessions, append(ended, s.ended...)
+}
+
+// newGRPCAgent returns an agent using the gRPC transport to srv, without retries
+func newGRPCAgent(t *testing.T, srv *grpcServer) *Agent {
+	t.Helper()
+	srv.registered = map[string]bool{}
+	srv.push = make(chan *pulsev1.Directive)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	pulsev1.RegisterAgentServiceServer(s, srv)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	a, err := NewFromConfig(DefaultConfig(),
+		WithServers("http://127.0.0.1:1"), WithGRPC(lis.Addr().String()),
+		WithStateDir(t.TempDir()), WithRetry(RetryPolicy{}),
+		func(c *Config) { c.Name, c.Type = "grpc-test", "worker" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// Test register, update and heartbeat go over gRPC, and pushed directives are run and acknowledged
+func TestAgent_GRPCTransport(t *testing.T) {
+	srv := &grpcServer{}
+	agent := newGRPCAgent(t, srv)
+	ctx := t.Context()
+
+	if err := agent.RegisterContext(ctx); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := agent.RegisterContext(ctx); err != nil {
+		t.Errorf("expected registering again to refresh the agent, got %v", err)
+	}
+
+	if err := agent.UpdateContext(ctx, "working", map[string]interface{}{"step": "import"}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	srv.mu.Lock()
+	update := srv.updates[0]
+	srv.mu.Unlock()
+	if update.GetStatus() != "working" || update.GetMessage().AsMap()["step"] != "import" || update.GetTime() == nil {
+		t.Errorf("expected the update to be converted, got %v", update)
+	}
+
+	applied := make(chan bool, 1)
+	agent.HandleDirective("maintenance", func(ctx context.Context, d Directive) error {
+		var p struct {
+			Enabled bool `json:"enabled"`
+		}
+		err := d.Decode(&p)
+		applied <- p.Enabled
+		return err
+	})
+	if err := agent.HeartbeatContext(ctx, "healthy"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	payload, _ := structpb.NewStruct(map[string]interface{}{"enabled": true})
+	srv.push <- &pulsev1.Directive{Id: "d1", Type: "maintenance", Payload: payload}
+	if enabled := <-applied; !enabled {
+		t.Error("expected the pushed payload to be decoded")
+	}
+	waitFor(t, func() bool {
+		agent.directivesMu.Lock()
+		defer agent.directivesMu.Unlock()
+		return len(agent.acks) == 1
+	})
+	if err := agent.HeartbeatContext(ctx, "healthy"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if err := agent.Shutdown(ctx); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	beats, sessions, ended := srv.state()
+	if len(beats) != 2 || len(beats[1].GetAcks()) != 1 || beats[1].GetAcks()[0].GetId() != "d1" {
+		t.Errorf("expected the directive to be acknowledged on the next heartbeat, got %v", beats)
+	}
+	if sessions != 1 || len(ended) != 1 || ended[0] != nil {
+		t.Errorf("expected one session, closed by the agent, got %d ended with %v", sessions, ended)
+	}
+}
+
+// Test a new session is opened once the previous one broke
+func TestAgent_GRPCSession_Reconnect(t *testing.T) {
+	srv := &grpcServer{}
+	srv.breakOnce.Store(true)
+	agent := newGRPCAgent(t, srv)
+	defer agent.Shutdown(t.Context())
+
+	if err := agent.HeartbeatContext(t.Context(), "healthy"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// The next heartbeat may still find the broken session
+	waitFor(t, func() bool { return agent.HeartbeatContext(t.Context(), "healthy") == nil })
+	if _, sessions, _ := srv.state(); sessions != 2 {
+		t.Errorf("expected a second session, got %d", sessions)
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	cases := map[codes.Code]int{
+		codes.InvalidArgument: http.StatusBadRequest,
+		codes.AlreadyExists:   http.StatusConflict,
+		codes.Unavailable:     0,
+		codes.Internal:        http.StatusInternalServerError,
+	}
+	for code, want := range cases {
+		if got := httpStatus(status.Error(code, "")); got != want {
+			t.Errorf("expected %d for %s, got %d", want, code, got)
+		}
+	}
+}
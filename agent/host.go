@@ -0,0 +1,385 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostCollectTimeout bounds a host collection so a hung filesystem doesn't hold up the heartbeat
+const hostCollectTimeout = 2 * time.Second
+
+// maxHostDisks and maxHostInterfaces keep host snapshots compact
+const (
+	maxHostDisks      = 20
+	maxHostInterfaces = 20
+)
+
+// pseudoFilesystems are skipped when reporting disk usage
+var pseudoFilesystems = map[string]bool{
+	"autofs": true, "binfmt_misc": true, "bpf": true, "cgroup": true, "cgroup2": true,
+	"configfs": true, "debugfs": true, "devpts": true, "devtmpfs": true, "efivarfs": true,
+	"fusectl": true, "hugetlbfs": true, "mqueue": true, "nsfs": true, "proc": true,
+	"pstore": true, "ramfs": true, "rpc_pipefs": true, "securityfs": true, "squashfs": true,
+	"sysfs": true, "tmpfs": true, "tracefs": true,
+}
+
+// HostCollector reads statistics of the Linux host the agent runs on from procfs and statfs
+type HostCollector struct {
+	// ProcRoot is where procfs is mounted, "/proc" unless set
+	ProcRoot string
+
+	mu      sync.Mutex
+	prevCPU *cpuTimes
+	pending map[string]bool // mounts whose statfs did not return yet
+
+	// statfs reads the usage of a mounted filesystem, diskUsage unless set
+	statfs func(path string) (total, free uint64, err error)
+}
+
+// NewHostCollector returns a collector reading /proc
+func NewHostCollector() *HostCollector {
+	return &HostCollector{ProcRoot: "/proc"}
+}
+
+// HostSnapshot is a compact view of the host, sent with heartbeats
+type HostSnapshot struct {
+	CPUPercent     *float64   `json:"cpu_percent,omitempty"` // busy share of all CPUs since the previous snapshot
+	Load1          float64    `json:"load1"`
+	Load5          float64    `json:"load5"`
+	Load15         float64    `json:"load15"`
+	MemTotal       uint64     `json:"mem_total_bytes"`
+	MemAvailable   uint64     `json:"mem_available_bytes"`
+	Disks          []DiskStat `json:"disks,omitempty"`
+	OpenFDs        int        `json:"open_fds"` // of the agent's process
+	UptimeSeconds  float64    `json:"uptime_seconds"`
+	Network        []NetStat  `json:"network,omitempty"`
+	CollectionErrs []string   `json:"errors,omitempty"` // parts of the snapshot that could not be read
+}
+
+// DiskStat is the usage of one mounted filesystem
+type DiskStat struct {
+	Mount string `json:"mount"`
+	Total uint64 `json:"total_bytes"`
+	Free  uint64 `json:"free_bytes"`
+}
+
+// NetStat holds the counters of one network interface since boot
+type NetStat struct {
+	Interface string `json:"interface"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	TxBytes   uint64 `json:"tx_bytes"`
+}
+
+type cpuTimes struct {
+	busy, total uint64
+}
+
+// Collect reads a snapshot of the host. Parts that can't be read are listed in
+// CollectionErrs and also returned as an error, the rest of the snapshot is usable.
+// Filesystems that don't answer before ctx is done, e.g. a hung NFS mount, are
+// left out, and skipped by later snapshots until they answered.
+func (h *HostCollector) Collect(ctx context.Context) (HostSnapshot, error) {
+	var s HostSnapshot
+	var errs []error
+	collectDisks := func(s *HostSnapshot) error { return h.collectDisks(ctx, s) }
+	for _, collect := range []func(*HostSnapshot) error{
+		h.collectCPU, h.collectLoad, h.collectMemory, collectDisks,
+		h.collectFDs, h.collectUptime, h.collectNetwork,
+	} {
+		if err := collect(&s); err != nil {
+			errs = append(errs, err)
+			s.CollectionErrs = append(s.CollectionErrs, err.Error())
+		}
+	}
+	return s, errors.Join(errs...)
+}
+
+func (h *HostCollector) path(parts ...string) string {
+	root := h.ProcRoot
+	if root == "" {
+		root = "/proc"
+	}
+	return filepath.Join(append([]string{root}, parts...)...)
+}
+
+func (h *HostCollector) collectCPU(s *HostSnapshot) error {
+	data, err := os.ReadFile(h.path("stat"))
+	if err != nil {
+		return fmt.Errorf("cpu: %w", err)
+	}
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return errors.New("cpu: unexpected /proc/stat format")
+	}
+
+	// user nice system idle iowait irq softirq steal; guest time is already in user
+	var cur cpuTimes
+	for i, f := range fields[1:min(len(fields), 9)] {
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return fmt.Errorf("cpu: %w", err)
+		}
+		cur.total += v
+		if i != 3 && i != 4 { // idle, iowait
+			cur.busy += v
+		}
+	}
+
+	h.mu.Lock()
+	prev := h.prevCPU
+	h.prevCPU = &cur
+	h.mu.Unlock()
+	// Counters going backwards, e.g. after a CPU went offline, skip a snapshot
+	if prev != nil && cur.total > prev.total && cur.busy >= prev.busy && cur.busy-prev.busy <= cur.total-prev.total {
+		pct := float64(cur.busy-prev.busy) / float64(cur.total-prev.total) * 100
+		s.CPUPercent = &pct
+	}
+	return nil
+}
+
+func (h *HostCollector) collectLoad(s *HostSnapshot) error {
+	data, err := os.ReadFile(h.path("loadavg"))
+	if err != nil {
+		return fmt.Errorf("load: %w", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return errors.New("load: unexpected /proc/loadavg format")
+	}
+	for i, dst := range []*float64{&s.Load1, &s.Load5, &s.Load15} {
+		if *dst, err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return fmt.Errorf("load: %w", err)
+		}
+	}
+	return nil
+}
+
+func (h *HostCollector) collectMemory(s *HostSnapshot) error {
+	f, err := os.Open(h.path("meminfo"))
+	if err != nil {
+		return fmt.Errorf("memory: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// e.g. "MemTotal:       16318412 kB"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		var dst *uint64
+		switch fields[0] {
+		case "MemTotal:":
+			dst = &s.MemTotal
+		case "MemAvailable:":
+			dst = &s.MemAvailable
+		default:
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("memory: %w", err)
+		}
+		*dst = kb * 1024
+	}
+	return scanner.Err()
+}
+
+func (h *HostCollector) collectDisks(ctx context.Context, s *HostSnapshot) error {
+	f, err := os.Open(h.path("mounts"))
+	if err != nil {
+		return fmt.Errorf("disks: %w", err)
+	}
+	defer f.Close()
+
+	seen := map[string]bool{}
+	var errs []error
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() && len(s.Disks) < maxHostDisks {
+		// device mountpoint fstype options dump pass
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || pseudoFilesystems[fields[2]] {
+			continue
+		}
+		mount := unescapeMount(fields[1])
+		if seen[mount] {
+			continue
+		}
+		seen[mount] = true
+
+		total, free, err := h.diskUsage(ctx, mount)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("disks: %s: %w", mount, err))
+			continue
+		}
+		s.Disks = append(s.Disks, DiskStat{Mount: mount, Total: total, Free: free})
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("disks: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// diskUsage runs statfs on mount until ctx is done. The call is left running
+// when it takes longer, and the mount skipped until it returned.
+func (h *HostCollector) diskUsage(ctx context.Context, mount string) (total, free uint64, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	h.mu.Lock()
+	if h.pending[mount] {
+		h.mu.Unlock()
+		return 0, 0, errors.New("statfs still pending")
+	}
+	if h.pending == nil {
+		h.pending = map[string]bool{}
+	}
+	h.pending[mount] = true
+	statfs := h.statfs
+	h.mu.Unlock()
+	if statfs == nil {
+		statfs = diskUsage
+	}
+
+	type usage struct {
+		total, free uint64
+		err         error
+	}
+	done := make(chan usage, 1)
+	go func() {
+		var u usage
+		u.total, u.free, u.err = statfs(mount)
+		h.mu.Lock()
+		delete(h.pending, mount)
+		h.mu.Unlock()
+		done <- u
+	}()
+	select {
+	case u := <-done:
+		return u.total, u.free, u.err
+	case <-ctx.Done():
+		return 0, 0, ctx.Err()
+	}
+}
+
+// unescapeMount decodes the octal escapes /proc/mounts uses for spaces and tabs
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
+
+func (h *HostCollector) collectFDs(s *HostSnapshot) error {
+	entries, err := os.ReadDir(h.path("self", "fd"))
+	if err != nil {
+		return fmt.Errorf("fds: %w", err)
+	}
+	s.OpenFDs = len(entries)
+	return nil
+}
+
+func (h *HostCollector) collectUptime(s *HostSnapshot) error {
+	data, err := os.ReadFile(h.path("uptime"))
+	if err != nil {
+		return fmt.Errorf("uptime: %w", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 1 {
+		return errors.New("uptime: unexpected /proc/uptime format")
+	}
+	if s.UptimeSeconds, err = strconv.ParseFloat(fields[0], 64); err != nil {
+		return fmt.Errorf("uptime: %w", err)
+	}
+	return nil
+}
+
+func (h *HostCollector) collectNetwork(s *HostSnapshot) error {
+	f, err := os.Open(h.path("net", "dev"))
+	if err != nil {
+		return fmt.Errorf("network: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() && len(s.Network) < maxHostInterfaces {
+		// "  eth0: rx_bytes rx_packets errs drop fifo frame compressed multicast tx_bytes ..."
+		name, counters, ok := strings.Cut(scanner.Text(), ":")
+		name = strings.TrimSpace(name)
+		fields := strings.Fields(counters)
+		if !ok || name == "lo" || len(fields) < 9 {
+			continue
+		}
+		rx, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("network: %w", err)
+		}
+		tx, err := strconv.ParseUint(fields[8], 10, 64)
+		if err != nil {
+			return fmt.Errorf("network: %w", err)
+		}
+		s.Network = append(s.Network, NetStat{Interface: name, RxBytes: rx, TxBytes: tx})
+	}
+	return scanner.Err()
+}
+
+// Samples turns the snapshot into metric samples, e.g. for ReportMetrics
+func (s HostSnapshot) Samples() []Sample {
+	samples := []Sample{
+		{Name: "host_load1", Value: s.Load1},
+		{Name: "host_load5", Value: s.Load5},
+		{Name: "host_load15", Value: s.Load15},
+		{Name: "host_memory_total_bytes", Value: float64(s.MemTotal)},
+		{Name: "host_memory_available_bytes", Value: float64(s.MemAvailable)},
+		{Name: "host_open_fds", Value: float64(s.OpenFDs)},
+		{Name: "host_uptime_seconds", Value: s.UptimeSeconds},
+	}
+	if s.CPUPercent != nil {
+		samples = append(samples, Sample{Name: "host_cpu_percent", Value: *s.CPUPercent})
+	}
+	for _, d := range s.Disks {
+		labels := map[string]string{"mount": d.Mount}
+		samples = append(samples,
+			Sample{Name: "host_disk_total_bytes", Value: float64(d.Total), Labels: labels},
+			Sample{Name: "host_disk_free_bytes", Value: float64(d.Free), Labels: labels},
+		)
+	}
+	for _, n := range s.Network {
+		labels := map[string]string{"interface": n.Interface}
+		samples = append(samples,
+			Sample{Name: "host_network_rx_bytes", Value: float64(n.RxBytes), Labels: labels},
+			Sample{Name: "host_network_tx_bytes", Value: float64(n.TxBytes), Labels: labels},
+		)
+	}
+	return samples
+}
+
+// collectHost takes a snapshot with the agent's Host collector, nil without one
+func (a *Agent) collectHost(ctx context.Context) *HostSnapshot {
+	if a.Host == nil {
+		return nil
+	}
+	collectCtx, cancel := context.WithTimeout(ctx, hostCollectTimeout)
+	defer cancel()
+	s, err := a.Host.Collect(collectCtx)
+	if err != nil {
+		a.logger().Warn("host collection incomplete", "error", err)
+	}
+	if a.HostMetrics {
+		if err := a.ReportMetricsContext(ctx, s.Samples()...); err != nil {
+			a.logger().Error("metrics report failed", "error", err)
+		}
+	}
+	return &s
+}
@@ -0,0 +1,14 @@
+//go:build linux
+
+package agent
+
+import "syscall"
+
+// diskUsage returns the size and the space available to unprivileged users of the filesystem at path
+func diskUsage(path string) (total, free uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Blocks * uint64(st.Bsize), st.Bavail * uint64(st.Bsize), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package agent
+
+import "errors"
+
+// diskUsage is only implemented on Linux
+func diskUsage(path string) (total, free uint64, err error) {
+	return 0, 0, errors.New("disk usage is only collected on linux")
+}
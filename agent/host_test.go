@@ -0,0 +1,169 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeProc writes a minimal procfs under a temporary directory, listing mount as an ext4 filesystem
+func fakeProc(t *testing.T, mount string) string {
+	t.Helper()
+	root := t.TempDir()
+	files := map[string]string{
+		"stat":    "cpu  100 0 100 700 100 0 0 0 0 0\ncpu0 100 0 100 700 100 0 0 0 0 0\n",
+		"loadavg": "0.52 0.38 0.21 2/345 6789\n",
+		"meminfo": "MemTotal:       2048 kB\nMemFree:         512 kB\nMemAvailable:   1024 kB\n",
+		"uptime":  "3600.50 7000.00\n",
+		"mounts":  fmt.Sprintf("proc /proc proc rw 0 0\n/dev/sda1 %s ext4 rw 0 0\n/dev/sda1 %s ext4 rw 0 0\ntmpfs /run tmpfs rw 0 0\n", mount, mount),
+		"net/dev": "Inter-|   Receive                            |  Transmit\n" +
+			" face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed\n" +
+			"    lo:     100       1    0    0    0     0          0         0      100       1    0    0    0     0       0          0\n" +
+			"  eth0:    5000      10    0    0    0     0          0         0     3000       8    0    0    0     0       0          0\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, fd := range []string{"0", "1", "2"} {
+		os.MkdirAll(filepath.Join(root, "self", "fd", fd), 0o755)
+	}
+	return root
+}
+
+// Test a snapshot is read from a fake procfs and CPU usage is computed between snapshots
+func TestHostCollector_Collect(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("host collection is linux only")
+	}
+	mount := t.TempDir()
+	root := fakeProc(t, mount)
+	h := &HostCollector{ProcRoot: root}
+
+	s, err := h.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+	if s.CPUPercent != nil {
+		t.Errorf("expected no CPU usage on the first snapshot, got %v", *s.CPUPercent)
+	}
+	if s.Load1 != 0.52 || s.Load5 != 0.38 || s.Load15 != 0.21 {
+		t.Errorf("unexpected load %v %v %v", s.Load1, s.Load5, s.Load15)
+	}
+	if s.MemTotal != 2048*1024 || s.MemAvailable != 1024*1024 {
+		t.Errorf("unexpected memory %d/%d", s.MemAvailable, s.MemTotal)
+	}
+	if s.UptimeSeconds != 3600.5 || s.OpenFDs != 3 {
+		t.Errorf("unexpected uptime %v or fds %d", s.UptimeSeconds, s.OpenFDs)
+	}
+	if len(s.Disks) != 1 || s.Disks[0].Mount != mount || s.Disks[0].Total == 0 {
+		t.Errorf("expected the disk usage of %s only, got %+v", mount, s.Disks)
+	}
+	if len(s.Network) != 1 || s.Network[0] != (NetStat{Interface: "eth0", RxBytes: 5000, TxBytes: 3000}) {
+		t.Errorf("expected eth0 counters only, got %+v", s.Network)
+	}
+
+	// 100 more busy and 100 more idle jiffies: 50% busy
+	os.WriteFile(filepath.Join(root, "stat"), []byte("cpu  150 0 150 750 150 0 0 0 0 0\n"), 0o644)
+	if s, _ = h.Collect(context.Background()); s.CPUPercent == nil || *s.CPUPercent != 50 {
+		t.Errorf("expected 50%% CPU usage, got %v", s.CPUPercent)
+	}
+}
+
+// Test unreadable parts are reported without dropping the rest of the snapshot
+func TestHostCollector_PartialSnapshot(t *testing.T) {
+	root := fakeProc(t, t.TempDir())
+	os.Remove(filepath.Join(root, "meminfo"))
+	os.Remove(filepath.Join(root, "mounts"))
+
+	s, err := (&HostCollector{ProcRoot: root}).Collect(context.Background())
+	if err == nil || len(s.CollectionErrs) != 2 {
+		t.Fatalf("expected memory and disks to fail, got %v %v", err, s.CollectionErrs)
+	}
+	if s.Load1 != 0.52 || s.UptimeSeconds != 3600.5 {
+		t.Errorf("expected the readable parts to be collected, got %+v", s)
+	}
+}
+
+// Test a filesystem that doesn't answer is left out without holding up the snapshot, and skipped until it answered
+func TestHostCollector_HungFilesystem(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	h := &HostCollector{ProcRoot: fakeProc(t, "/mnt/nfs")}
+	h.statfs = func(path string) (uint64, uint64, error) {
+		calls.Add(1)
+		<-release
+		return 100, 50, nil
+	}
+
+	for range 2 {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		s, err := h.Collect(ctx)
+		cancel()
+		if err == nil || len(s.Disks) != 0 {
+			t.Fatalf("expected the hung filesystem to be left out, got %v %+v", err, s.Disks)
+		}
+		if s.Load1 != 0.52 {
+			t.Errorf("expected the rest of the snapshot, got %+v", s)
+		}
+	}
+	close(release)
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected the pending statfs not to be repeated, got %d calls", n)
+	}
+}
+
+// Test counters going backwards don't produce a CPU usage
+func TestHostCollector_CPUCountersBackwards(t *testing.T) {
+	root := fakeProc(t, t.TempDir())
+	h := &HostCollector{ProcRoot: root}
+	h.Collect(context.Background())
+
+	os.WriteFile(filepath.Join(root, "stat"), []byte("cpu  50 0 50 900 100 0 0 0 0 0\n"), 0o644)
+	if s, _ := h.Collect(context.Background()); s.CPUPercent != nil {
+		t.Errorf("expected no CPU usage, got %v", *s.CPUPercent)
+	}
+}
+
+// Test the snapshot is sent with the heartbeat and, with HostMetrics, buffered as samples
+func TestAgent_Tick_SendsHostSnapshot(t *testing.T) {
+	var heartbeat heartbeatPayload
+	var metrics metricsPayload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/agent/heartbeat":
+			json.NewDecoder(r.Body).Decode(&heartbeat)
+		case "/agent/metrics":
+			json.NewDecoder(r.Body).Decode(&metrics)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	agent.Host = &HostCollector{ProcRoot: fakeProc(t, t.TempDir())}
+	agent.HostMetrics = true
+
+	agent.tick(context.Background())
+	if heartbeat.Host == nil || heartbeat.Host.Load1 != 0.52 {
+		t.Fatalf("expected the host snapshot in the heartbeat, got %+v", heartbeat.Host)
+	}
+	found := false
+	for _, s := range metrics.Samples {
+		found = found || s.Name == "host_load1" && s.Value == 0.52
+	}
+	if !found {
+		t.Errorf("expected host samples to be flushed, got %+v", metrics.Samples)
+	}
+}
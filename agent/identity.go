@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// identityFileName is the file LoadIdentity keeps the agent ID in
+const identityFileName = "agent-id"
+
+// identityNamespace derives agent IDs from a machine ID, a hostname and an agent name
+var identityNamespace = uuid.MustParse("8f6b2c4e-1d3a-5b7c-9e0f-a1b2c3d4e5f6")
+
+// machineIDFiles are read in order by DeriveID, as provided by systemd and D-Bus
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// hostname is read by DeriveID, replaced in tests
+var hostname = os.Hostname
+
+// LoadIdentity returns the agent ID stored in dir, generating and storing a
+// new one on first use so the agent keeps it across restarts
+func LoadIdentity(dir string) (uuid.UUID, error) {
+	path := filepath.Join(dir, identityFileName)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		id, err := uuid.ParseBytes(bytes.TrimSpace(data))
+		if err != nil {
+			return uuid.Nil, fmt.Errorf("identity: %s: %w", path, err)
+		}
+		return id, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return uuid.Nil, fmt.Errorf("identity: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return uuid.Nil, fmt.Errorf("identity: %w", err)
+	}
+	id := uuid.New()
+	if err := writeFileAtomic(path, []byte(id.String()+"\n")); err != nil {
+		return uuid.Nil, fmt.Errorf("identity: %w", err)
+	}
+	return id, nil
+}
+
+// DeriveID returns a UUIDv5 over the machine ID, the hostname and the agent
+// name, the same on every start of the agent on this machine. The hostname
+// tells apart containers and VMs cloned from an image that ships a machine ID,
+// at the cost of a new ID when the host is renamed; set Config.StateDir or
+// Config.ID to keep the ID across renames. Two agents sharing a name on one
+// machine get the same ID and must be given distinct names or a state dir.
+func DeriveID(name string) (uuid.UUID, error) {
+	host, err := hostname()
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("identity: %w", err)
+	}
+	if host == "" {
+		return uuid.Nil, errors.New("identity: no hostname")
+	}
+	for _, path := range machineIDFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if machineID := bytes.TrimSpace(data); len(machineID) > 0 {
+			return uuid.NewSHA1(identityNamespace, []byte(string(machineID)+"/"+host+"/"+name)), nil
+		}
+	}
+	return uuid.Nil, errors.New("identity: no machine ID found")
+}
+
+// resolveID picks the ID of an agent: Config.ID when set, else the ID kept in
+// Config.StateDir, else one derived from the machine ID. A random ID is only
+// used when none of those is available.
+func resolveID(cfg Config) (uuid.UUID, error) {
+	if cfg.ID != "" {
+		return uuid.Parse(cfg.ID)
+	}
+	if cfg.StateDir != "" {
+		return LoadIdentity(cfg.StateDir)
+	}
+	if id, err := DeriveID(cfg.Name); err == nil {
+		return id, nil
+	}
+	return uuid.New(), nil
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// Test the identity stored in the state dir is reused on the next start
+func TestLoadIdentity_Persists(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+
+	first, err := LoadIdentity(dir)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	second, err := LoadIdentity(dir)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if first != second {
+		t.Errorf("expected the same ID across restarts, got %s and %s", first, second)
+	}
+}
+
+// Test a corrupt identity file is reported rather than silently replaced
+func TestLoadIdentity_Corrupt(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, identityFileName), []byte("not-a-uuid"), 0o600)
+
+	if _, err := LoadIdentity(dir); err == nil {
+		t.Error("expected an error for a corrupt identity file")
+	}
+}
+
+// Test derived IDs depend only on the machine, its hostname and the agent name
+func TestDeriveID(t *testing.T) {
+	machineID := filepath.Join(t.TempDir(), "machine-id")
+	os.WriteFile(machineID, []byte("0123456789abcdef\n"), 0o600)
+	defer func(files []string) { machineIDFiles = files }(machineIDFiles)
+	machineIDFiles = []string{filepath.Join(t.TempDir(), "missing"), machineID}
+	defer func(h func() (string, error)) { hostname = h }(hostname)
+	hostname = func() (string, error) { return "web-1", nil }
+
+	a, err := DeriveID("worker")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	b, _ := DeriveID("worker")
+	c, _ := DeriveID("scheduler")
+	if a != b || a == c {
+		t.Errorf("expected a stable per-name ID, got %s, %s and %s", a, b, c)
+	}
+
+	// Clones of one image share the machine ID but not the hostname
+	hostname = func() (string, error) { return "web-2", nil }
+	if d, _ := DeriveID("worker"); d == a {
+		t.Errorf("expected another ID on another host sharing the machine ID, got %s", d)
+	}
+
+	hostname = func() (string, error) { return "", nil }
+	if _, err := DeriveID("worker"); err == nil {
+		t.Error("expected an error without a hostname")
+	}
+	hostname = func() (string, error) { return "web-1", nil }
+
+	machineIDFiles = nil
+	if _, err := DeriveID("worker"); err == nil {
+		t.Error("expected an error without a machine ID")
+	}
+}
+
+// Test New resumes the configured or persisted identity
+func TestNew_StableIdentity(t *testing.T) {
+	t.Setenv("PULSE_SERVER_URL", "http://localhost")
+
+	id := uuid.New()
+	t.Setenv("PULSE_AGENT_ID", id.String())
+	if got := New("worker", "default").ID; got != id {
+		t.Errorf("expected configured ID %s, got %s", id, got)
+	}
+
+	t.Setenv("PULSE_AGENT_ID", "")
+	t.Setenv("PULSE_STATE_DIR", t.TempDir())
+	first := New("worker", "default").ID
+	if second := New("worker", "default").ID; first != second {
+		t.Errorf("expected the same ID across restarts, got %s and %s", first, second)
+	}
+}
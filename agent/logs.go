@@ -0,0 +1,455 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultLogBatchSize is used when Agent.LogBatchSize is not set
+	DefaultLogBatchSize = 500
+	// DefaultLogFlushInterval is used when Agent.LogFlushInterval is not set
+	DefaultLogFlushInterval = 2 * time.Second
+	// LogPollInterval is how often files followed with TailLogFile are checked for new lines
+	LogPollInterval = time.Second
+
+	// maxLogsPerRequest and maxLogAttrs match the limits enforced by /agent/logs
+	maxLogsPerRequest = 1000
+	maxLogAttrs       = 32
+	// maxLogLineLength cuts long lines, Pulse keeps no more
+	maxLogLineLength = 8 << 10
+	// maxBufferedLogs bounds the buffer while Pulse is unreachable or over quota; the oldest lines are dropped first
+	maxBufferedLogs = 10000
+)
+
+// LogEntry is one log line shipped to Pulse
+type LogEntry struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`            // debug, info, warn or error
+	Source  string            `json:"source,omitempty"` // e.g. stderr or a file path
+	Message string            `json:"message"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+}
+
+type logsPayload struct {
+	ID      string     `json:"id"`
+	Entries []LogEntry `json:"entries"`
+}
+
+// ShipLog buffers log lines and sends them in the background once
+// LogBatchSize lines are pending or LogFlushInterval passed. Lines without a
+// time are stamped with the current time, those without a level are `info`.
+// ShipLog never blocks on Pulse: while it can't keep up the oldest buffered
+// lines are dropped, and their count is reported with the next batch.
+func (a *Agent) ShipLog(entries ...LogEntry) {
+	now := time.Now()
+
+	a.logsMu.Lock()
+	defer a.logsMu.Unlock()
+	for _, e := range entries {
+		if e.Time.IsZero() {
+			e.Time = now
+		}
+		if e.Level == "" {
+			e.Level = "info"
+		}
+		e.Message = cutLine(e.Message)
+		a.logs = append(a.logs, e)
+	}
+	a.trimLogsLocked()
+
+	if len(a.logs) >= a.logBatchSize() {
+		a.flushLogsLocked()
+	} else if len(a.logs) > 0 && a.logsTimer == nil {
+		interval := a.LogFlushInterval
+		if interval <= 0 {
+			interval = DefaultLogFlushInterval
+		}
+		a.logsTimer = time.AfterFunc(interval, func() {
+			a.logsMu.Lock()
+			a.logsTimer = nil
+			a.flushLogsLocked()
+			a.logsMu.Unlock()
+		})
+	}
+}
+
+func (a *Agent) logBatchSize() int {
+	if a.LogBatchSize <= 0 {
+		return DefaultLogBatchSize
+	}
+	return min(a.LogBatchSize, maxLogsPerRequest)
+}
+
+// trimLogsLocked drops the oldest lines over the buffer's bound. logsMu must be held.
+func (a *Agent) trimLogsLocked() {
+	if over := len(a.logs) - maxBufferedLogs; over > 0 {
+		a.logs = a.logs[over:]
+		a.logsDropped += over
+	}
+}
+
+// flushLogsLocked starts a flush in the background unless one is running.
+// logsMu must be held.
+func (a *Agent) flushLogsLocked() {
+	if a.logsFlushing || a.isStopped() {
+		return
+	}
+	a.logsFlushing = true
+	go func() {
+		if err := a.FlushLogs(context.Background()); err != nil {
+			a.logger().Error("logs flush failed", "error", err)
+		}
+		a.logsMu.Lock()
+		a.logsFlushing = false
+		a.logsMu.Unlock()
+	}()
+}
+
+// FlushLogs sends all buffered log lines. On failure they are kept for the
+// next attempt, unless Pulse rejected them as invalid.
+func (a *Agent) FlushLogs(ctx context.Context) error {
+	// Held while sending so lines reach Pulse in order
+	a.logsFlushMu.Lock()
+	defer a.logsFlushMu.Unlock()
+
+	a.logsMu.Lock()
+	entries := a.logs
+	a.logs = nil
+	if a.logsDropped > 0 {
+		entries = append([]LogEntry{{
+			Time:    time.Now(),
+			Level:   "warn",
+			Source:  "pulse-agent",
+			Message: fmt.Sprintf("%d log lines dropped", a.logsDropped),
+		}}, entries...)
+		a.logsDropped = 0
+	}
+	if a.logsTimer != nil {
+		a.logsTimer.Stop()
+		a.logsTimer = nil
+	}
+	a.logsMu.Unlock()
+
+	for len(entries) > 0 {
+		n := min(len(entries), maxLogsPerRequest)
+		err := a.postContext(ctx, "/agent/logs", logsPayload{ID: a.ID.String(), Entries: entries[:n]})
+		if err != nil && !IsRetryable(err) && ctx.Err() == nil {
+			// Sending them again would fail the same way
+			return fmt.Errorf("%d log lines rejected: %w", n, err)
+		}
+		if err != nil {
+			a.logsMu.Lock()
+			a.logs = append(entries, a.logs...)
+			a.trimLogsLocked()
+			a.logsMu.Unlock()
+			return err
+		}
+		entries = entries[n:]
+	}
+	return nil
+}
+
+// cutLine cuts s to maxLogLineLength bytes of valid UTF-8
+func cutLine(s string) string {
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "�")
+	}
+	if len(s) <= maxLogLineLength {
+		return s
+	}
+	n := maxLogLineLength
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// LogHandler returns a slog.Handler shipping the records at level or above
+// to Pulse, info and above when level is nil. Attributes are sent as strings,
+// those of groups with dotted keys. To keep local logs too, fan out to it and
+// the application's own handler.
+func (a *Agent) LogHandler(level slog.Leveler) slog.Handler {
+	if level == nil {
+		level = slog.LevelInfo
+	}
+	return &logHandler{agent: a, level: level}
+}
+
+type logHandler struct {
+	agent  *Agent
+	level  slog.Leveler
+	attrs  map[string]string // from WithAttrs
+	prefix string            // from WithGroup, with a trailing dot
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *logHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := make(map[string]string, len(h.attrs)+r.NumAttrs())
+	for k, v := range h.attrs {
+		attrs[k] = v
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		addAttr(attrs, h.prefix, attr)
+		return true
+	})
+	if len(attrs) == 0 {
+		attrs = nil
+	}
+	h.agent.ShipLog(LogEntry{Time: r.Time, Level: slogLevel(r.Level), Message: r.Message, Attrs: attrs})
+	return nil
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = make(map[string]string, len(h.attrs)+len(attrs))
+	for k, v := range h.attrs {
+		c.attrs[k] = v
+	}
+	for _, attr := range attrs {
+		addAttr(c.attrs, h.prefix, attr)
+	}
+	return &c
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.prefix = h.prefix + name + "."
+	return &c
+}
+
+// addAttr adds attr to attrs under prefix, flattening groups, as long as
+// Pulse accepts more attributes
+func addAttr(attrs map[string]string, prefix string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			prefix += attr.Key + "."
+		}
+		for _, g := range attr.Value.Group() {
+			addAttr(attrs, prefix, g)
+		}
+		return
+	}
+	if _, ok := attrs[prefix+attr.Key]; ok || len(attrs) < maxLogAttrs {
+		attrs[prefix+attr.Key] = attr.Value.String()
+	}
+}
+
+// slogLevel maps a slog level to the closest level Pulse knows
+func slogLevel(l slog.Level) string {
+	switch {
+	case l < slog.LevelInfo:
+		return "debug"
+	case l < slog.LevelWarn:
+		return "info"
+	case l < slog.LevelError:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// levelPattern finds the level of a text line, e.g. `level=warn`, `[ERROR]` or
+// `"level":"debug"`, near its start
+var levelPattern = regexp.MustCompile(`(?i)\b(debug|trace|info|notice|warn|warning|error|err|fatal|panic|crit|critical)\b`)
+
+// levelSearchLength is how far into a line its level is looked for, past it
+// words like "error" are more likely part of the message
+const levelSearchLength = 64
+
+// detectLevel returns the level a line states, or fallback
+func detectLevel(line []byte, fallback string) string {
+	m := levelPattern.Find(line[:min(len(line), levelSearchLength)])
+	switch strings.ToLower(string(m)) {
+	case "debug", "trace":
+		return "debug"
+	case "info", "notice":
+		return "info"
+	case "warn", "warning":
+		return "warn"
+	case "error", "err", "fatal", "panic", "crit", "critical":
+		return "error"
+	}
+	return fallback
+}
+
+// LogWriter returns a writer shipping every line written to it, e.g. a
+// process's stdout, with source. A line's level is read from its text when it
+// states one, e.g. `level=error`, and is level otherwise. Close ships a last,
+// unterminated line.
+func (a *Agent) LogWriter(source, level string) io.WriteCloser {
+	return &lineWriter{agent: a, source: source, level: level}
+}
+
+type lineWriter struct {
+	agent  *Agent
+	source string
+	level  string
+
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := len(p)
+	for len(p) > 0 {
+		line, rest, found := bytes.Cut(p, []byte("\n"))
+		if len(w.partial) < maxLogLineLength {
+			w.partial = append(w.partial, line[:min(len(line), maxLogLineLength-len(w.partial))]...)
+		}
+		if !found {
+			break
+		}
+		w.ship()
+		p = rest
+	}
+	return n, nil
+}
+
+// ship sends the pending line, unless it is blank. mu must be held.
+func (w *lineWriter) ship() {
+	line := bytes.TrimRight(w.partial, "\r")
+	if len(bytes.TrimSpace(line)) > 0 {
+		w.agent.ShipLog(LogEntry{Level: detectLevel(line, w.level), Source: w.source, Message: string(line)})
+	}
+	w.partial = w.partial[:0]
+}
+
+func (w *lineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.ship()
+	return nil
+}
+
+// TailLogFile follows the file at path, shipping the lines appended to it
+// with the path as their source. Files are followed from the time the
+// heartbeat loop, or Run, starts until the agent stops: from their end if
+// they exist by then, from their start if they are created later. A file
+// truncated or replaced, e.g. by log rotation, is read again from its start.
+func (a *Agent) TailLogFile(path string) {
+	a.logsMu.Lock()
+	defer a.logsMu.Unlock()
+	a.logFiles = append(a.logFiles, path)
+	if a.logsStop != nil {
+		go a.tailFile(path, a.logsStop)
+	}
+}
+
+// startLogTails starts following the log files, once, until stop is closed
+func (a *Agent) startLogTails(stop <-chan struct{}) {
+	a.logsMu.Lock()
+	defer a.logsMu.Unlock()
+	if a.logsStop != nil {
+		return
+	}
+	a.logsStop = stop
+	for _, path := range a.logFiles {
+		go a.tailFile(path, stop)
+	}
+}
+
+func (a *Agent) tailFile(path string, stop <-chan struct{}) {
+	t := &fileTail{path: path, w: &lineWriter{agent: a, source: path, level: "info"}}
+	defer t.close()
+
+	ticker := time.NewTicker(LogPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := t.poll(); err != nil {
+			a.logger().Warn("failed to read log file", "path", path, "error", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// fileTail reads what was appended to a file since the last poll
+type fileTail struct {
+	path   string
+	w      *lineWriter
+	f      *os.File
+	polled bool // files found on the first poll are read from their end
+}
+
+func (t *fileTail) poll() error {
+	first := !t.polled
+	t.polled = true
+
+	info, err := os.Stat(t.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Between a rotation and the new file's creation, or not created yet
+		if t.f != nil {
+			t.read()
+			t.close()
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if t.f != nil {
+		if current, err := t.f.Stat(); err != nil || !os.SameFile(current, info) {
+			// Replaced: what was written to the old file before comes first
+			t.read()
+			t.close()
+		} else if offset, err := t.f.Seek(0, io.SeekCurrent); err == nil && info.Size() < offset {
+			if _, err := t.f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	}
+	if t.f == nil {
+		if t.f, err = os.Open(t.path); err != nil {
+			return err
+		}
+		if first {
+			if _, err := t.f.Seek(0, io.SeekEnd); err != nil {
+				return err
+			}
+		}
+	}
+	return t.read()
+}
+
+func (t *fileTail) read() error {
+	_, err := io.Copy(t.w, t.f)
+	return err
+}
+
+// close ships an unterminated last line and closes the file
+func (t *fileTail) close() {
+	if t.f == nil {
+		return
+	}
+	t.w.Close()
+	t.f.Close()
+	t.f = nil
+}
@@ -0,0 +1,301 @@
+package agent
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// logServer records the log lines it receives, failing with status while it is set
+type logServer struct {
+	status atomic.Int32
+
+	mu      sync.Mutex
+	entries []LogEntry
+}
+
+func (s *logServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if status := int(s.status.Load()); status != 0 {
+		http.Error(w, "rejected", status)
+		return
+	}
+	var payload logsPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || len(payload.Entries) > maxLogsPerRequest {
+		http.Error(w, "invalid", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.entries = append(s.entries, payload.Entries...)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *logServer) received() []LogEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]LogEntry(nil), s.entries...)
+}
+
+// bufferedLogs returns the lines waiting to be sent
+func bufferedLogs(a *Agent) []LogEntry {
+	a.logsMu.Lock()
+	defer a.logsMu.Unlock()
+	return append([]LogEntry(nil), a.logs...)
+}
+
+// Test lines are buffered until the batch size is reached, then sent in the background
+func TestAgent_ShipLog_Batches(t *testing.T) {
+	srv := &logServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	agent.LogBatchSize = 2
+	agent.LogFlushInterval = time.Hour
+
+	agent.ShipLog(LogEntry{Message: "starting"})
+	time.Sleep(20 * time.Millisecond)
+	if n := len(srv.received()); n != 0 {
+		t.Fatalf("expected lines to be buffered, got %d sent", n)
+	}
+
+	agent.ShipLog(LogEntry{Level: "error", Source: "stderr", Message: "connection refused"})
+	waitFor(t, func() bool { return len(srv.received()) == 2 })
+	got := srv.received()
+	if got[0].Level != "info" || got[0].Time.IsZero() {
+		t.Errorf("expected the first line to default to info and be timestamped, got %+v", got[0])
+	}
+	if got[1].Level != "error" || got[1].Source != "stderr" {
+		t.Errorf("expected level and source to be sent, got %+v", got[1])
+	}
+}
+
+// Test starting the heartbeat loop while lines are being flushed doesn't deadlock
+func TestAgent_StartHeartbeatLoop_WhileShipping(t *testing.T) {
+	srv := &logServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	agent := newTestAgent(ts.URL)
+	defer agent.Shutdown(t.Context())
+
+	// Holding logsMu like ShipLog does while the loop starts its log tails
+	agent.logsMu.Lock()
+	go agent.StartHeartbeatLoop()
+	time.Sleep(20 * time.Millisecond)
+	stopped := make(chan bool)
+	go func() { stopped <- agent.isStopped() }()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected isStopped not to wait for the loop to start")
+	}
+	agent.logsMu.Unlock()
+}
+
+// Test a partial batch is sent once the flush interval passed
+func TestAgent_ShipLog_FlushInterval(t *testing.T) {
+	srv := &logServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	agent.LogFlushInterval = 10 * time.Millisecond
+
+	agent.ShipLog(LogEntry{Message: "one"})
+	waitFor(t, func() bool { return len(srv.received()) == 1 })
+}
+
+// Test lines are kept while Pulse is unavailable, and dropped when it rejects them as invalid
+func TestAgent_FlushLogs_Errors(t *testing.T) {
+	srv := &logServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	agent.LogFlushInterval = time.Hour
+	agent.ShipLog(LogEntry{Message: "one"})
+
+	srv.status.Store(http.StatusTooManyRequests)
+	if err := agent.FlushLogs(t.Context()); err == nil {
+		t.Fatal("expected flush to fail")
+	}
+	if n := len(bufferedLogs(agent)); n != 1 {
+		t.Fatalf("expected the line to be kept, got %d buffered", n)
+	}
+
+	srv.status.Store(http.StatusBadRequest)
+	if err := agent.FlushLogs(t.Context()); err == nil {
+		t.Fatal("expected flush to fail")
+	}
+	if n := len(bufferedLogs(agent)); n != 0 {
+		t.Fatalf("expected rejected lines to be dropped, got %d buffered", n)
+	}
+
+	srv.status.Store(0)
+	agent.ShipLog(LogEntry{Message: "two"})
+	if err := agent.FlushLogs(t.Context()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := srv.received(); len(got) != 1 || got[0].Message != "two" {
+		t.Errorf("expected only the new line to be sent, got %+v", got)
+	}
+}
+
+// Test the oldest lines are dropped past the buffer's bound, and the drop reported
+func TestAgent_ShipLog_DropsOldest(t *testing.T) {
+	srv := &logServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	agent.LogBatchSize = maxLogsPerRequest
+	entries := make([]LogEntry, maxBufferedLogs+5)
+	for i := range entries {
+		entries[i] = LogEntry{Message: "line"}
+	}
+	entries[5].Message = "first kept"
+
+	agent.ShipLog(entries...)
+	waitFor(t, func() bool { return len(srv.received()) == maxBufferedLogs+1 })
+	got := srv.received()
+	if got[0].Level != "warn" || got[0].Message != "5 log lines dropped" {
+		t.Errorf("expected the drop to be reported first, got %+v", got[0])
+	}
+	if got[1].Message != "first kept" {
+		t.Errorf("expected the oldest lines to be dropped, got %q", got[1].Message)
+	}
+}
+
+func TestAgent_LogHandler(t *testing.T) {
+	agent := newTestAgent("")
+	agent.LogFlushInterval = time.Hour
+	logger := slog.New(agent.LogHandler(slog.LevelInfo)).With("service", "api").WithGroup("req")
+
+	logger.Debug("ignored")
+	logger.Info("done", "status", 200, slog.Group("user", "id", 7))
+	logger.Warn("slow")
+
+	got := bufferedLogs(agent)
+	if len(got) != 2 {
+		t.Fatalf("expected 2 lines, got %+v", got)
+	}
+	want := map[string]string{"service": "api", "req.status": "200", "req.user.id": "7"}
+	for k, v := range want {
+		if got[0].Attrs[k] != v {
+			t.Errorf("expected attr %s=%s, got %v", k, v, got[0].Attrs)
+		}
+	}
+	if got[0].Level != "info" || got[0].Message != "done" {
+		t.Errorf("expected info line done, got %+v", got[0])
+	}
+	if got[1].Level != "warn" {
+		t.Errorf("expected warn, got %s", got[1].Level)
+	}
+}
+
+func TestDetectLevel(t *testing.T) {
+	cases := map[string]string{
+		`time=2025-03-01T12:00:00Z level=WARN msg="disk almost full"`:                         "warn",
+		`{"level":"debug","msg":"cache miss"}`:                                                "debug",
+		`2025/03/01 12:00:00 [ERROR] connection refused`:                                      "error",
+		`panic: runtime error: index out of range`:                                            "error",
+		`listening on :8080`:                                                                  "fallback",
+		`request served in 12ms to 10.0.0.1:51234 by worker 3 of the pool, error budget fine`: "fallback",
+	}
+	for line, want := range cases {
+		if got := detectLevel([]byte(line), "fallback"); got != want {
+			t.Errorf("expected %s for %q, got %s", want, line, got)
+		}
+	}
+}
+
+func TestAgent_LogWriter(t *testing.T) {
+	agent := newTestAgent("")
+	agent.LogFlushInterval = time.Hour
+	w := agent.LogWriter("stdout", "info")
+
+	for _, chunk := range []string{"level=warn low disk\npartial", "ly done\r\n", "\n", "last"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if n := len(bufferedLogs(agent)); n != 2 {
+		t.Fatalf("expected 2 complete lines, got %d", n)
+	}
+	w.Close()
+
+	got := bufferedLogs(agent)
+	want := []LogEntry{
+		{Level: "warn", Message: "level=warn low disk"},
+		{Level: "info", Message: "partially done"},
+		{Level: "info", Message: "last"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d lines, got %+v", len(want), got)
+	}
+	for i := range want {
+		if got[i].Level != want[i].Level || got[i].Message != want[i].Message || got[i].Source != "stdout" {
+			t.Errorf("expected %+v from stdout, got %+v", want[i], got[i])
+		}
+	}
+}
+
+func TestFileTail(t *testing.T) {
+	agent := newTestAgent("")
+	agent.LogFlushInterval = time.Hour
+	path := filepath.Join(t.TempDir(), "app.log")
+	write := func(path, data string, flag int) {
+		t.Helper()
+		f, err := os.OpenFile(path, flag|os.O_WRONLY|os.O_CREATE, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	poll := func(tail *fileTail, want ...string) {
+		t.Helper()
+		before := len(bufferedLogs(agent))
+		if err := tail.poll(); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		got := bufferedLogs(agent)[before:]
+		if len(got) != len(want) {
+			t.Fatalf("expected lines %q, got %+v", want, got)
+		}
+		for i := range want {
+			if got[i].Message != want[i] || got[i].Source != path {
+				t.Errorf("expected %q from %s, got %+v", want[i], path, got[i])
+			}
+		}
+	}
+
+	write(path, "before start\n", os.O_TRUNC)
+	tail := &fileTail{path: path, w: &lineWriter{agent: agent, source: path, level: "info"}}
+	defer tail.close()
+	poll(tail)
+
+	write(path, "appended\n", os.O_APPEND)
+	poll(tail, "appended")
+
+	write(path, "x\n", os.O_TRUNC)
+	poll(tail, "x")
+
+	// Rotation: the old file is renamed and still written to for a while
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	write(path+".1", "late\n", os.O_APPEND)
+	poll(tail, "late")
+	write(path, "fresh\n", os.O_TRUNC)
+	poll(tail, "fresh")
+}
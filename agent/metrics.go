@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// DefaultMetricsBatchSize is used when Agent.MetricsBatchSize is not set
+	DefaultMetricsBatchSize = 100
+	// maxSamplesPerRequest matches the limit enforced by /agent/metrics
+	maxSamplesPerRequest = 1000
+	// maxBufferedSamples bounds the buffer while the server is unreachable; the oldest samples are dropped first
+	maxBufferedSamples = 10000
+)
+
+// Sample is one numeric measurement, e.g. a queue depth or memory usage in MB
+type Sample struct {
+	Name   string            `json:"name"`
+	Value  float64           `json:"value"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Time   time.Time         `json:"time"`
+}
+
+type metricsPayload struct {
+	ID      string   `json:"id"`
+	Samples []Sample `json:"samples"`
+}
+
+// ReportMetrics buffers samples and sends them once MetricsBatchSize samples
+// are pending. Samples without a time are stamped with the current time.
+// The buffer is also flushed on every heartbeat tick and by FlushMetrics.
+func (a *Agent) ReportMetrics(samples ...Sample) error {
+	return a.ReportMetricsContext(context.Background(), samples...)
+}
+
+// ReportMetricsContext is ReportMetrics with a context bounding the send, if one is triggered
+func (a *Agent) ReportMetricsContext(ctx context.Context, samples ...Sample) error {
+	now := time.Now()
+
+	a.metricsMu.Lock()
+	for _, s := range samples {
+		if s.Time.IsZero() {
+			s.Time = now
+		}
+		a.metrics = append(a.metrics, s)
+	}
+	pending := len(a.metrics)
+	a.metricsMu.Unlock()
+
+	batch := a.MetricsBatchSize
+	if batch <= 0 {
+		batch = DefaultMetricsBatchSize
+	}
+	if pending < batch {
+		return nil
+	}
+	return a.FlushMetricsContext(ctx)
+}
+
+// FlushMetrics sends all buffered samples. On failure they are kept for the next
+// attempt, in the agent's Queue when it has one. With Coalesce they are added to
+// the batch instead, see FlushBatch.
+func (a *Agent) FlushMetrics() error {
+	return a.FlushMetricsContext(context.Background())
+}
+
+// FlushMetricsContext is FlushMetrics with a context bounding the requests
+func (a *Agent) FlushMetricsContext(ctx context.Context) error {
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+
+	a.metricsMu.Lock()
+	samples := a.metrics
+	a.metrics = nil
+	a.metricsMu.Unlock()
+
+	if a.Coalesce > 0 {
+		// The batch keeps them from here, a failed flush is queued like any batch
+		var errs []error
+		for len(samples) > 0 {
+			n := min(len(samples), maxSamplesPerRequest)
+			payload := metricsPayload{ID: a.ID.String(), Samples: samples[:n]}
+			if err := a.coalesce(ctx, batchItem{Type: "metrics", Metrics: &payload}); err != nil {
+				errs = append(errs, err)
+			}
+			samples = samples[n:]
+		}
+		return errors.Join(errs...)
+	}
+
+	for len(samples) > 0 {
+		n := min(len(samples), maxSamplesPerRequest)
+		err := a.deliver(ctx, "/agent/metrics", metricsPayload{
+			ID:      a.ID.String(),
+			Samples: samples[:n],
+		})
+		if err != nil {
+			a.metricsMu.Lock()
+			a.metrics = append(samples, a.metrics...)
+			if over := len(a.metrics) - maxBufferedSamples; over > 0 {
+				a.metrics = a.metrics[over:]
+			}
+			a.metricsMu.Unlock()
+			return err
+		}
+		samples = samples[n:]
+	}
+	return nil
+}
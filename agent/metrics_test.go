@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// Test samples are buffered until the batch size is reached
+func TestAgent_ReportMetrics_Batches(t *testing.T) {
+	var requests atomic.Int32
+	var received []Sample
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/agent/metrics" {
+			t.Fatalf("expected /agent/metrics, got %s", r.URL.Path)
+		}
+		var payload metricsPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Fatalf("failed to decode JSON payload: %v", err)
+		}
+		requests.Add(1)
+		received = append(received, payload.Samples...)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	agent.MetricsBatchSize = 3
+
+	if err := agent.ReportMetrics(Sample{Name: "queue_depth", Value: 1}, Sample{Name: "queue_depth", Value: 2}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if requests.Load() != 0 {
+		t.Fatalf("expected samples to be buffered, got %d requests", requests.Load())
+	}
+
+	if err := agent.ReportMetrics(Sample{Name: "jobs_per_sec", Value: 3, Labels: map[string]string{"queue": "emails"}}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if requests.Load() != 1 || len(received) != 3 {
+		t.Fatalf("expected one request with 3 samples, got %d requests and %d samples", requests.Load(), len(received))
+	}
+	for _, s := range received {
+		if s.Time.IsZero() {
+			t.Errorf("expected sample %s to be timestamped", s.Name)
+		}
+	}
+	if received[2].Labels["queue"] != "emails" {
+		t.Errorf("expected labels to be sent, got %v", received[2].Labels)
+	}
+}
+
+// Test samples are kept when the server rejects them and sent on the next flush
+func TestAgent_FlushMetrics_RetainsOnError(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+	var received int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var payload metricsPayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		received += len(payload.Samples)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	_ = agent.ReportMetrics(Sample{Name: "memory_mb", Value: 512})
+
+	if err := agent.FlushMetrics(); err == nil {
+		t.Fatal("expected flush to fail")
+	}
+
+	fail.Store(false)
+	if err := agent.FlushMetrics(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if received != 1 {
+		t.Errorf("expected the retained sample to be sent, got %d", received)
+	}
+}
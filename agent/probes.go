@@ -0,0 +1,291 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// DefaultProbeInterval is how often a probe without an Interval runs
+const DefaultProbeInterval = 10 * time.Second
+
+// maxProbeBody bounds how much of a response body an http probe reads
+const maxProbeBody = 64 << 10
+
+// ProbeConfig declares a probe: a check of something outside the agent's
+// process, run on its own schedule. Its latest result is sent along every
+// heartbeat like a StatusCheck's.
+type ProbeConfig struct {
+	Name string `json:"name" yaml:"name"`
+	Type string `json:"type" yaml:"type"` // http, tcp, exec or file
+	// Interval between runs, DefaultProbeInterval unless set
+	Interval Duration `json:"interval,omitempty" yaml:"interval,omitempty"`
+	// Timeout of a run, DefaultCheckTimeout unless set
+	Timeout Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// FailureThreshold is how many runs in a row must fail before the probe is
+	// reported as failed, 1 unless set
+	FailureThreshold int `json:"failure_threshold,omitempty" yaml:"failure_threshold,omitempty"`
+	// Critical probes turn the agent's status to `error` when they fail
+	Critical bool `json:"critical,omitempty" yaml:"critical,omitempty"`
+
+	// http: GET URL, expecting ExpectStatus, any 2xx unless set, and a body matching the BodyMatch regular expression
+	URL          string `json:"url,omitempty" yaml:"url,omitempty"`
+	ExpectStatus int    `json:"expect_status,omitempty" yaml:"expect_status,omitempty"`
+	BodyMatch    string `json:"body_match,omitempty" yaml:"body_match,omitempty"`
+	// tcp: connect to Address, host:port
+	Address string `json:"address,omitempty" yaml:"address,omitempty"`
+	// exec: run Command, expecting ExitCode
+	Command  []string `json:"command,omitempty" yaml:"command,omitempty"`
+	ExitCode int      `json:"exit_code,omitempty" yaml:"exit_code,omitempty"`
+	// file: Path must have been modified within MaxAge
+	Path   string   `json:"path,omitempty" yaml:"path,omitempty"`
+	MaxAge Duration `json:"max_age,omitempty" yaml:"max_age,omitempty"`
+}
+
+// Validate reports what is missing or invalid in the probe
+func (p ProbeConfig) Validate() error {
+	_, err := p.checkFunc()
+	return err
+}
+
+// checkFunc builds the check the probe runs
+func (p ProbeConfig) checkFunc() (func(ctx context.Context) error, error) {
+	if p.Name == "" {
+		return nil, errors.New("probe name is required")
+	}
+	if p.Interval < 0 || p.Timeout < 0 || p.FailureThreshold < 0 {
+		return nil, fmt.Errorf("probe %s: interval, timeout and failure_threshold can't be negative", p.Name)
+	}
+
+	switch p.Type {
+	case "http":
+		if p.URL == "" {
+			return nil, fmt.Errorf("probe %s: url is required", p.Name)
+		}
+		var body *regexp.Regexp
+		if p.BodyMatch != "" {
+			var err error
+			if body, err = regexp.Compile(p.BodyMatch); err != nil {
+				return nil, fmt.Errorf("probe %s: body_match: %w", p.Name, err)
+			}
+		}
+		return func(ctx context.Context) error { return probeHTTP(ctx, p.URL, p.ExpectStatus, body) }, nil
+	case "tcp":
+		if p.Address == "" {
+			return nil, fmt.Errorf("probe %s: address is required", p.Name)
+		}
+		return func(ctx context.Context) error {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", p.Address)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}, nil
+	case "exec":
+		if len(p.Command) == 0 {
+			return nil, fmt.Errorf("probe %s: command is required", p.Name)
+		}
+		return func(ctx context.Context) error { return probeExec(ctx, p.Command, p.ExitCode) }, nil
+	case "file":
+		if p.Path == "" || p.MaxAge <= 0 {
+			return nil, fmt.Errorf("probe %s: path and a positive max_age are required", p.Name)
+		}
+		return func(ctx context.Context) error { return probeFile(p.Path, time.Duration(p.MaxAge)) }, nil
+	default:
+		return nil, fmt.Errorf("probe %s: invalid type %q", p.Name, p.Type)
+	}
+}
+
+func probeHTTP(ctx context.Context, url string, expectStatus int, body *regexp.Regexp) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if expectStatus == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if expectStatus != 0 && resp.StatusCode != expectStatus {
+		return fmt.Errorf("status %d, expected %d", resp.StatusCode, expectStatus)
+	}
+	if body != nil {
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxProbeBody))
+		if err != nil {
+			return err
+		}
+		if !body.Match(data) {
+			return fmt.Errorf("body does not match %q", body.String())
+		}
+	}
+	return nil
+}
+
+func probeExec(ctx context.Context, command []string, exitCode int) error {
+	err := exec.CommandContext(ctx, command[0], command[1:]...).Run()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		if exitErr.ExitCode() != exitCode {
+			return fmt.Errorf("exit code %d, expected %d", exitErr.ExitCode(), exitCode)
+		}
+		return nil
+	case err != nil:
+		return err
+	case exitCode != 0:
+		return fmt.Errorf("exit code 0, expected %d", exitCode)
+	}
+	return nil
+}
+
+func probeFile(path string, maxAge time.Duration) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if age := time.Since(info.ModTime()); age > maxAge {
+		return fmt.Errorf("modified %s ago, more than %s", age.Round(time.Second), maxAge)
+	}
+	return nil
+}
+
+// probe runs a ProbeConfig and keeps the result to report
+type probe struct {
+	cfg   ProbeConfig
+	check StatusCheck
+
+	mu       sync.Mutex
+	failures int
+	result   *CheckResult // nil until the first success or the threshold is reached
+}
+
+func newProbe(cfg ProbeConfig) (*probe, error) {
+	check, err := cfg.checkFunc()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = Duration(DefaultProbeInterval)
+	}
+	if cfg.FailureThreshold == 0 {
+		cfg.FailureThreshold = 1
+	}
+	return &probe{
+		cfg:   cfg,
+		check: StatusCheck{Name: cfg.Name, Check: check, Timeout: time.Duration(cfg.Timeout), Critical: cfg.Critical},
+	}, nil
+}
+
+// run runs the probe once. A failure replaces the reported result only once
+// FailureThreshold runs in a row failed.
+func (p *probe) run(ctx context.Context) {
+	r := runCheck(ctx, p.check)
+	r.Probe = p.cfg.Type
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if r.Status == "ok" {
+		p.failures = 0
+	} else {
+		p.failures++
+	}
+	r.Failures = p.failures
+	if r.Status == "ok" || p.failures >= p.cfg.FailureThreshold {
+		p.result = &r
+	}
+}
+
+// latest returns the result to report, false when there is none yet
+func (p *probe) latest() (CheckResult, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.result == nil {
+		return CheckResult{}, false
+	}
+	return *p.result, true
+}
+
+// loop runs the probe right away, then on every interval until stop is closed
+func (p *probe) loop(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(time.Duration(p.cfg.Interval))
+	defer ticker.Stop()
+	for {
+		p.run(ctx)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// AddProbe registers a probe. Probes run from the time the heartbeat loop, or
+// Run, starts until the agent stops; their latest results are sent along every
+// heartbeat with those of the status checks.
+func (a *Agent) AddProbe(cfg ProbeConfig) error {
+	p, err := newProbe(cfg)
+	if err != nil {
+		return err
+	}
+
+	a.checksMu.Lock()
+	defer a.checksMu.Unlock()
+	for _, existing := range a.probes {
+		if existing.cfg.Name == cfg.Name {
+			return fmt.Errorf("probe %s already exists", cfg.Name)
+		}
+	}
+	a.probes = append(a.probes, p)
+	if a.probesStop != nil {
+		go p.loop(a.probesStop)
+	}
+	return nil
+}
+
+// startProbes starts the probes' loops, once, to run until stop is closed
+func (a *Agent) startProbes(stop <-chan struct{}) {
+	a.checksMu.Lock()
+	defer a.checksMu.Unlock()
+	if a.probesStop != nil {
+		return
+	}
+	a.probesStop = stop
+	for _, p := range a.probes {
+		go p.loop(stop)
+	}
+}
+
+// probeResults returns the latest results of the probes that have one
+func (a *Agent) probeResults() []CheckResult {
+	a.checksMu.Lock()
+	probes := append([]*probe(nil), a.probes...)
+	a.checksMu.Unlock()
+
+	var results []CheckResult
+	for _, p := range probes {
+		if r, ok := p.latest(); ok {
+			results = append(results, r)
+		}
+	}
+	return results
+}
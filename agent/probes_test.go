@@ -0,0 +1,189 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func runProbe(t *testing.T, cfg ProbeConfig) CheckResult {
+	t.Helper()
+	p, err := newProbe(cfg)
+	if err != nil {
+		t.Fatalf("expected a valid probe, got %v", err)
+	}
+	p.run(context.Background())
+	r, ok := p.latest()
+	if !ok {
+		t.Fatal("expected a result")
+	}
+	return r
+}
+
+func TestProbe_HTTP(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"status": "serving"}`))
+	}))
+	defer ts.Close()
+
+	cases := []struct {
+		name string
+		cfg  ProbeConfig
+		want string
+	}{
+		{"ok", ProbeConfig{URL: ts.URL}, "ok"},
+		{"body", ProbeConfig{URL: ts.URL, BodyMatch: `"status":\s*"serving"`}, "ok"},
+		{"body mismatch", ProbeConfig{URL: ts.URL, BodyMatch: "healthy"}, "fail"},
+		{"status", ProbeConfig{URL: ts.URL + "/missing"}, "fail"},
+		{"expected status", ProbeConfig{URL: ts.URL + "/missing", ExpectStatus: http.StatusNotFound}, "ok"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.cfg.Name, tc.cfg.Type = "api", "http"
+			r := runProbe(t, tc.cfg)
+			if r.Status != tc.want || r.Probe != "http" {
+				t.Errorf("expected %s, got %+v", tc.want, r)
+			}
+		})
+	}
+}
+
+func TestProbe_TCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	if r := runProbe(t, ProbeConfig{Name: "db", Type: "tcp", Address: addr}); r.Status != "ok" {
+		t.Errorf("expected ok, got %+v", r)
+	}
+	ln.Close()
+	if r := runProbe(t, ProbeConfig{Name: "db", Type: "tcp", Address: addr}); r.Status != "fail" {
+		t.Errorf("expected a closed port to fail, got %+v", r)
+	}
+}
+
+func TestProbe_Exec(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("needs sh")
+	}
+	if r := runProbe(t, ProbeConfig{Name: "script", Type: "exec", Command: []string{"sh", "-c", "exit 0"}}); r.Status != "ok" {
+		t.Errorf("expected ok, got %+v", r)
+	}
+	if r := runProbe(t, ProbeConfig{Name: "script", Type: "exec", Command: []string{"sh", "-c", "exit 2"}}); r.Status != "fail" {
+		t.Errorf("expected exit code 2 to fail, got %+v", r)
+	}
+	if r := runProbe(t, ProbeConfig{Name: "script", Type: "exec", Command: []string{"sh", "-c", "exit 2"}, ExitCode: 2}); r.Status != "ok" {
+		t.Errorf("expected the expected exit code to pass, got %+v", r)
+	}
+	if r := runProbe(t, ProbeConfig{Name: "script", Type: "exec", Command: []string{"./does-not-exist"}}); r.Status != "fail" {
+		t.Errorf("expected a missing command to fail, got %+v", r)
+	}
+}
+
+func TestProbe_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "heartbeat")
+	cfg := ProbeConfig{Name: "cron", Type: "file", Path: path, MaxAge: Duration(time.Minute)}
+	if r := runProbe(t, cfg); r.Status != "fail" {
+		t.Errorf("expected a missing file to fail, got %+v", r)
+	}
+	os.WriteFile(path, nil, 0o600)
+	if r := runProbe(t, cfg); r.Status != "ok" {
+		t.Errorf("expected a fresh file to pass, got %+v", r)
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(path, old, old)
+	if r := runProbe(t, cfg); r.Status != "fail" {
+		t.Errorf("expected a stale file to fail, got %+v", r)
+	}
+}
+
+// Test a failure is only reported once the threshold is reached
+func TestProbe_FailureThreshold(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "heartbeat")
+	os.WriteFile(path, nil, 0o600)
+	p, err := newProbe(ProbeConfig{Name: "cron", Type: "file", Path: path, MaxAge: Duration(time.Minute), FailureThreshold: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.run(context.Background())
+	os.Remove(path)
+
+	p.run(context.Background())
+	if r, _ := p.latest(); r.Status != "ok" {
+		t.Errorf("expected one failure to be tolerated, got %+v", r)
+	}
+	p.run(context.Background())
+	if r, _ := p.latest(); r.Status != "fail" || r.Failures != 2 {
+		t.Errorf("expected the second failure to be reported, got %+v", r)
+	}
+}
+
+func TestProbeConfig_Validate(t *testing.T) {
+	invalid := []ProbeConfig{
+		{Type: "tcp", Address: "localhost:5432"},
+		{Name: "x", Type: "grpc"},
+		{Name: "x", Type: "http"},
+		{Name: "x", Type: "http", URL: "http://localhost", BodyMatch: "("},
+		{Name: "x", Type: "tcp"},
+		{Name: "x", Type: "exec"},
+		{Name: "x", Type: "file", Path: "/tmp/x"},
+		{Name: "x", Type: "tcp", Address: "localhost:5432", Interval: Duration(-time.Second)},
+	}
+	for _, p := range invalid {
+		if err := p.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", p)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.Name, cfg.Servers = "worker", []string{"https://pulse.example.com"}
+	cfg.Probes = []ProbeConfig{
+		{Name: "db", Type: "tcp", Address: "localhost:5432"},
+		{Name: "db", Type: "tcp", Address: "localhost:5433"},
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected duplicate probe names to be rejected")
+	}
+}
+
+// Test probes run once the heartbeat loop starts and their results go along the heartbeat
+func TestAgent_Probes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "heartbeat")
+	srv := &directiveServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	agent.heartbeat = time.Hour
+	if err := agent.AddProbe(ProbeConfig{Name: "cron", Type: "file", Path: path, MaxAge: Duration(time.Minute), Critical: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.AddProbe(ProbeConfig{Name: "cron", Type: "file", Path: path, MaxAge: Duration(time.Minute)}); err == nil {
+		t.Error("expected a duplicate probe to be rejected")
+	}
+	if len(agent.RunChecks(context.Background())) != 0 {
+		t.Error("expected no result before the probes started")
+	}
+
+	agent.StartHeartbeatLoop()
+	defer agent.StopHeartbeatLoop()
+	waitFor(t, func() bool { return len(agent.RunChecks(context.Background())) == 1 })
+	results := agent.RunChecks(context.Background())
+	if r := results[0]; r.Name != "cron" || r.Status != "fail" || r.Probe != "file" {
+		t.Errorf("expected the failed probe, got %+v", r)
+	}
+	if status := agent.aggregateStatus(results); status != "error" {
+		t.Errorf("expected a failed critical probe to mean error, got %s", status)
+	}
+}
@@ -0,0 +1,263 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const (
+	// DefaultQueueMaxBytes bounds the queue opened by New from PULSE_QUEUE_DIR
+	DefaultQueueMaxBytes = 64 << 20
+
+	queueFileName  = "queue.log"
+	offsetFileName = "queue.offset"
+)
+
+// ErrEntryTooLarge is returned by Queue.Append for an entry that can never fit in the queue
+var ErrEntryTooLarge = errors.New("queue entry larger than the queue")
+
+// Queue is an on-disk FIFO of requests that could not be delivered to Pulse.
+//
+// Entries are appended as JSON lines to queue.log and synced before Append
+// returns. The number of bytes already replayed is kept in queue.offset,
+// replaced atomically after each delivered entry, so a crash replays at most
+// one entry twice. A line torn by a crash is dropped when the queue is opened.
+// When full, the oldest entries are dropped to make room for new ones.
+type Queue struct {
+	dir      string
+	maxBytes int64
+
+	replayMu sync.Mutex // held by Replay, which sends without holding mu
+	mu       sync.Mutex
+	file     *os.File
+	size     int64 // bytes in queue.log
+	offset   int64 // bytes of queue.log already replayed
+	start    int64 // bytes removed from the front of queue.log since it was opened
+}
+
+type queueEntry struct {
+	Path    string          `json:"path"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// OpenQueue opens the queue stored in dir, creating it if needed
+func OpenQueue(dir string, maxBytes int64) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("queue: %w", err)
+	}
+
+	q := &Queue{dir: dir, maxBytes: maxBytes}
+	data, err := os.ReadFile(q.path(queueFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("queue: %w", err)
+	}
+	// Drop a trailing entry whose write was interrupted
+	complete := int64(bytes.LastIndexByte(data, '\n') + 1)
+
+	q.file, err = os.OpenFile(q.path(queueFileName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("queue: %w", err)
+	}
+	if complete < int64(len(data)) {
+		if err := q.file.Truncate(complete); err != nil {
+			q.file.Close()
+			return nil, fmt.Errorf("queue: %w", err)
+		}
+	}
+	q.size = complete
+
+	if raw, err := os.ReadFile(q.path(offsetFileName)); err == nil {
+		q.offset, _ = strconv.ParseInt(string(bytes.TrimSpace(raw)), 10, 64)
+	}
+	if q.offset < 0 || q.offset > q.size {
+		q.offset = 0
+	}
+	return q, nil
+}
+
+func (q *Queue) path(name string) string {
+	return filepath.Join(q.dir, name)
+}
+
+// Append persists a request to send later
+func (q *Queue) Append(path string, payload any) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+	line, err := json.Marshal(queueEntry{Path: path, Payload: raw})
+	if err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+	line = append(line, '\n')
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if int64(len(line)) > q.maxBytes {
+		return ErrEntryTooLarge
+	}
+	if q.size+int64(len(line)) > q.maxBytes {
+		if err := q.compact(q.maxBytes - int64(len(line))); err != nil {
+			return fmt.Errorf("queue: %w", err)
+		}
+	}
+
+	if _, err := q.file.WriteAt(line, q.size); err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+	if err := q.file.Sync(); err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+	q.size += int64(len(line))
+	return nil
+}
+
+// Pending reports whether entries are waiting to be replayed
+func (q *Queue) Pending() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.offset < q.size
+}
+
+// Replay sends queued entries in order until the queue is empty or send
+// fails with a retryable error. Entries rejected for good are dropped so
+// they don't block the queue. It returns the number of entries delivered.
+// The entries pending when Replay starts are sent without holding the queue,
+// so Append doesn't wait for Pulse; those appended meanwhile wait for the next Replay.
+func (q *Queue) Replay(ctx context.Context, send func(ctx context.Context, path string, payload json.RawMessage) error) (int, error) {
+	q.replayMu.Lock()
+	defer q.replayMu.Unlock()
+
+	q.mu.Lock()
+	data := make([]byte, q.size-q.offset)
+	_, err := q.file.ReadAt(data, q.offset)
+	pos := q.start + q.offset
+	q.mu.Unlock()
+	if err != nil {
+		return 0, fmt.Errorf("queue: %w", err)
+	}
+
+	sent := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		pos += int64(len(line)) + 1
+		var entry queueEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			slog.Warn("dropping unreadable queue entry", "error", err)
+		} else if err := send(ctx, entry.Path, entry.Payload); err != nil {
+			if ctx.Err() != nil || IsRetryable(err) {
+				return sent, err
+			}
+			slog.Warn("dropping queue entry rejected by pulse", "path", entry.Path, "error", err)
+		} else {
+			sent++
+		}
+
+		if err := q.advanceTo(pos); err != nil {
+			return sent, fmt.Errorf("queue: %w", err)
+		}
+	}
+	return sent, nil
+}
+
+// advanceTo marks the entries up to pos, counted from the queue's opening, as
+// replayed, emptying the file once everything was. Entries compact dropped
+// in the meantime are already gone.
+func (q *Queue) advanceTo(pos int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if pos <= q.start+q.offset {
+		return nil
+	}
+	q.offset = pos - q.start
+	if q.offset >= q.size {
+		if err := q.file.Truncate(0); err != nil {
+			return err
+		}
+		q.start += q.size
+		q.size, q.offset = 0, 0
+	}
+	return q.writeOffset()
+}
+
+func (q *Queue) writeOffset() error {
+	return writeFileAtomic(q.path(offsetFileName), []byte(strconv.FormatInt(q.offset, 10)))
+}
+
+// writeFileAtomic replaces a file so that a crash leaves either the old or the new content
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// compact rewrites the queue without replayed entries, then drops the oldest
+// pending ones until at most limit bytes remain
+func (q *Queue) compact(limit int64) error {
+	data := make([]byte, q.size-q.offset)
+	if _, err := q.file.ReadAt(data, q.offset); err != nil {
+		return err
+	}
+
+	dropped := 0
+	for int64(len(data)) > limit {
+		i := bytes.IndexByte(data, '\n')
+		data = data[i+1:]
+		dropped++
+	}
+	if dropped > 0 {
+		slog.Warn("offline queue full, dropped oldest entries", "dropped", dropped)
+	}
+
+	// Reset the offset first: a crash in between replays entries rather than skipping them
+	q.offset = 0
+	if err := q.writeOffset(); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(q.path(queueFileName), data); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(q.path(queueFileName), os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	q.file.Close()
+	q.file = file
+	q.start += q.size - int64(len(data)) // the replayed entries, then the dropped ones
+	q.size = int64(len(data))
+	return nil
+}
+
+// Close releases the queue file
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.file.Close()
+}
@@ -0,0 +1,244 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func collect(t *testing.T, q *Queue, fail func(n int) error) []string {
+	t.Helper()
+	var got []string
+	_, err := q.Replay(context.Background(), func(ctx context.Context, path string, payload json.RawMessage) error {
+		if fail != nil {
+			if err := fail(len(got)); err != nil {
+				return err
+			}
+		}
+		var s string
+		if err := json.Unmarshal(payload, &s); err != nil {
+			t.Fatalf("failed to decode payload: %v", err)
+		}
+		got = append(got, path+" "+s)
+		return nil
+	})
+	if err != nil && fail == nil {
+		t.Fatalf("expected no replay error, got %v", err)
+	}
+	return got
+}
+
+// Test entries survive a restart and a partial replay resumes where it stopped
+func TestQueue_ReplayInOrderAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	q, err := OpenQueue(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"a", "b", "c"} {
+		if err := q.Append("/agent/update", s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Pulse goes away after the first entry
+	unreachable := &RequestError{Retryable: true, Err: errors.New("down")}
+	got := collect(t, q, func(n int) error {
+		if n == 1 {
+			return unreachable
+		}
+		return nil
+	})
+	if len(got) != 1 || got[0] != "/agent/update a" {
+		t.Fatalf("expected only the first entry, got %v", got)
+	}
+	q.Close()
+
+	q, err = OpenQueue(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	got = collect(t, q, nil)
+	if len(got) != 2 || got[0] != "/agent/update b" || got[1] != "/agent/update c" {
+		t.Errorf("expected the remaining entries in order, got %v", got)
+	}
+	if q.Pending() {
+		t.Error("expected the queue to be empty")
+	}
+}
+
+// Test entries rejected by Pulse are dropped instead of blocking the queue
+func TestQueue_DropsRejectedEntries(t *testing.T) {
+	q, err := OpenQueue(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	q.Append("/agent/update", "a")
+	q.Append("/agent/update", "b")
+
+	calls := 0
+	got := collect(t, q, func(int) error {
+		if calls++; calls == 1 {
+			return &RequestError{StatusCode: http.StatusBadRequest, Err: errors.New("invalid")}
+		}
+		return nil
+	})
+	if len(got) != 1 || got[0] != "/agent/update b" {
+		t.Errorf("expected the rejected entry to be skipped, got %v", got)
+	}
+}
+
+// Test a line torn by a crash is discarded when the queue is opened
+func TestQueue_DiscardsTornEntry(t *testing.T) {
+	dir := t.TempDir()
+	q, err := OpenQueue(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Append("/agent/update", "a")
+	q.Close()
+
+	f, err := os.OpenFile(filepath.Join(dir, queueFileName), os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"path":"/agent/upd`)
+	f.Close()
+
+	q, err = OpenQueue(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	q.Append("/agent/update", "b")
+
+	got := collect(t, q, nil)
+	if len(got) != 2 || got[0] != "/agent/update a" || got[1] != "/agent/update b" {
+		t.Errorf("expected the torn entry to be discarded, got %v", got)
+	}
+}
+
+// Test the oldest entries are dropped once the queue is full
+func TestQueue_Bounded(t *testing.T) {
+	line, _ := json.Marshal(queueEntry{Path: "/agent/update", Payload: json.RawMessage(`"0"`)})
+	q, err := OpenQueue(t.TempDir(), int64(3*(len(line)+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	for _, s := range []string{"1", "2", "3", "4", "5"} {
+		if err := q.Append("/agent/update", s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := collect(t, q, nil)
+	if len(got) != 3 || got[0] != "/agent/update 3" || got[2] != "/agent/update 5" {
+		t.Errorf("expected the 3 newest entries, got %v", got)
+	}
+
+	if err := q.Append("/agent/update", string(make([]byte, 100))); !errors.Is(err, ErrEntryTooLarge) {
+		t.Errorf("expected ErrEntryTooLarge, got %v", err)
+	}
+}
+
+// Test entries can be appended while a replay is sending, even when that drops entries being replayed
+func TestQueue_AppendDuringReplay(t *testing.T) {
+	line, _ := json.Marshal(queueEntry{Path: "/agent/update", Payload: json.RawMessage(`"0"`)})
+	q, err := OpenQueue(t.TempDir(), int64(3*(len(line)+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for _, s := range []string{"a", "b", "c"} {
+		q.Append("/agent/update", s)
+	}
+
+	done := make(chan []string)
+	go func() {
+		done <- collect(t, q, func(n int) error {
+			if n == 0 {
+				// The queue is full: these drop a and b, which this replay still sends
+				q.Append("/agent/update", "d")
+				q.Append("/agent/update", "e")
+			}
+			return nil
+		})
+	}()
+	select {
+	case got := <-done:
+		if len(got) != 3 || got[2] != "/agent/update c" {
+			t.Errorf("expected the entries pending when the replay started, got %v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Append not to wait for the replay")
+	}
+
+	got := collect(t, q, nil)
+	if len(got) != 2 || got[0] != "/agent/update d" || got[1] != "/agent/update e" {
+		t.Errorf("expected the entries appended during the replay, got %v", got)
+	}
+}
+
+// Test updates sent while Pulse is down are delivered later, in order, with their original time
+func TestAgent_Update_QueuedWhileServerDown(t *testing.T) {
+	var mu sync.Mutex
+	down := true
+	var received []updatePayload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		var p updatePayload
+		json.NewDecoder(r.Body).Decode(&p)
+		received = append(received, p)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	q, err := OpenQueue(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	agent := newTestAgent(ts.URL)
+	agent.Queue = q
+
+	if err := agent.Update("error", map[string]interface{}{"step": 1}); err != nil {
+		t.Fatalf("expected the update to be queued, got %v", err)
+	}
+	queuedAt := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+
+	if err := agent.Update("healthy", nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || received[0].Status != "error" || received[1].Status != "healthy" {
+		t.Fatalf("expected the queued update first, got %+v", received)
+	}
+	if received[0].Time.After(queuedAt) {
+		t.Errorf("expected the queued update to keep its original time, got %v", received[0].Time)
+	}
+	if q.Pending() {
+		t.Error("expected the queue to be drained")
+	}
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+type configResponse struct {
+	Version string          `json:"version"`
+	Config  json.RawMessage `json:"config"`
+}
+
+// OnConfig registers fn to receive the agent's configuration from Pulse,
+// decoded into T: the document of the agent's type with the agent's own
+// document merged over it. It is fetched once the agent registered and again
+// whenever a heartbeat response announces a new version. A version counts as
+// running, and is reported to Pulse, once fn returned nil; after an error it
+// is fetched again on the next heartbeat.
+func OnConfig[T any](a *Agent, fn func(ctx context.Context, cfg T, version string) error) {
+	a.configMu.Lock()
+	defer a.configMu.Unlock()
+	a.configHandler = func(ctx context.Context, raw json.RawMessage, version string) error {
+		var cfg T
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return fmt.Errorf("decode config: %w", err)
+		}
+		return fn(ctx, cfg, version)
+	}
+}
+
+// ConfigVersion returns the version of the configuration the agent runs, empty before the first one was applied
+func (a *Agent) ConfigVersion() string {
+	a.configMu.Lock()
+	defer a.configMu.Unlock()
+	return a.configVersion
+}
+
+// configOutdated reports whether Pulse announced a version the agent should fetch
+func (a *Agent) configOutdated(version string) bool {
+	a.configMu.Lock()
+	defer a.configMu.Unlock()
+	return a.configHandler != nil && version != "" && version != a.configVersion
+}
+
+// syncConfig fetches the agent's configuration and hands it to the OnConfig
+// handler, unless it is the version already running
+func (a *Agent) syncConfig(ctx context.Context) error {
+	a.configMu.Lock()
+	h := a.configHandler
+	a.configMu.Unlock()
+	if h == nil {
+		return nil
+	}
+
+	a.configSyncMu.Lock()
+	defer a.configSyncMu.Unlock()
+	applied := a.ConfigVersion()
+	cfg, err := a.fetchConfig(ctx, applied)
+	if err != nil || cfg == nil {
+		return err
+	}
+	if err := h(ctx, cfg.Config, cfg.Version); err != nil {
+		return fmt.Errorf("config %s rejected: %w", cfg.Version, err)
+	}
+
+	a.configMu.Lock()
+	a.configVersion = cfg.Version
+	a.configMu.Unlock()
+	a.logger().Info("config applied", "version", cfg.Version, "previous", applied)
+	return nil
+}
+
+// fetchConfig gets the agent's configuration, nil when it is still version current
+func (a *Agent) fetchConfig(ctx context.Context, current string) (*configResponse, error) {
+	server := a.server()
+	req, requestID, err := a.newRequest(ctx, http.MethodGet, server, "/agent/config/"+a.ID.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("config error: %w", err)
+	}
+	if current != "" {
+		req.Header.Set("If-None-Match", `"`+current+`"`)
+	}
+
+	a.requestsMu.RLock()
+	defer a.requestsMu.RUnlock()
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			a.failover(server)
+		}
+		return nil, fmt.Errorf("config error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		a.logger().Debug("request rejected", "path", "/agent/config", "status", resp.StatusCode, "request_id", requestID)
+		return nil, &RequestError{Path: "/agent/config", StatusCode: resp.StatusCode, Attempts: 1, Err: fmt.Errorf("server returned status %d", resp.StatusCode)}
+	}
+
+	var cfg configResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("config error: %w", err)
+	}
+	if cfg.Version == current {
+		return nil, nil
+	}
+	return &cfg, nil
+}
+
+// refreshConfig fetches the configuration in the background, so a slow
+// handler doesn't hold up heartbeats
+func (a *Agent) refreshConfig() {
+	if a.isStopped() {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), a.heartbeatInterval())
+		defer cancel()
+		if err := a.syncConfig(ctx); err != nil {
+			a.logger().Error("config sync failed", "error", err)
+		}
+	}()
+}
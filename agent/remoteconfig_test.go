@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+type testConfig struct {
+	Interval int      `json:"interval"`
+	Targets  []string `json:"targets"`
+}
+
+// configServer serves version with config, answers heartbeats with version and
+// records the config versions agents report
+type configServer struct {
+	mu         sync.Mutex
+	version    string
+	config     string
+	fetches    int
+	notChanged int
+	reported   []string
+}
+
+func (s *configServer) set(version, config string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version, s.config = version, config
+}
+
+func (s *configServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case r.URL.Path == "/agent/register":
+	case r.URL.Path == "/agent/heartbeat":
+		var p heartbeatPayload
+		json.NewDecoder(r.Body).Decode(&p)
+		s.reported = append(s.reported, p.ConfigVersion)
+		json.NewEncoder(w).Encode(map[string]any{"status": "OK", "config_version": s.version})
+	case r.Method == http.MethodGet:
+		s.fetches++
+		etag := `"` + s.version + `"`
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			s.notChanged++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(`{"version": "` + s.version + `", "config": ` + s.config + `}`))
+	}
+}
+
+func (s *configServer) state() (fetches, notChanged int, reported []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches, s.notChanged, append([]string(nil), s.reported...)
+}
+
+// Test the config is fetched on register and when a heartbeat announces a new version
+func TestAgent_OnConfig(t *testing.T) {
+	srv := &configServer{version: "t1.a0", config: `{"interval": 10, "targets": ["a"]}`}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	var mu sync.Mutex
+	var applied []testConfig
+	OnConfig(agent, func(ctx context.Context, cfg testConfig, version string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		applied = append(applied, cfg)
+		return nil
+	})
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(applied)
+	}
+
+	if err := agent.Register(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if count() != 1 || applied[0].Interval != 10 || len(applied[0].Targets) != 1 {
+		t.Fatalf("expected the config to be applied on register, got %+v", applied)
+	}
+	if v := agent.ConfigVersion(); v != "t1.a0" {
+		t.Errorf("expected version t1.a0, got %s", v)
+	}
+
+	// Same version: nothing to fetch
+	if err := agent.Heartbeat("healthy"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	srv.set("t2.a0", `{"interval": 20}`)
+	if err := agent.Heartbeat("healthy"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	waitFor(t, func() bool { return agent.ConfigVersion() == "t2.a0" })
+	if err := agent.Heartbeat("healthy"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	fetches, _, reported := srv.state()
+	if fetches != 2 {
+		t.Errorf("expected 2 fetches, got %d", fetches)
+	}
+	if count() != 2 || applied[1].Interval != 20 {
+		t.Errorf("expected the new config to be applied, got %+v", applied)
+	}
+	want := []string{"t1.a0", "t1.a0", "t2.a0"}
+	for i, v := range want {
+		if i >= len(reported) || reported[i] != v {
+			t.Fatalf("expected reported versions %v, got %v", want, reported)
+		}
+	}
+}
+
+// Test an unchanged config is answered with 304 and not applied again
+func TestAgent_OnConfig_NotModified(t *testing.T) {
+	srv := &configServer{version: "t1.a1", config: `{"interval": 10}`}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	calls := 0
+	OnConfig(agent, func(ctx context.Context, cfg testConfig, version string) error {
+		calls++
+		return nil
+	})
+	for i := 0; i < 2; i++ {
+		if err := agent.Register(); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	fetches, notChanged, _ := srv.state()
+	if fetches != 2 || notChanged != 1 {
+		t.Errorf("expected 2 fetches, 1 not modified, got %d and %d", fetches, notChanged)
+	}
+	if calls != 1 {
+		t.Errorf("expected the config to be applied once, got %d", calls)
+	}
+}
+
+// Test a rejected config isn't reported as running
+func TestAgent_OnConfig_Rejected(t *testing.T) {
+	srv := &configServer{version: "t1.a0", config: `{"interval": "often"}`}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	OnConfig(agent, func(ctx context.Context, cfg testConfig, version string) error {
+		return errors.New("unexpected")
+	})
+	if err := agent.syncConfig(context.Background()); err == nil {
+		t.Fatal("expected an undecodable config to be rejected")
+	}
+
+	srv.set("t1.a1", `{"interval": 5}`)
+	if err := agent.syncConfig(context.Background()); err == nil {
+		t.Fatal("expected the handler's error")
+	}
+	if v := agent.ConfigVersion(); v != "" {
+		t.Errorf("expected no version to be running, got %s", v)
+	}
+}
+
+// Test agents without a config handler don't fetch
+func TestAgent_WithoutOnConfig(t *testing.T) {
+	srv := &configServer{version: "t1.a0", config: `{}`}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	if err := agent.Register(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := agent.Heartbeat("healthy"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if fetches, _, _ := srv.state(); fetches != 0 {
+		t.Errorf("expected no fetch, got %d", fetches)
+	}
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how failed requests to Pulse are retried. Waits grow
+// exponentially from InitialInterval up to MaxInterval, each randomized by
+// ±Jitter. Retries stop once MaxElapsedTime would be exceeded; the zero value
+// never retries.
+type RetryPolicy struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	Jitter          float64 // fraction of the wait, between 0 and 1
+	MaxElapsedTime  time.Duration
+}
+
+// DefaultRetryPolicy is used by agents built with New
+var DefaultRetryPolicy = RetryPolicy{
+	InitialInterval: 500 * time.Millisecond,
+	MaxInterval:     30 * time.Second,
+	Multiplier:      2,
+	Jitter:          0.2,
+	MaxElapsedTime:  2 * time.Minute,
+}
+
+// backoff returns the wait before retry number n, starting at 1
+func (p RetryPolicy) backoff(n int) time.Duration {
+	wait := float64(p.InitialInterval)
+	multiplier := max(p.Multiplier, 1)
+	for i := 1; i < n && wait < float64(p.MaxInterval); i++ {
+		wait *= multiplier
+	}
+	if p.MaxInterval > 0 {
+		wait = min(wait, float64(p.MaxInterval))
+	}
+	if p.Jitter > 0 {
+		wait += wait * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(wait)
+}
+
+// ErrAlreadyRegistered is returned by Register when Pulse answers 409 for an ID
+// it already knows. Pulse now refreshes a known agent instead; only older
+// versions answer 409, and only for them is this error still returned.
+var ErrAlreadyRegistered = errors.New("agent already registered")
+
+// RequestError is returned when a request to Pulse fails, once retries are exhausted
+type RequestError struct {
+	Path       string
+	StatusCode int  // 0 when no response was received
+	Attempts   int  // requests sent, including the first
+	Retryable  bool // whether retrying later may succeed
+	Err        error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s: %v (%d attempts)", e.Path, e.Err, e.Attempts)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable reports whether err is a failed request that may succeed if sent again later
+func IsRetryable(err error) bool {
+	var re *RequestError
+	return errors.As(err, &re) && re.Retryable
+}
+
+// retryable classifies a failed attempt. Network errors, 429 and 5xx are
+// retryable; other statuses mean the payload itself was rejected.
+func retryable(ctx context.Context, status int) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return status == 0 || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// retryAfter reads the Retry-After header sent along 429 and 503 responses
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
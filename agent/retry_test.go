@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var fastRetry = RetryPolicy{
+	InitialInterval: time.Millisecond,
+	MaxInterval:     5 * time.Millisecond,
+	Multiplier:      2,
+	MaxElapsedTime:  time.Second,
+}
+
+// Test retryable failures are retried until the server recovers
+func TestAgent_Retry_RecoversFromServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case 2:
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	agent.Retry = fastRetry
+
+	if err := agent.Heartbeat("healthy"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+}
+
+// Test validation errors are not retried
+func TestAgent_Retry_PermanentError(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	agent.Retry = fastRetry
+
+	err := agent.Heartbeat("healthy")
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) {
+		t.Fatalf("expected RequestError, got %v", err)
+	}
+	if reqErr.StatusCode != http.StatusBadRequest || reqErr.Attempts != 1 || reqErr.Retryable || IsRetryable(err) {
+		t.Errorf("expected one permanent attempt, got %+v", reqErr)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected 1 attempt, got %d", n)
+	}
+}
+
+// Test retries stop once the maximum elapsed time is reached
+func TestAgent_Retry_GivesUp(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	agent.Retry = fastRetry
+	agent.Retry.MaxElapsedTime = 20 * time.Millisecond
+
+	err := agent.Heartbeat("healthy")
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) {
+		t.Fatalf("expected RequestError, got %v", err)
+	}
+	if reqErr.Attempts < 2 || !reqErr.Retryable {
+		t.Errorf("expected several retryable attempts, got %+v", reqErr)
+	}
+}
+
+// Test the 409 older Pulse versions answer on register is reported as ErrAlreadyRegistered
+func TestAgent_Register_Conflict(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "exists", http.StatusConflict)
+	}))
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	agent.Retry = fastRetry
+
+	if err := agent.Register(); !errors.Is(err, ErrAlreadyRegistered) {
+		t.Errorf("expected ErrAlreadyRegistered, got %v", err)
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{InitialInterval: 100 * time.Millisecond, MaxInterval: time.Second, Multiplier: 2}
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, w := range want {
+		if got := p.backoff(i + 1); got != w {
+			t.Errorf("retry %d: expected %s, got %s", i+1, w, got)
+		}
+	}
+
+	p.Jitter = 0.5
+	for range 100 {
+		if got := p.backoff(1); got < 50*time.Millisecond || got > 150*time.Millisecond {
+			t.Fatalf("expected jittered wait within 50%%, got %s", got)
+		}
+	}
+}
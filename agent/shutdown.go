@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// stopChannel returns the channel closed when the agent stops, creating it
+// on first use. lifeMu must be held.
+func (a *Agent) stopChannel() chan struct{} {
+	if a.stopChan == nil {
+		a.stopChan = make(chan struct{})
+	}
+	return a.stopChan
+}
+
+// stop stops the heartbeat loop, once, and returns the channel closed when it
+// has exited, nil when it never started
+func (a *Agent) stop() chan struct{} {
+	a.lifeMu.Lock()
+	defer a.lifeMu.Unlock()
+	if !a.stopped {
+		a.stopped = true
+		close(a.stopChannel())
+	}
+	return a.loopDone
+}
+
+// doneChannel returns the channel closed once Shutdown completed. lifeMu must be held.
+func (a *Agent) doneChannel() chan struct{} {
+	if a.shutdownDone == nil {
+		a.shutdownDone = make(chan struct{})
+	}
+	return a.shutdownDone
+}
+
+func (a *Agent) isStopped() bool {
+	a.lifeMu.Lock()
+	defer a.lifeMu.Unlock()
+	return a.stopped
+}
+
+// Shutdown stops the heartbeat loop and waits for requests in flight, then
+// replays the offline queue, flushes buffered metrics and logs and reports the agent as
+// `stopped`, along with any coalesced updates. The queue and gRPC session are closed, the agent can't be used afterwards. Only the
+// first call shuts down, later ones return its result. ctx bounds the whole
+// shutdown, waiting included.
+func (a *Agent) Shutdown(ctx context.Context) error {
+	return a.shutdown(ctx, "stopped", nil)
+}
+
+// ShutdownWithError is Shutdown for an agent stopping on a fatal error: it is
+// reported as `crashed`, with the error in the message
+func (a *Agent) ShutdownWithError(ctx context.Context, cause error) error {
+	message := map[string]interface{}{}
+	if cause != nil {
+		message["error"] = cause.Error()
+	}
+	return a.shutdown(ctx, "crashed", message)
+}
+
+// ShutdownWithMessage is Shutdown reporting status, e.g. crashed, with message
+// as the final update's message
+func (a *Agent) ShutdownWithMessage(ctx context.Context, status string, message map[string]interface{}) error {
+	return a.shutdown(ctx, status, message)
+}
+
+func (a *Agent) shutdown(ctx context.Context, status string, message map[string]interface{}) error {
+	a.shutdownOnce.Do(func() {
+		a.shutdownErr = a.doShutdown(ctx, status, message)
+		a.lifeMu.Lock()
+		close(a.doneChannel())
+		a.lifeMu.Unlock()
+	})
+	return a.shutdownErr
+}
+
+func (a *Agent) doShutdown(ctx context.Context, status string, message map[string]interface{}) error {
+	if done := a.stop(); done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return fmt.Errorf("shutdown: heartbeat loop: %w", ctx.Err())
+		}
+	}
+
+	// Taking the write lock waits until no request is in flight
+	drained := make(chan struct{})
+	go func() {
+		a.requestsMu.Lock()
+		a.requestsMu.Unlock()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return fmt.Errorf("shutdown: requests in flight: %w", ctx.Err())
+	}
+
+	var errs []error
+	if err := a.ReplayQueue(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("queue replay: %w", err))
+	}
+	if err := a.FlushMetricsContext(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("metrics flush: %w", err))
+	}
+	if err := a.FlushLogs(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("logs flush: %w", err))
+	}
+	if err := a.flushAcks(ctx, status); err != nil {
+		errs = append(errs, fmt.Errorf("directive acks: %w", err))
+	}
+	if err := a.UpdateContext(ctx, status, message); err != nil {
+		errs = append(errs, fmt.Errorf("final status: %w", err))
+	}
+	if err := a.FlushBatch(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("batch flush: %w", err))
+	}
+	if a.rpc != nil {
+		if err := a.rpc.close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("grpc: %w", err))
+		}
+	}
+	if a.Queue != nil {
+		if err := a.Queue.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("queue: %w", err))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	a.logger().Info("agent stopped", "status", status)
+	return nil
+}
+
+// ShutdownOnSignal shuts the agent down, within timeout, when the process
+// receives SIGINT or SIGTERM. The returned channel receives the result of
+// Shutdown, whether triggered by a signal or called directly, and is then closed.
+func (a *Agent) ShutdownOnSignal(timeout time.Duration) <-chan error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	a.lifeMu.Lock()
+	done := a.doneChannel()
+	a.lifeMu.Unlock()
+
+	result := make(chan error, 1)
+	go func() {
+		defer close(result)
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			a.logger().Info("shutting down", "signal", sig.String())
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			result <- a.Shutdown(ctx)
+		case <-done:
+			result <- a.shutdownErr
+		}
+	}()
+	return result
+}
@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// recordingServer records the path and status of every request
+func recordingServer(t *testing.T, handle func(r *http.Request)) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var calls []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload updatePayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		if handle != nil {
+			handle(r)
+		}
+		mu.Lock()
+		calls = append(calls, r.URL.Path+" "+payload.Status)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), calls...)
+	}
+}
+
+// Test stopping the heartbeat loop is idempotent, even before it starts
+func TestAgent_StopHeartbeatLoop_Idempotent(t *testing.T) {
+	ts, calls := recordingServer(t, nil)
+	agent := newTestAgent(ts.URL)
+	agent.heartbeat = 5 * time.Millisecond
+
+	agent.StopHeartbeatLoop()
+	agent.StopHeartbeatLoop()
+	agent.StartHeartbeatLoop()
+	time.Sleep(30 * time.Millisecond)
+	if got := calls(); len(got) != 0 {
+		t.Errorf("expected a stopped loop not to start, got %v", got)
+	}
+}
+
+// Test Shutdown waits for the heartbeat in flight, flushes metrics and reports the agent stopped, once
+func TestAgent_Shutdown(t *testing.T) {
+	inFlight := make(chan struct{})
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	defer releaseOnce.Do(func() { close(release) })
+	ts, calls := recordingServer(t, func(r *http.Request) {
+		if r.URL.Path == "/agent/heartbeat" {
+			close(inFlight)
+			<-release
+		}
+	})
+	agent := newTestAgent(ts.URL)
+	agent.ReportMetrics(Sample{Name: "jobs", Value: 1})
+	agent.StartHeartbeatLoop()
+	go agent.Heartbeat("healthy")
+	<-inFlight
+
+	done := make(chan error, 1)
+	go func() { done <- agent.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("expected Shutdown to wait for the heartbeat, returned %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	releaseOnce.Do(func() { close(release) })
+	if err := <-done; err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	got := calls()
+	want := []string{"/agent/heartbeat healthy", "/agent/metrics ", "/agent/update stopped"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if err := agent.Shutdown(context.Background()); err != nil || len(calls()) != len(got) {
+		t.Errorf("expected a second Shutdown to do nothing, got %v and %v", err, calls())
+	}
+}
+
+// Test ShutdownWithError reports the agent crashed with the error
+func TestAgent_ShutdownWithError(t *testing.T) {
+	var message map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload updatePayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		if payload.Status != "crashed" {
+			t.Errorf("expected crashed, got %q", payload.Status)
+		}
+		message = payload.Message
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	if err := newTestAgent(ts.URL).ShutdownWithError(context.Background(), errors.New("out of memory")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if message["error"] != "out of memory" {
+		t.Errorf("expected the error in the message, got %v", message)
+	}
+}
+
+// Test Shutdown gives up when its context ends before requests in flight finish
+func TestAgent_Shutdown_Timeout(t *testing.T) {
+	inFlight := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	ts, _ := recordingServer(t, func(r *http.Request) {
+		close(inFlight)
+		<-release
+	})
+	agent := newTestAgent(ts.URL)
+	go agent.Heartbeat("healthy")
+	<-inFlight
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := agent.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline error, got %v", err)
+	}
+}
+
+// Test SIGTERM shuts the agent down
+func TestAgent_ShutdownOnSignal(t *testing.T) {
+	ts, calls := recordingServer(t, nil)
+	agent := newTestAgent(ts.URL)
+	result := agent.ShutdownOnSignal(time.Second)
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the signal to shut the agent down")
+	}
+	if got := calls(); len(got) != 1 || got[0] != "/agent/update stopped" {
+		t.Errorf("expected a final stopped update, got %v", got)
+	}
+}
+
+// Test the signal helper reports a Shutdown called directly
+func TestAgent_ShutdownOnSignal_Direct(t *testing.T) {
+	ts, _ := recordingServer(t, nil)
+	agent := newTestAgent(ts.URL)
+	result := agent.ShutdownOnSignal(time.Second)
+
+	if err := agent.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := <-result; err != nil || !ok {
+		t.Errorf("expected the Shutdown result, got %v %v", err, ok)
+	}
+}
@@ -1 +1,145 @@
 package agent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrTaskFinished is returned when reporting on a task that already succeeded or failed
+var ErrTaskFinished = errors.New("task already finished")
+
+// Task is a unit of work tracked by Pulse, from StartTask until Succeed or Fail.
+// Every transition is sent as an update carrying the task, so Pulse keeps a
+// record of each run.
+type Task struct {
+	ID      uuid.UUID
+	Name    string
+	Started time.Time
+
+	agent    *Agent
+	mu       sync.Mutex
+	finished time.Time
+}
+
+type taskPayload struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Event    string    `json:"event"`
+	Started  time.Time `json:"started"`
+	Progress *float64  `json:"progress,omitempty"`
+	Message  string    `json:"message,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// StartTask starts tracking a task. The agent reports `working` while at least
+// one task runs and `idle` once they are all finished, in its updates and
+// heartbeats. The task is returned even when the update could not be sent.
+func (a *Agent) StartTask(ctx context.Context, name string) (*Task, error) {
+	t := &Task{ID: uuid.New(), Name: name, Started: time.Now(), agent: a}
+
+	a.tasksMu.Lock()
+	a.runningTasks++
+	a.trackingTasks = true
+	a.tasksMu.Unlock()
+
+	return t, t.send(ctx, taskPayload{Event: "started"})
+}
+
+// Progress reports how far the task is, as a fraction between 0 and 1, with an optional message
+func (t *Task) Progress(ctx context.Context, fraction float64, message string) error {
+	t.mu.Lock()
+	done := !t.finished.IsZero()
+	t.mu.Unlock()
+	if done {
+		return ErrTaskFinished
+	}
+
+	fraction = min(max(fraction, 0), 1)
+	return t.send(ctx, taskPayload{Event: "progress", Progress: &fraction, Message: message})
+}
+
+// Succeed marks the task as done
+func (t *Task) Succeed(ctx context.Context) error {
+	if err := t.finish(); err != nil {
+		return err
+	}
+	done := 1.0
+	return t.send(ctx, taskPayload{Event: "succeeded", Progress: &done})
+}
+
+// Fail marks the task as failed with err
+func (t *Task) Fail(ctx context.Context, err error) error {
+	if err := t.finish(); err != nil {
+		return err
+	}
+	msg := "failed"
+	if err != nil {
+		msg = err.Error()
+	}
+	return t.send(ctx, taskPayload{Event: "failed", Error: msg})
+}
+
+// Duration is how long the task ran, or has been running so far
+func (t *Task) Duration() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.finished.IsZero() {
+		return time.Since(t.Started)
+	}
+	return t.finished.Sub(t.Started)
+}
+
+func (t *Task) finish() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.finished.IsZero() {
+		return ErrTaskFinished
+	}
+	t.finished = time.Now()
+
+	t.agent.tasksMu.Lock()
+	t.agent.runningTasks--
+	t.agent.tasksMu.Unlock()
+	return nil
+}
+
+func (t *Task) send(ctx context.Context, p taskPayload) error {
+	p.ID, p.Name, p.Started = t.ID.String(), t.Name, t.Started
+	return t.agent.sendUpdate(ctx, updatePayload{
+		ID:     t.agent.ID.String(),
+		Status: t.agent.status(),
+		Time:   time.Now(),
+		Task:   &p,
+	})
+}
+
+// SetStatus overrides the status heartbeats report, e.g. `crashed` while a
+// supervised process waits to be restarted. An empty status restores the
+// status derived from the tasks. A failed critical check still reports `error`.
+func (a *Agent) SetStatus(status string) {
+	a.tasksMu.Lock()
+	defer a.tasksMu.Unlock()
+	a.statusOverride = status
+}
+
+// status is the status the agent reports: the one set with SetStatus, else
+// `healthy` until it tracks tasks, then `working` or `idle` depending on
+// whether any task runs
+func (a *Agent) status() string {
+	a.tasksMu.Lock()
+	defer a.tasksMu.Unlock()
+	switch {
+	case a.statusOverride != "":
+		return a.statusOverride
+	case !a.trackingTasks:
+		return "healthy"
+	case a.runningTasks > 0:
+		return "working"
+	default:
+		return "idle"
+	}
+}
@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test task transitions are sent as updates and drive the working/idle status
+func TestAgent_StartTask(t *testing.T) {
+	var mu sync.Mutex
+	var updates []updatePayload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p updatePayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Fatalf("failed to decode JSON payload: %v", err)
+		}
+		mu.Lock()
+		updates = append(updates, p)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	agent := newTestAgent(ts.URL)
+	ctx := context.Background()
+	if agent.status() != "healthy" {
+		t.Fatalf("expected healthy before any task, got %s", agent.status())
+	}
+
+	first, err := agent.StartTask(ctx, "import")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	second, _ := agent.StartTask(ctx, "export")
+	first.Progress(ctx, 0.5, "halfway")
+	first.Succeed(ctx)
+	if agent.status() != "working" {
+		t.Errorf("expected working while a task runs, got %s", agent.status())
+	}
+	second.Fail(ctx, errors.New("disk full"))
+	if agent.status() != "idle" {
+		t.Errorf("expected idle once every task finished, got %s", agent.status())
+	}
+
+	if err := first.Fail(ctx, errors.New("late")); !errors.Is(err, ErrTaskFinished) {
+		t.Errorf("expected ErrTaskFinished, got %v", err)
+	}
+	if d := first.Duration(); d <= 0 || d != first.Duration() {
+		t.Errorf("expected a fixed duration once finished, got %s", d)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []struct{ status, name, event string }{
+		{"working", "import", "started"},
+		{"working", "export", "started"},
+		{"working", "import", "progress"},
+		{"working", "import", "succeeded"},
+		{"idle", "export", "failed"},
+	}
+	if len(updates) != len(want) {
+		t.Fatalf("expected %d updates, got %+v", len(want), updates)
+	}
+	for i, w := range want {
+		u := updates[i]
+		if u.Task == nil || u.Status != w.status || u.Task.Name != w.name || u.Task.Event != w.event {
+			t.Errorf("update %d: expected %+v, got %+v (task %+v)", i, w, u, u.Task)
+		}
+	}
+	if updates[0].Task.ID != updates[3].Task.ID || !updates[0].Task.Started.Equal(updates[3].Task.Started) {
+		t.Error("expected every event of a run to carry its ID and start time")
+	}
+	if updates[4].Task.Error != "disk full" {
+		t.Errorf("expected the failure to be reported, got %q", updates[4].Task.Error)
+	}
+}
+
+// Test the task handle is usable even when Pulse can't be reached
+func TestAgent_StartTask_ServerDown(t *testing.T) {
+	agent := newTestAgent("http://127.0.0.1:1")
+
+	task, err := agent.StartTask(context.Background(), "import")
+	if err == nil || task == nil {
+		t.Fatalf("expected a task along with the send error, got %v, %v", task, err)
+	}
+	time.Sleep(time.Millisecond)
+	if task.Duration() <= 0 {
+		t.Error("expected the task to be timed")
+	}
+}
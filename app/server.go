@@ -1,15 +1,21 @@
 package app
 
 import (
+	"log/slog"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gofiber/contrib/swagger"
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/logger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 
 	"github.com/aphrollo/pulse/handlers"
+	"github.com/aphrollo/pulse/logging"
+	"github.com/aphrollo/pulse/metrics"
+	pulsev1 "github.com/aphrollo/pulse/proto/pulse/v1"
 )
 
 func New() *fiber.App {
@@ -24,6 +30,31 @@ func New() *fiber.App {
 		}
 	}
 
+	// OpenTelemetry gauges to keep, by OTel metric name
+	for _, name := range strings.Split(os.Getenv("OTLP_METRICS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			handlers.OTLPMetricNames[name] = true
+		}
+	}
+
+	if v := os.Getenv("INGESTION_MAX_INFLIGHT"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			handlers.MaxIngestionQueueDepth = n
+		}
+	}
+
+	if v := os.Getenv("LOG_QUOTA"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			handlers.LogQuota = n
+		}
+	}
+
+	if v := os.Getenv("HEARTBEAT_LATE_FACTOR"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 {
+			handlers.HeartbeatLateFactor = f
+		}
+	}
+
 	app := fiber.New(fiber.Config{
 		// Customize Fiber config here
 		ReadTimeout:  10 * time.Second,
@@ -32,7 +63,20 @@ func New() *fiber.App {
 	})
 
 	// Middlewares
-	app.Use(logger.New())
+	app.Use(metrics.Middleware())
+
+	// Probes are mounted ahead of logging, swagger and static files so orchestrators
+	// polling them neither flood the logs nor depend on those handlers
+	app.Get("/healthz", handlers.HealthzHandler)
+	app.Get("/readyz", handlers.ReadyzHandler)
+
+	app.Use(logging.RequestID())
+	app.Use(logging.Middleware(slog.Default()))
+
+	// Metrics are served here unless a dedicated listener is configured, see NewMetrics
+	if os.Getenv("METRICS_ADDR") == "" {
+		app.Get("/metrics", metrics.Handler())
+	}
 
 	cfg := swagger.Config{
 		BasePath: "/",
@@ -59,11 +103,70 @@ func New() *fiber.App {
 
 	// Routes
 	app.Get("/", handlers.DashboardHandler)
+	app.Get("/dashboard/uptime", handlers.UptimeHeatmapHandler)
+	app.Get("/dashboard/agents/:id", handlers.AgentPageHandler)
+	app.Get("/dashboard/configs", handlers.ConfigVersionsHandler)
 
-	client := app.Group("/agent")
+	client := app.Group("/agent", metrics.IngestionMiddleware())
 	client.Post("register", handlers.AgentRegisterHandler)
 	client.Post("update", handlers.AgentUpdateHandler)
 	client.Post("heartbeat", handlers.AgentHeartbeatHandler)
+	client.Post("metrics", handlers.AgentMetricsHandler)
+	client.Post("logs", handlers.AgentLogsHandler)
+	client.Post("batch", handlers.AgentBatchHandler)
+	client.Get("config/:id", handlers.AgentConfigHandler)
+
+	otlp := app.Group("/otlp/v1", metrics.IngestionMiddleware())
+	otlp.Post("metrics", handlers.OTLPMetricsHandler)
+	otlp.Post("traces", handlers.OTLPTracesHandler)
+	otlp.Post("logs", handlers.OTLPLogsHandler)
+
+	agents := app.Group("/agents")
+	agents.Get(":id", handlers.AgentDetailHandler)
+	agents.Get(":id/metrics", handlers.AgentMetricsQueryHandler)
+	agents.Get(":id/logs", handlers.AgentLogsQueryHandler)
+
+	reports := app.Group("/reports")
+	reports.Get("uptime", handlers.UptimeReportHandler)
+	reports.Get("tasks", handlers.TaskReportHandler)
+
+	handlers.AdminToken = os.Getenv("ADMIN_TOKEN")
+	if handlers.AdminToken == "" {
+		slog.Warn("ADMIN_TOKEN is not set, the admin routes are disabled")
+	}
+	admin := app.Group("/admin", handlers.AdminAuth)
+	admin.Get("storage", handlers.AdminStorageHandler)
+	admin.Get("agents/:id/directives", handlers.AdminDirectivesHandler)
+	admin.Post("agents/:id/directives", handlers.AdminCreateDirectiveHandler)
+	admin.Delete("agents/:id/directives/:directive", handlers.AdminCancelDirectiveHandler)
+	admin.Get("configs/:scope/:target", handlers.AdminConfigHistoryHandler)
+	admin.Put("configs/:scope/:target", handlers.AdminPutConfigHandler)
 
 	return app
 }
+
+// NewMetrics builds the app served on METRICS_ADDR. It only exposes /metrics
+// so Prometheus can scrape it without going through the public listener.
+// Settings like OTLP_METRICS are read by New.
+func NewMetrics() *fiber.App {
+	app := fiber.New(fiber.Config{
+		DisableStartupMessage: true,
+		ReadTimeout:           10 * time.Second,
+		WriteTimeout:          10 * time.Second,
+	})
+	app.Get("/metrics", metrics.Handler())
+	return app
+}
+
+// NewGRPC builds the gRPC server served on GRPC_ADDR, with the agent API of
+// handlers.AgentService. Settings like the allowed agent types are read by New.
+func NewGRPC() *grpc.Server {
+	srv := grpc.NewServer(
+		// Pings idle connections so a Session whose agent vanished breaks within
+		// seconds instead of when the kernel gives up on the connection
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: 30 * time.Second, Timeout: 10 * time.Second}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: 10 * time.Second, PermitWithoutStream: true}),
+	)
+	pulsev1.RegisterAgentServiceServer(srv, &handlers.AgentService{})
+	return srv
+}
@@ -0,0 +1,379 @@
+// Command pulse-agent runs a command line as a Pulse agent, for programs that
+// can't use the agent package. It registers with Pulse, heartbeats while the
+// command runs and reports how it ended: `stopped` on a clean exit, `crashed`
+// with the exit code, signal and last stderr lines otherwise.
+//
+//	pulse-agent -type worker -- ./worker --queue jobs
+//
+// Pulse is configured through the same PULSE_* environment variables, and
+// optional PULSE_CONFIG file, as agent.New. Probes declared in that file check
+// the command's health while it runs, e.g.
+//
+//	probes:
+//	  - name: api
+//	    type: http
+//	    url: http://localhost:8080/healthz
+//	    interval: 15s
+//	    failure_threshold: 3
+//	    critical: true
+//
+// With -restart, pulse-agent supervises the command: it is started again
+// after it exited, with an exponential backoff, until -max-restarts restarts
+// happened within -restart-window. Every restart is recorded as an update with
+// the exit details. A `restart` directive restarts the command at any time.
+//
+// With -ship-output, the command's stdout and stderr lines are shipped to
+// Pulse as logs, with the level they state, e.g. `level=warn`, or `info` for
+// stdout and `error` for stderr. Files listed in PULSE_LOG_FILES are followed
+// and shipped either way.
+//
+// With PULSE_TRANSPORT=grpc, heartbeats go on a gRPC session to
+// PULSE_GRPC_ADDR and directives, `restart` included, apply as soon as they
+// are issued instead of with the next heartbeat.
+//
+// pulse-agent exits with the command's exit code.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/aphrollo/pulse/agent"
+	"github.com/aphrollo/pulse/logging"
+)
+
+// Exit codes of pulse-agent itself, following the shell's conventions
+const (
+	exitUsage    = 2
+	exitNotFound = 127
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [--] command [args...]\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	name := flag.String("name", "", "agent name, defaults to the name in PULSE_CONFIG or the command's base name")
+	agentType := flag.String("type", "", "agent type, required unless set in PULSE_CONFIG")
+	stderrLines := flag.Int("stderr-lines", 20, "stderr lines of the command sent with a crash report")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "time allowed to deliver the final status")
+	shipOutput := flag.Bool("ship-output", false, "ship the command's stdout and stderr lines to Pulse as logs")
+	stopTimeout := flag.Duration("stop-timeout", 10*time.Second, "time the command gets to stop for a restart before it is killed")
+	var policy restartPolicy
+	flag.StringVar(&policy.Mode, "restart", "never", "when to restart the command: never, on-failure or always")
+	flag.IntVar(&policy.MaxRestarts, "max-restarts", 5, "restarts allowed within -restart-window before giving up")
+	flag.DurationVar(&policy.Window, "restart-window", 10*time.Minute, "window -max-restarts applies to")
+	flag.DurationVar(&policy.Backoff, "restart-backoff", time.Second, "wait before the first restart, doubled for every following one")
+	flag.DurationVar(&policy.MaxBackoff, "max-restart-backoff", time.Minute, "longest wait before a restart")
+	flag.StringVar(&policy.GiveUpStatus, "give-up-status", "crashed", "status reported once the restarts are exhausted: crashed or disabled")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	if err := policy.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "pulse-agent:", err)
+		os.Exit(exitUsage)
+	}
+
+	logger, err := logging.New(os.Stderr, os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "pulse-agent: invalid logging configuration:", err)
+		os.Exit(exitUsage)
+	}
+	slog.SetDefault(logger.With("component", "pulse-agent"))
+
+	cfg, err := agent.ConfigFromEnv()
+	if err != nil {
+		fatal(exitUsage, "invalid configuration", err)
+	}
+	if *name != "" {
+		cfg.Name = *name
+	}
+	if cfg.Name == "" {
+		cfg.Name = filepath.Base(flag.Arg(0))
+	}
+	if *agentType != "" {
+		cfg.Type = *agentType
+	}
+	if cfg.Type == "" {
+		fatal(exitUsage, "invalid configuration", errors.New("agent type is required"))
+	}
+	a, err := agent.NewFromConfig(cfg)
+	if err != nil {
+		fatal(exitUsage, "invalid configuration", err)
+	}
+
+	s := &sidecar{
+		agent:           a,
+		command:         flag.Args(),
+		stderrLines:     *stderrLines,
+		shipOutput:      *shipOutput,
+		shutdownTimeout: *shutdownTimeout,
+		stopTimeout:     *stopTimeout,
+		policy:          policy,
+	}
+	os.Exit(s.run(context.Background()))
+}
+
+// fatal logs the error and exits with code
+func fatal(code int, msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(code)
+}
+
+// sidecar runs one command as an agent, restarting it as its policy says
+type sidecar struct {
+	agent           *agent.Agent
+	command         []string
+	stderrLines     int
+	shipOutput      bool
+	shutdownTimeout time.Duration
+	stopTimeout     time.Duration // before a command asked to stop for a restart is killed
+	policy          restartPolicy
+	// registerRetry is the first wait before registering again while Pulse
+	// can't be reached, doubled up to maxRegisterRetry. Defaults to a second.
+	registerRetry time.Duration
+
+	restartRequests chan struct{}
+	done            chan struct{} // closed once the sidecar finishes
+}
+
+// maxRegisterRetry is the longest wait between two registration attempts
+const maxRegisterRetry = time.Minute
+
+// exitReason is why a run of the command ended
+type exitReason int
+
+const (
+	exitOnItsOwn   exitReason = iota
+	exitTerminated            // pulse-agent was asked to stop
+	exitRestart               // a restart directive stopped it
+)
+
+// run starts the command, reports it to Pulse and restarts it as the policy
+// says until it is done, then returns the exit code for pulse-agent
+func (s *sidecar) run(ctx context.Context) int {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+	s.restartRequests = make(chan struct{}, 1)
+	s.done = make(chan struct{})
+	s.agent.HandleDirective("restart", s.requestRestart)
+
+	registered := false
+	for runs := 1; ; runs++ {
+		var logs *agent.Agent
+		if s.shipOutput {
+			logs = s.agent
+		}
+		c, err := startChild(s.command, s.stderrLines, logs)
+		if err != nil {
+			slog.Error("failed to start command", "command", s.command[0], "error", err)
+			if !registered {
+				s.register(ctx)
+			}
+			s.finish(func(ctx context.Context) error { return s.agent.ShutdownWithError(ctx, err) })
+			return exitNotFound
+		}
+		slog.Info("command started", "command", s.command[0], "pid", c.cmd.Process.Pid, "run", runs)
+		started := time.Now()
+
+		if !registered {
+			// Even a command that already exited is registered, so its final status is accepted
+			registered = true
+			if err := s.register(ctx); err != nil {
+				go s.retryRegister(ctx)
+			} else {
+				if !c.exited() {
+					if err := s.agent.HeartbeatContext(ctx, "healthy"); err != nil {
+						slog.Error("heartbeat failed", "error", err)
+					}
+				}
+				s.agent.StartHeartbeatLoop()
+			}
+		}
+		s.agent.SetStatus("")
+
+		reason := s.wait(c, signals)
+		report := c.report()
+		switch {
+		case reason == exitTerminated:
+			slog.Info("command exited", "exit_code", report.ExitCode, "signal", report.Signal)
+			s.finish(s.agent.Shutdown)
+			return report.code()
+		case reason == exitRestart:
+			slog.Info("restarting command", "reason", "directive", "exit_code", report.ExitCode)
+			s.update(ctx, "starting", report, map[string]interface{}{"reason": "restart requested", "run": runs})
+			continue
+		case !s.policy.wants(report.clean()):
+			if report.clean() {
+				slog.Info("command exited", "exit_code", report.ExitCode)
+				s.finish(s.agent.Shutdown)
+			} else {
+				slog.Warn("command crashed", "exit_code", report.ExitCode, "signal", report.Signal)
+				s.finish(func(ctx context.Context) error {
+					return s.agent.ShutdownWithMessage(ctx, "crashed", report.message())
+				})
+			}
+			return report.code()
+		}
+
+		wait, ok := s.policy.next(time.Now(), time.Since(started))
+		if !ok {
+			slog.Error("restart limit reached", "restarts", s.policy.count(), "window", s.policy.Window)
+			message := report.message()
+			message["reason"] = "restart limit reached"
+			message["restarts"] = s.policy.count()
+			s.finish(func(ctx context.Context) error {
+				return s.agent.ShutdownWithMessage(ctx, s.policy.GiveUpStatus, message)
+			})
+			return report.code()
+		}
+
+		status := "crashed"
+		if report.clean() {
+			status = "stopped"
+		}
+		slog.Warn("command exited, restarting", "exit_code", report.ExitCode, "signal", report.Signal, "backoff", wait)
+		s.agent.SetStatus(status)
+		s.update(ctx, status, report, map[string]interface{}{"run": runs, "backoff_seconds": wait.Seconds()})
+		if !s.backoff(wait, signals) {
+			s.finish(s.agent.Shutdown)
+			return report.code()
+		}
+	}
+}
+
+// wait forwards signals to the child and handles restart requests until it exited
+func (s *sidecar) wait(c *child, signals <-chan os.Signal) exitReason {
+	reason := exitOnItsOwn
+	var kill <-chan time.Time
+	for {
+		select {
+		case <-c.done:
+			return reason
+		case sig := <-signals:
+			if isTermination(sig) {
+				reason = exitTerminated
+			}
+			slog.Info("forwarding signal", "signal", sig.String())
+			c.signal(sig)
+		case <-s.restartRequests:
+			if reason == exitOnItsOwn {
+				reason = exitRestart
+				c.terminate()
+				kill = time.After(s.stopTimeout)
+			}
+		case <-kill:
+			slog.Warn("command did not stop in time, killing it", "timeout", s.stopTimeout)
+			c.kill()
+		}
+	}
+}
+
+// backoff waits before a restart. A restart directive cuts it short; it
+// returns false when pulse-agent was asked to stop instead.
+func (s *sidecar) backoff(wait time.Duration, signals <-chan os.Signal) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case <-s.restartRequests:
+			return true
+		case sig := <-signals:
+			if isTermination(sig) {
+				return false
+			}
+		}
+	}
+}
+
+// requestRestart handles the restart directive
+func (s *sidecar) requestRestart(ctx context.Context, d agent.Directive) error {
+	select {
+	case s.restartRequests <- struct{}{}:
+	default: // a restart is already pending
+	}
+	return nil
+}
+
+// update records a run that ended, with its exit details and extra fields
+func (s *sidecar) update(ctx context.Context, status string, report exitStatus, extra map[string]interface{}) {
+	message := report.message()
+	for k, v := range extra {
+		message[k] = v
+	}
+	if err := s.agent.UpdateContext(ctx, status, message); err != nil {
+		slog.Error("update failed", "status", status, "error", err)
+	}
+}
+
+// register registers the agent, an agent already known to Pulse resumes its
+// history. Only older Pulse versions answer ErrAlreadyRegistered for it.
+func (s *sidecar) register(ctx context.Context) error {
+	err := s.agent.RegisterContext(ctx)
+	switch {
+	case errors.Is(err, agent.ErrAlreadyRegistered):
+		slog.Info("resuming registered agent", "agent_id", s.agent.ID)
+		return nil
+	case err != nil:
+		slog.Error("register failed", "agent_id", s.agent.ID, "error", err)
+		return err
+	default:
+		slog.Info("agent registered", "agent_id", s.agent.ID)
+		return nil
+	}
+}
+
+// retryRegister registers again, with a growing wait, until Pulse accepts the
+// agent, then starts the heartbeat loop. Pulse rejects heartbeats and updates
+// of an agent it doesn't know, so they wait for the registration; with a queue,
+// the updates sent meanwhile are replayed by the loop. It gives up when Pulse
+// rejected the registration itself or the sidecar finished.
+func (s *sidecar) retryRegister(ctx context.Context) {
+	wait := s.registerRetry
+	if wait <= 0 {
+		wait = time.Second
+	}
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.done:
+			timer.Stop()
+			return
+		}
+
+		err := s.register(ctx)
+		if err == nil {
+			s.agent.StartHeartbeatLoop()
+			return
+		}
+		if !agent.IsRetryable(err) {
+			return
+		}
+		wait = min(2*wait, maxRegisterRetry)
+	}
+}
+
+// finish shuts the agent down with shutdown, within the shutdown timeout
+func (s *sidecar) finish(shutdown func(ctx context.Context) error) {
+	close(s.done)
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		slog.Error("shutdown failed", "error", err)
+	}
+}
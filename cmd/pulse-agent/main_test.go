@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/google/uuid"
+
+	"github.com/aphrollo/pulse/agent"
+	"github.com/aphrollo/pulse/handlers"
+	db "github.com/aphrollo/pulse/storage"
+	"github.com/aphrollo/pulse/utils"
+)
+
+func TestTailWriter(t *testing.T) {
+	tail := newTailWriter(2)
+	tail.Write([]byte("one\ntwo\r\nthr"))
+	tail.Write([]byte("ee\nfour"))
+	if got, want := tail.Lines(), []string{"three", "four"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	tail = newTailWriter(1)
+	tail.Write([]byte(strings.Repeat("x", 2*maxTailLineLength) + "\n"))
+	if got := tail.Lines(); len(got) != 1 || len(got[0]) != maxTailLineLength {
+		t.Errorf("expected one line cut to %d bytes, got %d lines", maxTailLineLength, len(got))
+	}
+}
+
+// sidecarServer records the updates and logs the sidecar sends, and answers
+// the first heartbeat with directive, if set. With shipOutput the sidecar
+// ships its command's output.
+type sidecarServer struct {
+	directive  string
+	shipOutput bool
+	// unavailable registrations are answered 503 before one is accepted
+	unavailable int
+
+	mu        sync.Mutex
+	registers int
+	beats     int
+	statuses  []string
+	messages  []map[string]interface{}
+	logs      []agent.LogEntry
+}
+
+func (s *sidecarServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.URL.Path {
+	case "/agent/register":
+		s.registers++
+		if s.registers <= s.unavailable {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	case "/agent/heartbeat":
+		s.beats++
+		if s.beats == 1 && s.directive != "" {
+			json.NewEncoder(w).Encode(map[string]any{
+				"status":     "OK",
+				"directives": []map[string]string{{"id": "d1", "type": s.directive}},
+			})
+		}
+	case "/agent/update":
+		var p struct {
+			Status  string                 `json:"status"`
+			Message map[string]interface{} `json:"message"`
+		}
+		json.NewDecoder(r.Body).Decode(&p)
+		s.statuses = append(s.statuses, p.Status)
+		s.messages = append(s.messages, p.Message)
+	case "/agent/logs":
+		var p struct {
+			Entries []agent.LogEntry `json:"entries"`
+		}
+		json.NewDecoder(r.Body).Decode(&p)
+		s.logs = append(s.logs, p.Entries...)
+	}
+}
+
+func runSidecar(t *testing.T, command ...string) (*sidecarServer, int) {
+	t.Helper()
+	srv := &sidecarServer{}
+	return srv, runSupervised(t, srv, restartPolicy{Mode: "never"}, command...)
+}
+
+// runSupervised runs command in a sidecar reporting to srv
+func runSupervised(t *testing.T, srv *sidecarServer, policy restartPolicy, command ...string) int {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("needs sh")
+	}
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+
+	a, err := agent.NewFromConfig(agent.DefaultConfig(),
+		agent.WithServers(ts.URL), agent.WithStateDir(t.TempDir()), agent.WithRetry(agent.RetryPolicy{}),
+		func(c *agent.Config) { c.Name, c.Type = "sidecar-test", "worker" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sidecar{
+		agent:           a,
+		command:         command,
+		stderrLines:     2,
+		shipOutput:      srv.shipOutput,
+		shutdownTimeout: time.Second,
+		stopTimeout:     time.Second,
+		policy:          policy,
+		registerRetry:   10 * time.Millisecond,
+	}
+	return s.run(context.Background())
+}
+
+// Test a clean exit is reported as stopped
+func TestSidecar_Stopped(t *testing.T) {
+	srv, code := runSidecar(t, "sh", "-c", "exit 0")
+	if code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if want := []string{"stopped"}; !reflect.DeepEqual(srv.statuses, want) {
+		t.Errorf("expected statuses %v, got %v", want, srv.statuses)
+	}
+}
+
+// Test the registration is retried until Pulse can be reached
+func TestSidecar_RegisterRetried(t *testing.T) {
+	srv := &sidecarServer{unavailable: 2}
+	if code := runSupervised(t, srv, restartPolicy{Mode: "never"}, "sh", "-c", "sleep 0.5"); code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.registers != 3 {
+		t.Errorf("expected 3 registrations, got %d", srv.registers)
+	}
+}
+
+// Test a failing command is reported as crashed with its exit code and stderr
+func TestSidecar_Crashed(t *testing.T) {
+	srv, code := runSidecar(t, "sh", "-c", "echo one >&2; echo two >&2; echo three >&2; exit 3")
+	if code != 3 {
+		t.Errorf("expected exit code 3, got %d", code)
+	}
+	if len(srv.statuses) != 1 || srv.statuses[0] != "crashed" {
+		t.Fatalf("expected a crashed update, got %v", srv.statuses)
+	}
+	m := srv.messages[0]
+	if m["exit_code"] != 3.0 {
+		t.Errorf("expected exit_code 3, got %v", m["exit_code"])
+	}
+	if got, want := m["stderr"], []interface{}{"two", "three"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected stderr %v, got %v", want, got)
+	}
+}
+
+// Test the command's output is shipped as logs, flushed before the final status
+func TestSidecar_ShipOutput(t *testing.T) {
+	srv := &sidecarServer{shipOutput: true}
+	code := runSupervised(t, srv, restartPolicy{Mode: "never"}, "sh", "-c", "echo ready; echo 'level=warn slow disk' >&2; printf oops >&2; exit 1")
+	if code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	got := map[string]agent.LogEntry{}
+	for _, e := range srv.logs {
+		got[e.Message] = e
+	}
+	want := []agent.LogEntry{
+		{Level: "info", Source: "stdout", Message: "ready"},
+		{Level: "warn", Source: "stderr", Message: "level=warn slow disk"},
+		{Level: "error", Source: "stderr", Message: "oops"},
+	}
+	if len(srv.logs) != len(want) {
+		t.Fatalf("expected %d lines, got %+v", len(want), srv.logs)
+	}
+	for _, w := range want {
+		if e := got[w.Message]; e.Level != w.Level || e.Source != w.Source {
+			t.Errorf("expected %+v, got %+v", w, e)
+		}
+	}
+}
+
+// Test a command killed by a signal reports it and exits like a shell would
+func TestSidecar_Signaled(t *testing.T) {
+	srv, code := runSidecar(t, "sh", "-c", "kill -KILL $$")
+	if code != 128+9 {
+		t.Errorf("expected exit code 137, got %d", code)
+	}
+	if len(srv.messages) != 1 || srv.messages[0]["signal"] != "killed" {
+		t.Errorf("expected the signal to be reported, got %v", srv.messages)
+	}
+}
+
+// Test a command that can't be started is reported as crashed
+func TestSidecar_NotFound(t *testing.T) {
+	srv, code := runSidecar(t, "./does-not-exist")
+	if code != exitNotFound {
+		t.Errorf("expected exit code %d, got %d", exitNotFound, code)
+	}
+	if len(srv.statuses) != 1 || srv.statuses[0] != "crashed" {
+		t.Errorf("expected a crashed update, got %v", srv.statuses)
+	}
+}
+
+func TestRestartPolicy(t *testing.T) {
+	p := restartPolicy{Mode: "on-failure", MaxRestarts: 3, Window: time.Minute, Backoff: time.Second, MaxBackoff: 3 * time.Second, GiveUpStatus: "crashed"}
+	if err := p.validate(); err != nil {
+		t.Fatalf("expected a valid policy, got %v", err)
+	}
+	if p.wants(true) || !p.wants(false) {
+		t.Error("expected on-failure to restart failed runs only")
+	}
+
+	now := time.Now()
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		wait, ok := p.next(now, time.Millisecond)
+		if !ok || wait != want {
+			t.Errorf("restart %d: expected a %s backoff, got %s (ok %v)", i+1, want, wait, ok)
+		}
+	}
+	if _, ok := p.next(now, time.Millisecond); ok {
+		t.Error("expected the restarts to be exhausted")
+	}
+
+	// Once the window passed, restarts are allowed again; a long run resets the backoff
+	if wait, ok := p.next(now.Add(time.Minute), time.Hour); !ok || wait != time.Second {
+		t.Errorf("expected a restart with the initial backoff, got %s (ok %v)", wait, ok)
+	}
+
+	for _, invalid := range []restartPolicy{
+		{Mode: "sometimes", Window: time.Minute, Backoff: time.Second, MaxBackoff: time.Second, GiveUpStatus: "crashed"},
+		{Mode: "always", Window: time.Minute, Backoff: time.Second, MaxBackoff: time.Second, GiveUpStatus: "stopped"},
+		{Mode: "always", Window: time.Minute, Backoff: time.Minute, MaxBackoff: time.Second, GiveUpStatus: "crashed"},
+	} {
+		if err := invalid.validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", invalid)
+		}
+	}
+}
+
+// Test a failing command is restarted until the restarts are exhausted
+func TestSidecar_RestartLimit(t *testing.T) {
+	srv := &sidecarServer{}
+	policy := restartPolicy{Mode: "on-failure", MaxRestarts: 2, Window: time.Minute, Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond, GiveUpStatus: "disabled"}
+	code := runSupervised(t, srv, policy, "sh", "-c", "echo failing >&2; exit 4")
+	if code != 4 {
+		t.Errorf("expected exit code 4, got %d", code)
+	}
+	if want := []string{"crashed", "crashed", "disabled"}; !reflect.DeepEqual(srv.statuses, want) {
+		t.Fatalf("expected statuses %v, got %v", want, srv.statuses)
+	}
+	if m := srv.messages[0]; m["exit_code"] != 4.0 || m["run"] != 1.0 || m["stderr"] == nil {
+		t.Errorf("expected the restart to be recorded with exit details, got %v", m)
+	}
+	if m := srv.messages[2]; m["reason"] != "restart limit reached" || m["restarts"] != 2.0 {
+		t.Errorf("expected the final update to explain giving up, got %v", m)
+	}
+}
+
+// Test always restarts clean exits too, and on-failure stops after one
+func TestSidecar_RestartModes(t *testing.T) {
+	dir := t.TempDir()
+	// Succeeds twice, then fails
+	script := "n=$(cat count 2>/dev/null || echo 0); echo $((n+1)) > count; [ $n -lt 2 ]"
+	policy := restartPolicy{Mode: "always", MaxRestarts: 5, Window: time.Minute, Backoff: time.Millisecond, MaxBackoff: time.Millisecond, GiveUpStatus: "crashed"}
+
+	srv := &sidecarServer{}
+	code := runSupervised(t, srv, policy, "sh", "-c", "cd "+dir+" && "+script+" && exit 0 || exit 1")
+	// Every run is restarted, clean or not, until the 5 restarts are used up
+	if code != 1 || len(srv.statuses) != 6 || srv.statuses[0] != "stopped" || srv.statuses[2] != "crashed" {
+		t.Errorf("expected 5 restarts then giving up, got %d %v", code, srv.statuses)
+	}
+
+	policy.Mode = "on-failure"
+	srv = &sidecarServer{}
+	code = runSupervised(t, srv, policy, "sh", "-c", "exit 0")
+	if code != 0 || !reflect.DeepEqual(srv.statuses, []string{"stopped"}) {
+		t.Errorf("expected a clean exit not to be restarted, got %d %v", code, srv.statuses)
+	}
+}
+
+// Test a restart directive stops the running command and starts it again
+func TestSidecar_RestartDirective(t *testing.T) {
+	marker := t.TempDir() + "/restarted"
+	srv := &sidecarServer{directive: "restart"}
+	// The first run waits to be restarted, the second one exits right away
+	code := runSupervised(t, srv, restartPolicy{Mode: "never"},
+		"sh", "-c", "[ -f "+marker+" ] && exit 0; touch "+marker+"; exec sleep 10")
+	if code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if want := []string{"starting", "stopped"}; !reflect.DeepEqual(srv.statuses, want) {
+		t.Fatalf("expected statuses %v, got %v", want, srv.statuses)
+	}
+	if m := srv.messages[0]; m["reason"] != "restart requested" || m["signal"] != "terminated" {
+		t.Errorf("expected the restart to be recorded, got %v", m)
+	}
+}
+
+// storedSidecar returns a sidecar for command whose agent talks to the real
+// handlers, skipping the test when no database is configured
+func storedSidecar(t *testing.T, command ...string) *sidecar {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil || runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	utils.LoadEnvFromRoot()
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("needs DATABASE_URL")
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatalf("failed to connect to DB: %v", err)
+	}
+	t.Cleanup(db.Close)
+	types := handlers.AllowedAgentTypes
+	handlers.AllowedAgentTypes = []string{"worker"}
+	t.Cleanup(func() { handlers.AllowedAgentTypes = types })
+
+	app := fiber.New()
+	app.Post("/agent/register", handlers.AgentRegisterHandler)
+	app.Post("/agent/update", handlers.AgentUpdateHandler)
+	app.Post("/agent/heartbeat", handlers.AgentHeartbeatHandler)
+	ts := httptest.NewServer(adaptor.FiberApp(app))
+	t.Cleanup(ts.Close)
+
+	a, err := agent.NewFromConfig(agent.DefaultConfig(),
+		agent.WithServers(ts.URL), agent.WithStateDir(t.TempDir()),
+		func(c *agent.Config) { c.Name, c.Type = "sidecar-test", "worker" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Pool.Exec(context.Background(), `DELETE FROM agents WHERE id = $1`, a.ID) })
+	return &sidecar{
+		agent:           a,
+		command:         command,
+		stderrLines:     2,
+		shutdownTimeout: time.Second,
+		stopTimeout:     time.Second,
+	}
+}
+
+// storedUpdates reads back the statuses and decoded messages stored for id
+func storedUpdates(t *testing.T, id uuid.UUID) ([]string, []map[string]interface{}) {
+	t.Helper()
+	rows, err := db.Pool.Query(context.Background(),
+		`SELECT status::text, message FROM agent_updates WHERE agent_id = $1 ORDER BY time`, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var statuses []string
+	var messages []map[string]interface{}
+	for rows.Next() {
+		var status, message string
+		if err := rows.Scan(&status, &message); err != nil {
+			t.Fatal(err)
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(message), &m); err != nil {
+			t.Fatalf("expected a JSON message, got %q: %v", message, err)
+		}
+		statuses, messages = append(statuses, status), append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return statuses, messages
+}
+
+// Test a crash report reaches the database with its exit code and stderr
+func TestSidecar_Crashed_Stored(t *testing.T) {
+	s := storedSidecar(t, "sh", "-c", "echo one >&2; echo two >&2; exit 3")
+	if code := s.run(context.Background()); code != 3 {
+		t.Errorf("expected exit code 3, got %d", code)
+	}
+
+	statuses, messages := storedUpdates(t, s.agent.ID)
+	if want := []string{"crashed"}; !reflect.DeepEqual(statuses, want) {
+		t.Fatalf("expected statuses %v, got %v", want, statuses)
+	}
+	if m := messages[0]; m["exit_code"] != 3.0 || !reflect.DeepEqual(m["stderr"], []interface{}{"one", "two"}) {
+		t.Errorf("expected the crash to be stored with its details, got %v", m)
+	}
+}
+
+// Test the restart updates are stored by Pulse's update handler with their details
+func TestSidecar_RestartUpdate_Stored(t *testing.T) {
+	s := storedSidecar(t, "sh", "-c", "echo failing >&2; exit 4")
+	s.policy = restartPolicy{Mode: "on-failure", MaxRestarts: 1, Window: time.Minute, Backoff: time.Millisecond, MaxBackoff: time.Millisecond, GiveUpStatus: "disabled"}
+	if code := s.run(context.Background()); code != 4 {
+		t.Errorf("expected exit code 4, got %d", code)
+	}
+
+	statuses, messages := storedUpdates(t, s.agent.ID)
+	if want := []string{"crashed", "disabled"}; !reflect.DeepEqual(statuses, want) {
+		t.Fatalf("expected statuses %v, got %v", want, statuses)
+	}
+	if m := messages[0]; m["exit_code"] != 4.0 || m["run"] != 1.0 || m["backoff_seconds"] == nil || m["stderr"] == nil {
+		t.Errorf("expected the restart to be stored with its details, got %v", m)
+	}
+	if m := messages[1]; m["reason"] != "restart limit reached" || m["restarts"] != 1.0 {
+		t.Errorf("expected the final update to be stored with its reason, got %v", m)
+	}
+}
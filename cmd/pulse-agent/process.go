@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/aphrollo/pulse/agent"
+)
+
+// forwardedSignals are passed on to the command
+var forwardedSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}
+
+// child is one run of the command
+type child struct {
+	cmd    *exec.Cmd
+	stderr *tailWriter
+	done   chan struct{} // closed once it exited
+	err    error         // returned by Wait, set before done is closed
+}
+
+// startChild starts command with pulse-agent's stdin and stdout, and its stderr
+// also kept in a tail of stderrLines lines. With logs, its stdout and stderr
+// lines are also shipped to Pulse.
+func startChild(command []string, stderrLines int, logs *agent.Agent) (*child, error) {
+	c := &child{
+		cmd:    exec.Command(command[0], command[1:]...),
+		stderr: newTailWriter(stderrLines),
+		done:   make(chan struct{}),
+	}
+	c.cmd.Stdin = os.Stdin
+	c.cmd.Stdout = os.Stdout
+	c.cmd.Stderr = io.MultiWriter(os.Stderr, c.stderr)
+	var shipped []io.Closer
+	if logs != nil {
+		stdout, stderr := logs.LogWriter("stdout", "info"), logs.LogWriter("stderr", "error")
+		c.cmd.Stdout = io.MultiWriter(os.Stdout, stdout)
+		c.cmd.Stderr = io.MultiWriter(os.Stderr, c.stderr, stderr)
+		shipped = []io.Closer{stdout, stderr}
+	}
+	if err := c.cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		// Wait returns once the output was copied, last unterminated lines included
+		c.err = c.cmd.Wait()
+		for _, w := range shipped {
+			w.Close()
+		}
+		close(c.done)
+	}()
+	return c, nil
+}
+
+func (c *child) exited() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// report describes how the child ended, once done is closed
+func (c *child) report() exitStatus {
+	return exitReport(c.cmd.ProcessState, c.err, c.stderr.Lines())
+}
+
+// signal passes sig on to the child
+func (c *child) signal(sig os.Signal) {
+	if err := c.cmd.Process.Signal(sig); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		slog.Warn("failed to signal command", "signal", sig.String(), "error", err)
+	}
+}
+
+// terminate asks the child to stop, killing it where it can't be asked
+func (c *child) terminate() {
+	if err := c.cmd.Process.Signal(syscall.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		c.kill()
+	}
+}
+
+func (c *child) kill() {
+	if err := c.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		slog.Warn("failed to kill command", "error", err)
+	}
+}
+
+// isTermination reports whether sig asks pulse-agent to stop, rather than e.g. to reload
+func isTermination(sig os.Signal) bool {
+	return sig != syscall.SIGHUP
+}
+
+// exitStatus describes how the command ended
+type exitStatus struct {
+	ExitCode int      // -1 when killed by a signal
+	Signal   string   // the signal that killed it, if any
+	Err      error    // the error Wait returned
+	Stderr   []string // its last stderr lines
+}
+
+// exitReport builds the exit status from the command's process state and Wait error
+func exitReport(state *os.ProcessState, waitErr error, stderr []string) exitStatus {
+	s := exitStatus{ExitCode: -1, Err: waitErr, Stderr: stderr}
+	if state == nil {
+		return s
+	}
+	s.ExitCode = state.ExitCode()
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		s.Signal = ws.Signal().String()
+	}
+	return s
+}
+
+func (s exitStatus) clean() bool {
+	return s.ExitCode == 0 && s.Err == nil
+}
+
+// code is the exit code of pulse-agent: the command's, or 128 plus the signal
+// number like shells report it
+func (s exitStatus) code() int {
+	if s.ExitCode >= 0 {
+		return s.ExitCode
+	}
+	var exitErr *exec.ExitError
+	if errors.As(s.Err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+	}
+	return 1
+}
+
+// message is the message of the crashed update
+func (s exitStatus) message() map[string]interface{} {
+	m := map[string]interface{}{"exit_code": s.ExitCode}
+	if s.Err != nil {
+		m["error"] = s.Err.Error()
+	}
+	if s.Signal != "" {
+		m["signal"] = s.Signal
+	}
+	if len(s.Stderr) > 0 {
+		m["stderr"] = s.Stderr
+	}
+	return m
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// restartPolicy decides whether and when the command is started again after it exited
+type restartPolicy struct {
+	Mode        string // never, on-failure or always
+	MaxRestarts int    // within Window, then the agent gives up
+	Window      time.Duration
+	Backoff     time.Duration // before the first restart, doubled after every failed run
+	MaxBackoff  time.Duration
+	// GiveUpStatus is reported once the restarts are exhausted: crashed or disabled
+	GiveUpStatus string
+
+	restarts []time.Time // within Window
+	failures int         // runs in a row that ended too soon, for the backoff
+}
+
+func (p *restartPolicy) validate() error {
+	switch {
+	case p.Mode != "never" && p.Mode != "on-failure" && p.Mode != "always":
+		return fmt.Errorf("invalid restart mode %q", p.Mode)
+	case p.GiveUpStatus != "crashed" && p.GiveUpStatus != "disabled":
+		return fmt.Errorf("invalid give up status %q", p.GiveUpStatus)
+	case p.MaxRestarts < 0 || p.Window <= 0 || p.Backoff <= 0 || p.MaxBackoff < p.Backoff:
+		return fmt.Errorf("restarts need a positive window and backoff, and a max backoff of at least the backoff")
+	}
+	return nil
+}
+
+// wants reports whether the policy restarts a command that exited this way
+func (p *restartPolicy) wants(clean bool) bool {
+	return p.Mode == "always" || (p.Mode == "on-failure" && !clean)
+}
+
+// next records a restart at now of a command that ran for ran, and returns how
+// long to wait before it. ok is false when the restarts within the window are
+// exhausted.
+func (p *restartPolicy) next(now time.Time, ran time.Duration) (wait time.Duration, ok bool) {
+	kept := p.restarts[:0]
+	for _, t := range p.restarts {
+		if now.Sub(t) < p.Window {
+			kept = append(kept, t)
+		}
+	}
+	p.restarts = kept
+	if len(p.restarts) >= p.MaxRestarts {
+		return 0, false
+	}
+	p.restarts = append(p.restarts, now)
+
+	// A command that stayed up longer than the longest backoff counts as recovered
+	if ran > p.MaxBackoff {
+		p.failures = 0
+	}
+	wait = p.Backoff
+	for i := 0; i < p.failures && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	p.failures++
+	return min(wait, p.MaxBackoff), true
+}
+
+// count is the number of restarts within the window
+func (p *restartPolicy) count() int {
+	return len(p.restarts)
+}
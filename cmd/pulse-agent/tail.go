@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxTailLineLength cuts long lines so crash reports stay compact
+const maxTailLineLength = 1024
+
+// tailWriter keeps the last lines written to it
+type tailWriter struct {
+	max int
+
+	mu      sync.Mutex
+	lines   []string
+	partial []byte
+}
+
+func newTailWriter(lines int) *tailWriter {
+	return &tailWriter{max: lines}
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := len(p)
+	for len(p) > 0 {
+		line, rest, found := bytes.Cut(p, []byte("\n"))
+		if len(t.partial) < maxTailLineLength {
+			t.partial = append(t.partial, line[:min(len(line), maxTailLineLength-len(t.partial))]...)
+		}
+		if !found {
+			break
+		}
+		t.add(string(bytes.TrimSuffix(t.partial, []byte("\r"))))
+		t.partial = t.partial[:0]
+		p = rest
+	}
+	return n, nil
+}
+
+func (t *tailWriter) add(line string) {
+	if t.max <= 0 {
+		return
+	}
+	if len(t.lines) == t.max {
+		t.lines = append(t.lines[:0], t.lines[1:]...)
+	}
+	t.lines = append(t.lines, line)
+}
+
+// Lines returns the last lines, including an unterminated one
+func (t *tailWriter) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := append([]string(nil), t.lines...)
+	if len(t.partial) > 0 && t.max > 0 {
+		if len(lines) == t.max {
+			lines = lines[1:]
+		}
+		lines = append(lines, string(t.partial))
+	}
+	return lines
+}
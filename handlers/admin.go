@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+
+	db "github.com/aphrollo/pulse/storage"
+)
+
+// AdminToken is the bearer token required by the admin routes, see AdminAuth
+var AdminToken string
+
+// AdminAuth rejects requests without an `Authorization: Bearer` header holding
+// AdminToken. Without a configured token the admin routes are disabled.
+func AdminAuth(c *fiber.Ctx) error {
+	if AdminToken == "" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "admin API disabled"})
+	}
+	token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(AdminToken)) != 1 {
+		c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	return c.Next()
+}
+
+// StoragePolicyJob a Timescale job maintaining a table
+type StoragePolicyJob struct {
+	JobID            int                    `json:"job_id"`
+	Kind             string                 `json:"kind" example:"policy_retention"`
+	ScheduleInterval string                 `json:"schedule_interval" example:"1 day"`
+	Config           map[string]interface{} `json:"config"`
+	LastRunStatus    *string                `json:"last_run_status"`
+	LastSuccess      *time.Time             `json:"last_success"`
+	NextStart        *time.Time             `json:"next_start"`
+	TotalFailures    int64                  `json:"total_failures"`
+}
+
+// StorageTable size, chunks and policies of one hypertable or continuous aggregate
+type StorageTable struct {
+	Table                  string             `json:"table" example:"agent_heartbeats"`
+	Chunks                 int64              `json:"chunks"`
+	CompressedChunks       int64              `json:"compressed_chunks"`
+	TotalBytes             int64              `json:"total_bytes"`
+	CompressionEnabled     bool               `json:"compression_enabled"`
+	BeforeCompressionBytes *int64             `json:"before_compression_bytes"`
+	AfterCompressionBytes  *int64             `json:"after_compression_bytes"`
+	Policies               []StoragePolicyJob `json:"policies"`
+}
+
+// AdminStorageHandler reports chunk sizes and the status of retention and compression policies
+// @Summary Storage status
+// @Description Chunk counts, sizes, compression savings and policy job status of every hypertable
+// @Tags Admin
+// @Produce json
+// @Success 200 {array} StorageTable
+// @Failure 401 {object} ApiErrorResponse "UNAUTHORIZED - There was an unauthorized attempt to use functionality available only to authorized users. `{"message":"UNAUTHORIZED"}`"
+// @Router /admin/storage [get]
+func AdminStorageHandler(c *fiber.Ctx) error {
+	ctx := context.Background()
+
+	sql := `
+		SELECT COALESCE(ca.view_name, h.hypertable_name),
+		       h.num_chunks,
+		       (SELECT count(*) FROM timescaledb_information.chunks ch
+		        WHERE ch.hypertable_schema = h.hypertable_schema AND ch.hypertable_name = h.hypertable_name AND ch.is_compressed),
+		       hypertable_size(format('%I.%I', h.hypertable_schema, h.hypertable_name)::regclass),
+		       h.compression_enabled,
+		       cs.before_compression_total_bytes,
+		       cs.after_compression_total_bytes,
+		       h.hypertable_name
+		FROM timescaledb_information.hypertables h
+		LEFT JOIN timescaledb_information.continuous_aggregates ca
+		       ON ca.materialization_hypertable_schema = h.hypertable_schema
+		      AND ca.materialization_hypertable_name = h.hypertable_name
+		LEFT JOIN LATERAL (
+			SELECT sum(before_compression_total_bytes)::bigint AS before_compression_total_bytes,
+			       sum(after_compression_total_bytes)::bigint AS after_compression_total_bytes
+			FROM hypertable_compression_stats(format('%I.%I', h.hypertable_schema, h.hypertable_name)::regclass)
+		) cs ON h.compression_enabled
+		ORDER BY 1
+	`
+	rows, err := db.Pool.Query(ctx, sql)
+	if err != nil {
+		logStorageError(c, "failed to read storage status", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to read storage status"})
+	}
+
+	var tables []StorageTable
+	byHypertable := map[string]int{}
+	for rows.Next() {
+		var t StorageTable
+		var hypertable string
+		err := rows.Scan(&t.Table, &t.Chunks, &t.CompressedChunks, &t.TotalBytes, &t.CompressionEnabled,
+			&t.BeforeCompressionBytes, &t.AfterCompressionBytes, &hypertable)
+		if err != nil {
+			rows.Close()
+			logStorageError(c, "failed to read storage status", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to read storage status"})
+		}
+		t.Policies = []StoragePolicyJob{}
+		byHypertable[hypertable] = len(tables)
+		byHypertable[t.Table] = len(tables)
+		tables = append(tables, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		logStorageError(c, "failed to read storage status", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to read storage status"})
+	}
+
+	// Per agent type retention jobs have no hypertable, their table is in the config
+	sql = `
+		SELECT j.job_id, j.proc_name, j.schedule_interval::text, COALESCE(j.config, '{}'),
+		       COALESCE(j.hypertable_name, j.config->>'table', ''),
+		       s.last_run_status, s.last_successful_finish, s.next_start, COALESCE(s.total_failures, 0)
+		FROM timescaledb_information.jobs j
+		LEFT JOIN timescaledb_information.job_stats s ON s.job_id = j.job_id
+		WHERE j.proc_name IN ('policy_retention', 'policy_compression', 'policy_refresh_continuous_aggregate', 'pulse_type_retention')
+		ORDER BY j.job_id
+	`
+	rows, err = db.Pool.Query(ctx, sql)
+	if err != nil {
+		logStorageError(c, "failed to read storage policies", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to read storage policies"})
+	}
+	var job StoragePolicyJob
+	var table string
+	scans := []any{&job.JobID, &job.Kind, &job.ScheduleInterval, &job.Config, &table,
+		&job.LastRunStatus, &job.LastSuccess, &job.NextStart, &job.TotalFailures}
+	_, err = pgx.ForEachRow(rows, scans, func() error {
+		if i, ok := byHypertable[table]; ok {
+			tables[i].Policies = append(tables[i].Policies, job)
+		}
+		job = StoragePolicyJob{}
+		return nil
+	})
+	if err != nil {
+		logStorageError(c, "failed to read storage policies", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to read storage policies"})
+	}
+
+	return c.JSON(tables)
+}
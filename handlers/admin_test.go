@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestAdminAuth(t *testing.T) {
+	app := fiber.New()
+	app.Get("/admin/ping", AdminAuth, func(c *fiber.Ctx) error { return c.SendString("pong") })
+	defer func(token string) { AdminToken = token }(AdminToken)
+
+	cases := []struct {
+		name, token, header string
+		want                int
+	}{
+		{"NoTokenConfigured", "", "Bearer anything", fiber.StatusForbidden},
+		{"MissingHeader", "s3cret", "", fiber.StatusUnauthorized},
+		{"WrongToken", "s3cret", "Bearer nope", fiber.StatusUnauthorized},
+		{"NotBearer", "s3cret", "Basic s3cret", fiber.StatusUnauthorized},
+		{"Valid", "s3cret", "Bearer s3cret", fiber.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			AdminToken = tc.token
+			req := httptest.NewRequest(http.MethodGet, "/admin/ping", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tc.want {
+				t.Errorf("Expected status %d, got %d", tc.want, resp.StatusCode)
+			}
+		})
+	}
+}
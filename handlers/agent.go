@@ -2,11 +2,16 @@ package handlers
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
+	"fmt"
+	"time"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5"
 
+	"github.com/aphrollo/pulse/logging"
+	"github.com/aphrollo/pulse/metrics"
 	db "github.com/aphrollo/pulse/storage"
 )
 
@@ -32,6 +37,37 @@ func isAllowedAgentType(t string) bool {
 	return false
 }
 
+// ingestionError counts a rejected agent payload and writes the error response
+func ingestionError(c *fiber.Ctx, endpoint string, status int, message string) error {
+	reason := "invalid"
+	switch {
+	case status == fiber.StatusConflict:
+		reason = "conflict"
+	case status >= fiber.StatusInternalServerError:
+		reason = "storage"
+	}
+	metrics.IngestionErrors.WithLabelValues(endpoint, reason).Inc()
+	return c.Status(status).JSON(fiber.Map{"error": message})
+}
+
+// logStorageError logs a failed database call along with the request ID
+func logStorageError(c *fiber.Ctx, msg string, err error, attrs ...any) {
+	logging.FromCtx(c).Error(msg, append(attrs, "error", err)...)
+}
+
+// MaxClockSkew is how far ahead of the server an agent's clock may run
+var MaxClockSkew = time.Minute
+
+// clientTime picks the time to store for a timestamp sent by an agent. Agents replay
+// requests queued while Pulse was unreachable with their original time, so past
+// times are kept; a missing time or one ahead of the server clock becomes now.
+func clientTime(t, now time.Time) time.Time {
+	if t.IsZero() || t.After(now.Add(MaxClockSkew)) {
+		return now
+	}
+	return t
+}
+
 var allowedAgentStatus = map[string]bool{
 	"starting": true, "healthy": true, "working": true, "idle": true,
 	"error": true, "unreachable": true, "crashed": true, "stopped": true, "disabled": true,
@@ -43,11 +79,50 @@ type AgentRegisterRequest struct {
 	Name string                 `json:"name"` // Required
 	Type string                 `json:"type"`
 	Info map[string]interface{} `json:"info,omitempty"` // Optional JSON object
+
+	// HeartbeatInterval is how often the Agent heartbeats, in seconds. Optional, late beats are counted against it
+	HeartbeatInterval float64 `json:"heartbeat_interval,omitempty" example:"60"`
+}
+
+// validateRegister checks a registration request and returns the Agent's ID.
+// A heartbeat interval, when set, is bounded like the set_interval directive.
+func validateRegister(req *AgentRegisterRequest) (uuid.UUID, string) {
+	id, err := uuid.Parse(req.ID)
+	if err != nil {
+		return id, "invalid UUID"
+	}
+	if req.Name == "" {
+		return id, "name is required"
+	}
+	if !isAllowedAgentType(req.Type) {
+		return id, "invalid Agent type"
+	}
+	if req.HeartbeatInterval != 0 && (req.HeartbeatInterval < MinDirectiveInterval || req.HeartbeatInterval > MaxDirectiveInterval) {
+		return id, "heartbeat_interval must be between 1s and 24h"
+	}
+	return id, ""
+}
+
+// registerAgent inserts a new Agent. An Agent registering again, typically
+// after a restart, gets its name, type, info and heartbeat interval refreshed.
+// An unset heartbeat interval is stored as NULL.
+func registerAgent(ctx context.Context, id uuid.UUID, req *AgentRegisterRequest) error {
+	sql := `
+		INSERT INTO agents (id, name, type, info, heartbeat_interval)
+		VALUES ($1, $2, $3, $4, make_interval(secs => NULLIF($5::float8, 0)))
+		ON CONFLICT (id) DO UPDATE SET
+			name = EXCLUDED.name,
+			type = EXCLUDED.type,
+			info = EXCLUDED.info,
+			heartbeat_interval = EXCLUDED.heartbeat_interval
+	`
+	_, err := db.Pool.Exec(ctx, sql, id, req.Name, req.Type, req.Info, req.HeartbeatInterval)
+	return err
 }
 
 // AgentRegisterHandler registers a new Agent
 // @Summary Register a Agent
-// @Description Registers a Agent by UUID, name, type, and optional metadata
+// @Description Registers a Agent by UUID, name, type, and optional metadata. Registering an existing UUID again updates the Agent.
 // @Tags Agent
 // @Accept json
 // @Produce json
@@ -59,44 +134,89 @@ type AgentRegisterRequest struct {
 func AgentRegisterHandler(c *fiber.Ctx) error {
 	var req AgentRegisterRequest
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid request body"})
+		return ingestionError(c, "register", fiber.StatusBadRequest, "invalid request body")
 	}
 
-	id, err := uuid.Parse(req.ID)
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid UUID"})
+	id, msg := validateRegister(&req)
+	if msg != "" {
+		return ingestionError(c, "register", fiber.StatusBadRequest, msg)
 	}
-	if req.Name == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "name is required"})
-	}
-	if !isAllowedAgentType(req.Type) {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid Agent type"})
+
+	if err := registerAgent(context.Background(), id, &req); err != nil {
+		logStorageError(c, "failed to register agent", err, "agent_id", id)
+		return ingestionError(c, "register", fiber.StatusInternalServerError, "failed to register Agent")
 	}
 
-	ctx := context.Background()
+	return c.JSON(fiber.Map{"status": "OK"})
+}
 
-	// If you want to reject duplicates:
-	sql := `
-		INSERT INTO agents (id, name, type, info)
-		VALUES ($1, $2, $3, $4)
-	`
-	_, err = db.Pool.Exec(ctx, sql, id, req.Name, req.Type, req.Info)
+// AgentUpdateRequest Request to update a Agent's metadata/settings
+type AgentUpdateRequest struct {
+	ID      string                 `json:"id"`                // Agent UUID string
+	Status  string                 `json:"status"`            // Must be one of Agent_status enum
+	Message map[string]interface{} `json:"message,omitempty"` // Partial updates allowed
+	Info    map[string]interface{} `json:"info,omitempty"`    // Former name of message, still accepted
+	Time    time.Time              `json:"time,omitempty"`    // When the Agent sent the update, defaults to the time of ingestion
+	Task    *TaskEvent             `json:"task,omitempty"`    // Set when the update reports a task transition
+}
+
+// validateUpdate checks an update request and returns the Agent's ID
+func validateUpdate(req *AgentUpdateRequest) (uuid.UUID, string) {
+	id, err := uuid.Parse(req.ID)
 	if err != nil {
-		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) && pgErr.Code == "23505" { // unique_violation
-			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Agent ID already exists"})
+		return id, "invalid UUID"
+	}
+	// Validate status is provided (if required)
+	if req.Status == "" {
+		return id, "status is required"
+	}
+	if !allowedAgentStatus[req.Status] {
+		return id, "invalid status value"
+	}
+	if req.Message == nil {
+		req.Message = req.Info
+	}
+	if req.Task != nil {
+		if msg := validateTaskEvent(req.Task); msg != "" {
+			return id, msg
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to register Agent"})
 	}
+	return id, ""
+}
 
-	return c.JSON(fiber.Map{"status": "OK"})
+// messageText encodes an update message for the TEXT message column, nil when there is none
+func messageText(message map[string]interface{}) (*string, error) {
+	if message == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("encode message: %w", err)
+	}
+	text := string(b)
+	return &text, nil
 }
 
-// AgentUpdateRequest Request to update a Agent's metadata/settings
-type AgentUpdateRequest struct {
-	ID      string                 `json:"id"`             // Agent UUID string
-	Status  string                 `json:"status"`         // Must be one of Agent_status enum
-	Message map[string]interface{} `json:"info,omitempty"` // Partial updates allowed
+// insertUpdate stores a status update, along with the task run it reports if any
+func insertUpdate(ctx context.Context, id uuid.UUID, req *AgentUpdateRequest) error {
+	updateTime := clientTime(req.Time, time.Now())
+	message, err := messageText(req.Message)
+	if err != nil {
+		return err
+	}
+	return pgx.BeginFunc(ctx, db.Pool, func(tx pgx.Tx) error {
+		sql := `
+			INSERT INTO agent_updates (time, Agent_id, status, message)
+			VALUES ($1, $2, $3, $4)
+		`
+		if _, err := tx.Exec(ctx, sql, updateTime, id, req.Status, message); err != nil {
+			return err
+		}
+		if req.Task == nil {
+			return nil
+		}
+		return recordTaskRun(ctx, tx, id, req.Task, updateTime)
+	})
 }
 
 // AgentUpdateHandler updates an existing Agent's status or metadata
@@ -113,36 +233,180 @@ type AgentUpdateRequest struct {
 func AgentUpdateHandler(c *fiber.Ctx) error {
 	var req AgentUpdateRequest
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid request body"})
+		return ingestionError(c, "update", fiber.StatusBadRequest, "invalid request body")
 	}
 
-	id, err := uuid.Parse(req.ID)
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid UUID"})
+	id, msg := validateUpdate(&req)
+	if msg != "" {
+		return ingestionError(c, "update", fiber.StatusBadRequest, msg)
 	}
 
-	// Validate status is provided (if required)
-	if req.Status == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "status is required"})
-	}
-
-	ctx := context.Background()
-	sql := `
-		INSERT INTO agent_updates (Agent_id, status, message)
-		VALUES ($1, $2, $3)
-	`
-	_, err = db.Pool.Exec(ctx, sql, id, req.Status, req.Message)
+	err := insertUpdate(context.Background(), id, &req)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to update Agent status"})
+		logStorageError(c, "failed to insert update", err, "agent_id", id)
+		return ingestionError(c, "update", fiber.StatusInternalServerError, "failed to update Agent status")
 	}
 
 	return c.JSON(fiber.Map{"status": "OK"})
 }
 
+// MaxHeartbeatChecks limits the number of check results accepted in one heartbeat
+const MaxHeartbeatChecks = 100
+
+// HeartbeatCheck result of a status check run by a Agent before its heartbeat
+type HeartbeatCheck struct {
+	Name     string  `json:"name" example:"database"`
+	Status   string  `json:"status" example:"ok"` // ok or fail
+	Critical bool    `json:"critical,omitempty"`  // a failing critical check puts the Agent in error
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_ms" example:"3.2"`
+	Probe    string  `json:"probe,omitempty" example:"http"` // http, tcp, exec or file when a probe produced the result
+	Failures int     `json:"failures,omitempty"`             // failed probe runs in a row
+}
+
+// allowedProbeTypes are the probe types an Agent may report
+var allowedProbeTypes = map[string]bool{"": true, "http": true, "tcp": true, "exec": true, "file": true}
+
+// MaxHostEntries limits the number of disks and network interfaces accepted in a host snapshot
+const MaxHostEntries = 50
+
+// HostSnapshot statistics of the host a Agent runs on, sent along its heartbeat
+type HostSnapshot struct {
+	CPUPercent    *float64      `json:"cpu_percent,omitempty" example:"12.5"` // since the previous snapshot
+	Load1         float64       `json:"load1" example:"0.52"`
+	Load5         float64       `json:"load5" example:"0.38"`
+	Load15        float64       `json:"load15" example:"0.21"`
+	MemTotal      uint64        `json:"mem_total_bytes"`
+	MemAvailable  uint64        `json:"mem_available_bytes"`
+	Disks         []HostDisk    `json:"disks,omitempty"`
+	OpenFDs       int           `json:"open_fds"`
+	UptimeSeconds float64       `json:"uptime_seconds"`
+	Network       []HostNetwork `json:"network,omitempty"`
+	Errors        []string      `json:"errors,omitempty"` // parts the Agent could not read
+}
+
+// HostDisk usage of one filesystem of the host
+type HostDisk struct {
+	Mount string `json:"mount" example:"/"`
+	Total uint64 `json:"total_bytes"`
+	Free  uint64 `json:"free_bytes"`
+}
+
+// HostNetwork counters of one network interface since boot
+type HostNetwork struct {
+	Interface string `json:"interface" example:"eth0"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	TxBytes   uint64 `json:"tx_bytes"`
+}
+
+// validateHost checks the size of a host snapshot. A CPU usage out of range,
+// e.g. after the Agent's counters wrapped, is clamped rather than failing the heartbeat.
+func validateHost(h *HostSnapshot) string {
+	if h == nil {
+		return ""
+	}
+	if len(h.Disks) > MaxHostEntries || len(h.Network) > MaxHostEntries || len(h.Errors) > MaxHostEntries {
+		return "host snapshot too large"
+	}
+	if h.CPUPercent != nil {
+		cpu := min(max(*h.CPUPercent, 0), 100)
+		h.CPUPercent = &cpu
+	}
+	return ""
+}
+
 // AgentHeartbeatRequest Request to send a Agent heartbeat/status
 type AgentHeartbeatRequest struct {
-	ID     string `json:"id" example:"123e4567-e89b-12d3-a456-426614174000"`
-	Status string `json:"status" example:"healthy"`
+	ID     string           `json:"id" example:"123e4567-e89b-12d3-a456-426614174000"`
+	Status string           `json:"status" example:"healthy"`
+	Checks []HeartbeatCheck `json:"checks,omitempty"` // Optional, results of the Agent's status checks
+	Host   *HostSnapshot    `json:"host,omitempty"`   // Optional, statistics of the Agent's host
+	Acks   []DirectiveAck   `json:"acks,omitempty"`   // Optional, directives applied since the previous heartbeat
+
+	ConfigVersion string `json:"config_version,omitempty" example:"t3.a1"` // Optional, version of the configuration the Agent runs
+}
+
+func validateChecks(checks []HeartbeatCheck) string {
+	if len(checks) > MaxHeartbeatChecks {
+		return "too many checks"
+	}
+	for _, check := range checks {
+		if check.Name == "" {
+			return "check name is required"
+		}
+		if check.Status != "ok" && check.Status != "fail" {
+			return "invalid check status"
+		}
+		if !allowedProbeTypes[check.Probe] || check.Failures < 0 {
+			return "invalid check probe"
+		}
+	}
+	return ""
+}
+
+// validateHeartbeat checks a heartbeat request and returns the Agent's ID
+func validateHeartbeat(req *AgentHeartbeatRequest) (uuid.UUID, string) {
+	id, err := uuid.Parse(req.ID)
+	if err != nil {
+		return id, "invalid UUID"
+	}
+	if req.Status == "" {
+		return id, "status is required"
+	}
+	if !allowedAgentStatus[req.Status] {
+		return id, "invalid status value"
+	}
+	if msg := validateChecks(req.Checks); msg != "" {
+		return id, msg
+	}
+	if msg := validateAcks(req.Acks); msg != "" {
+		return id, msg
+	}
+	if len(req.ConfigVersion) > MaxConfigVersionLength {
+		return id, "config version too long"
+	}
+	return id, validateHost(req.Host)
+}
+
+// columns returns the checks and host of the heartbeat to store, NULL rather
+// than an empty JSON array or null
+func (req *AgentHeartbeatRequest) columns() (checks, host any) {
+	if len(req.Checks) > 0 {
+		checks = req.Checks
+	}
+	if req.Host != nil {
+		host = req.Host
+	}
+	return checks, host
+}
+
+// recordHeartbeat stores a heartbeat and its acknowledgements, and returns the
+// directives pending for the Agent along with its configuration version
+func recordHeartbeat(ctx context.Context, id uuid.UUID, req *AgentHeartbeatRequest) (AgentHeartbeatResponse, error) {
+	checks, host := req.columns()
+	resp := AgentHeartbeatResponse{Status: "OK"}
+	err := pgx.BeginFunc(ctx, db.Pool, func(tx pgx.Tx) error {
+		sql := `
+			INSERT INTO agent_heartbeats (Agent_id, status, checks, host)
+			VALUES ($1, $2, $3, $4)
+		`
+		if _, err := tx.Exec(ctx, sql, id, req.Status, checks, host); err != nil {
+			return err
+		}
+		if err := ackDirectives(ctx, tx, id, req.Acks); err != nil {
+			return err
+		}
+		if err := recordConfigVersion(ctx, tx, id, req.ConfigVersion); err != nil {
+			return err
+		}
+		var err error
+		if resp.ConfigVersion, err = currentConfigVersion(ctx, tx, id); err != nil {
+			return err
+		}
+		resp.Directives, err = pendingDirectives(ctx, tx, id)
+		return err
+	})
+	return resp, err
 }
 
 // AgentHeartbeatHandler receives a heartbeat ping from a Agent
@@ -152,37 +416,26 @@ type AgentHeartbeatRequest struct {
 // @Accept json
 // @Produce json
 // @Param request body handlers.AgentHeartbeatRequest true "Agent heartbeat. Possible: `starting`, `healthy`, `working`, `idle`, `error`, `unreachable`, `crashed`, `stopped`, `disabled`"
-// @Success 200 {object} ApiResponse "Success response `{"message":"OK"}`"
+// @Success 200 {object} AgentHeartbeatResponse "Success response, with the directives pending for the Agent"
 // @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
 // @Failure 401 {object} ApiErrorResponse "UNAUTHORIZED - There was an unauthorized attempt to use functionality available only to authorized users. `{"message":"UNAUTHORIZED"}`"
 // @Router /agent/heartbeat [post]
 func AgentHeartbeatHandler(c *fiber.Ctx) error {
 	var req AgentHeartbeatRequest
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid request body"})
+		return ingestionError(c, "heartbeat", fiber.StatusBadRequest, "invalid request body")
 	}
 
-	id, err := uuid.Parse(req.ID)
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid UUID"})
+	id, msg := validateHeartbeat(&req)
+	if msg != "" {
+		return ingestionError(c, "heartbeat", fiber.StatusBadRequest, msg)
 	}
 
-	if req.Status == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "status is required"})
-	}
-	if !allowedAgentStatus[req.Status] {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid status value"})
-	}
-
-	ctx := context.Background()
-	sql := `
-		INSERT INTO agent_heartbeats (Agent_id, status)
-		VALUES ($1, $2)
-	`
-	_, err = db.Pool.Exec(ctx, sql, id, req.Status)
+	resp, err := recordHeartbeat(context.Background(), id, &req)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to insert heartbeat"})
+		logStorageError(c, "failed to insert heartbeat", err, "agent_id", id)
+		return ingestionError(c, "heartbeat", fiber.StatusInternalServerError, "failed to insert heartbeat")
 	}
 
-	return c.JSON(fiber.Map{"status": "OK"})
+	return c.JSON(resp)
 }
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	db "github.com/aphrollo/pulse/storage"
+)
+
+// MaxMetricSamples limits the number of samples accepted in one request
+const MaxMetricSamples = 1000
+
+// MaxMetricBuckets limits the number of time buckets a metrics query spans
+const MaxMetricBuckets = 10000
+
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// MetricSample is one numeric measurement reported by an agent
+type MetricSample struct {
+	Name   string            `json:"name" example:"queue_depth"`
+	Value  float64           `json:"value" example:"42"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Time   time.Time         `json:"time,omitempty"` // Defaults to the time of ingestion
+}
+
+// AgentMetricsRequest Request to push numeric samples for a Agent
+type AgentMetricsRequest struct {
+	ID      string         `json:"id"` // Agent UUID string
+	Samples []MetricSample `json:"samples"`
+}
+
+// validateSample checks a single sample and fills in its timestamp
+func validateSample(s *MetricSample, now time.Time) string {
+	if !metricNamePattern.MatchString(s.Name) {
+		return "invalid metric name"
+	}
+	for k := range s.Labels {
+		if !metricNamePattern.MatchString(k) {
+			return "invalid label name"
+		}
+	}
+	s.Time = clientTime(s.Time, now)
+	return ""
+}
+
+// validateMetrics checks a metrics request, fills in the sample timestamps and returns the Agent's ID
+func validateMetrics(req *AgentMetricsRequest, now time.Time) (uuid.UUID, string) {
+	id, err := uuid.Parse(req.ID)
+	if err != nil {
+		return id, "invalid UUID"
+	}
+	if len(req.Samples) == 0 {
+		return id, "samples are required"
+	}
+	if len(req.Samples) > MaxMetricSamples {
+		return id, "too many samples"
+	}
+	for i := range req.Samples {
+		if msg := validateSample(&req.Samples[i], now); msg != "" {
+			return id, msg
+		}
+	}
+	return id, ""
+}
+
+// AgentMetricsHandler stores numeric samples pushed by a Agent
+// @Summary Push Agent metrics
+// @Description Stores a batch of numeric samples (name, value, labels, optional time) for a Agent
+// @Tags Agent
+// @Accept json
+// @Produce json
+// @Param request body AgentMetricsRequest true "Agent metric samples"
+// @Success 200 {object} ApiResponse "Success response `{"message":"OK"}`"
+// @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
+// @Failure 401 {object} ApiErrorResponse "UNAUTHORIZED - There was an unauthorized attempt to use functionality available only to authorized users. `{"message":"UNAUTHORIZED"}`"
+// @Failure 404 {object} ApiErrorResponse "Agent not found"
+// @Router /agent/metrics [post]
+func AgentMetricsHandler(c *fiber.Ctx) error {
+	var req AgentMetricsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return ingestionError(c, "metrics", fiber.StatusBadRequest, "invalid request body")
+	}
+
+	id, msg := validateMetrics(&req, time.Now())
+	if msg != "" {
+		return ingestionError(c, "metrics", fiber.StatusBadRequest, msg)
+	}
+
+	err := insertSamples(context.Background(), id, req.Samples)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" { // foreign_key_violation
+		return ingestionError(c, "metrics", fiber.StatusNotFound, "agent not found")
+	}
+	if err != nil {
+		logStorageError(c, "failed to insert metrics", err, "agent_id", id)
+		return ingestionError(c, "metrics", fiber.StatusInternalServerError, "failed to insert metrics")
+	}
+
+	return c.JSON(fiber.Map{"status": "OK"})
+}
+
+// insertSamples copies validated samples of one agent into agent_metrics
+func insertSamples(ctx context.Context, id uuid.UUID, samples []MetricSample) error {
+	_, err := db.Pool.CopyFrom(ctx, pgx.Identifier{"agent_metrics"}, sampleColumns,
+		pgx.CopyFromSlice(len(samples), func(i int) ([]any, error) {
+			return sampleRow(id, samples[i]), nil
+		}),
+	)
+	return err
+}
+
+var sampleColumns = []string{"time", "agent_id", "name", "labels", "value"}
+
+// sampleRow is the agent_metrics row of a sample, in sampleColumns order
+func sampleRow(id uuid.UUID, s MetricSample) []any {
+	labels := s.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	return []any{s.Time, id, s.Name, labels, s.Value}
+}
+
+// metricAggregates maps the accepted agg query values to SQL expressions
+var metricAggregates = map[string]string{
+	"avg":   "avg(value)",
+	"min":   "min(value)",
+	"max":   "max(value)",
+	"sum":   "sum(value)",
+	"count": "count(*)::float8",
+	"last":  "last(value, time)",
+}
+
+// MetricPoint is one aggregated bucket of a metric series
+type MetricPoint struct {
+	Time   time.Time         `json:"time"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// AgentMetricsQueryResponse Aggregated samples of one metric
+type AgentMetricsQueryResponse struct {
+	Name   string        `json:"name" example:"queue_depth"`
+	Bucket string        `json:"bucket" example:"1m0s"`
+	Agg    string        `json:"agg" example:"avg"`
+	Points []MetricPoint `json:"points"`
+}
+
+// parseTimeRange reads the from/to query parameters, defaulting to the last hour
+func parseTimeRange(c *fiber.Ctx) (time.Time, time.Time, string) {
+	to := time.Now()
+	from := to.Add(-time.Hour)
+	if v := c.Query("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return from, to, "invalid from"
+		}
+		from = t
+	}
+	if v := c.Query("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return from, to, "invalid to"
+		}
+		to = t
+	}
+	if !from.Before(to) {
+		return from, to, "from must be before to"
+	}
+	return from, to, ""
+}
+
+// AgentMetricsQueryHandler returns a metric of a Agent aggregated into time buckets
+// @Summary Query Agent metrics
+// @Description Aggregates a metric of a Agent with time_bucket, one series per label set
+// @Tags Agent
+// @Produce json
+// @Param id path string true "Agent UUID"
+// @Param name query string true "Metric name"
+// @Param from query string false "Range start (RFC3339), defaults to one hour ago"
+// @Param to query string false "Range end (RFC3339), defaults to now"
+// @Param bucket query string false "Bucket width as a Go duration, defaults to 1m. The range may span at most 10000 buckets"
+// @Param agg query string false "Aggregate: avg, min, max, sum, count or last. Defaults to avg"
+// @Param labels query string false "JSON object the sample labels must contain, e.g. {\"queue\":\"emails\"}"
+// @Success 200 {object} AgentMetricsQueryResponse
+// @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
+// @Router /agents/{id}/metrics [get]
+func AgentMetricsQueryHandler(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid UUID"})
+	}
+
+	name := c.Query("name")
+	if !metricNamePattern.MatchString(name) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid metric name"})
+	}
+
+	from, to, msg := parseTimeRange(c)
+	if msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+
+	bucket := time.Minute
+	if v := c.Query("bucket"); v != "" {
+		bucket, err = time.ParseDuration(v)
+		if err != nil || bucket < time.Second {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid bucket"})
+		}
+	}
+	if to.Sub(from)/bucket > MaxMetricBuckets {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "too many buckets, widen the bucket or narrow the range"})
+	}
+
+	agg := c.Query("agg", "avg")
+	expr, ok := metricAggregates[agg]
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid agg"})
+	}
+
+	labels := map[string]string{}
+	if v := c.Query("labels"); v != "" {
+		if err := json.Unmarshal([]byte(v), &labels); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid labels"})
+		}
+	}
+
+	ctx := context.Background()
+	sql := `
+		SELECT time_bucket(make_interval(secs => $1), time) AS bucket, labels, ` + expr + `
+		FROM agent_metrics
+		WHERE agent_id = $2 AND name = $3 AND labels @> $4 AND time >= $5 AND time < $6
+		GROUP BY bucket, labels
+		ORDER BY bucket, labels
+	`
+	rows, err := db.Pool.Query(ctx, sql, bucket.Seconds(), id, name, labels, from, to)
+	if err != nil {
+		logStorageError(c, "failed to query metrics", err, "agent_id", id)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to query metrics"})
+	}
+	points, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (MetricPoint, error) {
+		var p MetricPoint
+		err := row.Scan(&p.Time, &p.Labels, &p.Value)
+		return p, err
+	})
+	if err != nil {
+		logStorageError(c, "failed to query metrics", err, "agent_id", id)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to query metrics"})
+	}
+
+	return c.JSON(AgentMetricsQueryResponse{
+		Name:   name,
+		Bucket: bucket.String(),
+		Agg:    agg,
+		Points: points,
+	})
+}
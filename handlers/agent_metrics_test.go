@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func TestValidateSample(t *testing.T) {
+	now := time.Now()
+
+	s := MetricSample{Name: "queue_depth", Value: 3, Labels: map[string]string{"queue": "emails"}}
+	if msg := validateSample(&s, now); msg != "" {
+		t.Fatalf("Expected valid sample, got %q", msg)
+	}
+	if !s.Time.Equal(now) {
+		t.Errorf("Expected missing time to default to now, got %v", s.Time)
+	}
+
+	if msg := validateSample(&MetricSample{Name: "queue depth"}, now); msg == "" {
+		t.Errorf("Expected invalid metric name to be rejected")
+	}
+	if msg := validateSample(&MetricSample{Name: "jobs", Labels: map[string]string{"bad-label": "x"}}, now); msg == "" {
+		t.Errorf("Expected invalid label name to be rejected")
+	}
+}
+
+func TestAgentMetricsHandler_Validation(t *testing.T) {
+	app := fiber.New()
+	app.Post("/agent/metrics", AgentMetricsHandler)
+
+	cases := map[string]string{
+		"InvalidJSON":  `{"id": "123e4567-e89b-12d3-a456-426614174000", "samples":`,
+		"InvalidUUID":  `{"id": "not-a-uuid", "samples": [{"name": "jobs", "value": 1}]}`,
+		"NoSamples":    `{"id": "123e4567-e89b-12d3-a456-426614174000", "samples": []}`,
+		"InvalidName":  `{"id": "123e4567-e89b-12d3-a456-426614174000", "samples": [{"name": "", "value": 1}]}`,
+		"InvalidLabel": `{"id": "123e4567-e89b-12d3-a456-426614174000", "samples": [{"name": "jobs", "value": 1, "labels": {"a b": "c"}}]}`,
+	}
+	for name, body := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/agent/metrics", bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, _ := app.Test(req)
+			if resp.StatusCode != fiber.StatusBadRequest {
+				t.Errorf("Expected 400 Bad Request, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// Samples of an unregistered Agent are answered with 404 rather than a storage error
+func TestAgentMetricsHandler_UnknownAgent(t *testing.T) {
+	app := setupApp(t)
+	app.Post("/agent/metrics", AgentMetricsHandler)
+
+	body := `{"id": "` + uuid.NewString() + `", "samples": [{"name": "jobs", "value": 1}]}`
+	req := httptest.NewRequest(http.MethodPost, "/agent/metrics", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("Expected 404 Not Found, got %d", resp.StatusCode)
+	}
+}
+
+func TestAgentMetricsQueryHandler_Validation(t *testing.T) {
+	app := fiber.New()
+	app.Get("/agents/:id/metrics", AgentMetricsQueryHandler)
+
+	cases := map[string]string{
+		"InvalidUUID":    "/agents/not-a-uuid/metrics?name=jobs",
+		"MissingName":    "/agents/123e4567-e89b-12d3-a456-426614174000/metrics",
+		"InvalidBucket":  "/agents/123e4567-e89b-12d3-a456-426614174000/metrics?name=jobs&bucket=soon",
+		"InvalidAgg":     "/agents/123e4567-e89b-12d3-a456-426614174000/metrics?name=jobs&agg=median",
+		"InvalidRange":   "/agents/123e4567-e89b-12d3-a456-426614174000/metrics?name=jobs&from=2025-01-02T00:00:00Z&to=2025-01-01T00:00:00Z",
+		"TooManyBuckets": "/agents/123e4567-e89b-12d3-a456-426614174000/metrics?name=jobs&bucket=1s&from=2025-01-01T00:00:00Z&to=2025-01-02T00:00:00Z",
+	}
+	for name, url := range cases {
+		t.Run(name, func(t *testing.T) {
+			resp, _ := app.Test(httptest.NewRequest(http.MethodGet, url, nil))
+			if resp.StatusCode != fiber.StatusBadRequest {
+				t.Errorf("Expected 400 Bad Request, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestClientTime(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	if got := clientTime(time.Time{}, now); !got.Equal(now) {
+		t.Errorf("Expected missing time to default to now, got %v", got)
+	}
+	replayed := now.Add(-6 * time.Hour)
+	if got := clientTime(replayed, now); !got.Equal(replayed) {
+		t.Errorf("Expected replayed time to be kept, got %v", got)
+	}
+	if got := clientTime(now.Add(30*time.Second), now); !got.Equal(now.Add(30 * time.Second)) {
+		t.Errorf("Expected small clock skew to be tolerated, got %v", got)
+	}
+	if got := clientTime(now.Add(time.Hour), now); !got.Equal(now) {
+		t.Errorf("Expected future time to be clamped to now, got %v", got)
+	}
+}
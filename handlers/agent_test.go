@@ -168,6 +168,41 @@ func TestAgentRegisterHandler_MissingType(t *testing.T) {
 	}
 }
 
+// Registering an existing ID again, as an Agent does after a restart, refreshes the Agent
+func TestAgentRegisterHandler_Reregister(t *testing.T) {
+	app := setupApp(t)
+	id := uuid.NewString()
+	ctx := context.Background()
+	defer db.Pool.Exec(ctx, `DELETE FROM agents WHERE id = $1`, id)
+
+	for _, body := range []string{
+		`{"id":"` + id + `","name":"test-Agent","type":"default"}`,
+		`{"id":"` + id + `","name":"renamed-Agent","type":"default","info":{"version":"2"},"heartbeat_interval":30}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/agent/register", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Error on test request: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 OK, got %d", resp.StatusCode)
+		}
+	}
+
+	var name, version string
+	var interval float64
+	err := db.Pool.QueryRow(ctx,
+		`SELECT name, info->>'version', extract(epoch FROM heartbeat_interval) FROM agents WHERE id = $1`, id,
+	).Scan(&name, &version, &interval)
+	if err != nil {
+		t.Fatalf("Failed to query Agent: %v", err)
+	}
+	if name != "renamed-Agent" || version != "2" || interval != 30 {
+		t.Errorf("Expected the Agent to be refreshed, got name %q, version %q, interval %v", name, version, interval)
+	}
+}
+
 // Agent Update Handler
 func TestAgentUpdateHandler_Success(t *testing.T) {
 	app := setupApp(t) // uses real DB connection
@@ -175,7 +210,7 @@ func TestAgentUpdateHandler_Success(t *testing.T) {
 	payload := AgentUpdateRequest{
 		ID:      "12344567-e89b-12d3-a456-426614174000",
 		Status:  "healthy",
-		Message: "all systems go",
+		Message: map[string]interface{}{"text": "all systems go"},
 	}
 	body, _ := json.Marshal(payload)
 
@@ -209,17 +244,53 @@ func TestAgentUpdateHandler_Success(t *testing.T) {
 	if status != payload.Status {
 		t.Errorf("Expected status %s, got %s", payload.Status, status)
 	}
-	if message != payload.Message {
-		t.Errorf("Expected message %q, got %q", payload.Message, message)
+	wantMessage, _ := json.Marshal(payload.Message)
+	if message != string(wantMessage) {
+		t.Errorf("Expected message %q, got %q", wantMessage, message)
 	}
 
 	// Cleanup test data
-	_, err = db.Pool.Exec(ctx, `DELETE FROM Agent_updates WHERE Agent_id = $1 AND message = $2`, payload.ID, payload.Message)
+	_, err = db.Pool.Exec(ctx, `DELETE FROM Agent_updates WHERE Agent_id = $1 AND message = $2`, payload.ID, string(wantMessage))
 	if err != nil {
 		t.Logf("Cleanup failed: %v", err)
 	}
 }
 
+// The Agent client sends its details as message, older ones as info
+func TestAgentUpdateHandler_Message(t *testing.T) {
+	app := setupApp(t)
+	id := uuid.NewString()
+	ctx := context.Background()
+	if _, err := db.Pool.Exec(ctx, `INSERT INTO agents (id, name, type) VALUES ($1, 'test-Agent', 'default')`, id); err != nil {
+		t.Fatalf("Failed to insert Agent: %v", err)
+	}
+	defer db.Pool.Exec(ctx, `DELETE FROM agents WHERE id = $1`, id)
+
+	for _, field := range []string{"message", "info"} {
+		body := `{"id":"` + id + `","status":"working","` + field + `":{"step":"` + field + `"}}`
+		req := httptest.NewRequest(http.MethodPost, "/agent/update", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Error on test request: %v", err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("Expected status 200 OK, got %d", resp.StatusCode)
+		}
+
+		var step string
+		err = db.Pool.QueryRow(ctx,
+			`SELECT message::jsonb->>'step' FROM agent_updates WHERE agent_id = $1 ORDER BY time DESC LIMIT 1`, id,
+		).Scan(&step)
+		if err != nil {
+			t.Fatalf("Failed to query inserted Agent update: %v", err)
+		}
+		if step != field {
+			t.Errorf("Expected the %s field to be stored, got step %q", field, step)
+		}
+	}
+}
+
 func TestAgentUpdateHandler_InvalidUUID(t *testing.T) {
 	app := setupApp(t)
 
@@ -405,3 +476,31 @@ func TestAgentHeartbeatHandler_EmptyStatus(t *testing.T) {
 		t.Errorf("Expected 400 Bad Request for empty status, got %d", resp.StatusCode)
 	}
 }
+
+func TestMessageText(t *testing.T) {
+	text, err := messageText(map[string]interface{}{"step": "import", "rows": 3})
+	if err != nil || text == nil || *text != `{"rows":3,"step":"import"}` {
+		t.Errorf("Expected the message as JSON text, got %v, %v", text, err)
+	}
+	if text, err := messageText(nil); text != nil || err != nil {
+		t.Errorf("Expected no message, got %v, %v", text, err)
+	}
+}
+
+func TestValidateRegister_HeartbeatInterval(t *testing.T) {
+	defer func(types []string) { AllowedAgentTypes = types }(AllowedAgentTypes)
+	AllowedAgentTypes = []string{"default"}
+	req := AgentRegisterRequest{ID: "123e4567-e89b-12d3-a456-426614174000", Name: "test-Agent", Type: "default"}
+	for _, interval := range []float64{0, 1, 2.5, 24 * 60 * 60} {
+		req.HeartbeatInterval = interval
+		if _, msg := validateRegister(&req); msg != "" {
+			t.Errorf("Expected interval %g to be accepted, got %q", interval, msg)
+		}
+	}
+	for _, interval := range []float64{-1, 0.5, 24*60*60 + 1, 1e7} {
+		req.HeartbeatInterval = interval
+		if _, msg := validateRegister(&req); msg == "" {
+			t.Errorf("Expected interval %g to be rejected", interval)
+		}
+	}
+}
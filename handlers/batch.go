@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/aphrollo/pulse/metrics"
+	db "github.com/aphrollo/pulse/storage"
+)
+
+// MaxBatchItems limits the number of items accepted in one batch
+const MaxBatchItems = 500
+
+// MaxBatchSamples limits the number of metric samples accepted in one batch, all items together
+const MaxBatchSamples = 10 * MaxMetricSamples
+
+// BatchItem one heartbeat, update or metrics push. Type selects the field that is set.
+// Heartbeat acks and config versions are stored as by /agent/heartbeat.
+type BatchItem struct {
+	Type      string                 `json:"type" example:"update"` // heartbeat, update or metrics
+	Heartbeat *AgentHeartbeatRequest `json:"heartbeat,omitempty"`
+	Update    *AgentUpdateRequest    `json:"update,omitempty"`
+	Metrics   *AgentMetricsRequest   `json:"metrics,omitempty"`
+}
+
+// AgentBatchRequest Request to ingest many heartbeats, updates and metrics of one or more Agents at once
+type AgentBatchRequest struct {
+	Items []BatchItem `json:"items"`
+}
+
+// BatchItemResult outcome of one item of a batch, in request order. The last
+// accepted heartbeat of each Agent carries its pending directives and
+// configuration version, like the /agent/heartbeat response.
+type BatchItemResult struct {
+	Status        string      `json:"status" example:"ok"`        // ok or rejected
+	Error         string      `json:"error,omitempty" example:""` // why the item was rejected
+	Directives    []Directive `json:"directives,omitempty"`
+	ConfigVersion string      `json:"config_version,omitempty" example:"t3.a1"`
+}
+
+// AgentBatchResponse per item results of a batch
+type AgentBatchResponse struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []BatchItemResult `json:"results"`
+}
+
+// validateBatchItem checks an item and returns the ID of the Agent it belongs to
+func validateBatchItem(item *BatchItem, now time.Time) (uuid.UUID, string) {
+	switch {
+	case item.Type == "heartbeat" && item.Heartbeat != nil:
+		return validateHeartbeat(item.Heartbeat)
+	case item.Type == "update" && item.Update != nil:
+		return validateUpdate(item.Update)
+	case item.Type == "metrics" && item.Metrics != nil:
+		return validateMetrics(item.Metrics, now)
+	case item.Type == "heartbeat" || item.Type == "update" || item.Type == "metrics":
+		return uuid.Nil, item.Type + " is required"
+	default:
+		return uuid.Nil, "invalid item type"
+	}
+}
+
+// knownAgents returns which of ids are registered
+func knownAgents(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]bool, error) {
+	rows, err := db.Pool.Query(ctx, `SELECT id FROM agents WHERE id = ANY($1)`, ids)
+	if err != nil {
+		return nil, err
+	}
+	known, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[uuid.UUID]bool, len(known))
+	for _, id := range known {
+		m[id] = true
+	}
+	return m, nil
+}
+
+// acceptedItem an item of a batch that passed validation, index is its position in the request
+type acceptedItem struct {
+	id    uuid.UUID
+	item  *BatchItem
+	index int
+}
+
+// insertBatch stores the accepted items in one transaction: one multi-row
+// insert for heartbeats and one for updates, a COPY for metric samples. The
+// directive acks and config versions heartbeats carry are recorded as
+// recordHeartbeat does, and the result of each Agent's last heartbeat gets
+// its pending directives and configuration version.
+func insertBatch(ctx context.Context, items []acceptedItem, results []BatchItemResult, now time.Time) error {
+	var heartbeats, updates []any
+	var acked []acceptedItem
+	lastBeat := map[uuid.UUID]int{}
+	var samples [][]any
+	type taskEvent struct {
+		id   uuid.UUID
+		task *TaskEvent
+		at   time.Time
+	}
+	var tasks []taskEvent
+	for _, it := range items {
+		switch it.item.Type {
+		case "heartbeat":
+			hb := it.item.Heartbeat
+			checks, host := hb.columns()
+			heartbeats = append(heartbeats, it.id, hb.Status, checks, host)
+			if len(hb.Acks) > 0 || hb.ConfigVersion != "" {
+				acked = append(acked, it)
+			}
+			lastBeat[it.id] = it.index
+		case "update":
+			u := it.item.Update
+			at := clientTime(u.Time, now)
+			message, err := messageText(u.Message)
+			if err != nil {
+				return err
+			}
+			updates = append(updates, at, it.id, u.Status, message)
+			if u.Task != nil {
+				tasks = append(tasks, taskEvent{it.id, u.Task, at})
+			}
+		case "metrics":
+			for _, s := range it.item.Metrics.Samples {
+				samples = append(samples, sampleRow(it.id, s))
+			}
+		}
+	}
+
+	return pgx.BeginFunc(ctx, db.Pool, func(tx pgx.Tx) error {
+		if len(heartbeats) > 0 {
+			sql := `INSERT INTO agent_heartbeats (agent_id, status, checks, host) VALUES ` + valuesList(len(heartbeats)/4, 4)
+			if _, err := tx.Exec(ctx, sql, heartbeats...); err != nil {
+				return fmt.Errorf("heartbeats: %w", err)
+			}
+		}
+		for _, it := range acked {
+			hb := it.item.Heartbeat
+			if err := ackDirectives(ctx, tx, it.id, hb.Acks); err != nil {
+				return fmt.Errorf("directive acks: %w", err)
+			}
+			if err := recordConfigVersion(ctx, tx, it.id, hb.ConfigVersion); err != nil {
+				return fmt.Errorf("config versions: %w", err)
+			}
+		}
+		for id, i := range lastBeat {
+			var err error
+			if results[i].ConfigVersion, err = currentConfigVersion(ctx, tx, id); err != nil {
+				return fmt.Errorf("config versions: %w", err)
+			}
+			if results[i].Directives, err = pendingDirectives(ctx, tx, id); err != nil {
+				return fmt.Errorf("directives: %w", err)
+			}
+		}
+		if len(updates) > 0 {
+			sql := `INSERT INTO agent_updates (time, agent_id, status, message) VALUES ` + valuesList(len(updates)/4, 4)
+			if _, err := tx.Exec(ctx, sql, updates...); err != nil {
+				return fmt.Errorf("updates: %w", err)
+			}
+		}
+		for _, t := range tasks {
+			if err := recordTaskRun(ctx, tx, t.id, t.task, t.at); err != nil {
+				return fmt.Errorf("task runs: %w", err)
+			}
+		}
+		if len(samples) > 0 {
+			if _, err := tx.CopyFrom(ctx, pgx.Identifier{"agent_metrics"}, sampleColumns, pgx.CopyFromRows(samples)); err != nil {
+				return fmt.Errorf("metrics: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// valuesList returns the placeholders of a multi-row VALUES clause, e.g. ($1, $2), ($3, $4)
+func valuesList(rows, columns int) string {
+	var b strings.Builder
+	for r := 0; r < rows; r++ {
+		if r > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteByte('(')
+		for c := 0; c < columns; c++ {
+			if c > 0 {
+				b.WriteString(", ")
+			}
+			fmt.Fprintf(&b, "$%d", r*columns+c+1)
+		}
+		b.WriteByte(')')
+	}
+	return b.String()
+}
+
+// AgentBatchHandler ingests heartbeats, updates and metrics of one or more Agents in one request
+// @Summary Batch ingestion
+// @Description Validates every item on its own and stores the valid ones in one transaction. Items of unregistered Agents are rejected. The response lists the outcome of each item in request order.
+// @Tags Agent
+// @Accept json
+// @Produce json
+// @Param request body AgentBatchRequest true "Items, each with a type and the matching heartbeat, update or metrics request"
+// @Success 200 {object} AgentBatchResponse
+// @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
+// @Failure 401 {object} ApiErrorResponse "UNAUTHORIZED - There was an unauthorized attempt to use functionality available only to authorized users. `{"message":"UNAUTHORIZED"}`"
+// @Router /agent/batch [post]
+func AgentBatchHandler(c *fiber.Ctx) error {
+	var req AgentBatchRequest
+	if err := c.BodyParser(&req); err != nil {
+		return ingestionError(c, "batch", fiber.StatusBadRequest, "invalid request body")
+	}
+	if len(req.Items) == 0 {
+		return ingestionError(c, "batch", fiber.StatusBadRequest, "items are required")
+	}
+	if len(req.Items) > MaxBatchItems {
+		return ingestionError(c, "batch", fiber.StatusBadRequest, "too many items")
+	}
+	samples := 0
+	for _, item := range req.Items {
+		if item.Metrics != nil {
+			samples += len(item.Metrics.Samples)
+		}
+	}
+	if samples > MaxBatchSamples {
+		return ingestionError(c, "batch", fiber.StatusBadRequest, "too many samples")
+	}
+
+	now := time.Now()
+	resp := AgentBatchResponse{Results: make([]BatchItemResult, len(req.Items))}
+	ids := make([]uuid.UUID, len(req.Items))
+	var lookup []uuid.UUID
+	for i := range req.Items {
+		id, msg := validateBatchItem(&req.Items[i], now)
+		if msg != "" {
+			resp.Results[i] = BatchItemResult{Status: "rejected", Error: msg}
+			continue
+		}
+		ids[i] = id
+		lookup = append(lookup, id)
+	}
+
+	ctx := context.Background()
+	var accepted []acceptedItem
+	if len(lookup) > 0 {
+		known, err := knownAgents(ctx, lookup)
+		if err != nil {
+			logStorageError(c, "failed to look up batch agents", err)
+			return ingestionError(c, "batch", fiber.StatusInternalServerError, "failed to insert batch")
+		}
+		for i, id := range ids {
+			switch {
+			case resp.Results[i].Status != "":
+			case !known[id]:
+				resp.Results[i] = BatchItemResult{Status: "rejected", Error: "unknown Agent"}
+			default:
+				resp.Results[i].Status = "ok"
+				accepted = append(accepted, acceptedItem{id, &req.Items[i], i})
+			}
+		}
+	}
+
+	if len(accepted) > 0 {
+		if err := insertBatch(ctx, accepted, resp.Results, now); err != nil {
+			logStorageError(c, "failed to insert batch", err, "items", len(accepted))
+			return ingestionError(c, "batch", fiber.StatusInternalServerError, "failed to insert batch")
+		}
+	}
+
+	resp.Accepted = len(accepted)
+	resp.Rejected = len(req.Items) - resp.Accepted
+	if resp.Rejected > 0 {
+		metrics.IngestionErrors.WithLabelValues("batch", "invalid").Add(float64(resp.Rejected))
+	}
+	return c.JSON(resp)
+}
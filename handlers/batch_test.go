@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	db "github.com/aphrollo/pulse/storage"
+)
+
+func TestAgentBatchHandler_Validation(t *testing.T) {
+	app := fiber.New()
+	app.Post("/agent/batch", AgentBatchHandler)
+
+	tooMany := `{"items":[` + strings.Repeat(`{"type":"heartbeat"},`, MaxBatchItems) + `{"type":"heartbeat"}]}`
+	cases := map[string]string{
+		"InvalidJSON": `{"items":`,
+		"NoItems":     `{"items":[]}`,
+		"TooMany":     tooMany,
+	}
+	for name, body := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/agent/batch", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != fiber.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestAgentBatchHandler_RejectsEachItem(t *testing.T) {
+	app := fiber.New()
+	app.Post("/agent/batch", AgentBatchHandler)
+
+	body := `{"items":[
+		{"type":"heartbeat","heartbeat":{"id":"not-a-uuid","status":"healthy"}},
+		{"type":"update","update":{"id":"123e4567-e89b-12d3-a456-426614174000"}},
+		{"type":"update","update":{"id":"123e4567-e89b-12d3-a456-426614174000","status":"sleepy"}},
+		{"type":"metrics"},
+		{"type":"log"}
+	]}`
+	req := httptest.NewRequest(http.MethodPost, "/agent/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	var result AgentBatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"invalid UUID", "status is required", "invalid status value", "metrics is required", "invalid item type"}
+	if result.Accepted != 0 || result.Rejected != 5 || len(result.Results) != 5 {
+		t.Fatalf("Expected 5 rejected items, got %+v", result)
+	}
+	for i, r := range result.Results {
+		if r.Status != "rejected" || r.Error != want[i] {
+			t.Errorf("Expected item %d rejected with %q, got %+v", i, want[i], r)
+		}
+	}
+}
+
+// Valid items are stored with one multi-row insert per table, invalid ones don't fail the batch
+func TestAgentBatchHandler_Mixed(t *testing.T) {
+	app := setupApp(t)
+	app.Post("/agent/batch", AgentBatchHandler)
+	id := uuid.NewString()
+	ctx := context.Background()
+	if _, err := db.Pool.Exec(ctx, `INSERT INTO agents (id, name, type) VALUES ($1, 'test-Agent', 'default')`, id); err != nil {
+		t.Fatalf("Failed to insert Agent: %v", err)
+	}
+	defer db.Pool.Exec(ctx, `DELETE FROM agents WHERE id = $1`, id)
+
+	body := `{"items":[
+		{"type":"heartbeat","heartbeat":{"id":"` + id + `","status":"healthy"}},
+		{"type":"update","update":{"id":"` + id + `","status":"working","message":{"step":"import"}}},
+		{"type":"update","update":{"id":"` + id + `","status":"sleepy"}},
+		{"type":"heartbeat","heartbeat":{"id":"` + id + `","status":"idle"}},
+		{"type":"update","update":{"id":"` + id + `","status":"idle"}},
+		{"type":"heartbeat","heartbeat":{"id":"` + uuid.NewString() + `","status":"healthy"}},
+		{"type":"metrics","metrics":{"id":"` + id + `","samples":[{"name":"queue_depth","value":3}]}}
+	]}`
+	req := httptest.NewRequest(http.MethodPost, "/agent/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var result AgentBatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Accepted != 5 || result.Rejected != 2 {
+		t.Fatalf("Expected 5 accepted and 2 rejected items, got %+v", result)
+	}
+	if r := result.Results[2]; r.Error != "invalid status value" {
+		t.Errorf("Expected the unknown status to be rejected, got %+v", r)
+	}
+	if r := result.Results[5]; r.Error != "unknown Agent" {
+		t.Errorf("Expected the unregistered Agent to be rejected, got %+v", r)
+	}
+
+	var heartbeats, updates, samples int
+	err = db.Pool.QueryRow(ctx, `
+		SELECT (SELECT count(*) FROM agent_heartbeats WHERE agent_id = $1),
+		       (SELECT count(*) FROM agent_updates WHERE agent_id = $1),
+		       (SELECT count(*) FROM agent_metrics WHERE agent_id = $1)`, id,
+	).Scan(&heartbeats, &updates, &samples)
+	if err != nil {
+		t.Fatalf("Failed to count stored items: %v", err)
+	}
+	if heartbeats != 2 || updates != 2 || samples != 1 {
+		t.Errorf("Expected 2 heartbeats, 2 updates and 1 sample, got %d, %d and %d", heartbeats, updates, samples)
+	}
+
+	var step string
+	err = db.Pool.QueryRow(ctx, `
+		SELECT message::jsonb->>'step' FROM agent_updates
+		WHERE agent_id = $1 AND status = 'working'`, id,
+	).Scan(&step)
+	if err != nil {
+		t.Fatalf("Failed to read the stored message: %v", err)
+	}
+	if step != "import" {
+		t.Errorf("Expected the stored message step to be import, got %q", step)
+	}
+}
+
+func TestValidateBatchItem_Metrics(t *testing.T) {
+	now := time.Now()
+	item := BatchItem{Type: "metrics", Metrics: &AgentMetricsRequest{
+		ID:      "123e4567-e89b-12d3-a456-426614174000",
+		Samples: []MetricSample{{Name: "queue_depth", Value: 3}},
+	}}
+	id, msg := validateBatchItem(&item, now)
+	if msg != "" || id.String() != item.Metrics.ID {
+		t.Fatalf("Expected a valid item, got %q", msg)
+	}
+	if !item.Metrics.Samples[0].Time.Equal(now) {
+		t.Errorf("Expected the sample time to be filled in, got %v", item.Metrics.Samples[0].Time)
+	}
+
+	item.Metrics.Samples[0].Name = "queue depth"
+	if _, msg := validateBatchItem(&item, now); msg != "invalid metric name" {
+		t.Errorf("Expected an invalid metric name, got %q", msg)
+	}
+}
+
+func TestValuesList(t *testing.T) {
+	if got := valuesList(2, 3); got != "($1, $2, $3), ($4, $5, $6)" {
+		t.Errorf("Unexpected values list %s", got)
+	}
+	if got := valuesList(1, 1); got != "($1)" {
+		t.Errorf("Unexpected values list %s", got)
+	}
+}
+
+// Directive acks and config versions carried by batched heartbeats are recorded
+func TestAgentBatchHandler_HeartbeatAcks(t *testing.T) {
+	app := setupApp(t)
+	app.Post("/agent/batch", AgentBatchHandler)
+	id := uuid.NewString()
+	ctx := context.Background()
+	if _, err := db.Pool.Exec(ctx, `INSERT INTO agents (id, name, type) VALUES ($1, 'test-Agent', 'default')`, id); err != nil {
+		t.Fatalf("Failed to insert Agent: %v", err)
+	}
+	defer db.Pool.Exec(ctx, `DELETE FROM agents WHERE id = $1`, id)
+	directive := uuid.NewString()
+	_, err := db.Pool.Exec(ctx, `INSERT INTO agent_directives (id, agent_id, type, payload) VALUES ($1, $2, 'set_interval', '{"interval": 45}')`, directive, id)
+	if err != nil {
+		t.Fatalf("Failed to insert directive: %v", err)
+	}
+
+	body := `{"items":[
+		{"type":"heartbeat","heartbeat":{"id":"` + id + `","status":"healthy","acks":[{"id":"` + directive + `"}],"config_version":"1.0"}}
+	]}`
+	req := httptest.NewRequest(http.MethodPost, "/agent/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	var acked bool
+	var interval float64
+	var version *string
+	err = db.Pool.QueryRow(ctx, `
+		SELECT d.acked IS NOT NULL, extract(epoch FROM a.heartbeat_interval), a.config_version
+		FROM agent_directives d JOIN agents a ON a.id = d.agent_id
+		WHERE d.id = $1`, directive,
+	).Scan(&acked, &interval, &version)
+	if err != nil {
+		t.Fatalf("Failed to read the directive: %v", err)
+	}
+	if !acked || interval != 45 {
+		t.Errorf("Expected the directive to be acked and applied, got acked %v and interval %v", acked, interval)
+	}
+	if version == nil || *version != "1.0" {
+		t.Errorf("Expected config version 1.0, got %v", version)
+	}
+}
+
+// The last heartbeat of an Agent in a batch returns its pending directives and config version
+func TestAgentBatchHandler_HeartbeatDirectives(t *testing.T) {
+	app := setupApp(t)
+	app.Post("/agent/batch", AgentBatchHandler)
+	id := uuid.NewString()
+	ctx := context.Background()
+	if _, err := db.Pool.Exec(ctx, `INSERT INTO agents (id, name, type) VALUES ($1, 'test-Agent', 'default')`, id); err != nil {
+		t.Fatalf("Failed to insert Agent: %v", err)
+	}
+	defer db.Pool.Exec(ctx, `DELETE FROM agents WHERE id = $1`, id)
+	directive := uuid.NewString()
+	_, err := db.Pool.Exec(ctx, `INSERT INTO agent_directives (id, agent_id, type, payload) VALUES ($1, $2, 'set_interval', '{"interval": 45}')`, directive, id)
+	if err != nil {
+		t.Fatalf("Failed to insert directive: %v", err)
+	}
+
+	body := `{"items":[
+		{"type":"heartbeat","heartbeat":{"id":"` + id + `","status":"healthy"}},
+		{"type":"update","update":{"id":"` + id + `","status":"working"}},
+		{"type":"heartbeat","heartbeat":{"id":"` + id + `","status":"idle"}}
+	]}`
+	req := httptest.NewRequest(http.MethodPost, "/agent/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var result AgentBatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if r := result.Results[0]; len(r.Directives) != 0 || r.ConfigVersion != "" {
+		t.Errorf("Expected only the last heartbeat to carry directives, got %+v", r)
+	}
+	r := result.Results[2]
+	if len(r.Directives) != 1 || r.Directives[0].ID != directive {
+		t.Errorf("Expected the pending directive along the last heartbeat, got %+v", r.Directives)
+	}
+	if r.ConfigVersion == "" {
+		t.Errorf("Expected the config version along the last heartbeat")
+	}
+}
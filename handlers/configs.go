@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	db "github.com/aphrollo/pulse/storage"
+	"github.com/aphrollo/pulse/templates"
+)
+
+// MaxConfigVersionLength limits the config version an Agent reports
+const MaxConfigVersionLength = 64
+
+// configHistoryLimit is the number of versions returned by the config history
+const configHistoryLimit = 50
+
+// configScopes maps the scopes of the admin routes to the stored ones
+var configScopes = map[string]string{"types": "type", "agents": "agent"}
+
+// ConfigDocument one version of a configuration document
+type ConfigDocument struct {
+	Scope    string          `json:"scope" example:"type"` // type or agent
+	Target   string          `json:"target" example:"worker"`
+	Version  int             `json:"version" example:"3"`
+	Document json.RawMessage `json:"document" swaggertype:"object"`
+	Created  time.Time       `json:"created"`
+}
+
+// AgentConfigResponse effective configuration of a Agent: its type's document with its own merged over it
+type AgentConfigResponse struct {
+	Version string                 `json:"version" example:"t3.a1"` // latest type and agent document versions, 0 when there is none
+	Config  map[string]interface{} `json:"config"`
+}
+
+// configVersion names the effective configuration built from a type and an agent document version
+func configVersion(typeVersion, agentVersion int) string {
+	return fmt.Sprintf("t%d.a%d", typeVersion, agentVersion)
+}
+
+// mergeConfig returns base with override merged over it. Nested objects are
+// merged, any other value in override replaces the one in base.
+func mergeConfig(base, override map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(override))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range override {
+		if o, ok := v.(map[string]interface{}); ok {
+			if b, ok := merged[k].(map[string]interface{}); ok {
+				merged[k] = mergeConfig(b, o)
+				continue
+			}
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// queryRower is satisfied by the pool and by transactions
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// latestConfigSQL selects the latest type and agent config versions of the agent aliased a
+const latestConfigSQL = `
+	COALESCE((SELECT max(version) FROM agent_configs WHERE scope = 'type' AND target = a.type), 0),
+	COALESCE((SELECT max(version) FROM agent_configs WHERE scope = 'agent' AND target = a.id::text), 0)
+`
+
+// currentConfigVersion returns the version of the agent's effective configuration
+func currentConfigVersion(ctx context.Context, q queryRower, id uuid.UUID) (string, error) {
+	var typeVersion, agentVersion int
+	err := q.QueryRow(ctx, `SELECT `+latestConfigSQL+` FROM agents a WHERE a.id = $1`, id).Scan(&typeVersion, &agentVersion)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errAgentNotFound
+	}
+	return configVersion(typeVersion, agentVersion), err
+}
+
+// recordConfigVersion stores the configuration version an agent reported it applied, if any
+func recordConfigVersion(ctx context.Context, tx pgx.Tx, id uuid.UUID, version string) error {
+	if version == "" {
+		return nil
+	}
+	sql := `UPDATE agents SET config_version = $2 WHERE id = $1 AND config_version IS DISTINCT FROM $2`
+	_, err := tx.Exec(ctx, sql, id, version)
+	return err
+}
+
+// effectiveConfig builds the configuration of an agent from the latest documents of its type and its own
+func effectiveConfig(ctx context.Context, q queryRower, id uuid.UUID) (AgentConfigResponse, error) {
+	sql := `
+		SELECT COALESCE(t.version, 0), t.document, COALESCE(o.version, 0), o.document
+		FROM agents a
+		LEFT JOIN LATERAL (
+			SELECT version, document FROM agent_configs
+			WHERE scope = 'type' AND target = a.type
+			ORDER BY version DESC LIMIT 1
+		) t ON true
+		LEFT JOIN LATERAL (
+			SELECT version, document FROM agent_configs
+			WHERE scope = 'agent' AND target = a.id::text
+			ORDER BY version DESC LIMIT 1
+		) o ON true
+		WHERE a.id = $1
+	`
+	var typeVersion, agentVersion int
+	var typeDoc, agentDoc map[string]interface{}
+	err := q.QueryRow(ctx, sql, id).Scan(&typeVersion, &typeDoc, &agentVersion, &agentDoc)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return AgentConfigResponse{}, errAgentNotFound
+	}
+	if err != nil {
+		return AgentConfigResponse{}, err
+	}
+	return AgentConfigResponse{
+		Version: configVersion(typeVersion, agentVersion),
+		Config:  mergeConfig(typeDoc, agentDoc),
+	}, nil
+}
+
+// etagMatches reports whether an If-None-Match header lists etag
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// AgentConfigHandler returns the effective configuration of a Agent
+// @Summary Agent configuration
+// @Description Effective configuration of a Agent: the latest document of its type with its own latest document merged over it. The ETag is the version; send it in If-None-Match to get 304 while it is unchanged.
+// @Tags Agent
+// @Produce json
+// @Param id path string true "Agent UUID"
+// @Param If-None-Match header string false "ETag of the configuration the Agent has"
+// @Success 200 {object} AgentConfigResponse
+// @Success 304 "Not modified"
+// @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
+// @Failure 404 {object} ApiErrorResponse "NOT_FOUND - The Agent does not exist. `{"message":"NOT_FOUND"}`"
+// @Router /agent/config/{id} [get]
+func AgentConfigHandler(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return ingestionError(c, "config", fiber.StatusBadRequest, "invalid UUID")
+	}
+
+	cfg, err := effectiveConfig(context.Background(), db.Pool, id)
+	if errors.Is(err, errAgentNotFound) {
+		return ingestionError(c, "config", fiber.StatusNotFound, "agent not found")
+	}
+	if err != nil {
+		logStorageError(c, "failed to load agent config", err, "agent_id", id)
+		return ingestionError(c, "config", fiber.StatusInternalServerError, "failed to load config")
+	}
+
+	etag := `"` + cfg.Version + `"`
+	c.Set(fiber.HeaderETag, etag)
+	if etagMatches(c.Get(fiber.HeaderIfNoneMatch), etag) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	return c.JSON(cfg)
+}
+
+// AdminPutConfigHandler stores a new version of a configuration document
+// @Summary Update configuration
+// @Description Stores the body as the next version of the configuration document of an Agent type or of a single Agent. Agents pick it up on their next heartbeat.
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param scope path string true "types or agents"
+// @Param target path string true "Agent type or Agent UUID"
+// @Param request body object true "Configuration document, a JSON object"
+// @Success 201 {object} ConfigDocument
+// @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
+// @Failure 401 {object} ApiErrorResponse "UNAUTHORIZED - There was an unauthorized attempt to use functionality available only to authorized users. `{"message":"UNAUTHORIZED"}`"
+// @Failure 404 {object} ApiErrorResponse "NOT_FOUND - The Agent does not exist. `{"message":"NOT_FOUND"}`"
+// @Failure 409 {object} ApiErrorResponse "CONFLICT - Another version was stored at the same time, retry. `{"message":"CONFLICT"}`"
+// @Router /admin/configs/{scope}/{target} [put]
+func AdminPutConfigHandler(c *fiber.Ctx) error {
+	scope, target, msg := configTarget(c)
+	if msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(c.Body(), &document); err != nil || document == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "the document must be a JSON object"})
+	}
+
+	ctx := context.Background()
+	if scope == "agent" {
+		var exists bool
+		if err := db.Pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM agents WHERE id = $1)`, target).Scan(&exists); err != nil {
+			logStorageError(c, "failed to look up agent", err, "agent_id", target)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to store config"})
+		}
+		if !exists {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "agent not found"})
+		}
+	}
+
+	d := ConfigDocument{Scope: scope, Target: target, Document: c.Body()}
+	sql := `
+		INSERT INTO agent_configs (scope, target, version, document)
+		SELECT $1, $2, COALESCE(max(version), 0) + 1, $3
+		FROM agent_configs WHERE scope = $1 AND target = $2
+		RETURNING version, created
+	`
+	err := db.Pool.QueryRow(ctx, sql, scope, target, document).Scan(&d.Version, &d.Created)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" { // unique_violation
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "another version was stored at the same time"})
+	}
+	if err != nil {
+		logStorageError(c, "failed to store config", err, "scope", scope, "target", target)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to store config"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(d)
+}
+
+// AdminConfigHistoryHandler lists the versions of a configuration document
+// @Summary Configuration history
+// @Description The latest 50 versions of the configuration document of an Agent type or of a single Agent, newest first
+// @Tags Admin
+// @Produce json
+// @Param scope path string true "types or agents"
+// @Param target path string true "Agent type or Agent UUID"
+// @Success 200 {array} ConfigDocument
+// @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
+// @Failure 401 {object} ApiErrorResponse "UNAUTHORIZED - There was an unauthorized attempt to use functionality available only to authorized users. `{"message":"UNAUTHORIZED"}`"
+// @Router /admin/configs/{scope}/{target} [get]
+func AdminConfigHistoryHandler(c *fiber.Ctx) error {
+	scope, target, msg := configTarget(c)
+	if msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+
+	sql := `
+		SELECT scope, target, version, document, created
+		FROM agent_configs
+		WHERE scope = $1 AND target = $2
+		ORDER BY version DESC
+		LIMIT $3
+	`
+	rows, err := db.Pool.Query(context.Background(), sql, scope, target, configHistoryLimit)
+	if err != nil {
+		logStorageError(c, "failed to list configs", err, "scope", scope, "target", target)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to list configs"})
+	}
+	history, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (ConfigDocument, error) {
+		var d ConfigDocument
+		err := row.Scan(&d.Scope, &d.Target, &d.Version, &d.Document, &d.Created)
+		return d, err
+	})
+	if err != nil {
+		logStorageError(c, "failed to list configs", err, "scope", scope, "target", target)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to list configs"})
+	}
+
+	return c.JSON(history)
+}
+
+// configTarget reads and checks the scope and target route parameters
+func configTarget(c *fiber.Ctx) (scope, target, msg string) {
+	scope, ok := configScopes[c.Params("scope")]
+	if !ok {
+		return "", "", "scope must be types or agents"
+	}
+	target = c.Params("target")
+	if scope == "agent" {
+		id, err := uuid.Parse(target)
+		if err != nil {
+			return "", "", "invalid UUID"
+		}
+		target = id.String()
+	} else if !isAllowedAgentType(target) {
+		return "", "", "invalid Agent type"
+	}
+	return scope, target, ""
+}
+
+// configRows lists every agent with the config version it runs and the latest one
+func configRows(ctx context.Context) ([]templates.ConfigRow, error) {
+	sql := `
+		SELECT a.id::text, a.name, COALESCE(a.type, ''), COALESCE(a.config_version, ''),
+		` + latestConfigSQL + `
+		FROM agents a
+		ORDER BY a.name
+	`
+	rows, err := db.Pool.Query(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (templates.ConfigRow, error) {
+		var r templates.ConfigRow
+		var typeVersion, agentVersion int
+		err := row.Scan(&r.ID, &r.Name, &r.Type, &r.Running, &typeVersion, &agentVersion)
+		r.Latest = configVersion(typeVersion, agentVersion)
+		return r, err
+	})
+}
+
+// ConfigVersionsHandler renders the config version of every Agent
+// @Summary Config versions
+// @Description HTML fragment with the configuration version each Agent runs next to the latest one, loaded by the dashboard
+// @Tags Dashboard
+// @Produce html
+// @Success 200 {string} string "HTML content"
+// @Router /dashboard/configs [get]
+func ConfigVersionsHandler(c *fiber.Ctx) error {
+	rows, err := configRows(context.Background())
+	if err != nil {
+		logStorageError(c, "failed to list config versions", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("failed to list config versions")
+	}
+	return adaptor.HTTPHandler(
+		templ.Handler(templates.ConfigVersions(rows)),
+	)(c)
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	db "github.com/aphrollo/pulse/storage"
+)
+
+func TestMergeConfig(t *testing.T) {
+	base := map[string]interface{}{
+		"interval": 30.0,
+		"log":      map[string]interface{}{"level": "info", "format": "json"},
+		"targets":  []interface{}{"a", "b"},
+	}
+	override := map[string]interface{}{
+		"log":     map[string]interface{}{"level": "debug"},
+		"targets": []interface{}{"c"},
+		"extra":   true,
+	}
+	want := map[string]interface{}{
+		"interval": 30.0,
+		"log":      map[string]interface{}{"level": "debug", "format": "json"},
+		"targets":  []interface{}{"c"},
+		"extra":    true,
+	}
+	if got := mergeConfig(base, override); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if base["log"].(map[string]interface{})["level"] != "info" {
+		t.Error("Expected the base document to be left unchanged")
+	}
+	if got := mergeConfig(nil, nil); len(got) != 0 {
+		t.Errorf("Expected an empty config, got %v", got)
+	}
+}
+
+func TestConfigVersion(t *testing.T) {
+	if got := configVersion(3, 0); got != "t3.a0" {
+		t.Errorf("Expected t3.a0, got %s", got)
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	cases := map[string]bool{
+		`"t1.a2"`:          true,
+		`W/"t1.a2"`:        true,
+		`"t1.a1", "t1.a2"`: true,
+		`*`:                true,
+		`"t1.a1"`:          false,
+		``:                 false,
+	}
+	for header, want := range cases {
+		if got := etagMatches(header, `"t1.a2"`); got != want {
+			t.Errorf("Expected %q to match: %v, got %v", header, want, got)
+		}
+	}
+}
+
+func TestConfigHandlers_Validation(t *testing.T) {
+	AllowedAgentTypes = []string{"worker"}
+	app := fiber.New()
+	app.Get("/agent/config/:id", AgentConfigHandler)
+	app.Get("/admin/configs/:scope/:target", AdminConfigHistoryHandler)
+	app.Put("/admin/configs/:scope/:target", AdminPutConfigHandler)
+
+	cases := map[string]struct{ method, url, body string }{
+		"ConfigInvalidAgentID": {http.MethodGet, "/agent/config/nope", ""},
+		"HistoryInvalidScope":  {http.MethodGet, "/admin/configs/hosts/worker", ""},
+		"HistoryInvalidType":   {http.MethodGet, "/admin/configs/types/unknown", ""},
+		"PutInvalidAgentID":    {http.MethodPut, "/admin/configs/agents/nope", `{}`},
+		"PutInvalidJSON":       {http.MethodPut, "/admin/configs/types/worker", `{"interval":`},
+		"PutNotAnObject":       {http.MethodPut, "/admin/configs/types/worker", `[1, 2]`},
+		"PutNull":              {http.MethodPut, "/admin/configs/types/worker", `null`},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != fiber.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestValidateHeartbeat_ConfigVersion(t *testing.T) {
+	req := AgentHeartbeatRequest{ID: "123e4567-e89b-12d3-a456-426614174000", Status: "healthy", ConfigVersion: "t1.a0"}
+	if _, msg := validateHeartbeat(&req); msg != "" {
+		t.Errorf("Expected a valid heartbeat, got %q", msg)
+	}
+	req.ConfigVersion = strings.Repeat("t", MaxConfigVersionLength+1)
+	if _, msg := validateHeartbeat(&req); msg == "" {
+		t.Error("Expected a too long config version to be rejected")
+	}
+}
+
+func TestAgentConfigHandler_Versions(t *testing.T) {
+	app := setupApp(t)
+	app.Get("/agent/config/:id", AgentConfigHandler)
+	app.Put("/admin/configs/:scope/:target", AdminPutConfigHandler)
+	id := uuid.NewString()
+	ctx := context.Background()
+	if _, err := db.Pool.Exec(ctx, `INSERT INTO agents (id, name, type) VALUES ($1, 'test-Agent', 'default')`, id); err != nil {
+		t.Fatalf("Failed to insert Agent: %v", err)
+	}
+	defer db.Pool.Exec(ctx, `DELETE FROM agents WHERE id = $1`, id)
+	defer db.Pool.Exec(ctx, `DELETE FROM agent_configs WHERE scope = 'agent' AND target = $1`, id)
+
+	put := func(document string) ConfigDocument {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPut, "/admin/configs/agents/"+id, strings.NewReader(document))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != fiber.StatusCreated {
+			t.Fatalf("Expected status 201, got %d", resp.StatusCode)
+		}
+		var d ConfigDocument
+		if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	get := func(etag string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/agent/config/"+id, nil)
+		if etag != "" {
+			req.Header.Set(fiber.HeaderIfNoneMatch, etag)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if d := put(`{"interval": 30}`); d.Version != 1 {
+		t.Errorf("Expected version 1, got %d", d.Version)
+	}
+	if d := put(`{"interval": 60}`); d.Version != 2 {
+		t.Errorf("Expected version 2, got %d", d.Version)
+	}
+
+	resp := get("")
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var cfg AgentConfigResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(cfg.Version, ".a2") || cfg.Config["interval"] != float64(60) {
+		t.Errorf("Expected the latest agent document, got %+v", cfg)
+	}
+	etag := resp.Header.Get(fiber.HeaderETag)
+	if etag != `"`+cfg.Version+`"` {
+		t.Errorf("Expected the ETag to be the version, got %s", etag)
+	}
+
+	if resp := get(etag); resp.StatusCode != fiber.StatusNotModified {
+		t.Errorf("Expected status 304 for an unchanged config, got %d", resp.StatusCode)
+	}
+	put(`{"interval": 90}`)
+	if resp := get(etag); resp.StatusCode != fiber.StatusOK {
+		t.Errorf("Expected status 200 once a new version is stored, got %d", resp.StatusCode)
+	}
+}
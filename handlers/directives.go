@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	db "github.com/aphrollo/pulse/storage"
+)
+
+// MaxDirectivesPerHeartbeat limits the directives sent along one heartbeat response, the oldest go first
+const MaxDirectivesPerHeartbeat = 20
+
+// Bounds of the heartbeat interval a set_interval directive may set, or an Agent register with, in seconds
+const (
+	MinDirectiveInterval = 1
+	MaxDirectiveInterval = 24 * 60 * 60
+)
+
+// MaxHeartbeatAcks limits the directive acknowledgements accepted in one heartbeat
+const MaxHeartbeatAcks = 100
+
+// Directive an instruction for a Agent, sent along every heartbeat response until the Agent acknowledges it
+type Directive struct {
+	ID      string          `json:"id" example:"7b0e2c1a-3f4d-4e5f-8a9b-0c1d2e3f4a5b"`
+	Type    string          `json:"type" example:"set_interval"` // set_interval, maintenance, disable, reregister, run_task or restart
+	Payload json.RawMessage `json:"payload,omitempty" swaggertype:"object"`
+}
+
+// DirectiveAck acknowledgement of a directive, sent by the Agent along its next heartbeat
+type DirectiveAck struct {
+	ID    string `json:"id" example:"7b0e2c1a-3f4d-4e5f-8a9b-0c1d2e3f4a5b"`
+	Error string `json:"error,omitempty"` // Set when the Agent could not apply the directive
+}
+
+// AgentHeartbeatResponse Response to a heartbeat, with the directives pending for the Agent
+type AgentHeartbeatResponse struct {
+	Status     string      `json:"status" example:"OK"`
+	Directives []Directive `json:"directives,omitempty"`
+
+	ConfigVersion string `json:"config_version,omitempty" example:"t3.a1"` // Version of the Agent's current configuration, fetch it when it differs from the one the Agent runs
+}
+
+// Directive payloads, by type
+type (
+	// IntervalDirective payload of set_interval
+	IntervalDirective struct {
+		Interval float64 `json:"interval" example:"30"` // Heartbeat interval in seconds, from 1 to 86400
+	}
+	// MaintenanceDirective payload of maintenance
+	MaintenanceDirective struct {
+		Enabled bool `json:"enabled"` // Enter or leave maintenance
+	}
+	// RunTaskDirective payload of run_task
+	RunTaskDirective struct {
+		Name string                 `json:"name" example:"reindex"`
+		Args map[string]interface{} `json:"args,omitempty"`
+	}
+)
+
+// validateDirective checks the payload matches the directive type
+func validateDirective(typ string, payload json.RawMessage) string {
+	decode := func(v any) bool {
+		return len(payload) > 0 && json.Unmarshal(payload, v) == nil
+	}
+	switch typ {
+	case "set_interval":
+		var p IntervalDirective
+		if !decode(&p) || p.Interval < MinDirectiveInterval || p.Interval > MaxDirectiveInterval {
+			return "set_interval requires an interval between 1s and 24h"
+		}
+	case "maintenance":
+		var p MaintenanceDirective
+		if !decode(&p) {
+			return "maintenance requires enabled"
+		}
+	case "run_task":
+		var p RunTaskDirective
+		if !decode(&p) || p.Name == "" {
+			return "run_task requires a task name"
+		}
+	case "disable", "reregister", "restart":
+	default:
+		return "invalid directive type"
+	}
+	return ""
+}
+
+func validateAcks(acks []DirectiveAck) string {
+	if len(acks) > MaxHeartbeatAcks {
+		return "too many acks"
+	}
+	for _, ack := range acks {
+		if _, err := uuid.Parse(ack.ID); err != nil {
+			return "invalid directive id"
+		}
+	}
+	return ""
+}
+
+// ackDirectives marks the acknowledged directives of an agent. A successful
+// set_interval also becomes the agent's declared heartbeat interval.
+func ackDirectives(ctx context.Context, tx pgx.Tx, agentID uuid.UUID, acks []DirectiveAck) error {
+	if len(acks) == 0 {
+		return nil
+	}
+	ids := make([]uuid.UUID, len(acks))
+	errs := make([]string, len(acks))
+	for i, ack := range acks {
+		ids[i], errs[i] = uuid.MustParse(ack.ID), ack.Error
+	}
+
+	sql := `
+		WITH acked AS (
+			UPDATE agent_directives d SET acked = now(), error = NULLIF(a.error, '')
+			FROM unnest($2::uuid[], $3::text[]) AS a(id, error)
+			WHERE d.id = a.id AND d.agent_id = $1 AND d.acked IS NULL
+			RETURNING d.type, d.payload, d.error
+		)
+		UPDATE agents SET heartbeat_interval = make_interval(secs => (acked.payload->>'interval')::float8)
+		FROM acked
+		WHERE agents.id = $1 AND acked.type = 'set_interval' AND acked.error IS NULL
+	`
+	_, err := tx.Exec(ctx, sql, agentID, ids, errs)
+	return err
+}
+
+// pendingDirectives returns the unacknowledged directives of an agent, oldest first, marking them delivered
+func pendingDirectives(ctx context.Context, tx pgx.Tx, agentID uuid.UUID) ([]Directive, error) {
+	sql := `
+		UPDATE agent_directives SET delivered = COALESCE(delivered, now())
+		WHERE id IN (
+			SELECT id FROM agent_directives
+			WHERE agent_id = $1 AND acked IS NULL
+			ORDER BY created
+			LIMIT $2
+		)
+		RETURNING id::text, type, payload, created
+	`
+	rows, err := tx.Query(ctx, sql, agentID, MaxDirectivesPerHeartbeat)
+	if err != nil {
+		return nil, err
+	}
+	type row struct {
+		d       Directive
+		created time.Time
+	}
+	pending, err := pgx.CollectRows(rows, func(r pgx.CollectableRow) (row, error) {
+		var p row
+		err := r.Scan(&p.d.ID, &p.d.Type, &p.d.Payload, &p.created)
+		return p, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// RETURNING doesn't keep the subquery's order
+	sort.Slice(pending, func(i, j int) bool { return pending[i].created.Before(pending[j].created) })
+	directives := make([]Directive, len(pending))
+	for i, p := range pending {
+		directives[i] = p.d
+	}
+	return directives, nil
+}
+
+// DirectiveRequest Request to issue a directive to a Agent
+type DirectiveRequest struct {
+	Type    string          `json:"type" example:"set_interval"` // set_interval, maintenance, disable, reregister, run_task or restart
+	Payload json.RawMessage `json:"payload,omitempty" swaggertype:"object"`
+}
+
+// DirectiveStatus a directive and how far it got
+type DirectiveStatus struct {
+	Directive
+	Status    string     `json:"status" example:"acked"` // pending, delivered, acked or failed
+	Created   time.Time  `json:"created"`
+	Delivered *time.Time `json:"delivered,omitempty"`
+	Acked     *time.Time `json:"acked,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// AdminCreateDirectiveHandler issues a directive to a Agent
+// @Summary Issue directive
+// @Description Queues a directive for a Agent. It is sent along every heartbeat response until the Agent acknowledges it, and pushed right away to a Agent with a gRPC session open. Payloads: set_interval `{"interval": seconds}`, from 1 to 86400, maintenance `{"enabled": bool}`, run_task `{"name": "...", "args": {}}`; disable, reregister and restart take none.
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param id path string true "Agent UUID"
+// @Param request body DirectiveRequest true "Directive"
+// @Success 201 {object} Directive
+// @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
+// @Failure 401 {object} ApiErrorResponse "UNAUTHORIZED - There was an unauthorized attempt to use functionality available only to authorized users. `{"message":"UNAUTHORIZED"}`"
+// @Failure 404 {object} ApiErrorResponse "NOT_FOUND - The Agent does not exist. `{"message":"NOT_FOUND"}`"
+// @Router /admin/agents/{id}/directives [post]
+func AdminCreateDirectiveHandler(c *fiber.Ctx) error {
+	agentID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid UUID"})
+	}
+	var req DirectiveRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid request body"})
+	}
+	if msg := validateDirective(req.Type, req.Payload); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+
+	d := Directive{ID: uuid.NewString(), Type: req.Type, Payload: req.Payload}
+	var payload any // NULL rather than JSON null
+	if len(req.Payload) > 0 {
+		payload = req.Payload
+	}
+	sql := `
+		INSERT INTO agent_directives (id, agent_id, type, payload)
+		VALUES ($1, $2, $3, $4)
+	`
+	_, err = db.Pool.Exec(context.Background(), sql, d.ID, agentID, d.Type, payload)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" { // foreign_key_violation
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "agent not found"})
+	}
+	if err != nil {
+		logStorageError(c, "failed to insert directive", err, "agent_id", agentID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to issue directive"})
+	}
+	sessions.notify(agentID)
+
+	return c.Status(fiber.StatusCreated).JSON(d)
+}
+
+// AdminDirectivesHandler lists the directives of a Agent
+// @Summary List directives
+// @Description Directives issued to a Agent over the last 7 days, newest first, with their delivery status
+// @Tags Admin
+// @Produce json
+// @Param id path string true "Agent UUID"
+// @Success 200 {array} DirectiveStatus
+// @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
+// @Failure 401 {object} ApiErrorResponse "UNAUTHORIZED - There was an unauthorized attempt to use functionality available only to authorized users. `{"message":"UNAUTHORIZED"}`"
+// @Router /admin/agents/{id}/directives [get]
+func AdminDirectivesHandler(c *fiber.Ctx) error {
+	agentID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid UUID"})
+	}
+
+	sql := `
+		SELECT id::text, type, payload, created, delivered, acked, COALESCE(error, '')
+		FROM agent_directives
+		WHERE agent_id = $1 AND created > now() - INTERVAL '7 days'
+		ORDER BY created DESC
+	`
+	rows, err := db.Pool.Query(context.Background(), sql, agentID)
+	if err != nil {
+		logStorageError(c, "failed to list directives", err, "agent_id", agentID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to list directives"})
+	}
+	directives, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (DirectiveStatus, error) {
+		var d DirectiveStatus
+		err := row.Scan(&d.ID, &d.Type, &d.Payload, &d.Created, &d.Delivered, &d.Acked, &d.Error)
+		d.Status = directiveStatus(d)
+		return d, err
+	})
+	if err != nil {
+		logStorageError(c, "failed to list directives", err, "agent_id", agentID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to list directives"})
+	}
+
+	return c.JSON(directives)
+}
+
+func directiveStatus(d DirectiveStatus) string {
+	switch {
+	case d.Acked != nil && d.Error != "":
+		return "failed"
+	case d.Acked != nil:
+		return "acked"
+	case d.Delivered != nil:
+		return "delivered"
+	default:
+		return "pending"
+	}
+}
+
+// AdminCancelDirectiveHandler withdraws a directive the Agent has not acknowledged yet
+// @Summary Cancel directive
+// @Description Deletes a directive that was not acknowledged yet. A directive already delivered may still be applied by the Agent.
+// @Tags Admin
+// @Produce json
+// @Param id path string true "Agent UUID"
+// @Param directive path string true "Directive UUID"
+// @Success 200 {object} ApiResponse "Success response `{"message":"OK"}`"
+// @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
+// @Failure 401 {object} ApiErrorResponse "UNAUTHORIZED - There was an unauthorized attempt to use functionality available only to authorized users. `{"message":"UNAUTHORIZED"}`"
+// @Failure 404 {object} ApiErrorResponse "NOT_FOUND - No pending directive with this ID. `{"message":"NOT_FOUND"}`"
+// @Router /admin/agents/{id}/directives/{directive} [delete]
+func AdminCancelDirectiveHandler(c *fiber.Ctx) error {
+	agentID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid UUID"})
+	}
+	id, err := uuid.Parse(c.Params("directive"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid directive UUID"})
+	}
+
+	sql := `DELETE FROM agent_directives WHERE id = $1 AND agent_id = $2 AND acked IS NULL`
+	tag, err := db.Pool.Exec(context.Background(), sql, id, agentID)
+	if err != nil {
+		logStorageError(c, "failed to cancel directive", err, "agent_id", agentID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to cancel directive"})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "no pending directive with this ID"})
+	}
+
+	return c.JSON(fiber.Map{"status": "OK"})
+}
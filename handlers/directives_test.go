@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	db "github.com/aphrollo/pulse/storage"
+)
+
+func TestValidateDirective(t *testing.T) {
+	valid := map[string]string{
+		"set_interval": `{"interval": 30}`,
+		"maintenance":  `{"enabled": false}`,
+		"run_task":     `{"name": "reindex", "args": {"full": true}}`,
+		"disable":      ``,
+		"reregister":   ``,
+		"restart":      ``,
+	}
+	for typ, payload := range valid {
+		if msg := validateDirective(typ, json.RawMessage(payload)); msg != "" {
+			t.Errorf("Expected %s %s to be valid, got %q", typ, payload, msg)
+		}
+	}
+
+	invalid := map[string]string{
+		"set_interval": `{"interval": 0}`,
+		"maintenance":  ``,
+		"run_task":     `{"args": {}}`,
+		"reboot":       ``,
+	}
+	for typ, payload := range invalid {
+		if msg := validateDirective(typ, json.RawMessage(payload)); msg == "" {
+			t.Errorf("Expected %s %s to be rejected", typ, payload)
+		}
+	}
+
+	for _, payload := range []string{`{"interval": 0.5}`, `{"interval": 86401}`, `{"interval": 1e300}`} {
+		if msg := validateDirective("set_interval", json.RawMessage(payload)); msg == "" {
+			t.Errorf("Expected set_interval %s to be rejected", payload)
+		}
+	}
+}
+
+func TestValidateAcks(t *testing.T) {
+	if msg := validateAcks([]DirectiveAck{{ID: "7b0e2c1a-3f4d-4e5f-8a9b-0c1d2e3f4a5b", Error: "failed"}}); msg != "" {
+		t.Errorf("Expected valid acks, got %q", msg)
+	}
+	if msg := validateAcks([]DirectiveAck{{ID: "d1"}}); msg == "" {
+		t.Error("Expected an invalid directive id to be rejected")
+	}
+	if msg := validateAcks(make([]DirectiveAck, MaxHeartbeatAcks+1)); msg == "" {
+		t.Error("Expected too many acks to be rejected")
+	}
+}
+
+func TestDirectiveStatus(t *testing.T) {
+	now := time.Now()
+	cases := map[string]DirectiveStatus{
+		"pending":   {},
+		"delivered": {Delivered: &now},
+		"acked":     {Delivered: &now, Acked: &now},
+		"failed":    {Delivered: &now, Acked: &now, Error: "no handler"},
+	}
+	for want, d := range cases {
+		if got := directiveStatus(d); got != want {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+}
+
+func TestAdminDirectiveHandlers_Validation(t *testing.T) {
+	app := fiber.New()
+	app.Post("/admin/agents/:id/directives", AdminCreateDirectiveHandler)
+	app.Get("/admin/agents/:id/directives", AdminDirectivesHandler)
+	app.Delete("/admin/agents/:id/directives/:directive", AdminCancelDirectiveHandler)
+
+	id := "123e4567-e89b-12d3-a456-426614174000"
+	cases := map[string]struct{ method, url, body string }{
+		"CreateInvalidAgentID": {http.MethodPost, "/admin/agents/nope/directives", `{"type":"disable"}`},
+		"CreateInvalidJSON":    {http.MethodPost, "/admin/agents/" + id + "/directives", `{"type":`},
+		"CreateInvalidType":    {http.MethodPost, "/admin/agents/" + id + "/directives", `{"type":"reboot"}`},
+		"CreateInvalidPayload": {http.MethodPost, "/admin/agents/" + id + "/directives", `{"type":"set_interval","payload":{"interval":-1}}`},
+		"ListInvalidAgentID":   {http.MethodGet, "/admin/agents/nope/directives", ""},
+		"CancelInvalidID":      {http.MethodDelete, "/admin/agents/" + id + "/directives/nope", ""},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != fiber.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestAgentHeartbeatHandler_Directives(t *testing.T) {
+	app := setupApp(t)
+	id := uuid.NewString()
+	ctx := context.Background()
+	if _, err := db.Pool.Exec(ctx, `INSERT INTO agents (id, name, type) VALUES ($1, 'test-Agent', 'default')`, id); err != nil {
+		t.Fatalf("Failed to insert Agent: %v", err)
+	}
+	defer db.Pool.Exec(ctx, `DELETE FROM agents WHERE id = $1`, id)
+
+	// Created out of insertion order, the oldest must come first
+	interval, disable := uuid.NewString(), uuid.NewString()
+	_, err := db.Pool.Exec(ctx, `
+		INSERT INTO agent_directives (id, agent_id, type, payload, created) VALUES
+			($1, $3, 'disable', NULL, now() - INTERVAL '1 minute'),
+			($2, $3, 'set_interval', '{"interval": 45}', now() - INTERVAL '2 minutes')`,
+		disable, interval, id)
+	if err != nil {
+		t.Fatalf("Failed to insert directives: %v", err)
+	}
+
+	heartbeat := func(acks []DirectiveAck) AgentHeartbeatResponse {
+		t.Helper()
+		body, _ := json.Marshal(AgentHeartbeatRequest{ID: id, Status: "healthy", Acks: acks})
+		req := httptest.NewRequest(http.MethodPost, "/agent/heartbeat", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		var result AgentHeartbeatResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	result := heartbeat(nil)
+	if len(result.Directives) != 2 || result.Directives[0].ID != interval || result.Directives[1].ID != disable {
+		t.Fatalf("Expected set_interval then disable, got %+v", result.Directives)
+	}
+
+	result = heartbeat([]DirectiveAck{{ID: interval}, {ID: disable, Error: "not supported"}})
+	if len(result.Directives) != 0 {
+		t.Errorf("Expected no pending directives after the acks, got %+v", result.Directives)
+	}
+
+	var seconds float64
+	err = db.Pool.QueryRow(ctx, `SELECT extract(epoch FROM heartbeat_interval) FROM agents WHERE id = $1`, id).Scan(&seconds)
+	if err != nil {
+		t.Fatalf("Failed to query heartbeat interval: %v", err)
+	}
+	if seconds != 45 {
+		t.Errorf("Expected the acked set_interval to set a 45s interval, got %v", seconds)
+	}
+
+	var failed string
+	err = db.Pool.QueryRow(ctx, `SELECT COALESCE(error, '') FROM agent_directives WHERE id = $1`, disable).Scan(&failed)
+	if err != nil {
+		t.Fatalf("Failed to query directive: %v", err)
+	}
+	if failed != "not supported" {
+		t.Errorf("Expected the failed ack's error to be stored, got %q", failed)
+	}
+}
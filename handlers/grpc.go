@@ -0,0 +1,377 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/aphrollo/pulse/metrics"
+	pulsev1 "github.com/aphrollo/pulse/proto/pulse/v1"
+	db "github.com/aphrollo/pulse/storage"
+)
+
+// AgentService serves the agent API over gRPC. Register, Update and Heartbeat
+// mirror their HTTP endpoints, validation and storage included; Session lets an
+// Agent heartbeat over a stream Pulse pushes directives on.
+type AgentService struct {
+	pulsev1.UnimplementedAgentServiceServer
+}
+
+// rpcError counts a rejected agent payload like ingestionError and returns the error status
+func rpcError(endpoint string, code codes.Code, message string) error {
+	reason := "invalid"
+	switch code {
+	case codes.AlreadyExists:
+		reason = "conflict"
+	case codes.Internal:
+		reason = "storage"
+	}
+	metrics.IngestionErrors.WithLabelValues(endpoint, reason).Inc()
+	return status.Error(code, message)
+}
+
+// rpcStorageError logs a failed database call and returns it as an internal error
+func rpcStorageError(endpoint, msg string, err error, id uuid.UUID) error {
+	slog.Error(msg, "agent_id", id, "error", err, "transport", "grpc")
+	return rpcError(endpoint, codes.Internal, msg)
+}
+
+// Register registers an Agent, or refreshes an existing one, see AgentRegisterHandler
+func (s *AgentService) Register(ctx context.Context, in *pulsev1.RegisterRequest) (*pulsev1.RegisterResponse, error) {
+	defer metrics.TrackIngestion()()
+	req := AgentRegisterRequest{
+		ID:                in.GetId(),
+		Name:              in.GetName(),
+		Type:              in.GetType(),
+		Info:              structMap(in.GetInfo()),
+		HeartbeatInterval: in.GetHeartbeatInterval(),
+	}
+	id, msg := validateRegister(&req)
+	if msg != "" {
+		return nil, rpcError("register", codes.InvalidArgument, msg)
+	}
+
+	if err := registerAgent(ctx, id, &req); err != nil {
+		return nil, rpcStorageError("register", "failed to register Agent", err, id)
+	}
+	return &pulsev1.RegisterResponse{}, nil
+}
+
+// Update records a status update, see AgentUpdateHandler
+func (s *AgentService) Update(ctx context.Context, in *pulsev1.UpdateRequest) (*pulsev1.UpdateResponse, error) {
+	defer metrics.TrackIngestion()()
+	req := AgentUpdateRequest{
+		ID:      in.GetId(),
+		Status:  in.GetStatus(),
+		Message: structMap(in.GetMessage()),
+		Time:    protoTime(in.GetTime()),
+	}
+	if t := in.GetTask(); t != nil {
+		req.Task = &TaskEvent{
+			ID:       t.GetId(),
+			Name:     t.GetName(),
+			Event:    t.GetEvent(),
+			Started:  protoTime(t.GetStarted()),
+			Progress: doubleValue(t.GetProgress()),
+			Message:  t.GetMessage(),
+			Error:    t.GetError(),
+		}
+	}
+	id, msg := validateUpdate(&req)
+	if msg != "" {
+		return nil, rpcError("update", codes.InvalidArgument, msg)
+	}
+
+	if err := insertUpdate(ctx, id, &req); err != nil {
+		return nil, rpcStorageError("update", "failed to update Agent status", err, id)
+	}
+	return &pulsev1.UpdateResponse{}, nil
+}
+
+// Heartbeat records a heartbeat and returns the directives pending for the Agent, see AgentHeartbeatHandler
+func (s *AgentService) Heartbeat(ctx context.Context, in *pulsev1.HeartbeatRequest) (*pulsev1.HeartbeatResponse, error) {
+	defer metrics.TrackIngestion()()
+	req := heartbeatFrom(in)
+	id, msg := validateHeartbeat(&req)
+	if msg != "" {
+		return nil, rpcError("heartbeat", codes.InvalidArgument, msg)
+	}
+
+	resp, err := recordHeartbeat(ctx, id, &req)
+	if err != nil {
+		return nil, rpcStorageError("heartbeat", "failed to insert heartbeat", err, id)
+	}
+	return heartbeatResponse(resp), nil
+}
+
+// Session answers the heartbeats an Agent sends on the stream like Heartbeat,
+// and pushes its pending directives as soon as new ones are issued. The first
+// heartbeat binds the stream to its Agent. When the stream breaks, rather than
+// being closed by the Agent, the Agent is marked unreachable right away.
+func (s *AgentService) Session(stream pulsev1.AgentService_SessionServer) error {
+	ctx := stream.Context()
+	received := make(chan *pulsev1.SessionRequest)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			in, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case received <- in:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var id uuid.UUID
+	var pushed chan struct{}
+	defer func() {
+		if pushed != nil {
+			sessions.leave(id, pushed)
+		}
+	}()
+	// lost ends a broken session, once it is no longer pushed to
+	lost := func(err error) error {
+		if pushed != nil {
+			sessions.leave(id, pushed)
+			pushed = nil
+			sessionLost(id)
+		}
+		return err
+	}
+
+	for {
+		select {
+		case in := <-received:
+			req := heartbeatFrom(in.GetHeartbeat())
+			beatID, msg := validateHeartbeat(&req)
+			if msg != "" {
+				return rpcError("heartbeat", codes.InvalidArgument, msg)
+			}
+			if pushed == nil {
+				id, pushed = beatID, sessions.join(beatID)
+			} else if beatID != id {
+				return rpcError("heartbeat", codes.InvalidArgument, "heartbeat of another Agent")
+			}
+
+			done := metrics.TrackIngestion()
+			resp, err := recordHeartbeat(ctx, id, &req)
+			done()
+			if err != nil && ctx.Err() != nil {
+				return lost(ctx.Err())
+			}
+			if err != nil {
+				return rpcStorageError("heartbeat", "failed to insert heartbeat", err, id)
+			}
+			if err := stream.Send(&pulsev1.SessionResponse{Heartbeat: heartbeatResponse(resp)}); err != nil {
+				return lost(err)
+			}
+
+		case <-pushed:
+			directives, err := deliverDirectives(ctx, id)
+			if err != nil {
+				// They go along the next heartbeat instead
+				slog.Error("failed to push directives", "agent_id", id, "error", err)
+				continue
+			}
+			if len(directives) == 0 {
+				continue
+			}
+			if err := stream.Send(&pulsev1.SessionResponse{Directives: directivesTo(directives)}); err != nil {
+				return lost(err)
+			}
+
+		case err := <-recvErr:
+			if errors.Is(err, io.EOF) { // closed by the Agent
+				return nil
+			}
+			return lost(err)
+		}
+	}
+}
+
+// deliverDirectives returns the directives pending for an Agent, marking them delivered
+func deliverDirectives(ctx context.Context, id uuid.UUID) ([]Directive, error) {
+	var directives []Directive
+	err := pgx.BeginFunc(ctx, db.Pool, func(tx pgx.Tx) error {
+		var err error
+		directives, err = pendingDirectives(ctx, tx, id)
+		return err
+	})
+	return directives, err
+}
+
+// SessionLostTimeout bounds marking an Agent unreachable once its session broke
+const SessionLostTimeout = 5 * time.Second
+
+// sessionLost marks an Agent whose session broke unreachable, like the reaper
+// does once it missed its heartbeats, unless it has another session open here
+func sessionLost(id uuid.UUID) {
+	if sessions.open(id) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), SessionLostTimeout)
+	defer cancel()
+
+	sql := `
+		INSERT INTO agent_updates (agent_id, status, message)
+		SELECT agent_id, 'unreachable', json_build_object('reason', 'session lost')::text
+		FROM agent_status
+		WHERE agent_id = $1 AND status NOT IN ('unreachable', 'crashed', 'stopped', 'disabled')
+	`
+	if _, err := db.Pool.Exec(ctx, sql, id); err != nil {
+		slog.Error("failed to mark agent unreachable", "agent_id", id, "error", err)
+	}
+}
+
+// agentSessions are the Session streams open on this instance, by Agent. They
+// are woken up when a directive is issued, to push it; Agents connected to
+// another instance get it along their next heartbeat.
+type agentSessions struct {
+	mu      sync.Mutex
+	streams map[uuid.UUID]map[chan struct{}]bool
+}
+
+var sessions = &agentSessions{streams: map[uuid.UUID]map[chan struct{}]bool{}}
+
+// join registers a session of the Agent and returns the channel it is woken up on
+func (s *agentSessions) join(id uuid.UUID) chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan struct{}, 1)
+	if s.streams[id] == nil {
+		s.streams[id] = map[chan struct{}]bool{}
+	}
+	s.streams[id][ch] = true
+	return ch
+}
+
+func (s *agentSessions) leave(id uuid.UUID, ch chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams[id], ch)
+	if len(s.streams[id]) == 0 {
+		delete(s.streams, id)
+	}
+}
+
+// open reports whether the Agent has a session open on this instance
+func (s *agentSessions) open(id uuid.UUID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams[id]) > 0
+}
+
+// notify wakes up the sessions of the Agent, without waiting on them
+func (s *agentSessions) notify(id uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.streams[id] {
+		select {
+		case ch <- struct{}{}:
+		default: // a push is already pending
+		}
+	}
+}
+
+// structMap returns the fields of s, nil rather than an empty map when s is not set
+func structMap(s *structpb.Struct) map[string]interface{} {
+	if s == nil {
+		return nil
+	}
+	return s.AsMap()
+}
+
+// protoTime returns the time of t, the zero time rather than the epoch when t is not set
+func protoTime(t *timestamppb.Timestamp) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return t.AsTime()
+}
+
+func doubleValue(v *wrapperspb.DoubleValue) *float64 {
+	if v == nil {
+		return nil
+	}
+	f := v.GetValue()
+	return &f
+}
+
+// heartbeatFrom converts a heartbeat received over gRPC to its HTTP equivalent
+func heartbeatFrom(in *pulsev1.HeartbeatRequest) AgentHeartbeatRequest {
+	req := AgentHeartbeatRequest{
+		ID:            in.GetId(),
+		Status:        in.GetStatus(),
+		ConfigVersion: in.GetConfigVersion(),
+	}
+	for _, c := range in.GetChecks() {
+		req.Checks = append(req.Checks, HeartbeatCheck{
+			Name:     c.GetName(),
+			Status:   c.GetStatus(),
+			Critical: c.GetCritical(),
+			Error:    c.GetError(),
+			Duration: c.GetDurationMs(),
+			Probe:    c.GetProbe(),
+			Failures: int(c.GetFailures()),
+		})
+	}
+	for _, a := range in.GetAcks() {
+		req.Acks = append(req.Acks, DirectiveAck{ID: a.GetId(), Error: a.GetError()})
+	}
+	if h := in.GetHost(); h != nil {
+		host := &HostSnapshot{
+			CPUPercent:    doubleValue(h.GetCpuPercent()),
+			Load1:         h.GetLoad1(),
+			Load5:         h.GetLoad5(),
+			Load15:        h.GetLoad15(),
+			MemTotal:      h.GetMemTotalBytes(),
+			MemAvailable:  h.GetMemAvailableBytes(),
+			OpenFDs:       int(h.GetOpenFds()),
+			UptimeSeconds: h.GetUptimeSeconds(),
+			Errors:        h.GetErrors(),
+		}
+		for _, d := range h.GetDisks() {
+			host.Disks = append(host.Disks, HostDisk{Mount: d.GetMount(), Total: d.GetTotalBytes(), Free: d.GetFreeBytes()})
+		}
+		for _, n := range h.GetNetwork() {
+			host.Network = append(host.Network, HostNetwork{Interface: n.GetInterface(), RxBytes: n.GetRxBytes(), TxBytes: n.GetTxBytes()})
+		}
+		req.Host = host
+	}
+	return req
+}
+
+func heartbeatResponse(resp AgentHeartbeatResponse) *pulsev1.HeartbeatResponse {
+	return &pulsev1.HeartbeatResponse{Directives: directivesTo(resp.Directives), ConfigVersion: resp.ConfigVersion}
+}
+
+// directivesTo converts directives for gRPC. Payloads are JSON objects, checked when the directive was issued.
+func directivesTo(directives []Directive) []*pulsev1.Directive {
+	out := make([]*pulsev1.Directive, 0, len(directives))
+	for _, d := range directives {
+		pd := &pulsev1.Directive{Id: d.ID, Type: d.Type}
+		var payload map[string]interface{}
+		if len(d.Payload) > 0 && json.Unmarshal(d.Payload, &payload) == nil {
+			pd.Payload, _ = structpb.NewStruct(payload)
+		}
+		out = append(out, pd)
+	}
+	return out
+}
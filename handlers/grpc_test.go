@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	pulsev1 "github.com/aphrollo/pulse/proto/pulse/v1"
+)
+
+func TestAgentService_Validation(t *testing.T) {
+	s := &AgentService{}
+	ctx := context.Background()
+
+	_, err := s.Register(ctx, &pulsev1.RegisterRequest{Id: "not-a-uuid", Name: "worker"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an invalid UUID, got %v", err)
+	}
+	_, err = s.Update(ctx, &pulsev1.UpdateRequest{Id: uuid.NewString()})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument without status, got %v", err)
+	}
+	_, err = s.Update(ctx, &pulsev1.UpdateRequest{Id: uuid.NewString(), Status: "sleepy"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an invalid status, got %v", err)
+	}
+	_, err = s.Heartbeat(ctx, &pulsev1.HeartbeatRequest{Id: uuid.NewString(), Status: "sleepy"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an invalid status, got %v", err)
+	}
+}
+
+// Test an invalid heartbeat ends the session with InvalidArgument
+func TestAgentService_Session_Validation(t *testing.T) {
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pulsev1.RegisterAgentServiceServer(srv, &AgentService{})
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	stream, err := pulsev1.NewAgentServiceClient(conn).Session(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&pulsev1.SessionRequest{Heartbeat: &pulsev1.HeartbeatRequest{Id: "not-a-uuid", Status: "healthy"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestAgentSessions(t *testing.T) {
+	s := &agentSessions{streams: map[uuid.UUID]map[chan struct{}]bool{}}
+	id := uuid.New()
+
+	first, second := s.join(id), s.join(id)
+	s.notify(id)
+	s.notify(id) // doesn't block on a pending push
+	for _, ch := range []chan struct{}{first, second} {
+		select {
+		case <-ch:
+		default:
+			t.Error("Expected every session of the Agent to be woken up")
+		}
+	}
+
+	s.leave(id, first)
+	if !s.open(id) {
+		t.Error("Expected the Agent to still have a session")
+	}
+	s.leave(id, second)
+	if s.open(id) || len(s.streams) != 0 {
+		t.Error("Expected no session left")
+	}
+	s.notify(uuid.New()) // no session, nothing to do
+}
+
+func TestHeartbeatFrom(t *testing.T) {
+	ackID := uuid.NewString()
+	req := heartbeatFrom(&pulsev1.HeartbeatRequest{
+		Id:     uuid.NewString(),
+		Status: "healthy",
+		Checks: []*pulsev1.Check{{Name: "db", Status: "fail", DurationMs: 3.5, Probe: "tcp", Failures: 2}},
+		Host: &pulsev1.HostSnapshot{
+			CpuPercent: wrapperspb.Double(12.5),
+			Disks:      []*pulsev1.HostDisk{{Mount: "/", TotalBytes: 100, FreeBytes: 40}},
+		},
+		Acks: []*pulsev1.DirectiveAck{{Id: ackID, Error: "refused"}},
+	})
+	if _, msg := validateHeartbeat(&req); msg != "" {
+		t.Fatalf("Expected a valid heartbeat, got %q", msg)
+	}
+	if c := req.Checks[0]; c.Name != "db" || c.Duration != 3.5 || c.Failures != 2 {
+		t.Errorf("Expected the check to be converted, got %+v", c)
+	}
+	if req.Host == nil || req.Host.CPUPercent == nil || *req.Host.CPUPercent != 12.5 || req.Host.Disks[0].Free != 40 {
+		t.Errorf("Expected the host to be converted, got %+v", req.Host)
+	}
+	if len(req.Acks) != 1 || req.Acks[0].ID != ackID || req.Acks[0].Error != "refused" {
+		t.Errorf("Expected the ack to be converted, got %+v", req.Acks)
+	}
+
+	if req := heartbeatFrom(&pulsev1.HeartbeatRequest{}); req.Host != nil || req.Checks != nil {
+		t.Errorf("Expected no host nor checks, got %+v", req)
+	}
+}
+
+func TestDirectivesTo(t *testing.T) {
+	got := directivesTo([]Directive{
+		{ID: "d1", Type: "set_interval", Payload: json.RawMessage(`{"interval": 30}`)},
+		{ID: "d2", Type: "reregister"},
+	})
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 directives, got %d", len(got))
+	}
+	if got[0].GetPayload().AsMap()["interval"] != 30.0 {
+		t.Errorf("Expected the payload to be converted, got %v", got[0].GetPayload())
+	}
+	if got[1].GetType() != "reregister" || got[1].GetPayload() != nil {
+		t.Errorf("Expected a directive without payload, got %v", got[1])
+	}
+}
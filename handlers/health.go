@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/aphrollo/pulse/metrics"
+	db "github.com/aphrollo/pulse/storage"
+	"github.com/aphrollo/pulse/workers"
+)
+
+// MaxIngestionQueueDepth is the number of payloads in flight above which pulse reports not ready
+var MaxIngestionQueueDepth int64 = 500
+
+// ComponentStatus readiness of one component
+type ComponentStatus struct {
+	Status string `json:"status" example:"ok"` // ok or fail
+	Detail string `json:"detail,omitempty"`
+}
+
+// ReadinessResponse readiness of pulse, broken down per component
+type ReadinessResponse struct {
+	Status     string                     `json:"status" example:"ok"` // ok when every component is ok
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// HealthzHandler reports that the process is up
+// @Summary Liveness probe
+// @Description Succeeds as long as the process serves requests; does not touch dependencies
+// @Tags Health
+// @Produce json
+// @Success 200 {object} ApiResponse "Success response `{"status":"OK"}`"
+// @Router /healthz [get]
+func HealthzHandler(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"status": "OK"})
+}
+
+func checkDatabase(ctx context.Context) ComponentStatus {
+	if db.Pool == nil {
+		return ComponentStatus{Status: "fail", Detail: "not connected"}
+	}
+	start := time.Now()
+	if err := db.Pool.Ping(ctx); err != nil {
+		return ComponentStatus{Status: "fail", Detail: err.Error()}
+	}
+	return ComponentStatus{Status: "ok", Detail: fmt.Sprintf("ping %s", time.Since(start).Round(time.Millisecond))}
+}
+
+func checkMigrations(ctx context.Context) ComponentStatus {
+	if db.Pool == nil {
+		return ComponentStatus{Status: "fail", Detail: "not connected"}
+	}
+	pending, err := db.PendingMigrations(ctx)
+	if err != nil {
+		return ComponentStatus{Status: "fail", Detail: err.Error()}
+	}
+	if len(pending) > 0 {
+		return ComponentStatus{Status: "fail", Detail: "pending: " + strings.Join(pending, ", ")}
+	}
+	return ComponentStatus{Status: "ok"}
+}
+
+func checkWorker(w workers.Status) ComponentStatus {
+	switch {
+	case !w.Running:
+		return ComponentStatus{Status: "fail", Detail: strings.TrimSpace("not running " + w.LastError)}
+	case !w.Healthy:
+		return ComponentStatus{Status: "fail", Detail: "stalled, last run " + w.LastRun.Format(time.RFC3339)}
+	case w.LastError != "":
+		return ComponentStatus{Status: "ok", Detail: "last run failed: " + w.LastError}
+	}
+	return ComponentStatus{Status: "ok"}
+}
+
+func checkIngestion() ComponentStatus {
+	depth := metrics.IngestionQueueDepth()
+	detail := fmt.Sprintf("%d in flight", depth)
+	if depth > MaxIngestionQueueDepth {
+		return ComponentStatus{Status: "fail", Detail: detail}
+	}
+	return ComponentStatus{Status: "ok", Detail: detail}
+}
+
+// ReadyzHandler reports whether pulse can serve traffic
+// @Summary Readiness probe
+// @Description Checks the database connection, applied migrations, background workers and ingestion queue depth
+// @Tags Health
+// @Produce json
+// @Success 200 {object} ReadinessResponse
+// @Failure 503 {object} ReadinessResponse
+// @Router /readyz [get]
+func ReadyzHandler(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	resp := ReadinessResponse{
+		Status: "ok",
+		Components: map[string]ComponentStatus{
+			"database":   checkDatabase(ctx),
+			"migrations": checkMigrations(ctx),
+			"ingestion":  checkIngestion(),
+		},
+	}
+	for _, w := range workers.Statuses() {
+		resp.Components["worker:"+w.Name] = checkWorker(w)
+	}
+
+	for _, component := range resp.Components {
+		if component.Status != "ok" {
+			resp.Status = "fail"
+			return c.Status(fiber.StatusServiceUnavailable).JSON(resp)
+		}
+	}
+	return c.JSON(resp)
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aphrollo/pulse/workers"
+)
+
+func TestHealthzHandler(t *testing.T) {
+	app := fiber.New()
+	app.Get("/healthz", HealthzHandler)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestCheckWorker(t *testing.T) {
+	require.Equal(t, "ok", checkWorker(workers.Status{Running: true, Healthy: true}).Status)
+	require.Equal(t, "ok", checkWorker(workers.Status{Running: true, Healthy: true, LastError: "timeout"}).Status)
+	require.Equal(t, "fail", checkWorker(workers.Status{Running: true, Healthy: false}).Status)
+	require.Equal(t, "fail", checkWorker(workers.Status{Running: false}).Status)
+}
+
+// Every component is reported even when one of them fails
+func TestReadyzHandler_ReportsComponents(t *testing.T) {
+	if db := checkDatabase(t.Context()); db.Status == "ok" {
+		t.Skip("requires pulse to be disconnected from the database")
+	}
+
+	app := fiber.New()
+	app.Get("/readyz", ReadyzHandler)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	var body ReadinessResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Equal(t, "fail", body.Status)
+	require.Equal(t, "fail", body.Components["database"].Status)
+	require.Equal(t, "fail", body.Components["migrations"].Status)
+	require.Equal(t, "ok", body.Components["ingestion"].Status)
+}
@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	db "github.com/aphrollo/pulse/storage"
+	"github.com/aphrollo/pulse/templates"
+)
+
+// HeartbeatLateFactor is how many declared intervals may pass between two beats before the later one counts as late
+var HeartbeatLateFactor = 1.5
+
+// HeartbeatStats describes how regularly an agent heartbeats over a time range
+type HeartbeatStats struct {
+	From             time.Time  `json:"from"`
+	To               time.Time  `json:"to"`
+	DeclaredInterval *float64   `json:"declared_interval"` // seconds, null when the agent did not declare one
+	Beats            int64      `json:"beats"`
+	LastBeat         *time.Time `json:"last_beat"`
+	MeanInterval     *float64   `json:"mean_interval"` // seconds between consecutive beats
+	Jitter           *float64   `json:"jitter"`        // standard deviation of the seconds between beats
+	LateBeats        *int64     `json:"late_beats"`    // null without a declared interval
+	LongestGap       float64    `json:"longest_gap"`   // seconds, counting the silence since the last beat
+}
+
+// heartbeatStatsSQL computes HeartbeatStats for every agent that beat between $1 and $2.
+// The gap before the first beat of the range is unknown and left out.
+const heartbeatStatsSQL = `
+	WITH beats AS (
+		SELECT agent_id, time, time - lag(time) OVER (PARTITION BY agent_id ORDER BY time) AS gap
+		FROM agent_heartbeats
+		WHERE time >= $1 AND time < $2 AND ($3::uuid IS NULL OR agent_id = $3)
+	)
+	SELECT b.agent_id::text, COALESCE(a.type, ''), EXTRACT(EPOCH FROM a.heartbeat_interval)::float8,
+	       count(*), max(b.time),
+	       EXTRACT(EPOCH FROM avg(b.gap))::float8,
+	       stddev_samp(EXTRACT(EPOCH FROM b.gap))::float8,
+	       CASE WHEN a.heartbeat_interval IS NOT NULL
+	            THEN count(*) FILTER (WHERE b.gap > a.heartbeat_interval * $4::float8) END,
+	       EXTRACT(EPOCH FROM GREATEST(max(b.gap), LEAST($2, now()) - max(b.time)))::float8
+	FROM beats b
+	JOIN agents a ON a.id = b.agent_id
+	GROUP BY b.agent_id, a.type, a.heartbeat_interval
+	ORDER BY max(b.time) DESC
+`
+
+type agentHeartbeatStats struct {
+	AgentID string
+	Type    string
+	HeartbeatStats
+}
+
+// heartbeatStats computes the heartbeat statistics of every agent, or of one agent when id is set
+func heartbeatStats(ctx context.Context, from, to time.Time, id *uuid.UUID) ([]agentHeartbeatStats, error) {
+	rows, err := db.Pool.Query(ctx, heartbeatStatsSQL, from, to, id, HeartbeatLateFactor)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (agentHeartbeatStats, error) {
+		s := agentHeartbeatStats{HeartbeatStats: HeartbeatStats{From: from, To: to}}
+		err := row.Scan(&s.AgentID, &s.Type, &s.DeclaredInterval, &s.Beats, &s.LastBeat,
+			&s.MeanInterval, &s.Jitter, &s.LateBeats, &s.LongestGap)
+		return s, err
+	})
+}
+
+// AgentDetailResponse a registered Agent with its current status and heartbeat statistics
+type AgentDetailResponse struct {
+	ID         string                 `json:"id"`
+	Name       string                 `json:"name"`
+	Type       string                 `json:"type"`
+	Info       map[string]interface{} `json:"info,omitempty"`
+	Registered time.Time              `json:"registered"`
+	Status     string                 `json:"status,omitempty"` // empty until the first heartbeat or update
+	Since      *time.Time             `json:"since,omitempty"`
+	Heartbeats HeartbeatStats         `json:"heartbeats"`
+	Checks     []HeartbeatCheck       `json:"checks,omitempty"`     // from the latest heartbeat that carried checks
+	CheckedAt  *time.Time             `json:"checked_at,omitempty"` // time of that heartbeat
+	Host       *HostSnapshot          `json:"host,omitempty"`       // from the latest heartbeat that carried a host snapshot
+	HostAt     *time.Time             `json:"host_at,omitempty"`
+
+	ConfigVersion       string `json:"config_version,omitempty"` // configuration the Agent reported running, empty until it does
+	LatestConfigVersion string `json:"latest_config_version"`    // its current configuration
+}
+
+var errAgentNotFound = errors.New("agent not found")
+
+func loadAgentDetail(ctx context.Context, id uuid.UUID, from, to time.Time) (AgentDetailResponse, error) {
+	var d AgentDetailResponse
+	var interval *float64
+	sql := `
+		SELECT a.id::text, a.name, COALESCE(a.type, ''), a.info, a.time,
+		       COALESCE(s.status::text, ''), s.since, EXTRACT(EPOCH FROM a.heartbeat_interval)::float8,
+		       COALESCE(a.config_version, ''),` + latestConfigSQL + `
+		FROM agents a
+		LEFT JOIN agent_status s ON s.agent_id = a.id
+		WHERE a.id = $1
+	`
+	var typeVersion, agentVersion int
+	err := db.Pool.QueryRow(ctx, sql, id).Scan(&d.ID, &d.Name, &d.Type, &d.Info, &d.Registered, &d.Status, &d.Since, &interval,
+		&d.ConfigVersion, &typeVersion, &agentVersion)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return d, errAgentNotFound
+	}
+	if err != nil {
+		return d, err
+	}
+	d.LatestConfigVersion = configVersion(typeVersion, agentVersion)
+
+	// Only the last day is searched so agents without checks don't scan their whole history
+	sql = `
+		SELECT time, checks FROM agent_heartbeats
+		WHERE agent_id = $1 AND checks IS NOT NULL AND time > now() - INTERVAL '1 day'
+		ORDER BY time DESC
+		LIMIT 1
+	`
+	err = db.Pool.QueryRow(ctx, sql, id).Scan(&d.CheckedAt, &d.Checks)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return d, err
+	}
+
+	sql = `
+		SELECT time, host FROM agent_heartbeats
+		WHERE agent_id = $1 AND host IS NOT NULL AND time > now() - INTERVAL '1 day'
+		ORDER BY time DESC
+		LIMIT 1
+	`
+	err = db.Pool.QueryRow(ctx, sql, id).Scan(&d.HostAt, &d.Host)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return d, err
+	}
+
+	stats, err := heartbeatStats(ctx, from, to, &id)
+	if err != nil {
+		return d, err
+	}
+	if len(stats) > 0 {
+		d.Heartbeats = stats[0].HeartbeatStats
+		return d, nil
+	}
+
+	// No beats at all in the range: the whole range is one gap
+	d.Heartbeats = HeartbeatStats{From: from, To: to, DeclaredInterval: interval, LongestGap: minTime(to, time.Now()).Sub(from).Seconds()}
+	if interval != nil {
+		d.Heartbeats.LateBeats = new(int64)
+	}
+	return d, nil
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// agentDetailRange reads from/to, defaulting to the last 24 hours
+func agentDetailRange(c *fiber.Ctx) (time.Time, time.Time, string) {
+	if c.Query("from") == "" && c.Query("to") == "" {
+		to := time.Now()
+		return to.Add(-24 * time.Hour), to, ""
+	}
+	return parseTimeRange(c)
+}
+
+// AgentDetailHandler returns a Agent with its status and heartbeat statistics
+// @Summary Agent details
+// @Description Registration info, current status and heartbeat regularity (mean interval, jitter, late beats, longest gap) of a Agent
+// @Tags Agent
+// @Produce json
+// @Param id path string true "Agent UUID"
+// @Param from query string false "Range start (RFC3339), defaults to 24 hours ago"
+// @Param to query string false "Range end (RFC3339), defaults to now"
+// @Success 200 {object} AgentDetailResponse
+// @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
+// @Failure 404 {object} ApiErrorResponse "Agent not found"
+// @Router /agents/{id} [get]
+func AgentDetailHandler(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid UUID"})
+	}
+	from, to, msg := agentDetailRange(c)
+	if msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+
+	detail, err := loadAgentDetail(context.Background(), id, from, to)
+	if errors.Is(err, errAgentNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Agent not found"})
+	}
+	if err != nil {
+		logStorageError(c, "failed to load agent", err, "agent_id", id)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to load Agent"})
+	}
+	return c.JSON(detail)
+}
+
+// formatSeconds renders an optional number of seconds for the agent page
+func formatSeconds(v *float64) string {
+	if v == nil {
+		return "-"
+	}
+	return time.Duration(*v * float64(time.Second)).Round(time.Millisecond).String()
+}
+
+// agentPage maps the API response onto the agent page
+func agentPage(d AgentDetailResponse) templates.AgentPage {
+	h := d.Heartbeats
+	p := templates.AgentPage{
+		ID:               d.ID,
+		Name:             d.Name,
+		Type:             d.Type,
+		Status:           d.Status,
+		From:             h.From,
+		To:               h.To,
+		Beats:            h.Beats,
+		DeclaredInterval: formatSeconds(h.DeclaredInterval),
+		MeanInterval:     formatSeconds(h.MeanInterval),
+		Jitter:           formatSeconds(h.Jitter),
+		LongestGap:       formatSeconds(&h.LongestGap),
+		LateBeats:        "-",
+		LastBeat:         "-",
+	}
+	if h.LateBeats != nil {
+		p.LateBeats = fmt.Sprint(*h.LateBeats)
+	}
+	if h.LastBeat != nil {
+		p.LastBeat = h.LastBeat.UTC().Format(time.RFC3339)
+	}
+	for _, check := range d.Checks {
+		p.Checks = append(p.Checks, templates.AgentCheck{
+			Name:     check.Name,
+			OK:       check.Status == "ok",
+			Critical: check.Critical,
+			Error:    check.Error,
+			Duration: fmt.Sprintf("%.1f ms", check.Duration),
+		})
+	}
+	if d.CheckedAt != nil {
+		p.CheckedAt = d.CheckedAt.UTC().Format(time.RFC3339)
+	}
+	if d.Host != nil && d.HostAt != nil {
+		p.Host = hostPage(*d.Host, *d.HostAt)
+	}
+	p.ConfigVersion = d.ConfigVersion
+	p.ConfigOutdated = d.ConfigVersion != "" && d.ConfigVersion != d.LatestConfigVersion
+	return p
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. 1.5 GiB
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// hostPage maps a host snapshot onto the agent page
+func hostPage(h HostSnapshot, at time.Time) *templates.AgentHost {
+	p := &templates.AgentHost{
+		At:      at.UTC().Format(time.RFC3339),
+		CPU:     "-",
+		Load:    fmt.Sprintf("%.2f %.2f %.2f", h.Load1, h.Load5, h.Load15),
+		Memory:  "-",
+		Uptime:  time.Duration(h.UptimeSeconds * float64(time.Second)).Round(time.Second).String(),
+		OpenFDs: fmt.Sprint(h.OpenFDs),
+		Errors:  h.Errors,
+	}
+	if h.CPUPercent != nil {
+		p.CPU = fmt.Sprintf("%.1f%%", *h.CPUPercent)
+	}
+	if h.MemTotal > 0 {
+		used := h.MemTotal - min(h.MemAvailable, h.MemTotal)
+		p.Memory = fmt.Sprintf("%s / %s (%.0f%%)", formatBytes(used), formatBytes(h.MemTotal), float64(used)/float64(h.MemTotal)*100)
+	}
+	for _, d := range h.Disks {
+		disk := templates.AgentDisk{Mount: d.Mount, Used: "-", Size: formatBytes(d.Total)}
+		if d.Total > 0 {
+			used := d.Total - min(d.Free, d.Total)
+			disk.Used = fmt.Sprintf("%s (%.0f%%)", formatBytes(used), float64(used)/float64(d.Total)*100)
+		}
+		p.Disks = append(p.Disks, disk)
+	}
+	for _, n := range h.Network {
+		p.Network = append(p.Network, templates.AgentInterface{Name: n.Interface, Rx: formatBytes(n.RxBytes), Tx: formatBytes(n.TxBytes)})
+	}
+	return p
+}
+
+// AgentPageHandler renders the detail page of a Agent
+// @Summary Agent page
+// @Description HTML page with the status and heartbeat regularity of a Agent over the last 24 hours
+// @Tags Dashboard
+// @Produce html
+// @Param id path string true "Agent UUID"
+// @Success 200 {string} string "HTML content"
+// @Router /dashboard/agents/{id} [get]
+func AgentPageHandler(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("invalid UUID")
+	}
+
+	to := time.Now()
+	detail, err := loadAgentDetail(context.Background(), id, to.Add(-24*time.Hour), to)
+	if errors.Is(err, errAgentNotFound) {
+		return c.Status(fiber.StatusNotFound).SendString("Agent not found")
+	}
+	if err != nil {
+		logStorageError(c, "failed to load agent", err, "agent_id", id)
+		return c.Status(fiber.StatusInternalServerError).SendString("failed to load Agent")
+	}
+	page := agentPage(detail)
+	page.Activity, err = loadActivity(context.Background(), id, to.Add(-24*time.Hour), to)
+	if err != nil {
+		logStorageError(c, "failed to load agent activity", err, "agent_id", id)
+		return c.Status(fiber.StatusInternalServerError).SendString("failed to load Agent")
+	}
+
+	return adaptor.HTTPHandler(
+		templ.Handler(templates.Agent(page)),
+	)(c)
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	db "github.com/aphrollo/pulse/storage"
+)
+
+func TestAgentDetailHandler_Validation(t *testing.T) {
+	app := fiber.New()
+	app.Get("/agents/:id", AgentDetailHandler)
+
+	cases := map[string]string{
+		"InvalidAgentID": "/agents/not-a-uuid",
+		"InvalidFrom":    "/agents/123e4567-e89b-12d3-a456-426614174000?from=yesterday",
+		"InvalidRange":   "/agents/123e4567-e89b-12d3-a456-426614174000?from=2025-02-01T00:00:00Z&to=2025-01-01T00:00:00Z",
+	}
+	for name, url := range cases {
+		t.Run(name, func(t *testing.T) {
+			resp, err := app.Test(httptest.NewRequest(http.MethodGet, url, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != fiber.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestAgentPage(t *testing.T) {
+	interval, mean, jitter := 60.0, 61.5, 0.25
+	late := int64(3)
+	last := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	p := agentPage(AgentDetailResponse{
+		Name: "alpha",
+		Heartbeats: HeartbeatStats{
+			Beats:            1400,
+			DeclaredInterval: &interval,
+			MeanInterval:     &mean,
+			Jitter:           &jitter,
+			LateBeats:        &late,
+			LongestGap:       185,
+			LastBeat:         &last,
+		},
+	})
+	if p.DeclaredInterval != "1m0s" || p.MeanInterval != "1m1.5s" || p.Jitter != "250ms" || p.LongestGap != "3m5s" {
+		t.Errorf("Unexpected durations %+v", p)
+	}
+	if p.LateBeats != "3" || p.LastBeat != "2025-03-01T12:00:00Z" {
+		t.Errorf("Unexpected late beats or last beat %+v", p)
+	}
+
+	// An agent that never declared its interval nor beat
+	p = agentPage(AgentDetailResponse{Name: "beta", Heartbeats: HeartbeatStats{LongestGap: 86400}})
+	if p.DeclaredInterval != "-" || p.Jitter != "-" || p.LateBeats != "-" || p.LastBeat != "-" || p.LongestGap != "24h0m0s" {
+		t.Errorf("Unexpected page for an agent without data %+v", p)
+	}
+}
+
+func TestValidateChecks(t *testing.T) {
+	if msg := validateChecks([]HeartbeatCheck{{Name: "database", Status: "ok"}, {Name: "cache", Status: "fail"}}); msg != "" {
+		t.Errorf("Expected valid checks, got %q", msg)
+	}
+	if msg := validateChecks([]HeartbeatCheck{{Status: "ok"}}); msg == "" {
+		t.Error("Expected a check without name to be rejected")
+	}
+	if msg := validateChecks([]HeartbeatCheck{{Name: "database", Status: "degraded"}}); msg == "" {
+		t.Error("Expected an unknown check status to be rejected")
+	}
+	if msg := validateChecks([]HeartbeatCheck{{Name: "api", Status: "fail", Probe: "http", Failures: 3}}); msg != "" {
+		t.Errorf("Expected a valid probe result, got %q", msg)
+	}
+	if msg := validateChecks([]HeartbeatCheck{{Name: "api", Status: "ok", Probe: "grpc"}}); msg == "" {
+		t.Error("Expected an unknown probe type to be rejected")
+	}
+	if msg := validateChecks(make([]HeartbeatCheck, MaxHeartbeatChecks+1)); msg == "" {
+		t.Error("Expected too many checks to be rejected")
+	}
+}
+
+func TestAgentPage_Checks(t *testing.T) {
+	at := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	p := agentPage(AgentDetailResponse{
+		Checks:    []HeartbeatCheck{{Name: "database", Status: "fail", Critical: true, Error: "timeout", Duration: 5000}},
+		CheckedAt: &at,
+	})
+	if len(p.Checks) != 1 || p.Checks[0].OK || !p.Checks[0].Critical || p.Checks[0].Duration != "5000.0 ms" {
+		t.Errorf("Unexpected checks %+v", p.Checks)
+	}
+	if p.CheckedAt != "2025-03-01T12:00:00Z" {
+		t.Errorf("Unexpected checked at %q", p.CheckedAt)
+	}
+}
+
+func TestValidateHost(t *testing.T) {
+	cpu := 42.0
+	if msg := validateHost(&HostSnapshot{CPUPercent: &cpu, Disks: []HostDisk{{Mount: "/"}}}); msg != "" {
+		t.Errorf("Expected a valid host snapshot, got %q", msg)
+	}
+	cpu = 1.8e19
+	h := &HostSnapshot{CPUPercent: &cpu}
+	if msg := validateHost(h); msg != "" || *h.CPUPercent != 100 {
+		t.Errorf("Expected a CPU usage above 100%% to be clamped, got %q and %v", msg, *h.CPUPercent)
+	}
+	if msg := validateHost(&HostSnapshot{Network: make([]HostNetwork, MaxHostEntries+1)}); msg == "" {
+		t.Error("Expected too many interfaces to be rejected")
+	}
+}
+
+func TestAgentPage_Host(t *testing.T) {
+	at := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	cpu := 12.34
+	p := agentPage(AgentDetailResponse{
+		Host: &HostSnapshot{
+			CPUPercent:    &cpu,
+			Load1:         0.5,
+			Load5:         0.25,
+			Load15:        0.125,
+			MemTotal:      4 << 30,
+			MemAvailable:  1 << 30,
+			Disks:         []HostDisk{{Mount: "/", Total: 100 << 30, Free: 75 << 30}},
+			OpenFDs:       12,
+			UptimeSeconds: 90061,
+			Network:       []HostNetwork{{Interface: "eth0", RxBytes: 1536, TxBytes: 512}},
+		},
+		HostAt: &at,
+	})
+	h := p.Host
+	if h == nil || h.At != "2025-03-01T12:00:00Z" || h.CPU != "12.3%" || h.Load != "0.50 0.25 0.12" {
+		t.Fatalf("Unexpected host %+v", h)
+	}
+	if h.Memory != "3.0 GiB / 4.0 GiB (75%)" || h.Uptime != "25h1m1s" || h.OpenFDs != "12" {
+		t.Errorf("Unexpected memory, uptime or open files %+v", h)
+	}
+	if len(h.Disks) != 1 || h.Disks[0].Used != "25.0 GiB (25%)" || h.Disks[0].Size != "100.0 GiB" {
+		t.Errorf("Unexpected disks %+v", h.Disks)
+	}
+	if len(h.Network) != 1 || h.Network[0].Rx != "1.5 KiB" || h.Network[0].Tx != "512 B" {
+		t.Errorf("Unexpected network %+v", h.Network)
+	}
+
+	if p := agentPage(AgentDetailResponse{}); p.Host != nil {
+		t.Errorf("Expected no host without a snapshot, got %+v", p.Host)
+	}
+}
+
+// Heartbeats at known offsets give known intervals, jitter, late beats and gaps
+func TestHeartbeatStats(t *testing.T) {
+	setupApp(t)
+	id := uuid.New()
+	ctx := context.Background()
+	_, err := db.Pool.Exec(ctx, `INSERT INTO agents (id, name, type, heartbeat_interval) VALUES ($1, 'test-Agent', 'default', INTERVAL '60 seconds')`, id)
+	if err != nil {
+		t.Fatalf("Failed to insert Agent: %v", err)
+	}
+	defer db.Pool.Exec(ctx, `DELETE FROM agents WHERE id = $1`, id)
+
+	// Gaps of 60, 60, 120 and 60 seconds, the 120 one late against 1.5 x 60s
+	start := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	for _, offset := range []int{0, 60, 120, 240, 300} {
+		_, err := db.Pool.Exec(ctx, `INSERT INTO agent_heartbeats (time, agent_id, status) VALUES ($1, $2, 'healthy')`,
+			start.Add(time.Duration(offset)*time.Second), id)
+		if err != nil {
+			t.Fatalf("Failed to insert heartbeat: %v", err)
+		}
+	}
+
+	stats, err := heartbeatStats(ctx, start, start.Add(10*time.Minute), &id)
+	if err != nil {
+		t.Fatalf("Failed to compute heartbeat stats: %v", err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("Expected the stats of one Agent, got %+v", stats)
+	}
+	s := stats[0]
+	if s.Beats != 5 || s.LastBeat == nil || !s.LastBeat.Equal(start.Add(300*time.Second)) {
+		t.Errorf("Expected 5 beats, the last at +300s, got %d and %v", s.Beats, s.LastBeat)
+	}
+	if s.DeclaredInterval == nil || *s.DeclaredInterval != 60 {
+		t.Errorf("Expected a declared interval of 60s, got %v", s.DeclaredInterval)
+	}
+	if s.MeanInterval == nil || *s.MeanInterval != 75 {
+		t.Errorf("Expected a mean interval of 75s, got %v", s.MeanInterval)
+	}
+	if s.Jitter == nil || math.Abs(*s.Jitter-30) > 1e-9 {
+		t.Errorf("Expected a jitter of 30s, got %v", s.Jitter)
+	}
+	if s.LateBeats == nil || *s.LateBeats != 1 {
+		t.Errorf("Expected 1 late beat, got %v", s.LateBeats)
+	}
+	// The silence from the last beat to the end of the range is longer than any gap
+	if s.LongestGap != 300 {
+		t.Errorf("Expected a longest gap of 300s, got %v", s.LongestGap)
+	}
+}
@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/aphrollo/pulse/metrics"
+	db "github.com/aphrollo/pulse/storage"
+	"github.com/aphrollo/pulse/templates"
+)
+
+// Limits of a logs request, longer messages are cut rather than rejected
+const (
+	MaxLogEntries       = 1000
+	MaxLogMessageLength = 8 << 10
+	MaxLogSourceLength  = 256
+	MaxLogAttrs         = 32
+)
+
+// LogQuota is the number of log lines an agent may ship per minute, 0 for no limit
+var LogQuota = 6000
+
+// logLevels are the accepted levels, from the least to the most severe
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// LogEntry is one log line shipped by an agent
+type LogEntry struct {
+	Time    time.Time         `json:"time,omitempty"` // Defaults to the time of ingestion
+	Level   string            `json:"level" example:"error"`
+	Source  string            `json:"source,omitempty" example:"stderr"`
+	Message string            `json:"message" example:"connection refused"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+}
+
+// AgentLogsRequest Request to ship log lines of a Agent
+type AgentLogsRequest struct {
+	ID      string     `json:"id"` // Agent UUID string
+	Entries []LogEntry `json:"entries"`
+}
+
+// truncate cuts s to at most n bytes without splitting a UTF-8 sequence
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// validateLogEntry checks a single entry, cuts its message and fills in its timestamp
+func validateLogEntry(e *LogEntry, now time.Time) string {
+	if !isLogLevel(e.Level) {
+		return "invalid level"
+	}
+	if e.Message == "" {
+		return "message is required"
+	}
+	if len(e.Source) > MaxLogSourceLength {
+		return "source is too long"
+	}
+	if len(e.Attrs) > MaxLogAttrs {
+		return "too many attrs"
+	}
+	e.Message = truncate(strings.ToValidUTF8(e.Message, "�"), MaxLogMessageLength)
+	e.Time = clientTime(e.Time, now)
+	return ""
+}
+
+// validateLogs checks a logs request, fills in the entry timestamps and returns the Agent's ID
+func validateLogs(req *AgentLogsRequest, now time.Time) (uuid.UUID, string) {
+	id, err := uuid.Parse(req.ID)
+	if err != nil {
+		return id, "invalid UUID"
+	}
+	if len(req.Entries) == 0 {
+		return id, "entries are required"
+	}
+	if len(req.Entries) > MaxLogEntries {
+		return id, "too many entries"
+	}
+	for i := range req.Entries {
+		if msg := validateLogEntry(&req.Entries[i], now); msg != "" {
+			return id, msg
+		}
+	}
+	return id, ""
+}
+
+func isLogLevel(level string) bool {
+	for _, l := range logLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// levelsFrom returns level and the levels more severe than it
+func levelsFrom(level string) []string {
+	for i, l := range logLevels {
+		if l == level {
+			return logLevels[i:]
+		}
+	}
+	return nil
+}
+
+// logQuotas counts the lines each agent shipped within the current minute
+type logQuotas struct {
+	mu      sync.Mutex
+	windows map[uuid.UUID]*quotaWindow
+}
+
+type quotaWindow struct {
+	start time.Time
+	used  int
+}
+
+var agentLogQuotas = &logQuotas{windows: map[uuid.UUID]*quotaWindow{}}
+
+// take accounts n lines of an agent against limit. When they don't fit it
+// returns false and how long until the next window. A batch is accepted
+// whole, even over the limit, as the first of its window so an agent can't be
+// locked out by batches larger than its quota.
+func (q *logQuotas) take(id uuid.UUID, n, limit int, now time.Time) (time.Duration, bool) {
+	if limit <= 0 {
+		return 0, true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	w := q.windows[id]
+	if w == nil || now.Sub(w.start) >= time.Minute {
+		// Drop the windows that ended so agents gone away don't accumulate
+		for other, ow := range q.windows {
+			if now.Sub(ow.start) >= time.Minute {
+				delete(q.windows, other)
+			}
+		}
+		w = &quotaWindow{start: now}
+		q.windows[id] = w
+	}
+	if w.used > 0 && w.used+n > limit {
+		return w.start.Add(time.Minute).Sub(now), false
+	}
+	w.used += n
+	return 0, true
+}
+
+// retryAfter sets the Retry-After header to d, rounded up to whole seconds
+func retryAfter(c *fiber.Ctx, d time.Duration) {
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(max(1, int(math.Ceil(d.Seconds())))))
+}
+
+// AgentLogsHandler stores log lines shipped by a Agent
+// @Summary Ship Agent logs
+// @Description Stores a batch of log lines for a Agent. Lines are limited per Agent and minute, and shed first while pulse is overloaded; both answers carry a Retry-After header.
+// @Tags Agent
+// @Accept json
+// @Produce json
+// @Param request body AgentLogsRequest true "Agent log lines"
+// @Success 200 {object} ApiResponse "Success response `{"message":"OK"}`"
+// @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
+// @Failure 404 {object} ApiErrorResponse "Agent not found"
+// @Failure 429 {object} ApiErrorResponse "The Agent's log quota is used up"
+// @Failure 503 {object} ApiErrorResponse "pulse is overloaded"
+// @Router /agent/logs [post]
+func AgentLogsHandler(c *fiber.Ctx) error {
+	var req AgentLogsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return ingestionError(c, "logs", fiber.StatusBadRequest, "invalid request body")
+	}
+
+	now := time.Now()
+	id, msg := validateLogs(&req, now)
+	if msg != "" {
+		return ingestionError(c, "logs", fiber.StatusBadRequest, msg)
+	}
+
+	// Logs are the least urgent payload, they give way to heartbeats and updates
+	if metrics.IngestionQueueDepth() > MaxIngestionQueueDepth {
+		retryAfter(c, time.Second)
+		metrics.IngestionErrors.WithLabelValues("logs", "overloaded").Inc()
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "overloaded"})
+	}
+	if wait, ok := agentLogQuotas.take(id, len(req.Entries), LogQuota, now); !ok {
+		retryAfter(c, wait)
+		metrics.IngestionErrors.WithLabelValues("logs", "quota").Inc()
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "log quota exceeded"})
+	}
+
+	err := insertLogs(context.Background(), id, req.Entries)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" { // foreign_key_violation
+		return ingestionError(c, "logs", fiber.StatusNotFound, "agent not found")
+	}
+	if err != nil {
+		logStorageError(c, "failed to insert logs", err, "agent_id", id)
+		return ingestionError(c, "logs", fiber.StatusInternalServerError, "failed to insert logs")
+	}
+
+	return c.JSON(fiber.Map{"status": "OK"})
+}
+
+var logColumns = []string{"time", "agent_id", "level", "source", "message", "attrs"}
+
+// insertLogs copies validated entries of one agent into agent_logs
+func insertLogs(ctx context.Context, id uuid.UUID, entries []LogEntry) error {
+	_, err := db.Pool.CopyFrom(ctx, pgx.Identifier{"agent_logs"}, logColumns,
+		pgx.CopyFromSlice(len(entries), func(i int) ([]any, error) {
+			e := entries[i]
+			var attrs any
+			if len(e.Attrs) > 0 {
+				attrs = e.Attrs
+			}
+			return []any{e.Time, id, e.Level, e.Source, e.Message, attrs}, nil
+		}),
+	)
+	return err
+}
+
+// DefaultLogLimit and MaxLogLimit bound the lines returned by a logs query
+const (
+	DefaultLogLimit = 100
+	MaxLogLimit     = 1000
+)
+
+// LogRecord is a stored log line
+type LogRecord struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level" example:"error"`
+	Source  string            `json:"source" example:"stderr"`
+	Message string            `json:"message" example:"connection refused"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+}
+
+// AgentLogsQueryHandler searches the log lines of a Agent
+// @Summary Search Agent logs
+// @Description Returns the log lines of a Agent within a time range, newest first, optionally from a minimum level and matching a full-text query
+// @Tags Agent
+// @Produce json
+// @Param id path string true "Agent UUID"
+// @Param from query string false "Range start (RFC3339), defaults to one hour ago"
+// @Param to query string false "Range end (RFC3339), defaults to now"
+// @Param level query string false "Minimum level: debug, info, warn or error"
+// @Param q query string false "Words the message must contain"
+// @Param limit query int false "Maximum number of lines, defaults to 100, at most 1000"
+// @Success 200 {array} LogRecord
+// @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
+// @Router /agents/{id}/logs [get]
+func AgentLogsQueryHandler(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid UUID"})
+	}
+
+	from, to, msg := parseTimeRange(c)
+	if msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+
+	levels := levelsFrom(c.Query("level", "debug"))
+	if levels == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid level"})
+	}
+
+	limit := c.QueryInt("limit", DefaultLogLimit)
+	if limit < 1 || limit > MaxLogLimit {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid limit"})
+	}
+
+	records, err := queryLogs(context.Background(), id, from, to, levels, c.Query("q"), limit)
+	if err != nil {
+		logStorageError(c, "failed to query logs", err, "agent_id", id)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to query logs"})
+	}
+	return c.JSON(records)
+}
+
+// queryLogs returns the newest lines of an agent within [from, to) at one of
+// levels, matching text unless it is empty
+func queryLogs(ctx context.Context, id uuid.UUID, from, to time.Time, levels []string, text string, limit int) ([]LogRecord, error) {
+	sql := `
+		SELECT time, level, source, message, attrs
+		FROM agent_logs
+		WHERE agent_id = $1 AND time >= $2 AND time < $3 AND level = ANY($4)
+		  AND ($5 = '' OR to_tsvector('simple', message) @@ plainto_tsquery('simple', $5))
+		ORDER BY time DESC
+		LIMIT $6
+	`
+	rows, err := db.Pool.Query(ctx, sql, id, from, to, levels, text, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (LogRecord, error) {
+		var r LogRecord
+		err := row.Scan(&r.Time, &r.Level, &r.Source, &r.Message, &r.Attrs)
+		return r, err
+	})
+}
+
+// activityLimit bounds the entries of the agent page's activity timeline
+const activityLimit = 200
+
+// loadActivity returns the status changes and log lines of an agent within
+// [from, to), newest first, for the agent page
+func loadActivity(ctx context.Context, id uuid.UUID, from, to time.Time) ([]templates.AgentActivity, error) {
+	sql := `
+		(SELECT time, 'status', to_status::text, '', coalesce(from_status::text || ' -> ', '') || to_status::text
+		 FROM agent_status_transitions
+		 WHERE agent_id = $1 AND time >= $2 AND time < $3
+		 ORDER BY time DESC LIMIT $4)
+		UNION ALL
+		(SELECT time, 'log', level, source, message
+		 FROM agent_logs
+		 WHERE agent_id = $1 AND time >= $2 AND time < $3
+		 ORDER BY time DESC LIMIT $4)
+		ORDER BY 1 DESC
+		LIMIT $4
+	`
+	rows, err := db.Pool.Query(ctx, sql, id, from, to, activityLimit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (templates.AgentActivity, error) {
+		var a templates.AgentActivity
+		var at time.Time
+		err := row.Scan(&at, &a.Kind, &a.Level, &a.Source, &a.Text)
+		a.Time = at.UTC().Format(time.RFC3339)
+		return a, err
+	})
+}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	db "github.com/aphrollo/pulse/storage"
+)
+
+func TestValidateLogEntry(t *testing.T) {
+	now := time.Now()
+
+	e := LogEntry{Level: "warn", Source: "stderr", Message: "disk almost full"}
+	if msg := validateLogEntry(&e, now); msg != "" {
+		t.Fatalf("Expected valid entry, got %q", msg)
+	}
+	if !e.Time.Equal(now) {
+		t.Errorf("Expected missing time to default to now, got %v", e.Time)
+	}
+
+	long := LogEntry{Level: "info", Message: strings.Repeat("é", MaxLogMessageLength)}
+	if msg := validateLogEntry(&long, now); msg != "" {
+		t.Fatalf("Expected long message to be cut, got %q", msg)
+	}
+	if len(long.Message) > MaxLogMessageLength || !utf8.ValidString(long.Message) {
+		t.Errorf("Expected message cut to %d bytes of valid UTF-8, got %d bytes", MaxLogMessageLength, len(long.Message))
+	}
+
+	invalid := map[string]LogEntry{
+		"Level":   {Level: "fatal", Message: "x"},
+		"Message": {Level: "info"},
+		"Source":  {Level: "info", Message: "x", Source: strings.Repeat("s", MaxLogSourceLength+1)},
+	}
+	for name, e := range invalid {
+		if msg := validateLogEntry(&e, now); msg == "" {
+			t.Errorf("Expected invalid %s to be rejected", name)
+		}
+	}
+}
+
+func TestLevelsFrom(t *testing.T) {
+	if got := levelsFrom("warn"); len(got) != 2 || got[0] != "warn" || got[1] != "error" {
+		t.Errorf("Expected warn and error, got %v", got)
+	}
+	if got := levelsFrom("debug"); len(got) != len(logLevels) {
+		t.Errorf("Expected every level, got %v", got)
+	}
+	if got := levelsFrom("trace"); got != nil {
+		t.Errorf("Expected nil for an unknown level, got %v", got)
+	}
+}
+
+func TestLogQuotas(t *testing.T) {
+	q := &logQuotas{windows: map[uuid.UUID]*quotaWindow{}}
+	id, other := uuid.New(), uuid.New()
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	if _, ok := q.take(id, 8, 10, start); !ok {
+		t.Fatal("Expected the first batch to fit")
+	}
+	wait, ok := q.take(id, 5, 10, start.Add(20*time.Second))
+	if ok {
+		t.Fatal("Expected a batch over the quota to be rejected")
+	}
+	if wait != 40*time.Second {
+		t.Errorf("Expected to wait for the next window in 40s, got %v", wait)
+	}
+	if _, ok := q.take(id, 2, 10, start.Add(30*time.Second)); !ok {
+		t.Error("Expected a batch within the quota to fit")
+	}
+	if _, ok := q.take(other, 10, 10, start.Add(30*time.Second)); !ok {
+		t.Error("Expected quotas to be per agent")
+	}
+	if _, ok := q.take(id, 5, 10, start.Add(time.Minute)); !ok {
+		t.Error("Expected the quota to reset in the next window")
+	}
+	if _, ok := q.take(other, 50, 10, start.Add(2*time.Minute)); !ok {
+		t.Error("Expected a batch larger than the quota to fit as the first of its window")
+	}
+	if len(q.windows) != 1 {
+		t.Errorf("Expected ended windows to be dropped, got %d", len(q.windows))
+	}
+	if _, ok := q.take(id, 1000, 0, start); !ok {
+		t.Error("Expected no limit with a zero quota")
+	}
+}
+
+func TestAgentLogsHandler_Validation(t *testing.T) {
+	app := fiber.New()
+	app.Post("/agent/logs", AgentLogsHandler)
+
+	cases := map[string]string{
+		"InvalidJSON":  `{"id": "123e4567-e89b-12d3-a456-426614174000", "entries":`,
+		"InvalidUUID":  `{"id": "not-a-uuid", "entries": [{"level": "info", "message": "up"}]}`,
+		"NoEntries":    `{"id": "123e4567-e89b-12d3-a456-426614174000", "entries": []}`,
+		"InvalidLevel": `{"id": "123e4567-e89b-12d3-a456-426614174000", "entries": [{"level": "loud", "message": "up"}]}`,
+		"NoMessage":    `{"id": "123e4567-e89b-12d3-a456-426614174000", "entries": [{"level": "info"}]}`,
+	}
+	for name, body := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/agent/logs", bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, _ := app.Test(req)
+			if resp.StatusCode != fiber.StatusBadRequest {
+				t.Errorf("Expected 400 Bad Request, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestAgentLogsHandler_Quota(t *testing.T) {
+	defer func(quota int) { LogQuota = quota }(LogQuota)
+	LogQuota = 10
+	id := uuid.New()
+	agentLogQuotas.take(id, 10, LogQuota, time.Now())
+
+	app := fiber.New()
+	app.Post("/agent/logs", AgentLogsHandler)
+	body := `{"id": "` + id.String() + `", "entries": [{"level": "info", "message": "up"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/agent/logs", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, _ := app.Test(req)
+	if resp.StatusCode != fiber.StatusTooManyRequests {
+		t.Fatalf("Expected 429 Too Many Requests, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+}
+
+func TestAgentLogsQueryHandler_Validation(t *testing.T) {
+	app := fiber.New()
+	app.Get("/agents/:id/logs", AgentLogsQueryHandler)
+
+	cases := map[string]string{
+		"InvalidUUID":  "/agents/not-a-uuid/logs",
+		"InvalidLevel": "/agents/123e4567-e89b-12d3-a456-426614174000/logs?level=loud",
+		"InvalidLimit": "/agents/123e4567-e89b-12d3-a456-426614174000/logs?limit=5000",
+		"InvalidRange": "/agents/123e4567-e89b-12d3-a456-426614174000/logs?from=2025-01-02T00:00:00Z&to=2025-01-01T00:00:00Z",
+	}
+	for name, url := range cases {
+		t.Run(name, func(t *testing.T) {
+			resp, _ := app.Test(httptest.NewRequest(http.MethodGet, url, nil))
+			if resp.StatusCode != fiber.StatusBadRequest {
+				t.Errorf("Expected 400 Bad Request, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestAgentLogsQueryHandler_Search(t *testing.T) {
+	app := setupApp(t)
+	app.Post("/agent/logs", AgentLogsHandler)
+	app.Get("/agents/:id/logs", AgentLogsQueryHandler)
+	id := uuid.NewString()
+	ctx := context.Background()
+	if _, err := db.Pool.Exec(ctx, `INSERT INTO agents (id, name, type) VALUES ($1, 'test-Agent', 'default')`, id); err != nil {
+		t.Fatalf("Failed to insert Agent: %v", err)
+	}
+	defer db.Pool.Exec(ctx, `DELETE FROM agents WHERE id = $1`, id)
+
+	body := `{"id": "` + id + `", "entries": [
+		{"level": "debug", "source": "stdout", "message": "connection pool resized"},
+		{"level": "info", "source": "stdout", "message": "import started"},
+		{"level": "warn", "source": "stderr", "message": "slow connection to the database"},
+		{"level": "error", "source": "stderr", "message": "Connection refused by upstream"}
+	]}`
+	req := httptest.NewRequest(http.MethodPost, "/agent/logs", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %d", resp.StatusCode)
+	}
+
+	search := func(query string) []LogRecord {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/agents/"+id+"/logs?"+query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("Expected status 200 OK for %q, got %d", query, resp.StatusCode)
+		}
+		var records []LogRecord
+		if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+			t.Fatal(err)
+		}
+		return records
+	}
+	levels := func(records []LogRecord) []string {
+		var got []string
+		for _, r := range records {
+			got = append(got, r.Level)
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	cases := map[string][]string{
+		"":                        {"debug", "error", "info", "warn"},
+		"level=warn":              {"error", "warn"},
+		"q=connection":            {"debug", "error", "warn"},
+		"q=connection+refused":    {"error"},
+		"level=info&q=connection": {"error", "warn"},
+		"level=error&q=import":    nil,
+		"q=database&level=debug":  {"warn"},
+	}
+	for query, want := range cases {
+		if got := levels(search(query)); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected levels %v for %q, got %v", want, query, got)
+		}
+	}
+}
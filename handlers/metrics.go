@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/aphrollo/pulse/metrics"
+	db "github.com/aphrollo/pulse/storage"
+)
+
+// MaxAgentSeries caps the number of per-agent series exposed on /metrics.
+// The most recently seen agents win; the per type/status counts still cover the whole fleet.
+var MaxAgentSeries = 1000
+
+func init() {
+	metrics.Registry.MustRegister(newFleetCollector())
+}
+
+// fleetCollector reads the fleet state from the database at scrape time
+type fleetCollector struct {
+	agents       *prometheus.Desc
+	heartbeatAge *prometheus.Desc
+	jitter       *prometheus.Desc
+	lateBeats    *prometheus.Desc
+	longestGap   *prometheus.Desc
+	scrapeErrors prometheus.Counter
+}
+
+func newFleetCollector() *fleetCollector {
+	return &fleetCollector{
+		agents: prometheus.NewDesc(
+			"pulse_fleet_agents",
+			"Registered agents by type and last reported status.",
+			[]string{"type", "status"}, nil,
+		),
+		heartbeatAge: prometheus.NewDesc(
+			"pulse_fleet_agent_heartbeat_age_seconds",
+			"Seconds since the last heartbeat of each agent.",
+			[]string{"agent_id", "type"}, nil,
+		),
+		jitter: prometheus.NewDesc(
+			"pulse_fleet_agent_heartbeat_jitter_seconds",
+			"Standard deviation of the seconds between heartbeats of each agent over the last hour.",
+			[]string{"agent_id", "type"}, nil,
+		),
+		lateBeats: prometheus.NewDesc(
+			"pulse_fleet_agent_heartbeat_late_beats",
+			"Heartbeats of each agent that arrived late against its declared interval over the last hour.",
+			[]string{"agent_id", "type"}, nil,
+		),
+		longestGap: prometheus.NewDesc(
+			"pulse_fleet_agent_heartbeat_longest_gap_seconds",
+			"Longest silence between heartbeats of each agent over the last hour.",
+			[]string{"agent_id", "type"}, nil,
+		),
+		scrapeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pulse_fleet_scrape_errors_total",
+			Help: "Failed attempts to read the fleet state for /metrics.",
+		}),
+	}
+}
+
+func (f *fleetCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- f.agents
+	ch <- f.heartbeatAge
+	ch <- f.jitter
+	ch <- f.lateBeats
+	ch <- f.longestGap
+	f.scrapeErrors.Describe(ch)
+}
+
+func (f *fleetCollector) Collect(ch chan<- prometheus.Metric) {
+	defer f.scrapeErrors.Collect(ch)
+	if db.Pool == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sql := `
+		SELECT a.id::text, COALESCE(a.type, ''), COALESCE(h.status::text, ''),
+		       EXTRACT(EPOCH FROM now() - h.time)::float8
+		FROM agents a
+		LEFT JOIN LATERAL (
+			SELECT status, time FROM agent_heartbeats
+			WHERE agent_id = a.id
+			ORDER BY time DESC
+			LIMIT 1
+		) h ON true
+		ORDER BY h.time DESC NULLS LAST
+	`
+	rows, err := db.Pool.Query(ctx, sql)
+	if err != nil {
+		slog.Error("failed to read fleet state", "error", err)
+		f.scrapeErrors.Inc()
+		return
+	}
+	defer rows.Close()
+
+	type key struct{ agentType, status string }
+	counts := make(map[key]int)
+	series := 0
+	for rows.Next() {
+		var id, agentType, status string
+		var age *float64
+		if err := rows.Scan(&id, &agentType, &status, &age); err != nil {
+			slog.Error("failed to read fleet state", "error", err)
+			f.scrapeErrors.Inc()
+			return
+		}
+
+		// Keep label values bounded: unknown types and statuses are folded together
+		if !isAllowedAgentType(agentType) {
+			agentType = "other"
+		}
+		if !allowedAgentStatus[status] {
+			status = "unknown"
+		}
+		counts[key{agentType, status}]++
+
+		if age != nil && series < MaxAgentSeries {
+			ch <- prometheus.MustNewConstMetric(f.heartbeatAge, prometheus.GaugeValue, *age, id, agentType)
+			series++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("failed to read fleet state", "error", err)
+		f.scrapeErrors.Inc()
+		return
+	}
+
+	for k, n := range counts {
+		ch <- prometheus.MustNewConstMetric(f.agents, prometheus.GaugeValue, float64(n), k.agentType, k.status)
+	}
+
+	f.collectHeartbeatStats(ctx, ch)
+}
+
+// collectHeartbeatStats exposes heartbeat regularity so alert rules can fire
+// on agents that beat late long before they go silent
+func (f *fleetCollector) collectHeartbeatStats(ctx context.Context, ch chan<- prometheus.Metric) {
+	to := time.Now()
+	stats, err := heartbeatStats(ctx, to.Add(-time.Hour), to, nil)
+	if err != nil {
+		slog.Error("failed to read heartbeat stats", "error", err)
+		f.scrapeErrors.Inc()
+		return
+	}
+
+	for i, s := range stats {
+		if i >= MaxAgentSeries {
+			break
+		}
+		agentType := s.Type
+		if !isAllowedAgentType(agentType) {
+			agentType = "other"
+		}
+		ch <- prometheus.MustNewConstMetric(f.longestGap, prometheus.GaugeValue, s.LongestGap, s.AgentID, agentType)
+		if s.Jitter != nil {
+			ch <- prometheus.MustNewConstMetric(f.jitter, prometheus.GaugeValue, *s.Jitter, s.AgentID, agentType)
+		}
+		if s.LateBeats != nil {
+			ch <- prometheus.MustNewConstMetric(f.lateBeats, prometheus.GaugeValue, float64(*s.LateBeats), s.AgentID, agentType)
+		}
+	}
+}
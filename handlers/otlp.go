@@ -0,0 +1,300 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	collogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	db "github.com/aphrollo/pulse/storage"
+)
+
+// OTLPMetricNames selects the OpenTelemetry gauge metrics stored in agent_metrics, by OTel name
+var OTLPMetricNames = map[string]bool{}
+
+// otlpNamespace derives stable agent UUIDs from OpenTelemetry service identities
+var otlpNamespace = uuid.MustParse("5d1c8f0e-6a4b-4c1e-9a57-0b3f2f6e7a10")
+
+const (
+	otlpContentProtobuf = "application/x-protobuf"
+	otlpContentJSON     = "application/json"
+)
+
+// otlpAgent is the pulse agent a telemetry resource maps to
+type otlpAgent struct {
+	ID   uuid.UUID
+	Name string
+	Type string
+	Info map[string]interface{}
+}
+
+// otlpResourceAgent maps a resource to an agent using service.instance.id,
+// falling back to service.name. Resources without either are ignored.
+func otlpResourceAgent(res *resourcepb.Resource) (otlpAgent, bool) {
+	info := otlpAttributes(res.GetAttributes())
+
+	instance, _ := info["service.instance.id"].(string)
+	service, _ := info["service.name"].(string)
+	key := instance
+	if key == "" {
+		key = service
+	}
+	if key == "" {
+		return otlpAgent{}, false
+	}
+
+	id, err := uuid.Parse(key)
+	if err != nil {
+		id = uuid.NewSHA1(otlpNamespace, []byte(key))
+	}
+	name := service
+	if name == "" {
+		name = key
+	}
+
+	agentType, _ := info["pulse.agent.type"].(string)
+	if !isAllowedAgentType(agentType) && len(AllowedAgentTypes) > 0 {
+		agentType = AllowedAgentTypes[0]
+	}
+
+	return otlpAgent{ID: id, Name: name, Type: agentType, Info: info}, true
+}
+
+func otlpAttributes(attrs []*commonpb.KeyValue) map[string]interface{} {
+	out := make(map[string]interface{}, len(attrs))
+	for _, kv := range attrs {
+		out[kv.GetKey()] = otlpValue(kv.GetValue())
+	}
+	return out
+}
+
+func otlpValue(v *commonpb.AnyValue) interface{} {
+	switch v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.GetStringValue()
+	case *commonpb.AnyValue_BoolValue:
+		return v.GetBoolValue()
+	case *commonpb.AnyValue_IntValue:
+		return v.GetIntValue()
+	case *commonpb.AnyValue_DoubleValue:
+		return v.GetDoubleValue()
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(v.GetBytesValue())
+	case *commonpb.AnyValue_ArrayValue:
+		values := v.GetArrayValue().GetValues()
+		out := make([]interface{}, len(values))
+		for i, item := range values {
+			out[i] = otlpValue(item)
+		}
+		return out
+	case *commonpb.AnyValue_KvlistValue:
+		return otlpAttributes(v.GetKvlistValue().GetValues())
+	}
+	return nil
+}
+
+// otlpGaugeSamples converts the selected gauges of a resource into samples.
+// OTel names use dots, which are replaced so they pass metric name validation.
+func otlpGaugeSamples(rm *metricspb.ResourceMetrics) []MetricSample {
+	var samples []MetricSample
+	for _, sm := range rm.GetScopeMetrics() {
+		for _, m := range sm.GetMetrics() {
+			if m.GetGauge() == nil || !OTLPMetricNames[m.GetName()] {
+				continue
+			}
+			name := strings.NewReplacer(".", "_", "-", "_", "/", "_").Replace(m.GetName())
+			for _, dp := range m.GetGauge().GetDataPoints() {
+				s := MetricSample{Name: name, Labels: map[string]string{}}
+				switch dp.GetValue().(type) {
+				case *metricspb.NumberDataPoint_AsDouble:
+					s.Value = dp.GetAsDouble()
+				case *metricspb.NumberDataPoint_AsInt:
+					s.Value = float64(dp.GetAsInt())
+				default:
+					continue
+				}
+				if ts := dp.GetTimeUnixNano(); ts > 0 {
+					s.Time = time.Unix(0, int64(ts))
+				}
+				for _, kv := range dp.GetAttributes() {
+					if sv, ok := kv.GetValue().GetValue().(*commonpb.AnyValue_StringValue); ok {
+						s.Labels[strings.ReplaceAll(kv.GetKey(), ".", "_")] = sv.StringValue
+					}
+				}
+				if validateSample(&s, time.Now()) == "" {
+					samples = append(samples, s)
+				}
+			}
+		}
+	}
+	return samples
+}
+
+// decodeOTLP parses a protobuf or JSON encoded OTLP request body
+func decodeOTLP(c *fiber.Ctx, msg proto.Message) error {
+	switch strings.TrimSpace(strings.Split(c.Get(fiber.HeaderContentType), ";")[0]) {
+	case otlpContentProtobuf:
+		return proto.Unmarshal(c.Body(), msg)
+	case otlpContentJSON:
+		return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(c.Body(), msg)
+	}
+	return fiber.ErrUnsupportedMediaType
+}
+
+// encodeOTLP writes the OTLP response using the encoding of the request
+func encodeOTLP(c *fiber.Ctx, msg proto.Message) error {
+	var body []byte
+	var err error
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), otlpContentJSON) {
+		c.Set(fiber.HeaderContentType, otlpContentJSON)
+		body, err = protojson.Marshal(msg)
+	} else {
+		c.Set(fiber.HeaderContentType, otlpContentProtobuf)
+		body, err = proto.Marshal(msg)
+	}
+	if err != nil {
+		return err
+	}
+	return c.Send(body)
+}
+
+// touchOTLPAgent auto-registers the agent of a resource and records a heartbeat
+func touchOTLPAgent(ctx context.Context, a otlpAgent) error {
+	sql := `
+		INSERT INTO agents (id, name, type, info)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, info = EXCLUDED.info
+	`
+	if _, err := db.Pool.Exec(ctx, sql, a.ID, a.Name, a.Type, a.Info); err != nil {
+		return err
+	}
+	_, err := db.Pool.Exec(ctx, `INSERT INTO agent_heartbeats (agent_id, status) VALUES ($1, 'healthy')`, a.ID)
+	return err
+}
+
+// touchOTLPResources registers and heartbeats every identifiable resource
+func touchOTLPResources(ctx context.Context, resources []*resourcepb.Resource) error {
+	for _, res := range resources {
+		a, ok := otlpResourceAgent(res)
+		if !ok {
+			continue
+		}
+		if err := touchOTLPAgent(ctx, a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OTLPMetricsHandler receives OTLP/HTTP metrics
+// @Summary OTLP metrics
+// @Description Accepts OTLP/HTTP metrics (protobuf or JSON). Each resource is registered as a Agent and counts as a heartbeat; gauges listed in OTLP_METRICS are stored as Agent metrics
+// @Tags OTLP
+// @Accept application/x-protobuf,json
+// @Produce application/x-protobuf,json
+// @Success 200 {string} string "ExportMetricsServiceResponse"
+// @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
+// @Failure 415 {object} ApiErrorResponse "UNSUPPORTED_MEDIA_TYPE - Only application/x-protobuf and application/json are accepted"
+// @Router /otlp/v1/metrics [post]
+func OTLPMetricsHandler(c *fiber.Ctx) error {
+	var req colmetrics.ExportMetricsServiceRequest
+	if err := decodeOTLP(c, &req); err != nil {
+		if err == fiber.ErrUnsupportedMediaType {
+			return ingestionError(c, "otlp", fiber.StatusUnsupportedMediaType, "unsupported content type")
+		}
+		return ingestionError(c, "otlp", fiber.StatusBadRequest, "invalid request body")
+	}
+
+	ctx := context.Background()
+	for _, rm := range req.GetResourceMetrics() {
+		a, ok := otlpResourceAgent(rm.GetResource())
+		if !ok {
+			continue
+		}
+		if err := touchOTLPAgent(ctx, a); err != nil {
+			logStorageError(c, "failed to register OTLP agent", err, "agent_id", a.ID)
+			return ingestionError(c, "otlp", fiber.StatusInternalServerError, "failed to register Agent")
+		}
+		if samples := otlpGaugeSamples(rm); len(samples) > 0 {
+			if err := insertSamples(ctx, a.ID, samples); err != nil {
+				logStorageError(c, "failed to insert OTLP metrics", err, "agent_id", a.ID)
+				return ingestionError(c, "otlp", fiber.StatusInternalServerError, "failed to insert metrics")
+			}
+		}
+	}
+
+	return encodeOTLP(c, &colmetrics.ExportMetricsServiceResponse{})
+}
+
+// OTLPTracesHandler receives OTLP/HTTP traces
+// @Summary OTLP traces
+// @Description Accepts OTLP/HTTP traces (protobuf or JSON). Spans are not stored; each resource is registered as a Agent and counts as a heartbeat
+// @Tags OTLP
+// @Accept application/x-protobuf,json
+// @Produce application/x-protobuf,json
+// @Success 200 {string} string "ExportTraceServiceResponse"
+// @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
+// @Failure 415 {object} ApiErrorResponse "UNSUPPORTED_MEDIA_TYPE - Only application/x-protobuf and application/json are accepted"
+// @Router /otlp/v1/traces [post]
+func OTLPTracesHandler(c *fiber.Ctx) error {
+	var req coltrace.ExportTraceServiceRequest
+	if err := decodeOTLP(c, &req); err != nil {
+		if err == fiber.ErrUnsupportedMediaType {
+			return ingestionError(c, "otlp", fiber.StatusUnsupportedMediaType, "unsupported content type")
+		}
+		return ingestionError(c, "otlp", fiber.StatusBadRequest, "invalid request body")
+	}
+
+	resources := make([]*resourcepb.Resource, 0, len(req.GetResourceSpans()))
+	for _, rs := range req.GetResourceSpans() {
+		resources = append(resources, rs.GetResource())
+	}
+	if err := touchOTLPResources(context.Background(), resources); err != nil {
+		logStorageError(c, "failed to register OTLP agent", err)
+		return ingestionError(c, "otlp", fiber.StatusInternalServerError, "failed to register Agent")
+	}
+
+	return encodeOTLP(c, &coltrace.ExportTraceServiceResponse{})
+}
+
+// OTLPLogsHandler receives OTLP/HTTP logs
+// @Summary OTLP logs
+// @Description Accepts OTLP/HTTP logs (protobuf or JSON). Log records are not stored; each resource is registered as a Agent and counts as a heartbeat
+// @Tags OTLP
+// @Accept application/x-protobuf,json
+// @Produce application/x-protobuf,json
+// @Success 200 {string} string "ExportLogsServiceResponse"
+// @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
+// @Failure 415 {object} ApiErrorResponse "UNSUPPORTED_MEDIA_TYPE - Only application/x-protobuf and application/json are accepted"
+// @Router /otlp/v1/logs [post]
+func OTLPLogsHandler(c *fiber.Ctx) error {
+	var req collogs.ExportLogsServiceRequest
+	if err := decodeOTLP(c, &req); err != nil {
+		if err == fiber.ErrUnsupportedMediaType {
+			return ingestionError(c, "otlp", fiber.StatusUnsupportedMediaType, "unsupported content type")
+		}
+		return ingestionError(c, "otlp", fiber.StatusBadRequest, "invalid request body")
+	}
+
+	resources := make([]*resourcepb.Resource, 0, len(req.GetResourceLogs()))
+	for _, rl := range req.GetResourceLogs() {
+		resources = append(resources, rl.GetResource())
+	}
+	if err := touchOTLPResources(context.Background(), resources); err != nil {
+		logStorageError(c, "failed to register OTLP agent", err)
+		return ingestionError(c, "otlp", fiber.StatusInternalServerError, "failed to register Agent")
+	}
+
+	return encodeOTLP(c, &collogs.ExportLogsServiceResponse{})
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	colmetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func stringAttr(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func TestOTLPResourceAgent(t *testing.T) {
+	AllowedAgentTypes = []string{"default", "bot"}
+
+	res := &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+		stringAttr("service.name", "billing"),
+		stringAttr("service.instance.id", "billing-7f9c"),
+		stringAttr("pulse.agent.type", "bot"),
+	}}
+	a, ok := otlpResourceAgent(res)
+	if !ok {
+		t.Fatal("Expected resource to map to an agent")
+	}
+	if a.ID != uuid.NewSHA1(otlpNamespace, []byte("billing-7f9c")) {
+		t.Errorf("Expected ID derived from service.instance.id, got %s", a.ID)
+	}
+	if a.Name != "billing" || a.Type != "bot" {
+		t.Errorf("Expected name billing and type bot, got %s and %s", a.Name, a.Type)
+	}
+	if a.Info["service.instance.id"] != "billing-7f9c" {
+		t.Errorf("Expected resource attributes in info, got %v", a.Info)
+	}
+
+	// Same service name without an instance ID maps to the same agent every time
+	byName := &resourcepb.Resource{Attributes: []*commonpb.KeyValue{stringAttr("service.name", "billing")}}
+	first, _ := otlpResourceAgent(byName)
+	second, _ := otlpResourceAgent(byName)
+	if first.ID != second.ID || first.Type != "default" {
+		t.Errorf("Expected stable ID and default type, got %s/%s and %s", first.ID, second.ID, first.Type)
+	}
+
+	if _, ok := otlpResourceAgent(&resourcepb.Resource{}); ok {
+		t.Error("Expected resource without service identity to be ignored")
+	}
+}
+
+func TestOTLPGaugeSamples(t *testing.T) {
+	OTLPMetricNames = map[string]bool{"queue.depth": true}
+	defer func() { OTLPMetricNames = map[string]bool{} }()
+
+	gauge := func(name string, v float64) *metricspb.Metric {
+		return &metricspb.Metric{Name: name, Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+			DataPoints: []*metricspb.NumberDataPoint{{
+				TimeUnixNano: 1700000000000000000,
+				Attributes:   []*commonpb.KeyValue{stringAttr("queue.name", "emails")},
+				Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: v},
+			}},
+		}}}
+	}
+	rm := &metricspb.ResourceMetrics{ScopeMetrics: []*metricspb.ScopeMetrics{{
+		Metrics: []*metricspb.Metric{gauge("queue.depth", 7), gauge("not.selected", 1)},
+	}}}
+
+	samples := otlpGaugeSamples(rm)
+	if len(samples) != 1 {
+		t.Fatalf("Expected only the selected gauge, got %d samples", len(samples))
+	}
+	s := samples[0]
+	if s.Name != "queue_depth" || s.Value != 7 || s.Labels["queue_name"] != "emails" {
+		t.Errorf("Unexpected sample %+v", s)
+	}
+	if s.Time.UnixNano() != 1700000000000000000 {
+		t.Errorf("Expected data point time to be kept, got %v", s.Time)
+	}
+}
+
+// Requests without identifiable resources never reach the database
+func TestOTLPMetricsHandler_Encodings(t *testing.T) {
+	app := fiber.New()
+	app.Post("/otlp/v1/metrics", OTLPMetricsHandler)
+
+	body, _ := proto.Marshal(&colmetrics.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{Resource: &resourcepb.Resource{}}},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/otlp/v1/metrics", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	resp, _ := app.Test(req)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("Expected 200 OK for protobuf, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+		t.Errorf("Expected protobuf response, got %s", ct)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/otlp/v1/metrics", bytes.NewBufferString(`{"resourceMetrics":[{"resource":{}}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ = app.Test(req)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("Expected 200 OK for JSON, got %d", resp.StatusCode)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/otlp/v1/metrics", bytes.NewBufferString(`{"resourceMetrics":`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ = app.Test(req)
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("Expected 400 Bad Request for malformed JSON, got %d", resp.StatusCode)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/otlp/v1/metrics", bytes.NewBufferString("x"))
+	req.Header.Set("Content-Type", "text/plain")
+	resp, _ = app.Test(req)
+	if resp.StatusCode != fiber.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 Unsupported Media Type, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	db "github.com/aphrollo/pulse/storage"
+	"github.com/aphrollo/pulse/templates"
+)
+
+// uptimeGranularities maps the accepted granularity values to time_bucket widths
+var uptimeGranularities = map[string]string{
+	"daily":   "1 day",
+	"weekly":  "1 week",
+	"monthly": "1 month",
+}
+
+// UptimeReportRow availability of one agent (or agent type) over one period
+type UptimeReportRow struct {
+	Period        time.Time `json:"period"`
+	AgentID       string    `json:"agent_id,omitempty"`
+	Name          string    `json:"name,omitempty"`
+	Type          string    `json:"type"`
+	UptimePercent *float64  `json:"uptime_percent"` // null when the agent was neither up nor down in the period
+	UpSeconds     float64   `json:"up_seconds"`     // healthy, working, idle
+	DownSeconds   float64   `json:"down_seconds"`   // error, crashed, unreachable
+	Transitions   int64     `json:"transitions"`    // status changes within the period
+}
+
+// UptimeReportResponse SLA report over a time range
+type UptimeReportResponse struct {
+	Granularity string            `json:"granularity" example:"daily"`
+	GroupBy     string            `json:"group_by" example:"agent"`
+	From        time.Time         `json:"from"`
+	To          time.Time         `json:"to"`
+	Rows        []UptimeReportRow `json:"rows"`
+}
+
+// uptimeQuery selects the rows of an uptime report
+type uptimeQuery struct {
+	Bucket  string
+	From    time.Time
+	To      time.Time
+	AgentID *uuid.UUID
+	Type    string
+	ByType  bool
+}
+
+// uptimeReportSQL adds up the hours of agent_uptime_hourly over the periods.
+// A period starts with the status the agent was in when the range began, from
+// the last hour before it, or from the first hour after it when the agent has
+// not changed status since the range began, or from its current status once
+// retention dropped every hour. Each hour then shifts the time spent up or
+// down by its transitions and carries its net change to the end of the
+// period. The current status lasts until now, so an agent gone silent counts
+// as down once the reaper marked it unreachable. $2 and $3 are whole hours.
+// Time spent starting, stopped or disabled counts as neither up nor down.
+const uptimeReportSQL = `
+	WITH starts AS (
+		SELECT a.id AS agent_id, a.name, COALESCE(a.type, '') AS type,
+		       CASE WHEN b.bucket IS NOT NULL THEN b.end_status
+		            WHEN f.bucket IS NOT NULL THEN f.start_status
+		            ELSE s.status END AS status
+		FROM agents a
+		JOIN agent_status s ON s.agent_id = a.id
+		LEFT JOIN LATERAL (
+			SELECT bucket, end_status FROM agent_uptime_hourly h
+			WHERE h.agent_id = a.id AND h.bucket < $2
+			ORDER BY h.bucket DESC
+			LIMIT 1
+		) b ON true
+		LEFT JOIN LATERAL (
+			SELECT bucket, start_status FROM agent_uptime_hourly h
+			WHERE h.agent_id = a.id AND h.bucket >= $2
+			ORDER BY h.bucket
+			LIMIT 1
+		) f ON true
+		WHERE ($4::uuid IS NULL OR a.id = $4) AND ($5 = '' OR a.type = $5)
+	), periods AS (
+		SELECT st.agent_id, st.name, st.type, st.status, p.period,
+		       greatest(p.period, $2) AS start, least(p.period + $1::text::interval, $3) AS stop
+		FROM starts st,
+		     generate_series(time_bucket($1::text::interval, $2::timestamptz), $3::timestamptz, $1::text::interval) AS p(period)
+		WHERE p.period < $3 AND greatest(p.period, $2) < now()
+	), hours AS (
+		SELECT p.agent_id, p.period,
+		       sum(h.up_shift + h.up_change * extract(epoch FROM p.stop - (h.bucket + INTERVAL '1 hour'))) AS up_shift,
+		       sum(h.down_shift + h.down_change * extract(epoch FROM p.stop - (h.bucket + INTERVAL '1 hour'))) AS down_shift,
+		       sum(h.up_change) AS up_change,
+		       sum(h.down_change) AS down_change,
+		       sum(h.transitions) AS transitions
+		FROM periods p
+		JOIN agent_uptime_hourly h ON h.agent_id = p.agent_id AND h.bucket >= p.start AND h.bucket < p.stop
+		GROUP BY p.agent_id, p.period
+	), running AS (
+		SELECT p.period, p.agent_id, p.name, p.type,
+		       extract(epoch FROM p.stop - p.start) AS seconds,
+		       extract(epoch FROM greatest(p.stop - now(), INTERVAL '0')) AS future,
+		       COALESCE(h.up_shift, 0) AS up_shift,
+		       COALESCE(h.down_shift, 0) AS down_shift,
+		       COALESCE(h.transitions, 0) AS transitions,
+		       agent_status_up(p.status) + COALESCE(sum(h.up_change) OVER w, 0) - COALESCE(h.up_change, 0) AS up_before,
+		       agent_status_down(p.status) + COALESCE(sum(h.down_change) OVER w, 0) - COALESCE(h.down_change, 0) AS down_before,
+		       agent_status_up(p.status) + COALESCE(sum(h.up_change) OVER w, 0) AS up_after,
+		       agent_status_down(p.status) + COALESCE(sum(h.down_change) OVER w, 0) AS down_after,
+		       p.status IS NOT NULL OR count(h.period) OVER w > 0 AS seen
+		FROM periods p
+		LEFT JOIN hours h ON h.agent_id = p.agent_id AND h.period = p.period
+		WINDOW w AS (PARTITION BY p.agent_id ORDER BY p.period)
+	), report AS (
+		SELECT period, agent_id::text AS agent_id, name, type,
+		       (up_before * seconds + up_shift - up_after * future)::float8 AS up_seconds,
+		       (down_before * seconds + down_shift - down_after * future)::float8 AS down_seconds,
+		       transitions::bigint AS transitions
+		FROM running
+		WHERE seen
+	)
+`
+
+// hours returns the range widened to whole hours, the resolution of agent_uptime_hourly
+func (q uptimeQuery) hours() (time.Time, time.Time) {
+	from, to := q.From.Truncate(time.Hour), q.To.Truncate(time.Hour)
+	if to.Before(q.To) {
+		to = to.Add(time.Hour)
+	}
+	return from, to
+}
+
+func (q uptimeQuery) run(ctx context.Context) ([]UptimeReportRow, error) {
+	sql := uptimeReportSQL + `
+		SELECT period, agent_id, name, type, up_seconds, down_seconds, transitions
+		FROM report
+		ORDER BY name, agent_id, period
+	`
+	if q.ByType {
+		sql = uptimeReportSQL + `
+			SELECT period, '', '', type, sum(up_seconds), sum(down_seconds), sum(transitions)::bigint
+			FROM report
+			GROUP BY period, type
+			ORDER BY type, period
+		`
+	}
+
+	from, to := q.hours()
+	rows, err := db.Pool.Query(ctx, sql, q.Bucket, from, to, q.AgentID, q.Type)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (UptimeReportRow, error) {
+		var r UptimeReportRow
+		err := row.Scan(&r.Period, &r.AgentID, &r.Name, &r.Type, &r.UpSeconds, &r.DownSeconds, &r.Transitions)
+		if counted := r.UpSeconds + r.DownSeconds; counted > 0 {
+			pct := r.UpSeconds / counted * 100
+			r.UptimePercent = &pct
+		}
+		return r, err
+	})
+}
+
+// UptimeReportHandler returns availability per agent or per type
+// @Summary Uptime report
+// @Description Percent of time spent `healthy`/`working`/`idle` versus `error`/`crashed`/`unreachable`, from the hourly uptime aggregate of the status transitions, bucketed per day, week or month. The range is widened to whole hours. An Agent that stopped heartbeating counts as down once marked `unreachable`.
+// @Tags Reports
+// @Produce json
+// @Param granularity query string false "daily, weekly or monthly. Defaults to daily"
+// @Param from query string false "Range start (RFC3339), defaults to 30 days ago"
+// @Param to query string false "Range end (RFC3339), defaults to now"
+// @Param group_by query string false "agent or type. Defaults to agent"
+// @Param agent_id query string false "Only report this Agent"
+// @Param type query string false "Only report Agents of this type"
+// @Success 200 {object} UptimeReportResponse
+// @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
+// @Router /reports/uptime [get]
+func UptimeReportHandler(c *fiber.Ctx) error {
+	granularity := c.Query("granularity", "daily")
+	bucket, ok := uptimeGranularities[granularity]
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid granularity"})
+	}
+
+	groupBy := c.Query("group_by", "agent")
+	if groupBy != "agent" && groupBy != "type" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid group_by"})
+	}
+
+	q := uptimeQuery{Bucket: bucket, Type: c.Query("type"), ByType: groupBy == "type"}
+	if v := c.Query("agent_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid UUID"})
+		}
+		q.AgentID = &id
+	}
+
+	q.To = time.Now()
+	q.From = q.To.AddDate(0, 0, -30)
+	if c.Query("from") != "" || c.Query("to") != "" {
+		from, to, msg := parseTimeRange(c)
+		if msg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": msg})
+		}
+		q.From, q.To = from, to
+	}
+
+	rows, err := q.run(context.Background())
+	if err != nil {
+		logStorageError(c, "failed to compute uptime", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to compute uptime"})
+	}
+
+	return c.JSON(UptimeReportResponse{
+		Granularity: granularity,
+		GroupBy:     groupBy,
+		From:        q.From,
+		To:          q.To,
+		Rows:        rows,
+	})
+}
+
+// heatmapDays is the number of days shown on the dashboard uptime heatmap
+const heatmapDays = 30
+
+// buildUptimeHeatmap lays daily report rows out as one row per agent and one cell per day
+func buildUptimeHeatmap(rows []UptimeReportRow, first time.Time, days int) []templates.UptimeHeatmapRow {
+	var out []templates.UptimeHeatmapRow
+	index := map[string]int{}
+	for _, r := range rows {
+		i, ok := index[r.AgentID]
+		if !ok {
+			i = len(out)
+			index[r.AgentID] = i
+			out = append(out, templates.UptimeHeatmapRow{
+				AgentID: r.AgentID,
+				Name:    r.Name,
+				Cells:   make([]templates.UptimeCell, days),
+			})
+			for d := range days {
+				out[i].Cells[d].Day = first.AddDate(0, 0, d)
+			}
+		}
+
+		d := int(r.Period.UTC().Sub(first).Hours() / 24)
+		if d < 0 || d >= days || r.UptimePercent == nil {
+			continue
+		}
+		out[i].Cells[d].Percent = *r.UptimePercent
+		out[i].Cells[d].HasData = true
+	}
+	return out
+}
+
+// UptimeHeatmapHandler renders the per-agent daily uptime heatmap of the dashboard
+// @Summary Uptime heatmap
+// @Description HTML fragment with the daily uptime of every Agent over the last 30 days, loaded by the dashboard
+// @Tags Dashboard
+// @Produce html
+// @Success 200 {string} string "HTML content"
+// @Router /dashboard/uptime [get]
+func UptimeHeatmapHandler(c *fiber.Ctx) error {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	first := today.AddDate(0, 0, -(heatmapDays - 1))
+
+	q := uptimeQuery{Bucket: uptimeGranularities["daily"], From: first, To: today.AddDate(0, 0, 1)}
+	rows, err := q.run(context.Background())
+	if err != nil {
+		logStorageError(c, "failed to compute uptime heatmap", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("failed to compute uptime")
+	}
+
+	days := make([]time.Time, heatmapDays)
+	for d := range days {
+		days[d] = first.AddDate(0, 0, d)
+	}
+	return adaptor.HTTPHandler(
+		templ.Handler(templates.UptimeHeatmap(days, buildUptimeHeatmap(rows, first, heatmapDays))),
+	)(c)
+}
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	db "github.com/aphrollo/pulse/storage"
+)
+
+func TestBuildUptimeHeatmap(t *testing.T) {
+	first := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	pct := func(v float64) *float64 { return &v }
+
+	rows := []UptimeReportRow{
+		{Period: first, AgentID: "a", Name: "alpha", UptimePercent: pct(100)},
+		{Period: first.AddDate(0, 0, 2), AgentID: "a", Name: "alpha", UptimePercent: pct(50)},
+		{Period: first.AddDate(0, 0, 1), AgentID: "b", Name: "beta", UptimePercent: nil},
+		{Period: first.AddDate(0, 0, 9), AgentID: "b", Name: "beta", UptimePercent: pct(90)}, // outside the window
+	}
+
+	heatmap := buildUptimeHeatmap(rows, first, 3)
+	if len(heatmap) != 2 {
+		t.Fatalf("Expected one row per agent, got %d", len(heatmap))
+	}
+
+	alpha := heatmap[0]
+	if alpha.Name != "alpha" || len(alpha.Cells) != 3 {
+		t.Fatalf("Unexpected row %+v", alpha)
+	}
+	if !alpha.Cells[0].HasData || alpha.Cells[0].Percent != 100 {
+		t.Errorf("Expected day 0 at 100%%, got %+v", alpha.Cells[0])
+	}
+	if alpha.Cells[1].HasData {
+		t.Errorf("Expected day 1 without data, got %+v", alpha.Cells[1])
+	}
+	if alpha.Cells[2].Percent != 50 || !alpha.Cells[2].Day.Equal(first.AddDate(0, 0, 2)) {
+		t.Errorf("Expected day 2 at 50%%, got %+v", alpha.Cells[2])
+	}
+
+	for _, cell := range heatmap[1].Cells {
+		if cell.HasData {
+			t.Errorf("Expected beta to have no data in the window, got %+v", cell)
+		}
+	}
+}
+
+func TestUptimeQuery_Hours(t *testing.T) {
+	q := uptimeQuery{
+		From: time.Date(2025, 3, 1, 10, 20, 0, 0, time.UTC),
+		To:   time.Date(2025, 3, 1, 12, 5, 0, 0, time.UTC),
+	}
+	from, to := q.hours()
+	if want := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC); !from.Equal(want) {
+		t.Errorf("Expected the range to start at %v, got %v", want, from)
+	}
+	if want := time.Date(2025, 3, 1, 13, 0, 0, 0, time.UTC); !to.Equal(want) {
+		t.Errorf("Expected the range to end at %v, got %v", want, to)
+	}
+
+	q.To = time.Date(2025, 3, 2, 0, 0, 0, 0, time.UTC)
+	if _, to := q.hours(); !to.Equal(q.To) {
+		t.Errorf("Expected a whole hour to be kept, got %v", to)
+	}
+}
+
+func TestUptimeReportHandler_Validation(t *testing.T) {
+	app := fiber.New()
+	app.Get("/reports/uptime", UptimeReportHandler)
+
+	cases := map[string]string{
+		"InvalidGranularity": "/reports/uptime?granularity=hourly",
+		"InvalidGroupBy":     "/reports/uptime?group_by=name",
+		"InvalidAgentID":     "/reports/uptime?agent_id=not-a-uuid",
+		"InvalidRange":       "/reports/uptime?from=2025-02-01T00:00:00Z&to=2025-01-01T00:00:00Z",
+	}
+	for name, url := range cases {
+		t.Run(name, func(t *testing.T) {
+			resp, _ := app.Test(httptest.NewRequest(http.MethodGet, url, nil))
+			if resp.StatusCode != fiber.StatusBadRequest {
+				t.Errorf("Expected 400 Bad Request, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// Uptime is weighted by the time spent in each status, an agent gone silent counts as down once unreachable
+func TestUptimeReportHandler_TimeWeighted(t *testing.T) {
+	app := setupApp(t)
+	app.Get("/reports/uptime", UptimeReportHandler)
+	id := uuid.NewString()
+	ctx := context.Background()
+	if _, err := db.Pool.Exec(ctx, `INSERT INTO agents (id, name, type) VALUES ($1, 'test-Agent', 'default')`, id); err != nil {
+		t.Fatalf("Failed to insert Agent: %v", err)
+	}
+	defer db.Pool.Exec(ctx, `DELETE FROM agents WHERE id = $1`, id)
+
+	day := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -2)
+	// Healthy for an hour, one heartbeat only, then marked unreachable by the reaper for three hours
+	for _, u := range []struct {
+		at     time.Duration
+		status string
+	}{{0, "healthy"}, {time.Hour, "unreachable"}, {4 * time.Hour, "stopped"}} {
+		if _, err := db.Pool.Exec(ctx, `INSERT INTO agent_updates (time, agent_id, status) VALUES ($1, $2, $3)`,
+			day.Add(u.at), id, u.status); err != nil {
+			t.Fatalf("Failed to insert update: %v", err)
+		}
+	}
+
+	url := "/reports/uptime?agent_id=" + id + "&from=" + day.Format(time.RFC3339) + "&to=" + day.AddDate(0, 0, 1).Format(time.RFC3339)
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, url, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var report UptimeReportResponse
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Rows) != 1 {
+		t.Fatalf("Expected one row, got %+v", report.Rows)
+	}
+	r := report.Rows[0]
+	if r.UpSeconds != 3600 || r.DownSeconds != 3*3600 || r.UptimePercent == nil || *r.UptimePercent != 25 {
+		t.Errorf("Expected 25%% uptime over 1h up and 3h down, got %+v", r)
+	}
+	if r.Transitions != 2 {
+		t.Errorf("Expected 2 transitions, got %d", r.Transitions)
+	}
+}
+
+// An agent that has not changed status within the range is reported from the status it was already in
+func TestUptimeReportHandler_StableAgent(t *testing.T) {
+	app := setupApp(t)
+	app.Get("/reports/uptime", UptimeReportHandler)
+	id := uuid.NewString()
+	ctx := context.Background()
+	if _, err := db.Pool.Exec(ctx, `INSERT INTO agents (id, name, type) VALUES ($1, 'test-Agent', 'default')`, id); err != nil {
+		t.Fatalf("Failed to insert Agent: %v", err)
+	}
+	defer db.Pool.Exec(ctx, `DELETE FROM agents WHERE id = $1`, id)
+
+	day := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -2)
+	if _, err := db.Pool.Exec(ctx, `INSERT INTO agent_updates (time, agent_id, status) VALUES ($1, $2, 'healthy')`,
+		day.AddDate(0, 0, -10), id); err != nil {
+		t.Fatalf("Failed to insert update: %v", err)
+	}
+
+	url := "/reports/uptime?agent_id=" + id + "&from=" + day.Format(time.RFC3339) + "&to=" + day.AddDate(0, 0, 1).Format(time.RFC3339)
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, url, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var report UptimeReportResponse
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Rows) != 1 {
+		t.Fatalf("Expected one row, got %+v", report.Rows)
+	}
+	r := report.Rows[0]
+	if r.UpSeconds != 24*3600 || r.DownSeconds != 0 || r.Transitions != 0 {
+		t.Errorf("Expected a whole day up without transitions, got %+v", r)
+	}
+}
+
+// Transitions within an hour are weighted by the part of the hour they cover
+func TestUptimeReportHandler_PartialHours(t *testing.T) {
+	app := setupApp(t)
+	app.Get("/reports/uptime", UptimeReportHandler)
+	id := uuid.NewString()
+	ctx := context.Background()
+	if _, err := db.Pool.Exec(ctx, `INSERT INTO agents (id, name, type) VALUES ($1, 'test-Agent', 'default')`, id); err != nil {
+		t.Fatalf("Failed to insert Agent: %v", err)
+	}
+	defer db.Pool.Exec(ctx, `DELETE FROM agents WHERE id = $1`, id)
+
+	day := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -2)
+	// Healthy from 00:30 to 05:00 except for an error from 02:15 to 02:45
+	for _, u := range []struct {
+		at     time.Duration
+		status string
+	}{
+		{30 * time.Minute, "healthy"},
+		{2*time.Hour + 15*time.Minute, "error"},
+		{2*time.Hour + 45*time.Minute, "healthy"},
+		{5 * time.Hour, "stopped"},
+	} {
+		if _, err := db.Pool.Exec(ctx, `INSERT INTO agent_updates (time, agent_id, status) VALUES ($1, $2, $3)`,
+			day.Add(u.at), id, u.status); err != nil {
+			t.Fatalf("Failed to insert update: %v", err)
+		}
+	}
+
+	url := "/reports/uptime?agent_id=" + id + "&from=" + day.Format(time.RFC3339) + "&to=" + day.AddDate(0, 0, 1).Format(time.RFC3339)
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, url, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var report UptimeReportResponse
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Rows) != 1 {
+		t.Fatalf("Expected one row, got %+v", report.Rows)
+	}
+	r := report.Rows[0]
+	if r.UpSeconds != 4*3600 || r.DownSeconds != 1800 || r.Transitions != 3 {
+		t.Errorf("Expected 4h up, 30m down and 3 transitions, got %+v", r)
+	}
+}
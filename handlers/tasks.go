@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	db "github.com/aphrollo/pulse/storage"
+)
+
+// TaskEvent a transition of a task run, sent along an Agent update
+type TaskEvent struct {
+	ID       string    `json:"id" example:"7b0e2c1a-3f4d-4e5f-8a9b-0c1d2e3f4a5b"` // Run UUID, the same for every event of a run
+	Name     string    `json:"name" example:"import-orders"`
+	Event    string    `json:"event" example:"succeeded"` // started, progress, succeeded or failed
+	Started  time.Time `json:"started"`
+	Progress *float64  `json:"progress,omitempty" example:"0.5"` // 0 to 1
+	Message  string    `json:"message,omitempty"`
+	Error    string    `json:"error,omitempty"` // Set on failed
+}
+
+// taskRunStatus maps task events to the status of the run
+var taskRunStatus = map[string]string{
+	"started":   "running",
+	"progress":  "running",
+	"succeeded": "succeeded",
+	"failed":    "failed",
+}
+
+func validateTaskEvent(e *TaskEvent) string {
+	if _, err := uuid.Parse(e.ID); err != nil {
+		return "invalid task id"
+	}
+	if e.Name == "" {
+		return "task name is required"
+	}
+	if _, ok := taskRunStatus[e.Event]; !ok {
+		return "invalid task event"
+	}
+	if e.Started.IsZero() {
+		return "task started is required"
+	}
+	if e.Progress != nil && (*e.Progress < 0 || *e.Progress > 1) {
+		return "task progress must be between 0 and 1"
+	}
+	return ""
+}
+
+// recordTaskRun creates or updates the run a task event belongs to. Events
+// replayed after the run finished don't reopen it.
+func recordTaskRun(ctx context.Context, tx pgx.Tx, agentID uuid.UUID, e *TaskEvent, at time.Time) error {
+	status := taskRunStatus[e.Event]
+	var finished *time.Time
+	if status != "running" {
+		finished = &at
+	}
+
+	sql := `
+		INSERT INTO agent_task_runs (started, id, agent_id, name, status, progress, message, error, finished)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''), $9)
+		ON CONFLICT (id, started) DO UPDATE SET
+			status = EXCLUDED.status,
+			progress = COALESCE(EXCLUDED.progress, agent_task_runs.progress),
+			message = COALESCE(EXCLUDED.message, agent_task_runs.message),
+			error = EXCLUDED.error,
+			finished = EXCLUDED.finished
+		WHERE agent_task_runs.finished IS NULL
+	`
+	_, err := tx.Exec(ctx, sql, e.Started, uuid.MustParse(e.ID), agentID, e.Name, status, e.Progress, e.Message, e.Error, finished)
+	return err
+}
+
+// TaskReportRow runs of one task over the report range
+type TaskReportRow struct {
+	Name        string   `json:"name" example:"import-orders"`
+	Runs        int64    `json:"runs"`
+	Succeeded   int64    `json:"succeeded"`
+	Failed      int64    `json:"failed"`
+	Running     int64    `json:"running"`
+	SuccessRate *float64 `json:"success_rate"` // percent of finished runs that succeeded, null when none finished
+	P50         *float64 `json:"p50_seconds"`  // duration percentiles of finished runs
+	P90         *float64 `json:"p90_seconds"`
+	P99         *float64 `json:"p99_seconds"`
+}
+
+// TaskReportResponse task statistics over a time range
+type TaskReportResponse struct {
+	From  time.Time       `json:"from"`
+	To    time.Time       `json:"to"`
+	Tasks []TaskReportRow `json:"tasks"`
+}
+
+type taskQuery struct {
+	From    time.Time
+	To      time.Time
+	AgentID *uuid.UUID
+	Type    string
+	Name    string
+}
+
+func (q taskQuery) run(ctx context.Context) ([]TaskReportRow, error) {
+	sql := `
+		SELECT r.name, count(*),
+		       count(*) FILTER (WHERE r.status = 'succeeded'),
+		       count(*) FILTER (WHERE r.status = 'failed'),
+		       count(*) FILTER (WHERE r.status = 'running'),
+		       percentile_cont(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM r.finished - r.started)),
+		       percentile_cont(0.9) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM r.finished - r.started)),
+		       percentile_cont(0.99) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM r.finished - r.started))
+		FROM agent_task_runs r
+		JOIN agents a ON a.id = r.agent_id
+		WHERE r.started >= $1 AND r.started < $2
+		  AND ($3::uuid IS NULL OR r.agent_id = $3) AND ($4 = '' OR a.type = $4) AND ($5 = '' OR r.name = $5)
+		GROUP BY r.name
+		ORDER BY r.name
+	`
+	rows, err := db.Pool.Query(ctx, sql, q.From, q.To, q.AgentID, q.Type, q.Name)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (TaskReportRow, error) {
+		var r TaskReportRow
+		err := row.Scan(&r.Name, &r.Runs, &r.Succeeded, &r.Failed, &r.Running, &r.P50, &r.P90, &r.P99)
+		if finished := r.Succeeded + r.Failed; finished > 0 {
+			rate := float64(r.Succeeded) / float64(finished) * 100
+			r.SuccessRate = &rate
+		}
+		return r, err
+	})
+}
+
+// TaskReportHandler returns the success rate and duration percentiles of Agent tasks
+// @Summary Task report
+// @Description Runs, success rate and duration percentiles per task name, from the task events Agents send along their updates
+// @Tags Reports
+// @Produce json
+// @Param from query string false "Range start (RFC3339), defaults to 7 days ago"
+// @Param to query string false "Range end (RFC3339), defaults to now"
+// @Param agent_id query string false "Only report tasks of this Agent"
+// @Param type query string false "Only report tasks of Agents of this type"
+// @Param name query string false "Only report this task"
+// @Success 200 {object} TaskReportResponse
+// @Failure 400 {object} ApiErrorResponse "BAD_REQUEST - The query contains errors. In the event that a request was created using a form and contains user generated data, the user should be notified that the data must be corrected before the query is repeated. `{"message":"BAD_REQUEST"}`"
+// @Router /reports/tasks [get]
+func TaskReportHandler(c *fiber.Ctx) error {
+	q := taskQuery{Type: c.Query("type"), Name: c.Query("name")}
+	if v := c.Query("agent_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid UUID"})
+		}
+		q.AgentID = &id
+	}
+
+	q.To = time.Now()
+	q.From = q.To.AddDate(0, 0, -7)
+	if c.Query("from") != "" || c.Query("to") != "" {
+		from, to, msg := parseTimeRange(c)
+		if msg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": msg})
+		}
+		q.From, q.To = from, to
+	}
+
+	tasks, err := q.run(context.Background())
+	if err != nil {
+		logStorageError(c, "failed to compute task report", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to compute task report"})
+	}
+
+	return c.JSON(TaskReportResponse{From: q.From, To: q.To, Tasks: tasks})
+}
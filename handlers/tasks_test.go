@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestValidateTaskEvent(t *testing.T) {
+	progress := func(v float64) *float64 { return &v }
+	valid := func() TaskEvent {
+		return TaskEvent{ID: "7b0e2c1a-3f4d-4e5f-8a9b-0c1d2e3f4a5b", Name: "import", Event: "started", Started: time.Now()}
+	}
+
+	e := valid()
+	if msg := validateTaskEvent(&e); msg != "" {
+		t.Errorf("Expected valid event, got %q", msg)
+	}
+
+	cases := map[string]func(*TaskEvent){
+		"InvalidID":       func(e *TaskEvent) { e.ID = "1" },
+		"MissingName":     func(e *TaskEvent) { e.Name = "" },
+		"UnknownEvent":    func(e *TaskEvent) { e.Event = "paused" },
+		"MissingStarted":  func(e *TaskEvent) { e.Started = time.Time{} },
+		"InvalidProgress": func(e *TaskEvent) { e.Progress = progress(1.5) },
+	}
+	for name, mutate := range cases {
+		t.Run(name, func(t *testing.T) {
+			e := valid()
+			mutate(&e)
+			if msg := validateTaskEvent(&e); msg == "" {
+				t.Errorf("Expected %s to be rejected", name)
+			}
+		})
+	}
+}
+
+func TestTaskReportHandler_Validation(t *testing.T) {
+	app := fiber.New()
+	app.Get("/reports/tasks", TaskReportHandler)
+
+	cases := map[string]string{
+		"InvalidAgentID": "/reports/tasks?agent_id=not-a-uuid",
+		"InvalidRange":   "/reports/tasks?from=2025-02-01T00:00:00Z&to=2025-01-01T00:00:00Z",
+	}
+	for name, url := range cases {
+		t.Run(name, func(t *testing.T) {
+			resp, err := app.Test(httptest.NewRequest(http.MethodGet, url, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != fiber.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+)
+
+// requestIDKey is where the request ID middleware stores the ID in the locals
+const requestIDKey = "requestid"
+
+// loggerKey is where Middleware stores the request scoped logger in the locals
+const loggerKey = "logger"
+
+// New builds a logger writing to w. format is "json" or "text" (the default),
+// level one of "debug", "info" (the default), "warn" or "error".
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q", level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q", format)
+}
+
+// RequestID assigns every request an ID, taken from the X-Request-ID header
+// when the caller sent one, and echoes it in the response.
+func RequestID() fiber.Handler {
+	return requestid.New(requestid.Config{
+		Header:     fiber.HeaderXRequestID,
+		ContextKey: requestIDKey,
+	})
+}
+
+// Middleware logs every request once it completes and makes a logger carrying
+// the request ID available to handlers through FromCtx. It must run after RequestID.
+func Middleware(logger *slog.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		reqLogger := logger.With("request_id", c.Locals(requestIDKey))
+		c.Locals(loggerKey, reqLogger)
+
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			// Let the error handler write the response so the logged status is the one sent
+			if herr := c.App().ErrorHandler(c, err); herr != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
+			}
+			status = c.Response().StatusCode()
+		}
+
+		level := slog.LevelInfo
+		if status >= fiber.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		reqLogger.Log(c.UserContext(), level, "request",
+			"method", c.Method(),
+			"path", c.Path(),
+			"route", c.Route().Path,
+			"status", status,
+			"latency", time.Since(start),
+			"ip", c.IP(),
+		)
+		return nil
+	}
+}
+
+// FromCtx returns the request scoped logger, or the default logger outside of Middleware
+func FromCtx(c *fiber.Ctx) *slog.Logger {
+	if l, ok := c.Locals(loggerKey).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestApp(buf *bytes.Buffer) *fiber.App {
+	logger, _ := New(buf, "json", "debug")
+
+	app := fiber.New()
+	app.Use(RequestID())
+	app.Use(Middleware(logger))
+	app.Get("/db", func(c *fiber.Ctx) error {
+		FromCtx(c).Error("failed to insert heartbeat", "agent_id", "1234")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed"})
+	})
+	app.Get("/missing", func(c *fiber.Ctx) error {
+		return fiber.ErrNotFound
+	})
+	return app
+}
+
+func decodeLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &m))
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestMiddleware_RequestIDInResponseAndLogs(t *testing.T) {
+	var buf bytes.Buffer
+	app := newTestApp(&buf)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/db", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	requestID := resp.Header.Get(fiber.HeaderXRequestID)
+	require.NotEmpty(t, requestID)
+
+	lines := decodeLines(t, &buf)
+	require.Len(t, lines, 2)
+
+	require.Equal(t, "failed to insert heartbeat", lines[0]["msg"])
+	require.Equal(t, requestID, lines[0]["request_id"])
+	require.Equal(t, "1234", lines[0]["agent_id"])
+
+	require.Equal(t, "request", lines[1]["msg"])
+	require.Equal(t, "ERROR", lines[1]["level"])
+	require.Equal(t, requestID, lines[1]["request_id"])
+	require.EqualValues(t, http.StatusInternalServerError, lines[1]["status"])
+}
+
+func TestMiddleware_KeepsCallerRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	app := newTestApp(&buf)
+
+	req := httptest.NewRequest(http.MethodGet, "/missing", nil)
+	req.Header.Set(fiber.HeaderXRequestID, "caller-id")
+	resp, err := app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Equal(t, "caller-id", resp.Header.Get(fiber.HeaderXRequestID))
+
+	lines := decodeLines(t, &buf)
+	require.Equal(t, "caller-id", lines[0]["request_id"])
+	require.EqualValues(t, http.StatusNotFound, lines[0]["status"])
+}
+
+func TestNew_InvalidSettings(t *testing.T) {
+	_, err := New(&bytes.Buffer{}, "xml", "")
+	require.Error(t, err)
+	_, err = New(&bytes.Buffer{}, "text", "loud")
+	require.Error(t, err)
+}
@@ -1,28 +1,90 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 
 	"github.com/aphrollo/pulse/app"
+	"github.com/aphrollo/pulse/logging"
 	db "github.com/aphrollo/pulse/storage"
+	"github.com/aphrollo/pulse/workers"
 )
 
+// fatal logs the error and exits, there is no slog equivalent of log.Fatal
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
 func main() {
-	// Load .env file
-	if err := godotenv.Load(); err != nil {
-		log.Println("Warning: .env file not found or failed to load")
+	// Load .env file before configuring logging, it may hold the log settings
+	envErr := godotenv.Load()
+
+	logger, err := logging.New(os.Stderr, os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		fatal("Invalid logging configuration", err)
+	}
+	slog.SetDefault(logger)
+
+	if envErr != nil {
+		slog.Warn(".env file not found or failed to load", "error", envErr)
 	}
 
 	if err := db.Connect(); err != nil {
-		log.Fatalf("Failed to connect to DB: %v", err)
+		fatal("Failed to connect to DB", err)
 	}
 	defer db.Close()
 
+	if err := db.Migrate(context.Background()); err != nil {
+		fatal("Failed to migrate DB", err)
+	}
+
+	policies, err := db.ParsePolicies(os.Getenv("RETENTION_POLICIES"), os.Getenv("COMPRESSION_POLICIES"))
+	if err != nil {
+		fatal("Invalid storage policies", err)
+	}
+	if err := db.ApplyPolicies(context.Background(), policies); err != nil {
+		fatal("Failed to apply storage policies", err)
+	}
+
+	reaperTimeout := 3 * time.Minute
+	if v := os.Getenv("REAPER_TIMEOUT"); v != "" {
+		if reaperTimeout, err = time.ParseDuration(v); err != nil || reaperTimeout <= 0 {
+			fatal("Invalid REAPER_TIMEOUT", fmt.Errorf("%q must be a positive duration", v))
+		}
+	}
+	workers.Register(workers.NewReaper(reaperTimeout))
+	workers.Start(context.Background())
+
 	api := app.New()
 
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		go func() {
+			if err := app.NewMetrics().Listen(addr); err != nil {
+				fatal("Failed to start metrics server", err)
+			}
+		}()
+	}
+
+	if addr := os.Getenv("GRPC_ADDR"); addr != "" {
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			fatal("Failed to listen for gRPC", err)
+		}
+		go func() {
+			if err := app.NewGRPC().Serve(lis); err != nil {
+				fatal("Failed to start gRPC server", err)
+			}
+		}()
+	}
+
 	if err := api.Listen(":3000"); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+		fatal("Failed to start server", err)
 	}
 }
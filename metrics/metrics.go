@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "pulse"
+
+// Registry holds every metric exposed on /metrics. A dedicated registry is
+// used instead of the global one so tests and embedders get a clean slate.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HTTPRequests counts handled requests per method, route and status code
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests handled, by method, route and status code.",
+	}, []string{"method", "route", "code"})
+
+	// HTTPDuration observes request latency per method and route
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency in seconds, by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// IngestionInFlight is the number of agent payloads currently being ingested
+	IngestionInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ingestion_in_flight",
+		Help:      "Agent payloads currently being ingested.",
+	})
+
+	// IngestionErrors counts agent payloads that could not be ingested
+	IngestionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ingestion_errors_total",
+		Help:      "Agent payloads that failed to be ingested, by endpoint and reason.",
+	}, []string{"endpoint", "reason"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPDuration,
+		IngestionInFlight,
+		IngestionErrors,
+		newPoolCollector(),
+	)
+}
+
+// Middleware records request counts and latencies. The route label is the
+// matched route pattern (e.g. "/agent/:id"), never the raw path, so the
+// number of series stays bounded by the number of registered routes.
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		code := c.Response().StatusCode()
+		if err != nil {
+			code = fiber.StatusInternalServerError
+			var fe *fiber.Error
+			if errors.As(err, &fe) {
+				code = fe.Code
+			}
+		}
+
+		method := c.Method()
+		route := c.Route().Path
+		HTTPRequests.WithLabelValues(method, route, strconv.Itoa(code)).Inc()
+		HTTPDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+var inFlight atomic.Int64
+
+// IngestionMiddleware tracks payloads waiting on the database. Since ingestion
+// is synchronous this is the depth of the ingestion queue.
+func IngestionMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		defer TrackIngestion()()
+		return c.Next()
+	}
+}
+
+// TrackIngestion counts a payload as being ingested until done is called, for
+// payloads that don't go through IngestionMiddleware such as gRPC calls
+func TrackIngestion() (done func()) {
+	IngestionInFlight.Set(float64(inFlight.Add(1)))
+	return func() { IngestionInFlight.Set(float64(inFlight.Add(-1))) }
+}
+
+// IngestionQueueDepth returns the number of payloads currently being ingested
+func IngestionQueueDepth() int64 {
+	return inFlight.Load()
+}
+
+// Handler serves the registry in the Prometheus text exposition format
+func Handler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware_UsesRoutePattern(t *testing.T) {
+	app := fiber.New()
+	app.Use(Middleware())
+	app.Get("/agents/:id", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	for _, id := range []string{"a", "b", "c"} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/agents/"+id, nil))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+
+	require.Equal(t, 3.0, testutil.ToFloat64(HTTPRequests.WithLabelValues("GET", "/agents/:id", "204")))
+}
+
+func TestMiddleware_RecordsErrorStatus(t *testing.T) {
+	app := fiber.New()
+	app.Use(Middleware())
+	app.Get("/boom", func(c *fiber.Ctx) error {
+		return fiber.NewError(fiber.StatusTeapot, "nope")
+	})
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/boom", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTeapot, resp.StatusCode)
+
+	require.Equal(t, 1.0, testutil.ToFloat64(HTTPRequests.WithLabelValues("GET", "/boom", "418")))
+}
+
+func TestHandler_TextExposition(t *testing.T) {
+	IngestionErrors.WithLabelValues("heartbeat", "invalid").Inc()
+
+	app := fiber.New()
+	app.Get("/metrics", Handler())
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain"))
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `pulse_ingestion_errors_total{endpoint="heartbeat",reason="invalid"} 1`)
+	require.Contains(t, string(body), "go_goroutines")
+}
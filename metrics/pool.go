@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	db "github.com/aphrollo/pulse/storage"
+)
+
+// poolCollector exposes pgxpool.Stat of the shared storage pool at scrape time
+type poolCollector struct {
+	acquireCount         *prometheus.Desc
+	acquireDuration      *prometheus.Desc
+	acquiredConns        *prometheus.Desc
+	canceledAcquireCount *prometheus.Desc
+	constructingConns    *prometheus.Desc
+	emptyAcquireCount    *prometheus.Desc
+	idleConns            *prometheus.Desc
+	maxConns             *prometheus.Desc
+	totalConns           *prometheus.Desc
+}
+
+func newPoolCollector() *poolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", name), help, nil, nil)
+	}
+	return &poolCollector{
+		acquireCount:         desc("acquire_count_total", "Cumulative count of successful connection acquires."),
+		acquireDuration:      desc("acquire_duration_seconds_total", "Total time spent waiting for a connection to be acquired."),
+		acquiredConns:        desc("acquired_conns", "Connections currently acquired."),
+		canceledAcquireCount: desc("canceled_acquire_count_total", "Cumulative count of acquires canceled by a context."),
+		constructingConns:    desc("constructing_conns", "Connections currently being constructed."),
+		emptyAcquireCount:    desc("empty_acquire_count_total", "Cumulative count of acquires that had to wait for a connection."),
+		idleConns:            desc("idle_conns", "Connections currently idle."),
+		maxConns:             desc("max_conns", "Maximum size of the pool."),
+		totalConns:           desc("total_conns", "Total connections currently in the pool."),
+	}
+}
+
+func (p *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.acquireCount
+	ch <- p.acquireDuration
+	ch <- p.acquiredConns
+	ch <- p.canceledAcquireCount
+	ch <- p.constructingConns
+	ch <- p.emptyAcquireCount
+	ch <- p.idleConns
+	ch <- p.maxConns
+	ch <- p.totalConns
+}
+
+func (p *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	if db.Pool == nil {
+		return
+	}
+	s := db.Pool.Stat()
+	ch <- prometheus.MustNewConstMetric(p.acquireCount, prometheus.CounterValue, float64(s.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(p.acquireDuration, prometheus.CounterValue, s.AcquireDuration().Seconds())
+	ch <- prometheus.MustNewConstMetric(p.acquiredConns, prometheus.GaugeValue, float64(s.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(p.canceledAcquireCount, prometheus.CounterValue, float64(s.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(p.constructingConns, prometheus.GaugeValue, float64(s.ConstructingConns()))
+	ch <- prometheus.MustNewConstMetric(p.emptyAcquireCount, prometheus.CounterValue, float64(s.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(p.idleConns, prometheus.GaugeValue, float64(s.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(p.maxConns, prometheus.GaugeValue, float64(s.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(p.totalConns, prometheus.GaugeValue, float64(s.TotalConns()))
+}
@@ -0,0 +1,13 @@
+-- Numeric samples pushed by agents (queue depth, jobs/sec, memory, ...)
+CREATE TABLE agent_metrics (
+    time TIMESTAMPTZ NOT NULL DEFAULT now(),
+    agent_id UUID REFERENCES agents(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    labels JSONB NOT NULL DEFAULT '{}',  -- Sample dimensions (e.g. {"queue": "emails"})
+    value DOUBLE PRECISION NOT NULL
+);
+
+SELECT create_hypertable('agent_metrics', 'time');
+
+-- Series are looked up by agent, metric name and labels over a time range
+CREATE INDEX idx_agent_metrics_series ON agent_metrics(agent_id, name, labels, time DESC);
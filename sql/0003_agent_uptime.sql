@@ -0,0 +1,98 @@
+-- Current status of every agent, maintained by record_agent_status()
+CREATE TABLE agent_status (
+    agent_id UUID PRIMARY KEY REFERENCES agents(id) ON DELETE CASCADE,
+    status agent_state NOT NULL,
+    since TIMESTAMPTZ NOT NULL
+);
+
+-- Every change of an agent's status, whether reported by a heartbeat or an update
+CREATE TABLE agent_status_transitions (
+    time TIMESTAMPTZ NOT NULL,
+    agent_id UUID REFERENCES agents(id) ON DELETE CASCADE,
+    from_status agent_state,  -- NULL for the first status ever seen
+    to_status agent_state NOT NULL
+);
+
+SELECT create_hypertable('agent_status_transitions', 'time');
+
+CREATE INDEX idx_agent_status_transitions_agent ON agent_status_transitions(agent_id, time DESC);
+
+CREATE FUNCTION record_agent_status() RETURNS trigger AS $$
+DECLARE
+    previous agent_state;
+BEGIN
+    IF NEW.agent_id IS NULL THEN
+        RETURN NEW;
+    END IF;
+
+    SELECT status INTO previous FROM agent_status WHERE agent_id = NEW.agent_id FOR UPDATE;
+    IF NOT FOUND THEN
+        INSERT INTO agent_status (agent_id, status, since) VALUES (NEW.agent_id, NEW.status, NEW.time)
+        ON CONFLICT (agent_id) DO NOTHING;
+        INSERT INTO agent_status_transitions (time, agent_id, from_status, to_status)
+        VALUES (NEW.time, NEW.agent_id, NULL, NEW.status);
+    ELSIF previous <> NEW.status THEN
+        UPDATE agent_status SET status = NEW.status, since = NEW.time WHERE agent_id = NEW.agent_id;
+        INSERT INTO agent_status_transitions (time, agent_id, from_status, to_status)
+        VALUES (NEW.time, NEW.agent_id, previous, NEW.status);
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_agent_heartbeats_status AFTER INSERT ON agent_heartbeats
+    FOR EACH ROW EXECUTE FUNCTION record_agent_status();
+CREATE TRIGGER trg_agent_updates_status AFTER INSERT ON agent_updates
+    FOR EACH ROW EXECUTE FUNCTION record_agent_status();
+
+-- Seed the transitions and the current status from the heartbeats received so far
+INSERT INTO agent_status_transitions (time, agent_id, from_status, to_status)
+SELECT time, agent_id, previous, status
+FROM (
+    SELECT time, agent_id, status, lag(status) OVER (PARTITION BY agent_id ORDER BY time) AS previous
+    FROM agent_heartbeats
+    WHERE agent_id IS NOT NULL
+) h
+WHERE previous IS DISTINCT FROM status;
+
+INSERT INTO agent_status (agent_id, status, since)
+SELECT DISTINCT ON (agent_id) agent_id, to_status, time
+FROM agent_status_transitions
+ORDER BY agent_id, time DESC;
+
+-- 1 when a status counts as up (or down), 0 otherwise or when there is none
+CREATE FUNCTION agent_status_up(status agent_state) RETURNS int AS $$
+    SELECT CASE WHEN status IN ('healthy', 'working', 'idle') THEN 1 ELSE 0 END
+$$ LANGUAGE sql IMMUTABLE;
+
+CREATE FUNCTION agent_status_down(status agent_state) RETURNS int AS $$
+    SELECT CASE WHEN status IN ('error', 'crashed', 'unreachable') THEN 1 ELSE 0 END
+$$ LANGUAGE sql IMMUTABLE;
+
+-- Hourly uptime per agent, from the status transitions. A transition changes
+-- whether the agent is up (or down) from its time to the end of the hour:
+-- up_shift and down_shift are those changes weighted by the seconds left in
+-- the hour, up_change and down_change the net change the hour carries over to
+-- the next ones. start_status is the status the hour began with, NULL before
+-- the first one, end_status the one it ended with.
+CREATE MATERIALIZED VIEW agent_uptime_hourly
+WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+SELECT time_bucket(INTERVAL '1 hour', time) AS bucket,
+       agent_id,
+       first(from_status, time) AS start_status,
+       last(to_status, time) AS end_status,
+       sum(extract(epoch FROM INTERVAL '1 hour' - (time - time_bucket(INTERVAL '1 hour', time)))
+           * (agent_status_up(to_status) - agent_status_up(from_status))) AS up_shift,
+       sum(extract(epoch FROM INTERVAL '1 hour' - (time - time_bucket(INTERVAL '1 hour', time)))
+           * (agent_status_down(to_status) - agent_status_down(from_status))) AS down_shift,
+       sum(agent_status_up(to_status) - agent_status_up(from_status)) AS up_change,
+       sum(agent_status_down(to_status) - agent_status_down(from_status)) AS down_change,
+       count(from_status) AS transitions
+FROM agent_status_transitions
+GROUP BY bucket, agent_id
+WITH NO DATA;
+
+SELECT add_continuous_aggregate_policy('agent_uptime_hourly',
+    start_offset => INTERVAL '3 days',
+    end_offset => INTERVAL '1 hour',
+    schedule_interval => INTERVAL '30 minutes');
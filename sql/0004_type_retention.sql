@@ -0,0 +1,11 @@
+-- Timescale job that drops rows of one agent type older than a given age.
+-- Scheduled by storage.ApplyPolicies with config {"table": ..., "type": ..., "drop_after": ...}
+CREATE PROCEDURE pulse_type_retention(job_id INT, config JSONB)
+LANGUAGE plpgsql AS $$
+BEGIN
+    EXECUTE format(
+        'DELETE FROM %I t USING agents a WHERE a.id = t.agent_id AND a.type = $1 AND t.time < now() - $2::interval',
+        config->>'table')
+    USING config->>'type', config->>'drop_after';
+END
+$$;
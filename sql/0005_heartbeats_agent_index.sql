@@ -0,0 +1,2 @@
+-- Latest heartbeat per agent lookups (reaper, fleet metrics) would otherwise scan every chunk
+CREATE INDEX idx_agent_heartbeats_agent ON agent_heartbeats(agent_id, time DESC);
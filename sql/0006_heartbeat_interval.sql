@@ -0,0 +1,2 @@
+-- Heartbeat interval declared by the agent at registration, used to count late beats
+ALTER TABLE agents ADD COLUMN heartbeat_interval INTERVAL;
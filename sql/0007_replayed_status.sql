@@ -0,0 +1,28 @@
+-- Agents replay updates queued while Pulse was unreachable with their original
+-- time. Those arrive after newer heartbeats and must not overwrite the current
+-- status, so rows older than the current status are only kept as history.
+CREATE OR REPLACE FUNCTION record_agent_status() RETURNS trigger AS $$
+DECLARE
+    previous agent_state;
+    previous_since TIMESTAMPTZ;
+BEGIN
+    IF NEW.agent_id IS NULL THEN
+        RETURN NEW;
+    END IF;
+
+    SELECT status, since INTO previous, previous_since FROM agent_status WHERE agent_id = NEW.agent_id FOR UPDATE;
+    IF NOT FOUND THEN
+        INSERT INTO agent_status (agent_id, status, since) VALUES (NEW.agent_id, NEW.status, NEW.time)
+        ON CONFLICT (agent_id) DO NOTHING;
+        INSERT INTO agent_status_transitions (time, agent_id, from_status, to_status)
+        VALUES (NEW.time, NEW.agent_id, NULL, NEW.status);
+    ELSIF NEW.time < previous_since THEN
+        RETURN NEW;
+    ELSIF previous <> NEW.status THEN
+        UPDATE agent_status SET status = NEW.status, since = NEW.time WHERE agent_id = NEW.agent_id;
+        INSERT INTO agent_status_transitions (time, agent_id, from_status, to_status)
+        VALUES (NEW.time, NEW.agent_id, previous, NEW.status);
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
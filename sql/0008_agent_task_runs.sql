@@ -0,0 +1,18 @@
+-- One row per task run reported by an agent, updated as the run progresses
+CREATE TABLE agent_task_runs (
+    started TIMESTAMPTZ NOT NULL,
+    id UUID NOT NULL,
+    agent_id UUID REFERENCES agents(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    status TEXT NOT NULL CHECK (status IN ('running', 'succeeded', 'failed')),
+    progress DOUBLE PRECISION,  -- 0 to 1, as last reported
+    message TEXT,
+    error TEXT,
+    finished TIMESTAMPTZ,
+    PRIMARY KEY (id, started)
+);
+
+SELECT create_hypertable('agent_task_runs', 'started');
+
+-- Success rate and duration percentiles are computed per agent and task name
+CREATE INDEX idx_agent_task_runs_name ON agent_task_runs(agent_id, name, started DESC);
@@ -0,0 +1,2 @@
+-- Results of the status checks an agent ran before sending the heartbeat
+ALTER TABLE agent_heartbeats ADD COLUMN checks JSONB;
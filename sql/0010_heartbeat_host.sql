@@ -0,0 +1,2 @@
+-- Snapshot of the host an agent runs on, sent along its heartbeats
+ALTER TABLE agent_heartbeats ADD COLUMN host JSONB;
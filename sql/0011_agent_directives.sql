@@ -0,0 +1,14 @@
+-- Instructions for agents, sent along heartbeat responses until the agent acknowledges them
+CREATE TABLE agent_directives (
+    id UUID PRIMARY KEY,
+    agent_id UUID NOT NULL REFERENCES agents(id) ON DELETE CASCADE,
+    type TEXT NOT NULL CHECK (type IN ('set_interval', 'maintenance', 'disable', 'reregister', 'run_task')),
+    payload JSONB,
+    created TIMESTAMPTZ NOT NULL DEFAULT now(),
+    delivered TIMESTAMPTZ,  -- first sent to the agent
+    acked TIMESTAMPTZ,
+    error TEXT              -- set when the agent failed to apply the directive
+);
+
+-- Every heartbeat looks up the pending directives of its agent
+CREATE INDEX idx_agent_directives_pending ON agent_directives(agent_id, created) WHERE acked IS NULL;
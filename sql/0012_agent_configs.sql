@@ -0,0 +1,13 @@
+-- Versioned configuration documents, for every agent of a type or for a single agent.
+-- An agent's effective configuration is the latest type document merged with its own latest one.
+CREATE TABLE agent_configs (
+    scope TEXT NOT NULL CHECK (scope IN ('type', 'agent')),
+    target TEXT NOT NULL,  -- agent type or agent ID
+    version INT NOT NULL,
+    document JSONB NOT NULL,
+    created TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (scope, target, version)
+);
+
+-- Effective configuration version the agent reported running, e.g. t3.a1
+ALTER TABLE agents ADD COLUMN config_version TEXT;
@@ -0,0 +1,4 @@
+-- Lets operators restart the process a supervising agent runs
+ALTER TABLE agent_directives DROP CONSTRAINT agent_directives_type_check;
+ALTER TABLE agent_directives ADD CONSTRAINT agent_directives_type_check
+    CHECK (type IN ('set_interval', 'maintenance', 'disable', 'reregister', 'run_task', 'restart'));
@@ -0,0 +1,15 @@
+-- Log lines shipped by agents
+CREATE TABLE agent_logs (
+    time TIMESTAMPTZ NOT NULL DEFAULT now(),
+    agent_id UUID REFERENCES agents(id) ON DELETE CASCADE,
+    level TEXT NOT NULL CHECK (level IN ('debug', 'info', 'warn', 'error')),
+    source TEXT NOT NULL DEFAULT '',  -- Where the agent read the line (e.g. "stderr", a file path)
+    message TEXT NOT NULL,
+    attrs JSONB                       -- Structured fields of the line, if any
+);
+
+SELECT create_hypertable('agent_logs', 'time');
+
+-- Logs are read per agent over a time range, text searches use the full-text index
+CREATE INDEX idx_agent_logs_agent ON agent_logs(agent_id, time DESC);
+CREATE INDEX idx_agent_logs_text ON agent_logs USING GIN (to_tsvector('simple', message));
@@ -0,0 +1,8 @@
+// Package sql embeds the database schema. Files are applied in lexical order
+// by storage.Migrate, each one exactly once.
+package sql
+
+import "embed"
+
+//go:embed *.sql
+var Migrations embed.FS
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	schema "github.com/aphrollo/pulse/sql"
+)
+
+// baselineMigration is the schema that used to be applied by hand from sql/tables.sql
+const baselineMigration = "0001_tables.sql"
+
+// Migrate applies every embedded migration that has not been applied yet.
+// Databases created by hand from the original tables.sql are adopted by
+// marking the baseline as applied instead of running it again.
+func Migrate(ctx context.Context) error {
+	if Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+
+	_, err := Pool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version TEXT PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		var exists bool
+		if err := Pool.QueryRow(ctx, `SELECT to_regclass('agents') IS NOT NULL`).Scan(&exists); err != nil {
+			return fmt.Errorf("detect existing schema: %w", err)
+		}
+		if exists {
+			if _, err := Pool.Exec(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, baselineMigration); err != nil {
+				return fmt.Errorf("adopt baseline schema: %w", err)
+			}
+			applied[baselineMigration] = true
+		}
+	}
+
+	versions, err := Migrations()
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if applied[version] {
+			continue
+		}
+		if err := applyMigration(ctx, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Migrations lists the embedded migration versions in the order they are applied
+func Migrations() ([]string, error) {
+	names, err := fs.Glob(schema.Migrations, "*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("list migrations: %w", err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// PendingMigrations returns the embedded migrations missing from schema_migrations
+func PendingMigrations(ctx context.Context) ([]string, error) {
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	var pending []string
+	for _, version := range versions {
+		if !applied[version] {
+			pending = append(pending, version)
+		}
+	}
+	return pending, nil
+}
+
+func appliedMigrations(ctx context.Context) (map[string]bool, error) {
+	rows, err := Pool.Query(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("read schema_migrations: %w", err)
+	}
+	versions, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("read schema_migrations: %w", err)
+	}
+
+	applied := make(map[string]bool, len(versions))
+	for _, v := range versions {
+		applied[v] = true
+	}
+	return applied, nil
+}
+
+func applyMigration(ctx context.Context, version string) error {
+	body, err := fs.ReadFile(schema.Migrations, version)
+	if err != nil {
+		return fmt.Errorf("read migration %s: %w", version, err)
+	}
+
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin migration %s: %w", version, err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Without arguments pgx uses the simple protocol, so a file may hold several statements
+	if _, err := tx.Exec(ctx, strings.TrimSpace(string(body))); err != nil {
+		return fmt.Errorf("apply migration %s: %w", version, err)
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+		return fmt.Errorf("record migration %s: %w", version, err)
+	}
+	return tx.Commit(ctx)
+}
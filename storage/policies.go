@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PolicyTables are the tables whose retention and compression pulse manages.
+// The value tells whether rows carry an agent_id, which per type retention needs.
+var PolicyTables = map[string]bool{
+	"agent_heartbeats":         true,
+	"agent_updates":            true,
+	"agent_metrics":            true,
+	"agent_logs":               true,
+	"agent_status_transitions": true,
+	"agent_uptime_hourly":      false, // continuous aggregate, whole view only
+}
+
+// Policy is the retention and compression of one table, or of one agent type within it
+type Policy struct {
+	Table       string
+	AgentType   string        // Empty for the whole table
+	Retention   time.Duration // Zero keeps data forever
+	Compression time.Duration // Zero leaves chunks uncompressed; whole hypertables only
+}
+
+// ParsePolicies reads the RETENTION_POLICIES and COMPRESSION_POLICIES settings.
+// Both are comma separated lists of table=age or table:agent_type=age, where
+// age is a Go duration or a number of days (d) or weeks (w), e.g.
+// "agent_heartbeats=14d,agent_heartbeats:bot=7d,agent_updates=90d".
+func ParsePolicies(retention, compression string) ([]Policy, error) {
+	byKey := map[string]*Policy{}
+	get := func(table, agentType string) *Policy {
+		key := table + ":" + agentType
+		if byKey[key] == nil {
+			byKey[key] = &Policy{Table: table, AgentType: agentType}
+		}
+		return byKey[key]
+	}
+
+	parse := func(setting string, compress bool) error {
+		for _, entry := range strings.Split(setting, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			target, age, ok := strings.Cut(entry, "=")
+			if !ok {
+				return fmt.Errorf("invalid policy %q: expected table=age", entry)
+			}
+			table, agentType, _ := strings.Cut(strings.TrimSpace(target), ":")
+			perAgent, known := PolicyTables[table]
+			if !known {
+				return fmt.Errorf("invalid policy %q: unknown table %s", entry, table)
+			}
+			if agentType != "" && (compress || !perAgent) {
+				return fmt.Errorf("invalid policy %q: per agent type policies only support retention on hypertables", entry)
+			}
+			if compress && !perAgent {
+				return fmt.Errorf("invalid policy %q: compression is not supported on %s", entry, table)
+			}
+			d, err := parseAge(strings.TrimSpace(age))
+			if err != nil {
+				return fmt.Errorf("invalid policy %q: %w", entry, err)
+			}
+
+			p := get(table, agentType)
+			if compress {
+				p.Compression = d
+			} else {
+				p.Retention = d
+			}
+		}
+		return nil
+	}
+
+	if err := parse(retention, false); err != nil {
+		return nil, err
+	}
+	if err := parse(compression, true); err != nil {
+		return nil, err
+	}
+
+	policies := make([]Policy, 0, len(byKey))
+	for _, p := range byKey {
+		policies = append(policies, *p)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		if policies[i].Table != policies[j].Table {
+			return policies[i].Table < policies[j].Table
+		}
+		return policies[i].AgentType < policies[j].AgentType
+	})
+	return policies, nil
+}
+
+// parseAge accepts Go durations plus whole days ("14d") and weeks ("2w")
+func parseAge(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	switch {
+	case strings.HasSuffix(s, "d"), strings.HasSuffix(s, "w"):
+		n, perr := strconv.Atoi(s[:len(s)-1])
+		if perr != nil {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+		if strings.HasSuffix(s, "w") {
+			d *= 7
+		}
+	default:
+		d, err = time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("age %q must be positive", s)
+	}
+	return d, nil
+}
+
+// interval formats a duration for a $n::text::interval parameter
+func interval(d time.Duration) string {
+	return fmt.Sprintf("%d seconds", int64(d.Seconds()))
+}
+
+// ApplyPolicies makes the Timescale policies match the configuration. Managed
+// tables without a configured policy get theirs removed, so the settings
+// stay the single source of truth.
+func ApplyPolicies(ctx context.Context, policies []Policy) error {
+	if Pool == nil {
+		return fmt.Errorf("database not connected")
+	}
+
+	whole := map[string]Policy{}
+	var perType []Policy
+	for _, p := range policies {
+		if p.AgentType == "" {
+			whole[p.Table] = p
+		} else {
+			perType = append(perType, p)
+		}
+	}
+
+	tables := make([]string, 0, len(PolicyTables))
+	for table := range PolicyTables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	for _, table := range tables {
+		p := whole[table]
+
+		if _, err := Pool.Exec(ctx, `SELECT remove_retention_policy($1::text::regclass, if_exists => true)`, table); err != nil {
+			return fmt.Errorf("remove retention policy on %s: %w", table, err)
+		}
+		if p.Retention > 0 {
+			_, err := Pool.Exec(ctx, `SELECT add_retention_policy($1::text::regclass, drop_after => $2::text::interval)`, table, interval(p.Retention))
+			if err != nil {
+				return fmt.Errorf("add retention policy on %s: %w", table, err)
+			}
+		}
+
+		if !PolicyTables[table] {
+			continue
+		}
+		if _, err := Pool.Exec(ctx, `SELECT remove_compression_policy($1::text::regclass, if_exists => true)`, table); err != nil {
+			return fmt.Errorf("remove compression policy on %s: %w", table, err)
+		}
+		if p.Compression > 0 {
+			if err := enableCompression(ctx, table); err != nil {
+				return err
+			}
+			_, err := Pool.Exec(ctx, `SELECT add_compression_policy($1::text::regclass, compress_after => $2::text::interval)`, table, interval(p.Compression))
+			if err != nil {
+				return fmt.Errorf("add compression policy on %s: %w", table, err)
+			}
+		}
+	}
+
+	_, err := Pool.Exec(ctx, `
+		SELECT delete_job(job_id) FROM timescaledb_information.jobs
+		WHERE proc_name = 'pulse_type_retention'
+	`)
+	if err != nil {
+		return fmt.Errorf("remove agent type retention jobs: %w", err)
+	}
+	for _, p := range perType {
+		config := map[string]string{"table": p.Table, "type": p.AgentType, "drop_after": interval(p.Retention)}
+		_, err := Pool.Exec(ctx, `SELECT add_job('pulse_type_retention', INTERVAL '1 hour', config => $1::jsonb)`, config)
+		if err != nil {
+			return fmt.Errorf("add retention job for %s agents on %s: %w", p.AgentType, p.Table, err)
+		}
+	}
+	return nil
+}
+
+// enableCompression turns on native compression, segmenting chunks by agent.
+// Settings are left alone once enabled since they cannot change while compressed chunks exist.
+func enableCompression(ctx context.Context, table string) error {
+	var enabled bool
+	err := Pool.QueryRow(ctx, `
+		SELECT compression_enabled FROM timescaledb_information.hypertables
+		WHERE hypertable_name = $1
+	`, table).Scan(&enabled)
+	if err != nil {
+		return fmt.Errorf("read compression settings of %s: %w", table, err)
+	}
+	if enabled {
+		return nil
+	}
+
+	// table comes from PolicyTables, never from user input
+	sql := fmt.Sprintf(`ALTER TABLE %s SET (timescaledb.compress, timescaledb.compress_segmentby = 'agent_id')`, table)
+	if _, err := Pool.Exec(ctx, sql); err != nil {
+		return fmt.Errorf("enable compression on %s: %w", table, err)
+	}
+	return nil
+}
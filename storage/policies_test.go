@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePolicies(t *testing.T) {
+	policies, err := ParsePolicies(
+		"agent_heartbeats=14d, agent_heartbeats:bot=36h, agent_updates=90d, agent_status_transitions=52w, agent_uptime_hourly=104w",
+		"agent_heartbeats=2d",
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	want := []Policy{
+		{Table: "agent_heartbeats", Retention: 14 * 24 * time.Hour, Compression: 2 * 24 * time.Hour},
+		{Table: "agent_heartbeats", AgentType: "bot", Retention: 36 * time.Hour},
+		{Table: "agent_status_transitions", Retention: 52 * 7 * 24 * time.Hour},
+		{Table: "agent_updates", Retention: 90 * 24 * time.Hour},
+		{Table: "agent_uptime_hourly", Retention: 104 * 7 * 24 * time.Hour},
+	}
+	if len(policies) != len(want) {
+		t.Fatalf("expected %d policies, got %+v", len(want), policies)
+	}
+	for i := range want {
+		if policies[i] != want[i] {
+			t.Errorf("policy %d: expected %+v, got %+v", i, want[i], policies[i])
+		}
+	}
+}
+
+func TestParsePolicies_Empty(t *testing.T) {
+	policies, err := ParsePolicies("", "")
+	if err != nil || len(policies) != 0 {
+		t.Errorf("expected no policies, got %+v, %v", policies, err)
+	}
+}
+
+func TestParsePolicies_Invalid(t *testing.T) {
+	cases := []struct {
+		retention, compression, wantErr string
+	}{
+		{"agents=14d", "", "unknown table"},
+		{"agent_heartbeats", "", "expected table=age"},
+		{"agent_heartbeats=soon", "", "invalid age"},
+		{"agent_heartbeats=-1h", "", "must be positive"},
+		{"agent_uptime_hourly:bot=7d", "", "per agent type"},
+		{"", "agent_heartbeats:bot=7d", "per agent type"},
+		{"", "agent_uptime_hourly=7d", "compression is not supported"},
+	}
+	for _, tc := range cases {
+		_, err := ParsePolicies(tc.retention, tc.compression)
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("ParsePolicies(%q, %q): expected error containing %q, got %v", tc.retention, tc.compression, tc.wantErr, err)
+		}
+	}
+}
@@ -1,16 +1,18 @@
 package utils
 
 import (
-	"github.com/joho/godotenv"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+
+	"github.com/joho/godotenv"
 )
 
 func LoadEnvFromRoot() {
 	dir, err := os.Getwd()
 	if err != nil {
-		log.Fatalf("failed to get working dir: %v", err)
+		slog.Error("failed to get working dir", "error", err)
+		os.Exit(1)
 	}
 
 	for {
@@ -18,13 +20,13 @@ func LoadEnvFromRoot() {
 		if _, err := os.Stat(envPath); err == nil {
 			err = godotenv.Load(envPath)
 			if err != nil {
-				log.Printf("Failed to load .env from %s: %v", envPath, err)
+				slog.Warn("failed to load .env", "path", envPath, "error", err)
 			}
 			return
 		}
 		parent := filepath.Dir(dir)
 		if parent == dir {
-			log.Println("Warning: .env file not found in any parent directory")
+			slog.Warn(".env file not found in any parent directory")
 			return
 		}
 		dir = parent
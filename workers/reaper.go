@@ -0,0 +1,55 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	db "github.com/aphrollo/pulse/storage"
+)
+
+// ReaperMissedBeats is how many declared heartbeat intervals an agent may stay
+// silent for before it is marked unreachable
+const ReaperMissedBeats = 3
+
+// NewReaper marks agents unreachable once they have not been heard from for
+// timeout, or for ReaperMissedBeats of their declared heartbeat interval when
+// that is longer. The status is recorded as an update, so it shows up in the
+// status transitions and the agent recovers with its next heartbeat. The
+// message keeps the timeout, formatted like a Go duration.
+func NewReaper(timeout time.Duration) *Worker {
+	interval := max(min(timeout/2, 30*time.Second), time.Second)
+	return &Worker{
+		Name:     "reaper",
+		Interval: interval,
+		Run: func(ctx context.Context) error {
+			ctx, cancel := context.WithTimeout(ctx, interval)
+			defer cancel()
+
+			sql := `
+				INSERT INTO agent_updates (agent_id, status, message)
+				SELECT s.agent_id, 'unreachable',
+				       json_build_object('reason', 'no heartbeat', 'last_seen', GREATEST(h.time, s.since), 'timeout', $3::text)::text
+				FROM agent_status s
+				JOIN agents a ON a.id = s.agent_id
+				LEFT JOIN LATERAL (
+					SELECT time FROM agent_heartbeats
+					WHERE agent_id = s.agent_id
+					ORDER BY time DESC
+					LIMIT 1
+				) h ON true
+				WHERE s.status NOT IN ('unreachable', 'crashed', 'stopped', 'disabled')
+				  AND GREATEST(h.time, s.since) < now() - GREATEST(make_interval(secs => $1::float8), a.heartbeat_interval * $2::int)
+			`
+			tag, err := db.Pool.Exec(ctx, sql, timeout.Seconds(), ReaperMissedBeats, timeout.String())
+			if err != nil {
+				return fmt.Errorf("mark unreachable agents: %w", err)
+			}
+			if n := tag.RowsAffected(); n > 0 {
+				slog.Info("marked agents unreachable", "count", n, "timeout", timeout)
+			}
+			return nil
+		},
+	}
+}
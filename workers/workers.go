@@ -0,0 +1,135 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Worker runs a task periodically in the background of the server
+type Worker struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+
+	mu      sync.Mutex
+	running bool
+	started time.Time
+	lastRun time.Time
+	lastErr error
+}
+
+// Status is a snapshot of a worker for readiness checks
+type Status struct {
+	Name      string    `json:"name"`
+	Running   bool      `json:"running"`
+	Healthy   bool      `json:"healthy"`
+	LastRun   time.Time `json:"last_run,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*Worker
+)
+
+// Register adds a worker started by Start
+func Register(w *Worker) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, w)
+}
+
+// Start runs every registered worker until ctx is done
+func Start(ctx context.Context) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, w := range registry {
+		go w.loop(ctx)
+	}
+}
+
+func (w *Worker) loop(ctx context.Context) {
+	w.mu.Lock()
+	w.running = true
+	w.started = time.Now()
+	w.mu.Unlock()
+
+	defer func() {
+		w.mu.Lock()
+		w.running = false
+		w.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		if !w.runOnce(ctx) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runOnce runs the task and reports false when it panicked
+func (w *Worker) runOnce(ctx context.Context) (ok bool) {
+	// A panicking run must not take the server down, the worker stops and reports unhealthy instead
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("worker panicked, stopping it", "worker", w.Name, "panic", r)
+			w.mu.Lock()
+			w.lastErr = fmt.Errorf("panic: %v", r)
+			w.mu.Unlock()
+			ok = false
+		}
+	}()
+
+	err := w.Run(ctx)
+	if err != nil {
+		slog.Error("worker run failed", "worker", w.Name, "error", err)
+	}
+
+	w.mu.Lock()
+	w.lastRun = time.Now()
+	w.lastErr = err
+	w.mu.Unlock()
+	return true
+}
+
+// Status reports whether the worker is running and has completed a run
+// within three intervals. Failed runs still count, the error is reported.
+func (w *Worker) Status() Status {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s := Status{Name: w.Name, Running: w.running, LastRun: w.lastRun}
+	if w.lastErr != nil {
+		s.LastError = w.lastErr.Error()
+	}
+	last := w.lastRun
+	if last.IsZero() {
+		last = w.started
+	}
+	s.Healthy = w.running && time.Since(last) <= 3*w.Interval
+	return s
+}
+
+// Statuses returns the status of every registered worker, sorted by name
+func Statuses() []Status {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	out := make([]Status, 0, len(registry))
+	for _, w := range registry {
+		out = append(out, w.Status())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
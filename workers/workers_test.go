@@ -0,0 +1,73 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWorker_Status(t *testing.T) {
+	w := &Worker{Name: "test", Interval: 10 * time.Millisecond, Run: func(ctx context.Context) error {
+		return errors.New("db down")
+	}}
+	if s := w.Status(); s.Running || s.Healthy {
+		t.Fatalf("expected a worker that was never started to be unhealthy, got %+v", s)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go w.loop(ctx)
+	waitFor(t, func() bool { return !w.Status().LastRun.IsZero() })
+
+	s := w.Status()
+	if !s.Running || !s.Healthy {
+		t.Errorf("expected running worker to be healthy, got %+v", s)
+	}
+	if s.LastError != "db down" {
+		t.Errorf("expected last error to be reported, got %q", s.LastError)
+	}
+
+	cancel()
+	waitFor(t, func() bool { return !w.Status().Running })
+	if w.Status().Healthy {
+		t.Error("expected stopped worker to be unhealthy")
+	}
+}
+
+func TestWorker_PanicStopsWorker(t *testing.T) {
+	w := &Worker{Name: "test", Interval: 10 * time.Millisecond, Run: func(ctx context.Context) error {
+		panic("boom")
+	}}
+
+	go w.loop(context.Background())
+	waitFor(t, func() bool { return w.Status().LastError != "" })
+	waitFor(t, func() bool { return !w.Status().Running })
+
+	if s := w.Status(); s.Healthy || s.LastError != "panic: boom" {
+		t.Errorf("expected panicked worker to be reported unhealthy, got %+v", s)
+	}
+}
+
+func TestNewReaper_Interval(t *testing.T) {
+	cases := map[time.Duration]time.Duration{
+		3 * time.Minute:  30 * time.Second,
+		20 * time.Second: 10 * time.Second,
+		time.Nanosecond:  time.Second,
+	}
+	for timeout, want := range cases {
+		if got := NewReaper(timeout).Interval; got != want {
+			t.Errorf("NewReaper(%s): expected interval %s, got %s", timeout, want, got)
+		}
+	}
+}